@@ -3,6 +3,9 @@ package clients
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"strings"
+	"sync"
 
 	"github.com/libgolang/log"
 
@@ -10,20 +13,74 @@ import (
 	"gopkg.in/resty.v1"
 )
 
+// NodeTokenHeader carries the node token, the master only sends the
+// credentials of private registries to the nodes presenting it
+const NodeTokenHeader = "X-One-Node-Token"
+
 // MasterClient main interface
 type MasterClient interface {
 	//ListContainersByNode(nodeName string) []model.Container
 	PingNodeInfo(nfo model.NodeInfo) (*model.NodeInfoResponse, error)
 	GetDefinition(name string) (*model.Definition, error)
+	ListDefinitions() (map[string]*model.Definition, error)
+	ListContainers() (map[string]*model.Container, error)
+	ListNodes() (map[string]*model.Node, error)
+	CreateBackup() (*model.Backup, error)
+	DownloadBackup(name string) ([]byte, error)
 }
 
 type masterClient struct {
-	endPoint string
+	mu        sync.Mutex
+	endPoints []string
+	current   int    // end point that answered last
+	token     string // sent in NodeTokenHeader
 }
 
-// NewMasterClient constructor for MasterClient
-func NewMasterClient(masterAddr string) MasterClient {
-	return &masterClient{fmt.Sprintf("http://%s", masterAddr)}
+// NewMasterClient constructor for MasterClient.  masterAddr is a comma
+// separated list of master addresses.  Requests go to the master that
+// answered last and fail over to the others when it is unreachable or
+// has no leader.  Followers redirect requests to the leader.  token is
+// the node token, empty unless the client is a node.
+func NewMasterClient(masterAddr, token string) MasterClient {
+	m := &masterClient{token: token}
+	for _, addr := range strings.Split(masterAddr, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if !strings.Contains(addr, "://") {
+			addr = fmt.Sprintf("http://%s", addr)
+		}
+		m.endPoints = append(m.endPoints, strings.TrimSuffix(addr, "/"))
+	}
+	return m
+}
+
+// request calls f with each end point until one answers
+func (m *masterClient) request(f func(endPoint string) (*resty.Response, error)) (*resty.Response, error) {
+	m.mu.Lock()
+	first := m.current
+	m.mu.Unlock()
+
+	var resp *resty.Response
+	err := fmt.Errorf("no master address")
+	for i := range m.endPoints {
+		idx := (first + i) % len(m.endPoints)
+		resp, err = f(m.endPoints[idx])
+		if err != nil {
+			log.Warn("master %s unreachable: %s", m.endPoints[idx], err)
+			continue
+		}
+		if resp.StatusCode() == http.StatusServiceUnavailable {
+			err = fmt.Errorf("master %s has no leader", m.endPoints[idx])
+			continue
+		}
+		m.mu.Lock()
+		m.current = idx
+		m.mu.Unlock()
+		return resp, nil
+	}
+	return nil, err
 }
 
 func (m *masterClient) ListContainersByNode(nodeName string) []model.Container {
@@ -31,16 +88,21 @@ func (m *masterClient) ListContainersByNode(nodeName string) []model.Container {
 }
 
 func (m *masterClient) PingNodeInfo(nfo model.NodeInfo) (*model.NodeInfoResponse, error) {
-	url := fmt.Sprintf("%s/master/nodeinfo", m.endPoint)
 	jsonBody, err := json.Marshal(&nfo)
 	if err != nil {
 		return nil, err
 	}
-	log.Debug("POST %s\n%s\n", url, jsonBody)
-	resp, err := resty.R().
-		SetBody(jsonBody).
-		SetHeader("Content-Type", "application/json").
-		Post(url)
+	resp, err := m.request(func(endPoint string) (*resty.Response, error) {
+		url := fmt.Sprintf("%s/master/nodeinfo", endPoint)
+		log.Debug("POST %s\n%s\n", url, jsonBody)
+		req := resty.R().
+			SetBody(jsonBody).
+			SetHeader("Content-Type", "application/json")
+		if m.token != "" {
+			req.SetHeader(NodeTokenHeader, m.token)
+		}
+		return req.Post(url)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -54,9 +116,11 @@ func (m *masterClient) PingNodeInfo(nfo model.NodeInfo) (*model.NodeInfoResponse
 }
 
 func (m *masterClient) GetDefinition(name string) (*model.Definition, error) {
-	resp, err := resty.R().
-		SetPathParams(map[string]string{"name": name}).
-		Get(fmt.Sprintf("%s/master/definitions/{name}", m.endPoint))
+	resp, err := m.request(func(endPoint string) (*resty.Response, error) {
+		return resty.R().
+			SetPathParams(map[string]string{"name": name}).
+			Get(fmt.Sprintf("%s/master/definitions/{name}", endPoint))
+	})
 
 	if err != nil {
 		return nil, err
@@ -69,3 +133,84 @@ func (m *masterClient) GetDefinition(name string) (*model.Definition, error) {
 	err = json.Unmarshal(resp.Body(), def)
 	return def, err
 }
+
+func (m *masterClient) ListDefinitions() (map[string]*model.Definition, error) {
+	resp, err := m.request(func(endPoint string) (*resty.Response, error) {
+		return resty.R().Get(fmt.Sprintf("%s/master/definitions", endPoint))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("Returned %d status code", resp.StatusCode())
+	}
+
+	defs := make(map[string]*model.Definition)
+	err = json.Unmarshal(resp.Body(), &defs)
+	return defs, err
+}
+
+func (m *masterClient) ListContainers() (map[string]*model.Container, error) {
+	resp, err := m.request(func(endPoint string) (*resty.Response, error) {
+		return resty.R().Get(fmt.Sprintf("%s/master/containers", endPoint))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("Returned %d status code", resp.StatusCode())
+	}
+
+	containers := make(map[string]*model.Container)
+	err = json.Unmarshal(resp.Body(), &containers)
+	return containers, err
+}
+
+func (m *masterClient) ListNodes() (map[string]*model.Node, error) {
+	resp, err := m.request(func(endPoint string) (*resty.Response, error) {
+		return resty.R().Get(fmt.Sprintf("%s/master/nodes", endPoint))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("Returned %d status code", resp.StatusCode())
+	}
+
+	nodes := make(map[string]*model.Node)
+	err = json.Unmarshal(resp.Body(), &nodes)
+	return nodes, err
+}
+
+// CreateBackup asks the master to write a snapshot of its store
+func (m *masterClient) CreateBackup() (*model.Backup, error) {
+	resp, err := m.request(func(endPoint string) (*resty.Response, error) {
+		return resty.R().Post(fmt.Sprintf("%s/master/backups", endPoint))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("Returned %d status code", resp.StatusCode())
+	}
+
+	manifest := &model.Backup{}
+	err = json.Unmarshal(resp.Body(), manifest)
+	return manifest, err
+}
+
+// DownloadBackup returns the contents of the snapshot name
+func (m *masterClient) DownloadBackup(name string) ([]byte, error) {
+	resp, err := m.request(func(endPoint string) (*resty.Response, error) {
+		return resty.R().
+			SetPathParams(map[string]string{"name": name}).
+			Get(fmt.Sprintf("%s/master/backups/{name}", endPoint))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("Returned %d status code", resp.StatusCode())
+	}
+	return resp.Body(), nil
+}
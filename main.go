@@ -1,13 +1,19 @@
 package main
 
 import (
+	"encoding/base64"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"os/signal"
+	"path"
+	"strconv"
 	"text/tabwriter"
 	"time"
 
+	"github.com/libgolang/one/clients"
 	"github.com/libgolang/one/service"
 	"github.com/libgolang/one/utils"
 
@@ -27,10 +33,60 @@ var (
 	dockerAPIHost        = utils.ConfigString("docker.host", "", "Host or unix that node service uses to connect to docker daemon. E.g.: \"\" = unix socket || \"tcp:/127.0.0.1:2375\"")
 	dockerAPIVersion     = utils.ConfigString("docker.api.version", "1.37", "Docker API Version. defaults to 1.37.")
 	defDir               = utils.ConfigString("var.dir", "./var", "Var directory.")
+	cfgDbDriver          = utils.ConfigString("db.driver", service.DbFile, "Storage backend: file (json files under var.dir) or bolt (single transactional file).")
+	cfgDbFile            = utils.ConfigString("db.file", "", "Database file of the bolt backend. Defaults to <var.dir>/one.db.")
+	cfgDbImport          = utils.ConfigString("db.import", "", "Imports the file backend var.dir at the given path into the configured backend and exits.")
+	cfgBackupDir         = utils.ConfigString("backup.dir", "", "Directory of the periodic snapshots of the master. Defaults to <var.dir>/backups.")
+	cfgBackupInterval    = utils.ConfigString("backup.interval", "0", "Hours between periodic snapshots of the master. 0 takes snapshots only on request.")
+	cfgBackupKeep        = utils.ConfigString("backup.keep", "7", "Number of periodic snapshots kept. 0 keeps every snapshot.")
 	cfgMasterAddrPtr     = utils.ConfigString("master", "", "Starts the master and attaches it to the given address. e.g. --master=127.0.0.1:8080")
-	cfgNodeMasterAddrPtr = utils.ConfigString("node", "", "Starts the node and takes the master address. e.g. --node=127.0.0.1:8080")
+	cfgNodeMasterAddrPtr = utils.ConfigString("node", "", "Starts the node and takes the master address, or comma separated addresses of highly available masters. e.g. --node=127.0.0.1:8080")
+	cfgNodeToken         = utils.ConfigString("node.token", "", "Shared secret of the master and its nodes. The master sends the credentials of private registries only over TLS to the nodes presenting it.")
+	cfgNodeMetricsAddr   = utils.ConfigString("node.metrics.addr", ":9101", "Address the node serves its Prometheus /metrics and the recent container stats on. Empty disables them.")
+	cfgMasterName        = utils.ConfigString("master.name", "master01", "Name of this master in master.cluster.")
+	cfgMasterClientAddr  = utils.ConfigString("master.client.addr", "", "URL nodes are redirected to while this master leads. Defaults to the master address.")
+	cfgMasterPeerAddr    = utils.ConfigString("master.peer.addr", "", "URL the other masters reach this master on. Defaults to the master.cluster entry of master.name.")
+	cfgMasterCluster     = utils.ConfigString("master.cluster", "", "Comma separated name=peer-url of every master. e.g. master01=http://10.0.1.10:2380,master02=http://10.0.1.11:2380. Empty runs a single master.")
+	cfgMasterToken       = utils.ConfigString("master.cluster.token", "", "Shared secret authenticating the masters to each other, required by master.cluster.")
+	cfgMasterPeerCert    = utils.ConfigString("master.peer.cert.file", "", "Certificate serving master.peer.addr over TLS, required when the peer url is https.")
+	cfgMasterPeerKey     = utils.ConfigString("master.peer.key.file", "", "Key of master.peer.cert.file.")
+	cfgMasterPeerCA      = utils.ConfigString("master.peer.ca.file", "", "Extra CA certificates trusted to reach the https peer urls of the other masters.")
+	cfgMasterRegistryKey = utils.ConfigString("master.registry.key", "", "Base64 AES key of 16, 24 or 32 bytes encrypting the registry passwords, the same on every master. Empty refuses registry passwords.")
+	cfgProxyMasterAddr   = utils.ConfigString("proxy", "", "Starts the native load balancing proxy and takes the master address. e.g. --proxy=127.0.0.1:8080")
+	cfgProxyListen       = utils.ConfigString("proxy.listen", ":80", "Address the native proxy listens on.")
+	cfgProxyBalance      = utils.ConfigString("proxy.balance", service.BalanceRoundRobin, "Native proxy balancing strategy: round-robin or least-conn.")
+	cfgProxyReconcile    = utils.ConfigString("proxy.reconcile", "false", "When true the master keeps the proxy sites in sync with the running replicas.")
+	cfgProxyDriver       = utils.ConfigString("proxy.driver", service.ProxyApache, "Proxy driver: apache, nginx, haproxy or caddy.")
+	cfgProxyAdminEmail   = utils.ConfigString("proxy.admin.email", "", "Administrator email used in proxy configuration and certificate requests.")
+	cfgProxyConfigDir    = utils.ConfigString("proxy.config.dir", "", "Directory where proxy site configuration is written. Defaults to the driver's directory.")
+	cfgProxyEnabledDir   = utils.ConfigString("proxy.enabled.dir", "", "Directory where sites are enabled by symlink. Defaults to the driver's directory.")
+	cfgProxyEnableCmd    = utils.ConfigString("proxy.cmd.enable", "", "Command to enable a site. The site name is appended.")
+	cfgProxyDisableCmd   = utils.ConfigString("proxy.cmd.disable", "", "Command to disable a site. The site name is appended.")
+	cfgProxyTestCmd      = utils.ConfigString("proxy.cmd.test", "", "Command to test the proxy configuration before reloading.")
+	cfgProxyReloadCmd    = utils.ConfigString("proxy.cmd.reload", "", "Command to reload the proxy.")
+	cfgProxyTemplate     = utils.ConfigString("proxy.template", "", "Template file overriding the driver's site template.")
+	cfgProxyChallengeTpl = utils.ConfigString("proxy.template.challenge", "", "Template file overriding the driver's certificate challenge template.")
+	cfgCertProvider      = utils.ConfigString("cert.provider", service.CertACME, "Certificate provider: acme, selfsigned or manual.")
+	cfgCertDir           = utils.ConfigString("cert.dir", "", "Directory where certificates are stored. Defaults to <var.dir>/certs.")
+	cfgCertRenewDays     = utils.ConfigString("cert.renew.days", "30", "Certificates are renewed when they expire in less than this number of days.")
+	cfgCertWebRoot       = utils.ConfigString("cert.webroot", "/var/www/virtual", "Directory of the per domain htdocs used for http-01 challenges.")
+	cfgCertACMEDirectory = utils.ConfigString("cert.acme.directory", "https://acme-v02.api.letsencrypt.org/directory", "ACME directory URL.")
+	cfgCertACMECAFile    = utils.ConfigString("cert.acme.ca.file", "", "Extra CA certificates trusted to reach the ACME directory.")
+	cfgCertSelfSignedDay = utils.ConfigString("cert.selfsigned.days", "90", "Validity in days of certificates issued by the internal CA.")
+	cfgCertManualDir     = utils.ConfigString("cert.manual.dir", "", "Directory with <domain>/fullchain.pem and <domain>/privkey.pem provided by the administrator.")
+	cfgCertWildcard      = utils.ConfigString("cert.wildcard", "false", "When true a single *.<proxy.domain> certificate serves every host under the proxy domain.")
+	cfgCertDNSProvider   = utils.ConfigString("cert.dns.provider", "", "DNS provider for ACME dns-01 challenges: rfc2136 or exec. Required for wildcard ACME certificates.")
+	cfgCertDNSWait       = utils.ConfigString("cert.dns.propagation", "30", "Seconds to wait for dns-01 records to propagate.")
+	cfgCertDNSTTL        = utils.ConfigString("cert.dns.ttl", "60", "TTL of dns-01 records.")
+	cfgCertDNSExec       = utils.ConfigString("cert.dns.exec", "", "Command called with present|cleanup <fqdn> <value> to publish dns-01 records.")
+	cfgCertDNSServer     = utils.ConfigString("cert.dns.rfc2136.server", "", "host:port of the name server accepting RFC2136 updates.")
+	cfgCertDNSZone       = utils.ConfigString("cert.dns.rfc2136.zone", "", "Zone updated with RFC2136. Defaults to proxy.domain.")
+	cfgCertDNSTSIGKey    = utils.ConfigString("cert.dns.rfc2136.tsig.key", "", "TSIG key name signing RFC2136 updates.")
+	cfgCertDNSTSIGSecret = utils.ConfigString("cert.dns.rfc2136.tsig.secret", "", "Base64 TSIG secret.")
+	cfgCertDNSTSIGAlg    = utils.ConfigString("cert.dns.rfc2136.tsig.algorithm", "hmac-sha256", "TSIG algorithm: hmac-sha1, hmac-sha256 or hmac-sha512.")
 	db                   service.Db
 	dbBack               service.Db
+	unlockStore          func()
 	proxy                service.Proxy
 	docker               service.Docker
 	cycle                service.Cycle
@@ -39,9 +95,64 @@ var (
 func main() {
 	utils.ConfigParse()
 
-	dbBack = service.NewDb(*defDir)
-	db = service.NewFrontDb(dbBack)
-	proxy = service.NewProxy(*proxyPublicIP, *proxyPrivateIP, *proxyBaseDomain)
+	if args := flag.Args(); len(args) > 0 {
+		switch args[0] {
+		case "backup":
+			backupDb(args[1:])
+			return
+		case "restore":
+			restoreDb(args[1:])
+			return
+		}
+	}
+	if *cfgMasterAddrPtr != "" {
+		unlockStore = lockStore("Master", "use another var.dir")
+	}
+	dbBack = newDb()
+	if *cfgDbImport != "" {
+		importDb(*cfgDbImport)
+		return
+	}
+	if args := flag.Args(); len(args) > 0 {
+		switch args[0] {
+		case "migrate":
+			defer dbBack.Close()
+			if err := migrateDb(); err != nil {
+				fmt.Printf("Migration failed: %s\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	if err := migrateDb(); err != nil {
+		panic(fmt.Sprintf("unable to migrate the db: %s", err))
+	}
+	var cluster service.Cluster
+	if *cfgMasterAddrPtr != "" && *cfgMasterCluster != "" {
+		cluster = newCluster()
+		db = service.NewFrontDb(cluster.Db())
+	} else {
+		db = service.NewFrontDb(dbBack)
+	}
+	wildcard, _ := strconv.ParseBool(*cfgCertWildcard)
+	certs := newCertManager(wildcard)
+	proxy = service.NewProxy(*cfgProxyDriver, service.ProxyConfig{
+		PublicIP:          *proxyPublicIP,
+		PrivateIP:         *proxyPrivateIP,
+		BaseDomain:        *proxyBaseDomain,
+		AdminEmail:        *cfgProxyAdminEmail,
+		ConfigDir:         *cfgProxyConfigDir,
+		EnabledDir:        *cfgProxyEnabledDir,
+		EnableCmd:         *cfgProxyEnableCmd,
+		DisableCmd:        *cfgProxyDisableCmd,
+		TestCmd:           *cfgProxyTestCmd,
+		ReloadCmd:         *cfgProxyReloadCmd,
+		SiteTemplate:      *cfgProxyTemplate,
+		ChallengeTemplate: *cfgProxyChallengeTpl,
+		WebRoot:           *cfgCertWebRoot,
+		Certs:             certs,
+		WildcardCert:      wildcard,
+	})
 	docker = service.NewDocker(*dockerHostIP /*, dockerAPIHost, dockerAPIVersion*/, db)
 	cycle = service.NewLifecycle(*dockerHostIP, db, proxy, docker)
 
@@ -54,7 +165,7 @@ func main() {
 	log.LoadLogProperties()
 
 	//
-	if *cfgMasterAddrPtr == "" && *cfgNodeMasterAddrPtr == "" {
+	if *cfgMasterAddrPtr == "" && *cfgNodeMasterAddrPtr == "" && *cfgProxyMasterAddr == "" {
 		utils.ConfigPrintHelp()
 		os.Exit(1)
 	}
@@ -62,12 +173,36 @@ func main() {
 	var rs service.RestServer
 	if *cfgMasterAddrPtr != "" {
 		rs = service.NewRestServer(*cfgMasterAddrPtr, *cfgMasterCertFile, *cfgMasterKeyFile)
-		service.NewMasterService(rs, db)
+		service.NewMasterService(rs, db, *proxyBaseDomain, cluster, registryKey(), *cfgNodeToken)
+		if cluster != nil {
+			rs.Use(service.LeaderRedirect(cluster))
+			service.NewClusterService(rs, cluster)
+		}
+		service.NewCertService(rs, certs)
+		service.NewMetricsService(rs)
+		newBackupService(rs, cluster)
+		if reconcile, _ := strconv.ParseBool(*cfgProxyReconcile); reconcile {
+			service.NewProxyController(rs, db, proxy, *proxyBaseDomain)
+		}
 		rs.Start()
 	}
 
+	var nrs service.RestServer
 	if *cfgNodeMasterAddrPtr != "" {
-		service.NewNodeService(*cfgNodeMasterAddrPtr, docker, *nodeName, *dockerHostIP, *preRunHookPtr, *postRunHookPtr)
+		if *cfgNodeMetricsAddr != "" {
+			nrs = service.NewRestServer(*cfgNodeMetricsAddr, "", "")
+			service.NewMetricsService(nrs)
+		}
+		service.NewNodeService(*cfgNodeMasterAddrPtr, *cfgNodeToken, docker, *nodeName, *dockerHostIP, *preRunHookPtr, *postRunHookPtr, nrs)
+		if nrs != nil {
+			nrs.Start()
+		}
+	}
+
+	var np service.NativeProxy
+	if *cfgProxyMasterAddr != "" {
+		np = service.NewNativeProxy(*cfgProxyListen, *proxyBaseDomain, *cfgProxyBalance, clients.NewMasterClient(*cfgProxyMasterAddr, ""))
+		np.Start()
 	}
 
 	c := make(chan os.Signal, 1)
@@ -77,6 +212,18 @@ func main() {
 		if rs != nil {
 			rs.Stop()
 		}
+		if nrs != nil {
+			nrs.Stop()
+		}
+		if cluster != nil {
+			cluster.Stop()
+		}
+		if np != nil {
+			np.Stop()
+		}
+		if unlockStore != nil {
+			unlockStore()
+		}
 		os.Exit(1)
 	}
 
@@ -95,6 +242,289 @@ func main() {
 	*/
 }
 
+func newDb() service.Db {
+	switch *cfgDbDriver {
+	case service.DbFile:
+		return service.NewDb(*defDir)
+	case service.DbBolt:
+		file := *cfgDbFile
+		if file == "" {
+			utils.EnsureDir(*defDir)
+			file = path.Join(*defDir, "one.db")
+		}
+		return service.NewBoltDb(file)
+	}
+	panic(fmt.Sprintf("unknown db driver %s", *cfgDbDriver))
+}
+
+// registryKey returns the decoded master.registry.key, nil when unset
+func registryKey() []byte {
+	if *cfgMasterRegistryKey == "" {
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(*cfgMasterRegistryKey)
+	if err != nil {
+		panic(fmt.Sprintf("invalid master.registry.key: %s", err))
+	}
+	if n := len(key); n != 16 && n != 24 && n != 32 {
+		panic(fmt.Sprintf("invalid master.registry.key: %d bytes, expected 16, 24 or 32", n))
+	}
+	return key
+}
+
+func newCluster() service.Cluster {
+	members, err := service.ParseClusterMembers(*cfgMasterCluster)
+	if err != nil {
+		panic(fmt.Sprintf("invalid master.cluster: %s", err))
+	}
+	if *cfgMasterToken == "" {
+		panic("master.cluster requires master.cluster.token")
+	}
+	clientURL := *cfgMasterClientAddr
+	if clientURL == "" {
+		scheme := "http"
+		if *cfgMasterCertFile != "" {
+			scheme = "https"
+		}
+		clientURL = fmt.Sprintf("%s://%s", scheme, *cfgMasterAddrPtr)
+	}
+	return service.NewCluster(service.ClusterConfig{
+		Name:      *cfgMasterName,
+		PeerURL:   *cfgMasterPeerAddr,
+		ClientURL: clientURL,
+		Members:   members,
+		Dir:       *defDir,
+		Token:     *cfgMasterToken,
+		CertFile:  *cfgMasterPeerCert,
+		KeyFile:   *cfgMasterPeerKey,
+		CAFile:    *cfgMasterPeerCA,
+	}, dbBack)
+}
+
+// importDb copies the file backend at dir into dbBack
+func importDb(dir string) {
+	defer dbBack.Close()
+	if *cfgDbDriver == service.DbFile && path.Clean(dir) == path.Clean(*defDir) {
+		fmt.Println("Nothing to import, db.import is the var.dir of the file backend")
+		os.Exit(1)
+	}
+	stats, err := service.ImportDb(service.NewDb(dir), dbBack)
+	if err != nil {
+		fmt.Printf("Import failed: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Imported %d definitions, %d containers, %d nodes and %d vars from %s\n",
+		stats["definitions"], stats["containers"], stats["nodes"], stats["vars"], dir)
+}
+
+// migrateDb upgrades the objects dbBack stored with older schema versions
+func migrateDb() error {
+	m, ok := dbBack.(service.Migrator)
+	if !ok {
+		return nil
+	}
+	stats, err := m.Migrate()
+	if err != nil {
+		return err
+	}
+	log.Info("Schema version %d: %d objects current, %d migrated, %d quarantined, %d skipped",
+		service.SchemaVersion, stats["current"], stats["migrated"], stats["quarantined"], stats["skipped"])
+	return nil
+}
+
+// storeLockFile is locked in var.dir while a master or an offline
+// backup or restore uses the store
+const storeLockFile = "store.lock"
+
+// lockStore locks the store for action, which is refused with hint when
+// a master holds the store already
+func lockStore(action, hint string) func() {
+	utils.EnsureDir(*defDir)
+	unlock, err := utils.LockFile(path.Join(*defDir, storeLockFile))
+	if err == utils.ErrLocked {
+		fmt.Printf("%s refused, a master is running on %s, %s\n", action, *defDir, hint)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("%s failed: %s\n", action, err)
+		os.Exit(1)
+	}
+	return unlock
+}
+
+// backupDb writes a snapshot to the file in args.  The master at
+// --master takes it when given, otherwise the store is read directly,
+// which is refused while a master is running on it.
+func backupDb(args []string) {
+	if len(args) != 1 {
+		printHelp()
+		os.Exit(1)
+	}
+	if *cfgMasterAddrPtr != "" {
+		backupMaster(args[0])
+		return
+	}
+	defer lockStore("Backup", "pass its address with --master")()
+	dbBack = newDb()
+	defer dbBack.Close()
+	f, err := os.Create(args[0])
+	if err != nil {
+		fmt.Printf("Backup failed: %s\n", err)
+		os.Exit(1)
+	}
+	manifest, err := service.WriteBackup(service.NewFrontDb(dbBack), f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(args[0])
+		fmt.Printf("Backup failed: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Backed up %d definitions, %d containers, %d nodes and %d vars to %s\n",
+		manifest.Counts["definitions"], manifest.Counts["containers"], manifest.Counts["nodes"], manifest.Counts["vars"], args[0])
+}
+
+// backupMaster asks the master at --master for a snapshot and
+// downloads it to file
+func backupMaster(file string) {
+	master := clients.NewMasterClient(*cfgMasterAddrPtr, "")
+	manifest, err := master.CreateBackup()
+	var b []byte
+	if err == nil {
+		b, err = master.DownloadBackup(manifest.Name)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(file, b, 0600)
+	}
+	if err != nil {
+		fmt.Printf("Backup failed: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Backed up %d definitions, %d containers, %d nodes and %d vars to %s\n",
+		manifest.Counts["definitions"], manifest.Counts["containers"], manifest.Counts["nodes"], manifest.Counts["vars"], file)
+}
+
+// restoreDb loads the snapshot file in args into the store, which is
+// refused while a master is running on it
+func restoreDb(args []string) {
+	if len(args) != 1 {
+		printHelp()
+		os.Exit(1)
+	}
+	defer lockStore("Restore", "stop it first")()
+	dbBack = newDb()
+	defer dbBack.Close()
+	f, err := os.Open(args[0])
+	if err != nil {
+		fmt.Printf("Restore failed: %s\n", err)
+		os.Exit(1)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	manifest, err := service.RestoreBackup(f, dbBack)
+	if err != nil {
+		fmt.Printf("Restore failed: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Restored %d definitions, %d containers, %d nodes and %d vars from %s taken %s\n",
+		manifest.Counts["definitions"], manifest.Counts["containers"], manifest.Counts["nodes"], manifest.Counts["vars"],
+		args[0], manifest.CreatedAt.Format(time.RFC3339))
+}
+
+func newBackupService(rs service.RestServer, cluster service.Cluster) service.BackupService {
+	dir := *cfgBackupDir
+	if dir == "" {
+		dir = path.Join(*defDir, "backups")
+	}
+	hours, err := strconv.Atoi(*cfgBackupInterval)
+	if err != nil {
+		panic(fmt.Errorf("invalid backup.interval %s: %s", *cfgBackupInterval, err))
+	}
+	keep, err := strconv.Atoi(*cfgBackupKeep)
+	if err != nil {
+		panic(fmt.Errorf("invalid backup.keep %s: %s", *cfgBackupKeep, err))
+	}
+	return service.NewBackupService(rs, db, dir, time.Hour*time.Duration(hours), keep, cluster)
+}
+
+func newCertManager(wildcard bool) service.CertManager {
+	dir := *cfgCertDir
+	if dir == "" {
+		dir = path.Join(*defDir, "certs")
+	}
+	renewDays, err := strconv.Atoi(*cfgCertRenewDays)
+	if err != nil {
+		panic(fmt.Errorf("invalid cert.renew.days %s: %s", *cfgCertRenewDays, err))
+	}
+
+	var provider service.CertProvider
+	switch *cfgCertProvider {
+	case service.CertACME:
+		dnsSolver := newDNSSolver()
+		if wildcard && dnsSolver == nil {
+			panic("cert.wildcard requires cert.dns.provider with the acme certificate provider")
+		}
+		propagation, err := strconv.Atoi(*cfgCertDNSWait)
+		if err != nil {
+			panic(fmt.Errorf("invalid cert.dns.propagation %s: %s", *cfgCertDNSWait, err))
+		}
+		provider = service.NewACMEProvider(service.ACMEConfig{
+			DirectoryURL:   *cfgCertACMEDirectory,
+			Email:          *cfgProxyAdminEmail,
+			AccountKeyFile: path.Join(dir, "acme", "account.key"),
+			CAFile:         *cfgCertACMECAFile,
+			HTTPSolver:     service.NewWebrootSolver(*cfgCertWebRoot),
+			DNSSolver:      dnsSolver,
+			DNSPropagation: time.Second * time.Duration(propagation),
+		})
+	case service.CertSelfSigned:
+		days, err := strconv.Atoi(*cfgCertSelfSignedDay)
+		if err != nil {
+			panic(fmt.Errorf("invalid cert.selfsigned.days %s: %s", *cfgCertSelfSignedDay, err))
+		}
+		provider = service.NewSelfSignedProvider(path.Join(dir, "ca"), time.Hour*24*time.Duration(days))
+	case service.CertManual:
+		provider = service.NewManualProvider(*cfgCertManualDir)
+	default:
+		panic(fmt.Sprintf("unknown certificate provider %s", *cfgCertProvider))
+	}
+	return service.NewCertManager(dir, provider, time.Hour*24*time.Duration(renewDays))
+}
+
+// newDNSSolver returns the dns-01 solver configured with cert.dns.provider, or nil
+func newDNSSolver() service.ChallengeSolver {
+	switch *cfgCertDNSProvider {
+	case "":
+		return nil
+	case service.DNSExec:
+		return service.NewExecSolver(*cfgCertDNSExec)
+	case service.DNSRFC2136:
+		ttl, err := strconv.Atoi(*cfgCertDNSTTL)
+		if err != nil {
+			panic(fmt.Errorf("invalid cert.dns.ttl %s: %s", *cfgCertDNSTTL, err))
+		}
+		zone := *cfgCertDNSZone
+		if zone == "" {
+			zone = *proxyBaseDomain
+		}
+		solver, err := service.NewRFC2136Solver(service.RFC2136Config{
+			Server:        *cfgCertDNSServer,
+			Zone:          zone,
+			TTL:           ttl,
+			TSIGKey:       *cfgCertDNSTSIGKey,
+			TSIGSecret:    *cfgCertDNSTSIGSecret,
+			TSIGAlgorithm: *cfgCertDNSTSIGAlg,
+		})
+		if err != nil {
+			panic(err)
+		}
+		return solver
+	}
+	panic(fmt.Sprintf("unknown dns provider %s", *cfgCertDNSProvider))
+}
+
 func listAction(args []string) {
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
 	fmt.Fprintln(w, fmt.Sprintf("%s\t%s\t", "=Name=", "=State="))
@@ -149,5 +579,9 @@ const helpTxt = `
 	{{.progName}} list
 	{{.progName}} start <name>
 	{{.progName}} stop  <name>
+	{{.progName}} backup <file> [--master=127.0.0.1:8080]
+	{{.progName}} restore <file>
+	{{.progName}} migrate
 	{{.progName}} service --node=127.0.0.1:8080 --master=127.0.0.1:8080
+	{{.progName}} service --proxy=127.0.0.1:8080 --proxy.listen=:80
 `
@@ -0,0 +1,13 @@
+package model
+
+import "time"
+
+// Backup manifest of a snapshot archive of the master's state
+type Backup struct {
+	Name      string            `json:"name"` // archive file name
+	Version   int               `json:"version"`
+	CreatedAt time.Time         `json:"createdAt"`
+	Size      int64             `json:"size"`
+	Counts    map[string]int    `json:"counts"`              // objects by kind
+	Checksums map[string]string `json:"checksums,omitempty"` // sha256 of each archive entry
+}
@@ -0,0 +1,25 @@
+package model
+
+import "time"
+
+// Certificate states
+const (
+	CertificateValid    = "valid"    // issued and outside of the renewal window
+	CertificateExpiring = "expiring" // inside the renewal window
+	CertificateExpired  = "expired"
+	CertificateMissing  = "missing" // requested but never issued
+)
+
+// Certificate inventory entry of a TLS certificate managed by the master
+type Certificate struct {
+	Domain      string    `json:"domain"`
+	Provider    string    `json:"provider"` // acme, selfsigned or manual
+	Issuer      string    `json:"issuer"`
+	Serial      string    `json:"serial"`
+	NotBefore   time.Time `json:"notBefore"`
+	NotAfter    time.Time `json:"notAfter"`
+	State       string    `json:"state"`
+	LastRenewal time.Time `json:"lastRenewal"` // time the certificate was last issued
+	LastAttempt time.Time `json:"lastAttempt"` // time of the last issue or renewal attempt
+	Error       string    `json:"error"`       // error of the last attempt, empty on success
+}
@@ -0,0 +1,23 @@
+package model
+
+import "time"
+
+// Cluster member roles
+const (
+	ClusterLeader      = "leader"
+	ClusterFollower    = "follower"
+	ClusterCandidate   = "candidate"
+	ClusterUnreachable = "unreachable" // peer that did not answer the last request
+)
+
+// ClusterMember state of a master of a highly available cluster as
+// seen by the master answering the request
+type ClusterMember struct {
+	Name        string    `json:"name"`
+	PeerURL     string    `json:"peerUrl"`
+	ClientURL   string    `json:"clientUrl"` // where nodes are redirected when the member leads
+	Role        string    `json:"role"`
+	Term        uint64    `json:"term"`
+	Index       uint64    `json:"index"` // last replicated entry
+	LastContact time.Time `json:"lastContact"`
+}
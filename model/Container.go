@@ -1,19 +1,78 @@
 package model
 
+import "time"
+
+// Container lifecycle states
+const (
+	ContainerPending     = "Pending"     // waiting for a node
+	ContainerScheduled   = "Scheduled"   // assigned to a node that has not reported it yet
+	ContainerStarting    = "Starting"    // the node was asked to run it
+	ContainerRunning     = "Running"     // reported running by its node
+	ContainerFailed      = "Failed"      // exited or could not be started, the node retries
+	ContainerTerminating = "Terminating" // to be removed by its node
+	ContainerTerminated  = "Terminated"  // removal confirmed by its node, the record is deleted
+	ContainerSucceeded   = "Succeeded"   // exited 0 and not restarted, see RestartNever
+)
+
+// Container restart policies
+const (
+	RestartAlways = "Always" // dead containers are replaced, the default
+	RestartNever  = "Never"  // exited containers are kept until the master removes them
+)
+
 // Container strcuture
 type Container struct {
-	Name           string            `json:"name"`
-	DefinitionName string            `json:"definitionName"`
-	Image          string            `json:"image"`
-	NodeName       string            `json:"nodeName"`
-	ContainerID    string            `json:"containerId"`
-	Running        bool              `json:"running"`
-	Labels         map[string]string `json:"labels"`
-	Volumes        map[string]string `json:"volumes"`
-	HTTPPort       int               `json:"httpPort"`     // the HTTP Port on the container
-	NodeHTTPPort   int               `json:"nodeHttpPort"` // the rnadomly generated HTTP Port to access HTTPPort
-	Ports          []string          `json:"ports"`
-	Env            map[string]string `json:"env"`
-	Cmd            []string          `json:"cmd"`
-	Caps           []string          `json:"caps"`
+	Name            string            `json:"name"`
+	DefinitionName  string            `json:"definitionName"`
+	Index           int               `json:"index"` // replica index, the lowest free one of the definition
+	Image           string            `json:"image"`
+	NodeName        string            `json:"nodeName"`
+	ContainerID     string            `json:"containerId"`           // observed docker id
+	Running         bool              `json:"running"`               // observed
+	Labels          map[string]string `json:"labels"`                // of the definition, also set on the docker container
+	Annotations     map[string]string `json:"annotations,omitempty"` // of the definition
+	Volumes         map[string]string `json:"volumes"`
+	HTTPPort        int               `json:"httpPort"`     // the HTTP Port on the container
+	NodeHTTPPort    int               `json:"nodeHttpPort"` // the rnadomly generated HTTP Port to access HTTPPort
+	Ports           []string          `json:"ports"`
+	Env             map[string]string `json:"env"`
+	Cmd             []string          `json:"cmd"`
+	Caps            []string          `json:"caps"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"` // changes with every save, see Db
+	SchemaVersion   int               `json:"schemaVersion"`             // version of the stored json, see Db
+
+	DesiredState  string        `json:"desiredState"`            // Running or Terminated, set by the master
+	State         string        `json:"state"`                   // lifecycle state, see the Container states
+	RestartPolicy string        `json:"restartPolicy,omitempty"` // Always or Never, also set on the docker container
+	JobName       string        `json:"jobName,omitempty"`       // job run the container belongs to
+	Sidecars      []Sidecar     `json:"sidecars,omitempty"`      // of the definition, started after the container
+	Networks      []string      `json:"networks,omitempty"`      // joined with the definition name as DNS alias
+	Registry      string        `json:"registry,omitempty"`      // of the definition
+	NamedVolumes  []NamedVolume `json:"namedVolumes,omitempty"`  // of the definition, names resolved for Index
+
+	// observed by the node
+	StartedAt     time.Time       `json:"startedAt"`
+	FinishedAt    time.Time       `json:"finishedAt"`
+	ExitCode      int             `json:"exitCode"`
+	RestartCount  int             `json:"restartCount"`
+	Health        string          `json:"health,omitempty"`        // docker health check status: starting, healthy or unhealthy
+	Message       string          `json:"message,omitempty"`       // why the container failed
+	ObservedAt    time.Time       `json:"observedAt"`              // last report of the node
+	Stats         *ContainerStats `json:"stats,omitempty"`         // last resource usage sample
+	SidecarStates []SidecarState  `json:"sidecarStates,omitempty"` // in the order of Sidecars
+}
+
+// Desired returns the desired state, Running for containers saved
+// before desired states existed
+func (c *Container) Desired() string {
+	if c.DesiredState == "" {
+		return ContainerRunning
+	}
+	return c.DesiredState
+}
+
+// Finished returns whether cont ran to completion and is not restarted:
+// Succeeded, or Failed when it never restarts
+func (c *Container) Finished() bool {
+	return c.State == ContainerSucceeded || (c.State == ContainerFailed && c.RestartPolicy == RestartNever)
 }
@@ -0,0 +1,23 @@
+package model
+
+import "time"
+
+// ContainerStats resource usage of a container sampled by its node
+type ContainerStats struct {
+	Time          time.Time `json:"time"`
+	CPUPercent    float64   `json:"cpuPercent"`  // of a single core, may exceed 100 with several cores
+	MemoryUsage   uint64    `json:"memoryUsage"` // bytes, excluding the page cache
+	MemoryLimit   uint64    `json:"memoryLimit"`
+	MemoryPercent float64   `json:"memoryPercent"`
+	NetworkRx     uint64    `json:"networkRx"` // bytes received since the container started
+	NetworkTx     uint64    `json:"networkTx"`
+	BlockRead     uint64    `json:"blockRead"` // bytes read from block devices since the container started
+	BlockWrite    uint64    `json:"blockWrite"`
+}
+
+// ContainerStatsHistory recent resource usage of a container
+type ContainerStatsHistory struct {
+	Name    string           `json:"name"`
+	Current *ContainerStats  `json:"current"`
+	History []ContainerStats `json:"history"` // oldest first
+}
@@ -1,14 +1,69 @@
 package model
 
+// Definition modes
+const (
+	ModeReplicated = "replicated" // Count long running containers, the default
+	ModeJob        = "job"        // containers that run to completion once, see JobSpec
+	ModeCronJob    = "cronjob"    // jobs started on a schedule, see CronJobSpec
+	ModeGlobal     = "global"     // one container on every eligible node, Count is ignored
+	ModeStateful   = "stateful"   // Count containers named <name>-<ordinal>, started and removed one at a time in order
+)
+
+// Dependency conditions
+const (
+	DependencyStarted   = "started"   // a container of the dependency runs
+	DependencyHealthy   = "healthy"   // a container of the dependency runs and passes its docker health check, if any
+	DependencyCompleted = "completed" // a job of the dependency is complete
+)
+
+// Dependency definition that must meet a condition before the
+// containers of the definition depending on it are created
+type Dependency struct {
+	Name      string `json:"name"`
+	Condition string `json:"condition"` // started, healthy or completed, defaults to started
+}
+
 // Definition model
 type Definition struct {
-	Name     string            `json:"name"`
-	Image    string            `json:"image"`
-	Count    int               `json:"count"`
-	HTTPPort int               `json:"httpPort"` // container port. it will be mapped to nodehttpport in Container model
-	Ports    []string          `json:"ports"`
-	Volumes  map[string]string `json:"volumes"`
-	Env      map[string]string `json:"env"`
-	Caps     []string          `json:"caps"`
-	Cmd      []string          `json:"cmd"`
+	Name            string            `json:"name"`
+	Image           string            `json:"image"`
+	Count           int               `json:"count"`
+	HTTPPort        int               `json:"httpPort"` // container port. it will be mapped to nodehttpport in Container model
+	Ports           []string          `json:"ports"`
+	Volumes         map[string]string `json:"volumes"`
+	Env             map[string]string `json:"env"`
+	Caps            []string          `json:"caps"`
+	Cmd             []string          `json:"cmd"`
+	Routes          []Route           `json:"routes"`                    // public routes. defaults to <name>.<proxy.domain>
+	Labels          map[string]string `json:"labels,omitempty"`          // copied to the containers, see LabelSelector
+	Annotations     map[string]string `json:"annotations,omitempty"`     // free text metadata, copied to the containers
+	Mode            string            `json:"mode,omitempty"`            // replicated, stateful, job, cronjob or global, see WorkloadMode
+	NodeSelector    string            `json:"nodeSelector,omitempty"`    // label selector of the nodes eligible to run the containers
+	DependsOn       []Dependency      `json:"dependsOn,omitempty"`       // started before and removed after this definition
+	Sidecars        []Sidecar         `json:"sidecars,omitempty"`        // containers run with each container, see Sidecar
+	Networks        []string          `json:"networks,omitempty"`        // names of the networks the containers join, see Network
+	Registry        string            `json:"registry,omitempty"`        // name of the Registry of the image, the one of its host when empty
+	NamedVolumes    []NamedVolume     `json:"namedVolumes,omitempty"`    // docker volumes, see NamedVolume
+	Job             *JobSpec          `json:"job,omitempty"`             // job and cronjob modes
+	CronJob         *CronJobSpec      `json:"cronJob,omitempty"`         // cronjob mode
+	Status          *DefinitionStatus `json:"status,omitempty"`          // maintained by the master
+	ResourceVersion string            `json:"resourceVersion,omitempty"` // changes with every save, see Db
+	SchemaVersion   int               `json:"schemaVersion"`             // version of the stored json, see Db
+}
+
+// WorkloadMode returns the mode of the definition, replicated when
+// empty
+func (d *Definition) WorkloadMode() string {
+	if d.Mode == "" {
+		return ModeReplicated
+	}
+	return d.Mode
+}
+
+// DependencyCondition returns the condition of dep, started when empty
+func (dep Dependency) DependencyCondition() string {
+	if dep.Condition == "" {
+		return DependencyStarted
+	}
+	return dep.Condition
 }
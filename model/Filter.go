@@ -2,8 +2,10 @@ package model
 
 import (
 	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Filter filter
@@ -16,31 +18,59 @@ type FilterString struct {
 	Operation string
 	Field     string
 	Value     string
+	Values    []string       // in and nin
+	Regexp    *regexp.Regexp // re, compiled from Value when nil
 }
 
 // Eval Implementation of Filter.Eval
 func (f *FilterString) Eval(it interface{}) bool {
 	v := reflect.ValueOf(it)
 	fld := reflect.Indirect(v).FieldByName(f.Field)
-	left := fld.String()
+	return evalString(f.Operation, fld.String(), f.Value, f.Values, f.Regexp)
+}
 
-	switch f.Operation {
+// evalString compares left with the value of a string filter
+func evalString(operation, left, value string, values []string, re *regexp.Regexp) bool {
+	switch operation {
+	case "in":
+		return containsString(values, left)
+	case "nin":
+		return !containsString(values, left)
+	case "re":
+		if re == nil {
+			var err error
+			if re, err = regexp.Compile(value); err != nil {
+				return false
+			}
+		}
+		return re.MatchString(left)
+	case "exists":
+		return (left != "") == (value == "true")
 	case "eq":
-		return left == f.Value
+		return left == value
 	case "ne":
-		return left != f.Value
+		return left != value
 	case "gt":
-		return strings.Compare(left, f.Value) > 0
+		return strings.Compare(left, value) > 0
 	case "ge":
-		i := strings.Compare(left, f.Value)
+		i := strings.Compare(left, value)
 		return i == 0 || i > 0
 	case "lt":
-		return strings.Compare(left, f.Value) < 0
+		return strings.Compare(left, value) < 0
 	case "le":
-		i := strings.Compare(left, f.Value)
+		i := strings.Compare(left, value)
 		return i == 0 || i < 0
 	case "like":
-		return strings.Contains(left, f.Value)
+		return strings.Contains(left, value)
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, it := range list {
+		if it == s {
+			return true
+		}
 	}
 	return false
 }
@@ -50,6 +80,7 @@ type FilterInt struct {
 	Operation string
 	Field     string
 	Value     int64
+	Values    []int64 // in and nin
 }
 
 // Eval Implementation of Filter.Eval
@@ -59,6 +90,14 @@ func (f *FilterInt) Eval(it interface{}) bool {
 	left := fld.Int()
 
 	switch f.Operation {
+	case "in", "nin":
+		found := false
+		for _, v := range f.Values {
+			found = found || v == left
+		}
+		return found == (f.Operation == "in")
+	case "exists":
+		return (left != 0) == (f.Value != 0)
 	case "eq":
 		return left == f.Value
 	case "ne":
@@ -94,6 +133,8 @@ func (f *FilterBool) Eval(it interface{}) bool {
 	left := fld.Bool()
 
 	switch f.Operation {
+	case "exists":
+		return left == f.Value
 	case "eq":
 		return left == f.Value
 	case "ne":
@@ -111,3 +152,92 @@ func (f *FilterBool) Eval(it interface{}) bool {
 	}
 	return false
 }
+
+// FilterTime Filter of time.Time types
+type FilterTime struct {
+	Operation string
+	Field     string
+	Value     time.Time
+	Exists    bool // exists
+}
+
+// Eval Implementation of Filter.Eval
+func (f *FilterTime) Eval(it interface{}) bool {
+	v := reflect.ValueOf(it)
+	fld := reflect.Indirect(v).FieldByName(f.Field)
+	if !fld.IsValid() {
+		return false
+	}
+	left, ok := fld.Interface().(time.Time)
+	if !ok {
+		return false
+	}
+
+	switch f.Operation {
+	case "eq":
+		return left.Equal(f.Value)
+	case "ne":
+		return !left.Equal(f.Value)
+	case "gt":
+		return left.After(f.Value)
+	case "ge":
+		return !left.Before(f.Value)
+	case "lt":
+		return left.Before(f.Value)
+	case "le":
+		return !left.After(f.Value)
+	case "exists":
+		return !left.IsZero() == f.Exists
+	}
+	return false
+}
+
+// FilterMap Filter of the string values of map[string]string types,
+// e.g. Labels
+type FilterMap struct {
+	Operation string
+	Field     string
+	Key       string
+	Value     string
+	Values    []string       // in and nin
+	Regexp    *regexp.Regexp // re, compiled from Value when nil
+}
+
+// Eval Implementation of Filter.Eval.  Missing keys only match ne, nin
+// and exists=false.
+func (f *FilterMap) Eval(it interface{}) bool {
+	v := reflect.ValueOf(it)
+	fld := reflect.Indirect(v).FieldByName(f.Field)
+	var left reflect.Value
+	if fld.Kind() == reflect.Map && !fld.IsNil() {
+		left = fld.MapIndex(reflect.ValueOf(f.Key))
+	}
+	if !left.IsValid() {
+		switch f.Operation {
+		case "ne", "nin":
+			return true
+		case "exists":
+			return f.Value != "true"
+		}
+		return false
+	}
+	if f.Operation == "exists" {
+		return f.Value == "true"
+	}
+	return evalString(f.Operation, left.String(), f.Value, f.Values, f.Regexp)
+}
+
+// FilterOr Filter matching when any of its filters match
+type FilterOr struct {
+	Filters []Filter
+}
+
+// Eval Implementation of Filter.Eval
+func (f *FilterOr) Eval(it interface{}) bool {
+	for _, filter := range f.Filters {
+		if filter.Eval(it) {
+			return true
+		}
+	}
+	return false
+}
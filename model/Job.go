@@ -0,0 +1,128 @@
+package model
+
+import "time"
+
+// Job states
+const (
+	JobActive   = "Active"   // containers still to run
+	JobComplete = "Complete" // the required completions succeeded
+	JobFailed   = "Failed"   // backoff limit or deadline exceeded, or replaced
+)
+
+// Cron job concurrency policies
+const (
+	ConcurrencyAllow   = "Allow"   // runs may overlap
+	ConcurrencyForbid  = "Forbid"  // skip a run while the previous one is active
+	ConcurrencyReplace = "Replace" // fail the active run and start the new one
+)
+
+// defaults of the job and cron job specs
+const (
+	defaultSuccessfulJobsHistoryLimit = 3
+	defaultFailedJobsHistoryLimit     = 1
+)
+
+// JobSpec how the containers of a job definition run to completion
+type JobSpec struct {
+	Completions           int `json:"completions"`           // containers that must exit 0, defaults to 1
+	Parallelism           int `json:"parallelism"`           // containers running at once, defaults to 1
+	BackoffLimit          int `json:"backoffLimit"`          // failed containers tolerated, 0 fails the job on the first failure
+	ActiveDeadlineSeconds int `json:"activeDeadlineSeconds"` // time allowed to the job, 0 for no limit
+}
+
+// CronJobSpec when a cron job definition starts job runs
+type CronJobSpec struct {
+	Schedule                   string `json:"schedule"`                   // cron expression in the time zone of the master
+	ConcurrencyPolicy          string `json:"concurrencyPolicy"`          // Allow, Forbid or Replace, defaults to Allow
+	SuccessfulJobsHistoryLimit int    `json:"successfulJobsHistoryLimit"` // complete runs kept, defaults to 3
+	FailedJobsHistoryLimit     int    `json:"failedJobsHistoryLimit"`     // failed runs kept, defaults to 1
+	Suspend                    bool   `json:"suspend"`                    // start no new runs
+}
+
+// DefinitionStatus state of a definition maintained by the master.
+// It is kept when the definition is saved through the API.
+type DefinitionStatus struct {
+	Jobs         []*Job         `json:"jobs,omitempty"`     // runs of a job or cron job, oldest first
+	LastSchedule time.Time      `json:"lastSchedule"`       // last time a cron job was due
+	Waiting      string         `json:"waiting,omitempty"`  // why no container is created, see Definition.DependsOn
+	Pins         map[int]string `json:"pins,omitempty"`     // node holding the local volumes of each replica index, see NamedVolume
+	Deleting     bool           `json:"deleting,omitempty"` // removed once its containers are gone
+}
+
+// Job run of a job definition, or one of the runs of a cron job
+type Job struct {
+	Name           string    `json:"name"` // the definition name, or <cron job>-<unix time> for cron jobs
+	DefinitionName string    `json:"definitionName"`
+	State          string    `json:"state"`
+	StartedAt      time.Time `json:"startedAt"`
+	CompletedAt    time.Time `json:"completedAt"`
+	Active         int       `json:"active"` // containers not finished yet
+	Succeeded      int       `json:"succeeded"`
+	Failed         int       `json:"failed"`
+	LastFailure    time.Time `json:"lastFailure"` // delays the next container, see JobBackoff
+	Message        string    `json:"message,omitempty"`
+	Runs           []JobRun  `json:"runs"` // finished containers, oldest first
+}
+
+// JobRun result of a finished container of a job
+type JobRun struct {
+	Container  string    `json:"container"`
+	NodeName   string    `json:"nodeName"`
+	State      string    `json:"state"` // Succeeded or Failed
+	ExitCode   int       `json:"exitCode"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Message    string    `json:"message,omitempty"`
+}
+
+// Finished returns whether the job is complete or failed
+func (j *Job) Finished() bool {
+	return j.State == JobComplete || j.State == JobFailed
+}
+
+// JobBackoff delay before a job starts a new container after a number
+// of failed containers: 10s doubled with each failure, up to 6 minutes
+func JobBackoff(failures int) time.Duration {
+	d := 10 * time.Second
+	for i := 1; i < failures && d < 6*time.Minute; i++ {
+		d *= 2
+	}
+	if d > 6*time.Minute {
+		d = 6 * time.Minute
+	}
+	return d
+}
+
+// JobSpec returns the job spec of the definition with defaults applied
+func (d *Definition) JobSpec() JobSpec {
+	spec := JobSpec{}
+	if d.Job != nil {
+		spec = *d.Job
+	}
+	if spec.Completions <= 0 {
+		spec.Completions = 1
+	}
+	if spec.Parallelism <= 0 {
+		spec.Parallelism = 1
+	}
+	return spec
+}
+
+// CronJobSpec returns the cron job spec of the definition with defaults
+// applied
+func (d *Definition) CronJobSpec() CronJobSpec {
+	spec := CronJobSpec{}
+	if d.CronJob != nil {
+		spec = *d.CronJob
+	}
+	if spec.ConcurrencyPolicy == "" {
+		spec.ConcurrencyPolicy = ConcurrencyAllow
+	}
+	if spec.SuccessfulJobsHistoryLimit <= 0 {
+		spec.SuccessfulJobsHistoryLimit = defaultSuccessfulJobsHistoryLimit
+	}
+	if spec.FailedJobsHistoryLimit <= 0 {
+		spec.FailedJobsHistoryLimit = defaultFailedJobsHistoryLimit
+	}
+	return spec
+}
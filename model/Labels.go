@@ -0,0 +1,169 @@
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// LabelReservedPrefix prefix of the labels set by one on docker
+// containers, e.g. one.managed
+const LabelReservedPrefix = "one."
+
+var (
+	labelNameRegexp   = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?$`)
+	labelValueRegexp  = regexp.MustCompile(`^([A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?)?$`)
+	selectorSetRegexp = regexp.MustCompile(`^(\S+)\s+(in|notin)\s+\((.*)\)$`)
+)
+
+// ValidateLabelKey checks a label or annotation key: a name of up to 63
+// letters, digits, -, _ and . optionally prefixed by a domain and /, e.g.
+// app or example.com/tier.  Keys of the reserved prefix are refused.
+func ValidateLabelKey(key string) error {
+	name := key
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		prefix := key[:i]
+		name = key[i+1:]
+		if prefix == "" || len(prefix) > 253 || !hostRegexp.MatchString(prefix) {
+			return fmt.Errorf("invalid label key %q: the prefix must be a domain", key)
+		}
+	}
+	if !labelNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid label key %q: up to 63 letters, digits, -, _ or . starting and ending with a letter or digit", key)
+	}
+	if strings.HasPrefix(key, LabelReservedPrefix) {
+		return fmt.Errorf("invalid label key %q: the prefix %s is reserved", key, LabelReservedPrefix)
+	}
+	return nil
+}
+
+// ValidateLabels checks the keys and values of labels.  Values are empty
+// or follow the syntax of the names of keys.
+func ValidateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if err := ValidateLabelKey(k); err != nil {
+			return err
+		}
+		if !labelValueRegexp.MatchString(v) {
+			return fmt.Errorf("invalid value %q of label %s: up to 63 letters, digits, -, _ or . starting and ending with a letter or digit", v, k)
+		}
+	}
+	return nil
+}
+
+// ValidateAnnotations checks the keys of annotations, whose values are
+// free text
+func ValidateAnnotations(annotations map[string]string) error {
+	for k := range annotations {
+		if err := ValidateLabelKey(k); err != nil {
+			return fmt.Errorf("invalid annotation: %s", err)
+		}
+	}
+	return nil
+}
+
+// LabelSelector selects objects by labels, all its filters must match
+type LabelSelector []Filter
+
+// labeled wraps a label map in a struct the filters can evaluate
+type labeled struct {
+	Labels map[string]string
+}
+
+// ParseLabelSelector parses a selector of comma separated requirements
+// on the field Labels, as in app=web,tier!=db:
+//
+//	key=value, key==value  the label is value
+//	key!=value             the label is not value or is missing
+//	key in (a,b)           the label is one of the values
+//	key notin (a,b)        the label is none of the values or is missing
+//	key                    the label exists
+//	!key                   the label is missing
+func ParseLabelSelector(selector string) (LabelSelector, error) {
+	result := make(LabelSelector, 0)
+	for _, req := range splitSelector(selector) {
+		req = strings.TrimSpace(req)
+		if req == "" {
+			return nil, fmt.Errorf("invalid selector %q: empty requirement", selector)
+		}
+		f, err := parseRequirement(req)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector %q: %s", selector, err)
+		}
+		result = append(result, f)
+	}
+	return result, nil
+}
+
+// splitSelector splits selector on the commas outside of parentheses
+func splitSelector(selector string) []string {
+	if strings.TrimSpace(selector) == "" {
+		return nil
+	}
+	parts := make([]string, 0)
+	depth, start := 0, 0
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, selector[start:])
+}
+
+func parseRequirement(req string) (*FilterMap, error) {
+	f := &FilterMap{Field: "Labels"}
+	switch {
+	case selectorSetRegexp.MatchString(req):
+		m := selectorSetRegexp.FindStringSubmatch(req)
+		f.Key = m[1]
+		f.Operation = map[string]string{"in": "in", "notin": "nin"}[m[2]]
+		for _, v := range strings.Split(m[3], ",") {
+			f.Values = append(f.Values, strings.TrimSpace(v))
+		}
+	case strings.Contains(req, "!="):
+		kv := strings.SplitN(req, "!=", 2)
+		f.Operation, f.Key, f.Value = "ne", kv[0], kv[1]
+	case strings.Contains(req, "="):
+		kv := strings.SplitN(strings.Replace(req, "==", "=", 1), "=", 2)
+		f.Operation, f.Key, f.Value = "eq", kv[0], kv[1]
+	case strings.HasPrefix(req, "!"):
+		f.Operation, f.Key, f.Value = "exists", strings.TrimPrefix(req, "!"), "false"
+	default:
+		f.Operation, f.Key, f.Value = "exists", req, "true"
+	}
+	f.Key = strings.TrimSpace(f.Key)
+	f.Value = strings.TrimSpace(f.Value)
+	if f.Key == "" || strings.ContainsAny(f.Key, " ()!=") {
+		return nil, fmt.Errorf("invalid requirement %q", req)
+	}
+	for _, v := range append([]string{f.Value}, f.Values...) {
+		if !labelValueRegexp.MatchString(v) {
+			return nil, fmt.Errorf("invalid value %q in requirement %q", v, req)
+		}
+	}
+	return f, nil
+}
+
+// Eval Implementation of Filter.Eval, it matches objects whose field
+// Labels matches every requirement
+func (s LabelSelector) Eval(it interface{}) bool {
+	for _, f := range s {
+		if !f.Eval(it) {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches returns whether labels match every requirement
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	return s.Eval(&labeled{Labels: labels})
+}
@@ -0,0 +1,15 @@
+package model
+
+// Network docker network declared on the master.  The nodes create it
+// when they run a container of a definition attached to it and remove
+// it once no such container is left.  Containers join it with the name
+// of their definition as DNS alias.
+type Network struct {
+	Name            string            `json:"name"`
+	Driver          string            `json:"driver,omitempty"`          // bridge when empty
+	Internal        bool              `json:"internal,omitempty"`        // no route outside of the network
+	Subnet          string            `json:"subnet,omitempty"`          // CIDR, chosen by docker when empty
+	Labels          map[string]string `json:"labels,omitempty"`          // also set on the docker network
+	ResourceVersion string            `json:"resourceVersion,omitempty"` // changes with every save, see Db
+	SchemaVersion   int               `json:"schemaVersion"`             // version of the stored json, see Db
+}
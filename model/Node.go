@@ -4,8 +4,12 @@ import "time"
 
 // Node represents a server that hosts containers
 type Node struct {
-	Name        string    `json:"name"`
-	Addr        string    `json:"addr"` // of the form 10.10.10.1:8080
-	Enabled     bool      `json:"enabled"`
-	LastUpdated time.Time `json:"lastUpdated"`
+	Name            string            `json:"name"`
+	Addr            string            `json:"addr"`             // of the form 10.10.10.1:8080
+	Enabled         bool              `json:"enabled"`          // containers are only scheduled on enabled nodes
+	Labels          map[string]string `json:"labels,omitempty"` // matched by the node selectors of definitions
+	LastUpdated     time.Time         `json:"lastUpdated"`
+	Volumes         []VolumeInfo      `json:"volumes,omitempty"`         // reported by the node
+	ResourceVersion string            `json:"resourceVersion,omitempty"` // changes with every save, see Db
+	SchemaVersion   int               `json:"schemaVersion"`             // version of the stored json, see Db
 }
@@ -5,10 +5,22 @@ package model
 type NodeInfo struct {
 	Node       Node        `json:"node"`
 	Containers []Container `json:"containers"`
+	// Errors of the containers the node failed to run, by name
+	Errors map[string]string `json:"errors,omitempty"`
+	// Volumes docker volumes of the node
+	Volumes []VolumeInfo `json:"volumes,omitempty"`
+	// Stats current resource usage of the running containers, by name
+	Stats map[string]ContainerStats `json:"stats,omitempty"`
 }
 
 // NodeInfoResponse is the response from the server after a NodeInfo
 // is posted
 type NodeInfoResponse struct {
+	// Containers the node should run, any other managed container is removed
 	Containers []Container `json:"containers"`
+	// Networks joined by the containers, any other managed network is removed
+	Networks []Network `json:"networks,omitempty"`
+	// Registries credentials of the registries of the images of the
+	// containers, by host
+	Registries []RegistryAuth `json:"registries,omitempty"`
 }
@@ -0,0 +1,18 @@
+package model
+
+import "time"
+
+// ProxyDrift differences between the sites the proxy should serve
+// and the sites it is configured with
+type ProxyDrift struct {
+	Missing  []string          `json:"missing"`  // sites with running replicas that are not configured
+	Orphaned []string          `json:"orphaned"` // configured sites without a definition or replicas
+	Outdated []string          `json:"outdated"` // configured sites whose backends changed
+	Errors   map[string]string `json:"errors"`   // site -> error of the last reconciliation
+	LastRun  time.Time         `json:"lastRun"`  // time of the last reconciliation
+}
+
+// InSync whether the proxy matches the desired state
+func (d *ProxyDrift) InSync() bool {
+	return len(d.Missing) == 0 && len(d.Orphaned) == 0 && len(d.Outdated) == 0
+}
@@ -0,0 +1,21 @@
+package model
+
+// Registry credentials of a private image registry.  The master stores
+// the password encrypted and sends it only to the nodes pulling images
+// from the registry, see Definition.Registry.
+type Registry struct {
+	Name              string `json:"name"`
+	Host              string `json:"host"` // e.g. registry.example.com:5000, matched against the host of the images
+	Username          string `json:"username"`
+	Password          string `json:"password,omitempty"`          // write only, cleared once encrypted
+	EncryptedPassword string `json:"encryptedPassword,omitempty"` // base64 AES-GCM with the registry key of the master
+	ResourceVersion   string `json:"resourceVersion,omitempty"`   // changes with every save, see Db
+	SchemaVersion     int    `json:"schemaVersion"`               // version of the stored json, see Db
+}
+
+// RegistryAuth credentials of a registry sent to the nodes
+type RegistryAuth struct {
+	Host     string `json:"host"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
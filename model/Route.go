@@ -0,0 +1,146 @@
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var hostRegexp = regexp.MustCompile(`^(\*\.)?([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// pathPrefixRegexp characters allowed in path prefixes, they are written
+// into the proxy configuration
+var pathPrefixRegexp = regexp.MustCompile(`^/[A-Za-z0-9._~/-]*$`)
+
+// Route public route to the replicas of a definition
+type Route struct {
+	Hosts       []string `json:"hosts"`       // defaults to <name>.<proxy.domain>
+	PathPrefix  string   `json:"pathPrefix"`  // defaults to /
+	StripPrefix bool     `json:"stripPrefix"` // remove PathPrefix before forwarding
+	AllowHTTP   bool     `json:"allowHttp"`   // serve plain http instead of redirecting to https
+}
+
+// ResolveRoutes returns routes with defaults applied.  A definition
+// without routes is served at <name>.<baseDomain>.
+func ResolveRoutes(name string, routes []Route, baseDomain string) []Route {
+	defaultHost := fmt.Sprintf("%s.%s", name, baseDomain)
+	if len(routes) == 0 {
+		return []Route{{Hosts: []string{defaultHost}, PathPrefix: "/"}}
+	}
+	result := make([]Route, 0, len(routes))
+	for _, r := range routes {
+		hosts := make([]string, 0, len(r.Hosts))
+		for _, h := range r.Hosts {
+			hosts = append(hosts, strings.ToLower(strings.TrimSpace(h)))
+		}
+		if len(hosts) == 0 {
+			hosts = append(hosts, defaultHost)
+		}
+		r.Hosts = hosts
+		r.PathPrefix = NormalizePathPrefix(r.PathPrefix)
+		result = append(result, r)
+	}
+	return result
+}
+
+// NormalizePathPrefix returns the prefix with a leading slash and
+// without a trailing one.  The empty prefix is "/".
+func NormalizePathPrefix(prefix string) string {
+	prefix = strings.TrimSpace(prefix)
+	prefix = "/" + strings.Trim(prefix, "/")
+	return prefix
+}
+
+// ValidateRoutes checks host names and path prefixes of the routes
+func ValidateRoutes(routes []Route) error {
+	for _, r := range routes {
+		for _, h := range r.Hosts {
+			if !hostRegexp.MatchString(h) {
+				return fmt.Errorf("invalid host %q", h)
+			}
+		}
+		if !pathPrefixRegexp.MatchString(r.PathPrefix) {
+			return fmt.Errorf("invalid path prefix %q", r.PathPrefix)
+		}
+	}
+	return nil
+}
+
+// routeKeys returns the host+prefix keys claimed by the definition
+func routeKeys(def *Definition, baseDomain string) ([]string, error) {
+	routes := ResolveRoutes(def.Name, def.Routes, baseDomain)
+	if err := ValidateRoutes(routes); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0)
+	for _, r := range routes {
+		for _, h := range r.Hosts {
+			keys = append(keys, h+r.PathPrefix)
+		}
+	}
+	return keys, nil
+}
+
+// RouteConflict returns an error when the routes of def are invalid or
+// claim a host and path prefix used by any of the other definitions
+func RouteConflict(def *Definition, others map[string]*Definition, baseDomain string) error {
+	keys, err := routeKeys(def, baseDomain)
+	if err != nil {
+		return err
+	}
+	claimed := make(map[string]bool)
+	for _, key := range keys {
+		claimed[key] = true
+	}
+	for name, other := range others {
+		if name == def.Name {
+			continue
+		}
+		otherKeys, err := routeKeys(other, baseDomain)
+		if err != nil {
+			continue
+		}
+		for _, key := range otherKeys {
+			if claimed[key] {
+				return fmt.Errorf("route %s is already used by definition %s", key, name)
+			}
+		}
+	}
+	return nil
+}
+
+// RouteConflicts returns an error for every definition whose routes
+// are invalid or claim a host and path prefix already claimed by another
+// definition.  Definitions are checked in name order so the first one
+// keeps the route.
+func RouteConflicts(defs map[string]*Definition, baseDomain string) map[string]error {
+	names := make([]string, 0, len(defs))
+	for name := range defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	conflicts := make(map[string]error)
+	claimed := make(map[string]string) // host+prefix -> definition name
+	for _, name := range names {
+		keys, err := routeKeys(defs[name], baseDomain)
+		if err != nil {
+			conflicts[name] = err
+			continue
+		}
+		for _, key := range keys {
+			if owner, ok := claimed[key]; ok {
+				conflicts[name] = fmt.Errorf("route %s is already used by definition %s", key, owner)
+				break
+			}
+		}
+		if conflicts[name] != nil {
+			continue
+		}
+		for _, key := range keys {
+			claimed[key] = name
+		}
+	}
+	return conflicts
+}
@@ -0,0 +1,25 @@
+package model
+
+// Sidecar container run beside the main container of a definition.  The
+// sidecars of a container are started in order on its node after it,
+// share its network, so they reach each other on localhost, and mount
+// its volumes.  The group is running only when all of its containers
+// are.
+type Sidecar struct {
+	Name    string            `json:"name"` // unique in the definition, the docker container is <container>.<name>
+	Image   string            `json:"image"`
+	Env     map[string]string `json:"env"`
+	Volumes map[string]string `json:"volumes"` // in addition to those of the main container
+	Cmd     []string          `json:"cmd"`
+	Caps    []string          `json:"caps"`
+}
+
+// SidecarState observed state of a sidecar, reported by the node with
+// the main container
+type SidecarState struct {
+	Name         string `json:"name"`
+	ContainerID  string `json:"containerId"` // empty when the docker container is missing
+	Running      bool   `json:"running"`
+	ExitCode     int    `json:"exitCode"`
+	RestartCount int    `json:"restartCount"`
+}
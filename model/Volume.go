@@ -0,0 +1,46 @@
+package model
+
+import (
+	"bytes"
+	"text/template"
+)
+
+// NamedVolume docker volume mounted by the containers of a definition.
+// Volumes of the local driver keep their data on the node, so replicas
+// mounting them are pinned to the node they first ran on, see
+// DefinitionStatus.Pins.
+type NamedVolume struct {
+	Name     string            `json:"name"`              // template, e.g. data-{{.Index}} gives every replica its own volume
+	Path     string            `json:"path"`              // mount point in the container
+	Driver   string            `json:"driver,omitempty"`  // local when empty
+	Options  map[string]string `json:"options,omitempty"` // of the driver
+	ReadOnly bool              `json:"readOnly,omitempty"`
+}
+
+// VolumeInfo docker volume reported by a node
+type VolumeInfo struct {
+	Name           string `json:"name"`
+	Driver         string `json:"driver"`
+	Scope          string `json:"scope"`                    // local or global
+	DefinitionName string `json:"definitionName,omitempty"` // of the volumes created for a definition
+	Index          int    `json:"index"`                    // replica index of the volumes created for a definition
+	NodeName       string `json:"nodeName,omitempty"`       // set by the master
+}
+
+// Local returns whether the data of the volume stays on its node
+func (v NamedVolume) Local() bool {
+	return v.Driver == "" || v.Driver == "local"
+}
+
+// Resolve returns the name of the volume of the replica index
+func (v NamedVolume) Resolve(index int) (string, error) {
+	tmpl, err := template.New(v.Name).Option("missingkey=error").Parse(v.Name)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, struct{ Index int }{index}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,471 @@
+package service
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/libgolang/log"
+	"github.com/libgolang/one/model"
+	"github.com/libgolang/one/utils"
+)
+
+// BackupVersion version of the archives written by WriteBackup.
+// Archives of newer versions are refused by ReadBackup.  Version 2
+// adds the networks and version 3 the registries.
+const BackupVersion = 3
+
+const (
+	backupManifest   = "manifest.json"
+	backupPrefix     = "one-backup-"
+	backupSuffix     = ".tar.gz"
+	backupTimeLayout = "20060102T150405.000000000Z"
+)
+
+// backupEntries archive entries after the manifest
+var backupEntries = []string{"definitions.json", "containers.json", "nodes.json", "networks.json", "registries.json", "vars.json"}
+
+// backupEntriesOf returns the entries of the archives of version
+func backupEntriesOf(version int) []string {
+	switch version {
+	case 1:
+		return []string{"definitions.json", "containers.json", "nodes.json", "vars.json"}
+	case 2:
+		return []string{"definitions.json", "containers.json", "nodes.json", "networks.json", "vars.json"}
+	}
+	return backupEntries
+}
+
+// WriteBackup writes a gzipped tar archive of every object of d to w.
+// The objects are read in a single transaction of d, so on a front Db
+// the snapshot is consistent with every write queued before and after
+// it.  The archive starts with a manifest holding the checksum of the
+// other entries.
+func WriteBackup(d Db, w io.Writer) (*model.Backup, error) {
+	var content *dbContent
+	if err := d.Trx(func(d Db) {
+		content = readContent(d)
+	}); err != nil {
+		return nil, fmt.Errorf("unable to read the db: %s", err)
+	}
+	if content == nil {
+		return nil, fmt.Errorf("unable to read the db")
+	}
+
+	objects := map[string]interface{}{
+		"definitions.json": content.Definitions,
+		"containers.json":  content.Containers,
+		"nodes.json":       content.Nodes,
+		"networks.json":    content.Networks,
+		"registries.json":  content.Registries,
+		"vars.json":        content.Vars,
+	}
+	manifest := &model.Backup{
+		Version:   BackupVersion,
+		CreatedAt: time.Now().UTC(),
+		Counts:    content.stats(),
+		Checksums: make(map[string]string),
+	}
+	data := make(map[string][]byte)
+	for _, name := range backupEntries {
+		b, err := json.MarshalIndent(objects[name], "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		data[name] = b
+		manifest.Checksums[name] = checksum(b)
+	}
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	write := func(name string, b []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(b)), ModTime: manifest.CreatedAt}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(b)
+		return err
+	}
+	if err := write(backupManifest, b); err != nil {
+		return nil, err
+	}
+	for _, name := range backupEntries {
+		if err := write(name, data[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// ReadBackup reads and validates an archive written by WriteBackup: the
+// version must be supported, every entry must match its checksum and
+// every object must be stored under its own name.
+func ReadBackup(r io.Reader) (*model.Backup, *dbContent, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("not a backup archive: %s", err)
+	}
+	defer func() {
+		_ = gz.Close()
+	}()
+	tr := tar.NewReader(gz)
+	entries := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("corrupt backup archive: %s", err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("corrupt backup archive: %s", err)
+		}
+		entries[hdr.Name] = b
+	}
+
+	manifest := &model.Backup{}
+	b, ok := entries[backupManifest]
+	if !ok {
+		return nil, nil, fmt.Errorf("backup archive has no %s", backupManifest)
+	}
+	if err := json.Unmarshal(b, manifest); err != nil {
+		return nil, nil, fmt.Errorf("invalid %s: %s", backupManifest, err)
+	}
+	if manifest.Version < 1 || manifest.Version > BackupVersion {
+		return nil, nil, fmt.Errorf("unsupported backup version %d, expected at most %d", manifest.Version, BackupVersion)
+	}
+	for _, name := range backupEntriesOf(manifest.Version) {
+		b, ok := entries[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("backup archive has no %s", name)
+		}
+		if sum := checksum(b); sum != manifest.Checksums[name] {
+			return nil, nil, fmt.Errorf("checksum mismatch of %s", name)
+		}
+	}
+
+	// objects are upgraded to the current schema version
+	raw := make(map[string]map[string]json.RawMessage)
+	for _, name := range backupEntriesOf(manifest.Version) {
+		if name == "vars.json" {
+			continue
+		}
+		m := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(entries[name], &m); err != nil {
+			return nil, nil, fmt.Errorf("invalid %s: %s", name, err)
+		}
+		raw[name] = m
+	}
+	content := &dbContent{
+		Definitions: make(map[string]*model.Definition),
+		Containers:  make(map[string]*model.Container),
+		Nodes:       make(map[string]*model.Node),
+		Networks:    make(map[string]*model.Network),
+		Registries:  make(map[string]*model.Registry),
+	}
+	for key, b := range raw["definitions.json"] {
+		def := &model.Definition{}
+		if err := decodeStored(kindDefinition, b, def); err != nil {
+			return nil, nil, fmt.Errorf("invalid definition %s: %s", key, err)
+		}
+		content.Definitions[key] = def
+	}
+	for key, b := range raw["containers.json"] {
+		cont := &model.Container{}
+		if err := decodeStored(kindContainer, b, cont); err != nil {
+			return nil, nil, fmt.Errorf("invalid container %s: %s", key, err)
+		}
+		content.Containers[key] = cont
+	}
+	for key, b := range raw["nodes.json"] {
+		node := &model.Node{}
+		if err := decodeStored(kindNode, b, node); err != nil {
+			return nil, nil, fmt.Errorf("invalid node %s: %s", key, err)
+		}
+		content.Nodes[key] = node
+	}
+	for key, b := range raw["networks.json"] {
+		network := &model.Network{}
+		if err := decodeStored(kindNetwork, b, network); err != nil {
+			return nil, nil, fmt.Errorf("invalid network %s: %s", key, err)
+		}
+		content.Networks[key] = network
+	}
+	for key, b := range raw["registries.json"] {
+		registry := &model.Registry{}
+		if err := decodeStored(kindRegistry, b, registry); err != nil {
+			return nil, nil, fmt.Errorf("invalid registry %s: %s", key, err)
+		}
+		content.Registries[key] = registry
+	}
+	if err := json.Unmarshal(entries["vars.json"], &content.Vars); err != nil {
+		return nil, nil, fmt.Errorf("invalid vars.json: %s", err)
+	}
+	if err := content.validate(); err != nil {
+		return nil, nil, err
+	}
+	for kind, n := range content.stats() {
+		if manifest.Counts[kind] != n {
+			return nil, nil, fmt.Errorf("backup has %d %s, the manifest lists %d", n, kind, manifest.Counts[kind])
+		}
+	}
+	return manifest, content, nil
+}
+
+// validate checks every object is stored under its own name
+func (c *dbContent) validate() error {
+	check := func(kind, key, name string) error {
+		if name == "" || name != key {
+			return fmt.Errorf("%s %q is stored as %q", kind, name, key)
+		}
+		return nil
+	}
+	for key, def := range c.Definitions {
+		if err := check("definition", key, def.Name); err != nil {
+			return err
+		}
+	}
+	for key, cont := range c.Containers {
+		if err := check("container", key, cont.Name); err != nil {
+			return err
+		}
+	}
+	for key, node := range c.Nodes {
+		if err := check("node", key, node.Name); err != nil {
+			return err
+		}
+	}
+	for key, network := range c.Networks {
+		if err := check("network", key, network.Name); err != nil {
+			return err
+		}
+	}
+	for key, registry := range c.Registries {
+		if err := check("registry", key, registry.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreBackup validates the archive read from r and loads it into
+// to in a single transaction.  to must hold no definitions, containers,
+// nodes, networks or registries, and must not be a front Db, see
+// ImportDb.
+func RestoreBackup(r io.Reader, to Db) (*model.Backup, error) {
+	manifest, content, err := ReadBackup(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(to.ListDefinitions()) > 0 || len(to.ListContainers()) > 0 || len(to.ListNodes()) > 0 || len(to.ListNetworks()) > 0 || len(to.ListRegistries()) > 0 {
+		return nil, fmt.Errorf("restore requires an empty db")
+	}
+	if err := importContent(content, to); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// BackupService takes periodic snapshots of the master's state into a
+// directory and serves them through the REST API
+type BackupService interface {
+	// Backup writes a new snapshot and removes the ones beyond retention
+	Backup() (*model.Backup, error)
+}
+
+type backupService struct {
+	rs       RestServer
+	db       Db
+	dir      string
+	interval time.Duration
+	keep     int
+	cluster  Cluster
+}
+
+// NewBackupService constructor.  Snapshots are written to dir every
+// interval, or only on request when interval is zero, and the newest
+// keep snapshots are kept, all of them when keep is zero.  cluster is
+// nil unless the master is one of several masters, in which case only
+// the leader takes periodic snapshots.
+func NewBackupService(rs RestServer, db Db, dir string, interval time.Duration, keep int, cluster Cluster) BackupService {
+	s := &backupService{rs: rs, db: db, dir: dir, interval: interval, keep: keep, cluster: cluster}
+	s.init()
+	return s
+}
+
+func (s *backupService) init() {
+	s.rs.HandleFunc("/master/backups", func(w http.ResponseWriter, r *http.Request) RestResponse { return s.listBackups(w, r) }).Methods("GET")
+	s.rs.HandleFunc("/master/backups", func(w http.ResponseWriter, r *http.Request) RestResponse { return s.createBackup(w, r) }).Methods("POST")
+	s.rs.HandleFunc("/master/backups/{name}", func(w http.ResponseWriter, r *http.Request) RestResponse { return s.downloadBackup(w, r) }).Methods("GET")
+
+	if s.interval <= 0 {
+		return
+	}
+	timer := time.NewTicker(s.interval)
+	go func() {
+		for range timer.C {
+			if s.cluster != nil && !s.cluster.IsLeader() {
+				continue
+			}
+			if _, err := s.Backup(); err != nil {
+				log.Error("backup failed: %s", err)
+			}
+		}
+	}()
+}
+
+func (s *backupService) Backup() (*model.Backup, error) {
+	utils.EnsureDir(s.dir)
+	tmp, err := ioutil.TempFile(s.dir, ".backup-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	manifest, err := WriteBackup(s.db, tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	manifest.Name = backupPrefix + manifest.CreatedAt.Format(backupTimeLayout) + backupSuffix
+	file := path.Join(s.dir, manifest.Name)
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(file); err == nil {
+		manifest.Size = fi.Size()
+	}
+	log.Info("backup %s written", manifest.Name)
+	s.prune()
+	return manifest, nil
+}
+
+// list returns the snapshot file names, oldest first
+func (s *backupService) list() []string {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0)
+	for _, fi := range files {
+		if !fi.IsDir() && isBackupName(fi.Name()) {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// prune removes the oldest snapshots beyond retention
+func (s *backupService) prune() {
+	if s.keep <= 0 {
+		return
+	}
+	names := s.list()
+	for len(names) > s.keep {
+		log.Info("removing backup %s", names[0])
+		if err := os.Remove(path.Join(s.dir, names[0])); err != nil {
+			log.Error("unable to remove backup %s: %s", names[0], err)
+		}
+		names = names[1:]
+	}
+}
+
+func isBackupName(name string) bool {
+	return filepath.Base(name) == name && strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix)
+}
+
+// readManifest reads the manifest of a snapshot file
+func (s *backupService) readManifest(name string) (*model.Backup, error) {
+	file := path.Join(s.dir, name)
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	manifest, _, err := ReadBackup(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	manifest.Name = name
+	manifest.Size = int64(len(b))
+	manifest.Checksums = nil
+	return manifest, nil
+}
+
+func (s *backupService) listBackups(w http.ResponseWriter, r *http.Request) RestResponse {
+	list := make([]*model.Backup, 0)
+	for _, name := range s.list() {
+		manifest, err := s.readManifest(name)
+		if err != nil {
+			log.Warn("skipping backup %s: %s", name, err)
+			continue
+		}
+		list = append(list, manifest)
+	}
+	def := map[string]string{
+		"Name":      "string",
+		"Version":   "int",
+		"CreatedAt": "time",
+		"Size":      "int",
+	}
+	page, err := utils.RestList(def, "Name", r, &list)
+	if err != nil {
+		return (&JSONResponse{}).SetStatus(400).SetBody(map[string]string{"error": err.Error()})
+	}
+	return listResponse(page)
+}
+
+func (s *backupService) createBackup(w http.ResponseWriter, r *http.Request) RestResponse {
+	manifest, err := s.Backup()
+	if err != nil {
+		log.Error("backup failed: %s", err)
+		return (&JSONResponse{}).SetStatus(500).SetBody(`{"error":"Unable to write backup"}`)
+	}
+	manifest.Checksums = nil
+	return (&JSONResponse{}).SetBody(manifest)
+}
+
+func (s *backupService) downloadBackup(w http.ResponseWriter, r *http.Request) RestResponse {
+	name := mux.Vars(r)["name"]
+	if !isBackupName(name) || !utils.FileExists(path.Join(s.dir, name)) {
+		return (&JSONResponse{}).SetStatus(404).SetBody(`{"error":"backup not found"}`)
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeFile(w, r, path.Join(s.dir, name))
+	return nil
+}
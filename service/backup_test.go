@@ -0,0 +1,122 @@
+package service
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/libgolang/one/model"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	// given
+	tmpDir, _ := ioutil.TempDir("", "testing-backup")
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	from := NewFrontDb(NewDb(path.Join(tmpDir, "from")))
+	_ = from.SaveDefinition(&model.Definition{Name: "web", Image: "nginx", Count: 2})
+	_ = from.SaveContainer(&model.Container{Name: "web-1", DefinitionName: "web", NodeName: "node01"})
+	_ = from.SaveNode(&model.Node{Name: "node01", Enabled: true})
+	_ = from.SaveNetwork(&model.Network{Name: "backend", Internal: true})
+	_ = from.SaveRegistry(&model.Registry{Name: "private", Host: "registry.example.com", Username: "ci", EncryptedPassword: "c2VhbGVk"})
+	from.NextAutoIncrement("inc.container", "web")
+	to := NewBoltDb(path.Join(tmpDir, "one.db"))
+	defer to.Close()
+
+	// when
+	buf := &bytes.Buffer{}
+	written, err := WriteBackup(from, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := RestoreBackup(buf, to)
+
+	// then
+	if err != nil {
+		t.Fatalf("restore should succeed: %s", err)
+	}
+	if restored.Version != BackupVersion || restored.Counts["containers"] != 1 || !restored.CreatedAt.Equal(written.CreatedAt) {
+		t.Errorf("unexpected manifest %+v", restored)
+	}
+	if def, err := to.GetDefinition("web"); err != nil || def.Count != 2 {
+		t.Errorf("definition should be restored: %v", err)
+	}
+	if len(to.ListContainersByNode("node01")) != 1 || len(to.ListNodes()) != 1 {
+		t.Error("containers and nodes should be restored")
+	}
+	if network, err := to.GetNetwork("backend"); err != nil || !network.Internal {
+		t.Errorf("network should be restored: %v", err)
+	}
+	if registry, err := to.GetRegistry("private"); err != nil || registry.EncryptedPassword != "c2VhbGVk" {
+		t.Errorf("registry should be restored with its encrypted password: %v", err)
+	}
+	if vars := to.GetVars(func(map[string]string) {}); vars["inc.container.web"] != "1" {
+		t.Errorf("vars should be restored: %v", vars)
+	}
+}
+
+func TestRestoreValidatesArchive(t *testing.T) {
+	// given
+	tmpDir, _ := ioutil.TempDir("", "testing-backup")
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	from := NewDb(path.Join(tmpDir, "from"))
+	_ = from.SaveDefinition(&model.Definition{Name: "web", Image: "nginx"})
+	buf := &bytes.Buffer{}
+	if _, err := WriteBackup(from, buf); err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+	corrupt := append([]byte{}, archive...)
+	corrupt[len(corrupt)/2] ^= 0xff
+
+	// when
+	_, corruptErr := RestoreBackup(bytes.NewReader(corrupt), NewDb(path.Join(tmpDir, "corrupt")))
+	_, garbageErr := RestoreBackup(strings.NewReader("not an archive"), NewDb(path.Join(tmpDir, "garbage")))
+	_, nonEmptyErr := RestoreBackup(bytes.NewReader(archive), from)
+
+	// then
+	if corruptErr == nil {
+		t.Error("corrupt archive should be refused")
+	}
+	if garbageErr == nil {
+		t.Error("garbage should be refused")
+	}
+	if nonEmptyErr == nil {
+		t.Error("restore into a db with data should be refused")
+	}
+	if len(NewDb(path.Join(tmpDir, "corrupt")).ListDefinitions()) != 0 {
+		t.Error("refused archive should not be loaded")
+	}
+}
+
+func TestBackupRetention(t *testing.T) {
+	// given
+	tmpDir, _ := ioutil.TempDir("", "testing-backup")
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	rs := NewRestServer("127.0.0.1:0", "", "")
+	s := NewBackupService(rs, NewFrontDb(NewDb(path.Join(tmpDir, "var"))), path.Join(tmpDir, "backups"), 0, 2, nil)
+
+	// when
+	var last *model.Backup
+	for i := 0; i < 3; i++ {
+		b, err := s.Backup()
+		if err != nil {
+			t.Fatal(err)
+		}
+		last = b
+	}
+
+	// then
+	names := s.(*backupService).list()
+	if len(names) != 2 || names[1] != last.Name {
+		t.Errorf("the newest 2 backups should be kept, got %v", names)
+	}
+}
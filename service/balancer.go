@@ -0,0 +1,155 @@
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// BalanceRoundRobin picks backends in turn
+	BalanceRoundRobin = "round-robin"
+	// BalanceLeastConn picks the backend with the fewest active connections
+	BalanceLeastConn = "least-conn"
+
+	balancerMaxFails     = 3
+	balancerEjectTimeout = time.Second * 30
+)
+
+// Backend a single upstream address (host:port) of a balanced pool
+type Backend struct {
+	Addr   string
+	active int64 // in-flight requests
+
+	mu           sync.Mutex
+	fails        int
+	ejectedUntil time.Time
+}
+
+// Active number of in-flight requests
+func (b *Backend) Active() int64 {
+	return atomic.LoadInt64(&b.active)
+}
+
+// Ejected whether the backend has been passively taken out of rotation
+func (b *Backend) Ejected(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Before(b.ejectedUntil)
+}
+
+// Balancer picks backends out of a pool
+type Balancer interface {
+	// Next returns the next backend to use skipping the ones in tried.
+	// Returns nil when no backend is available.
+	Next(tried map[*Backend]bool) *Backend
+	// Acquire marks the start of a request to the backend
+	Acquire(b *Backend)
+	// Release marks the end of a request.  failed tells the balancer
+	// whether the request could not be delivered to the backend.
+	Release(b *Backend, failed bool)
+	// Backends returns the current pool
+	Backends() []*Backend
+	// SetAddrs replaces the pool keeping the state of addresses
+	// that were already present
+	SetAddrs(addrs []string)
+}
+
+type balancer struct {
+	mu       sync.RWMutex
+	strategy string
+	backends []*Backend
+	next     uint64
+	now      func() time.Time
+}
+
+// NewBalancer constructor.  strategy is one of BalanceRoundRobin or
+// BalanceLeastConn.  Unknown strategies default to round robin.
+func NewBalancer(strategy string, addrs []string) Balancer {
+	b := &balancer{strategy: strategy, now: time.Now}
+	b.SetAddrs(addrs)
+	return b
+}
+
+func (b *balancer) Backends() []*Backend {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return append([]*Backend{}, b.backends...)
+}
+
+func (b *balancer) SetAddrs(addrs []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	existing := make(map[string]*Backend)
+	for _, be := range b.backends {
+		existing[be.Addr] = be
+	}
+	backends := make([]*Backend, 0, len(addrs))
+	for _, addr := range addrs {
+		if be, ok := existing[addr]; ok {
+			backends = append(backends, be)
+		} else {
+			backends = append(backends, &Backend{Addr: addr})
+		}
+	}
+	b.backends = backends
+}
+
+func (b *balancer) Next(tried map[*Backend]bool) *Backend {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	now := b.now()
+	candidates := make([]*Backend, 0, len(b.backends))
+	for _, be := range b.backends {
+		if tried[be] || be.Ejected(now) {
+			continue
+		}
+		candidates = append(candidates, be)
+	}
+
+	// when everything is ejected, fall back to any backend not yet tried
+	// rather than failing every request until the ejection expires
+	if len(candidates) == 0 {
+		for _, be := range b.backends {
+			if !tried[be] {
+				candidates = append(candidates, be)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	if b.strategy == BalanceLeastConn {
+		var found *Backend
+		for _, be := range candidates {
+			if found == nil || be.Active() < found.Active() {
+				found = be
+			}
+		}
+		return found
+	}
+
+	n := atomic.AddUint64(&b.next, 1)
+	return candidates[(n-1)%uint64(len(candidates))]
+}
+
+func (b *balancer) Acquire(be *Backend) {
+	atomic.AddInt64(&be.active, 1)
+}
+
+func (b *balancer) Release(be *Backend, failed bool) {
+	atomic.AddInt64(&be.active, -1)
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	if !failed {
+		be.fails = 0
+		return
+	}
+	be.fails++
+	if be.fails >= balancerMaxFails {
+		be.fails = 0
+		be.ejectedUntil = b.now().Add(balancerEjectTimeout)
+	}
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBalancerRoundRobin(t *testing.T) {
+	// given
+	b := NewBalancer(BalanceRoundRobin, []string{"a:1", "b:1", "c:1"})
+
+	// when
+	seen := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		seen[b.Next(nil).Addr]++
+	}
+
+	// then
+	for _, addr := range []string{"a:1", "b:1", "c:1"} {
+		if seen[addr] != 2 {
+			t.Errorf("%s should have been picked twice, but it was %d times", addr, seen[addr])
+		}
+	}
+}
+
+func TestBalancerLeastConn(t *testing.T) {
+	// given
+	b := NewBalancer(BalanceLeastConn, []string{"a:1", "b:1"})
+	backends := b.Backends()
+
+	// when
+	b.Acquire(backends[0])
+	next := b.Next(nil)
+
+	// then
+	if next.Addr != "b:1" {
+		t.Errorf("should pick the idle backend, but picked %s", next.Addr)
+	}
+}
+
+func TestBalancerSkipsTried(t *testing.T) {
+	// given
+	b := NewBalancer(BalanceRoundRobin, []string{"a:1", "b:1"})
+	backends := b.Backends()
+
+	// when
+	tried := map[*Backend]bool{backends[0]: true}
+
+	// then
+	for i := 0; i < 3; i++ {
+		if next := b.Next(tried); next != backends[1] {
+			t.Errorf("should skip tried backend, but picked %s", next.Addr)
+		}
+	}
+	tried[backends[1]] = true
+	if next := b.Next(tried); next != nil {
+		t.Errorf("should return nil when all backends were tried")
+	}
+}
+
+func TestBalancerPassiveEjection(t *testing.T) {
+	// given
+	now := time.Now()
+	b := NewBalancer(BalanceRoundRobin, []string{"a:1", "b:1"}).(*balancer)
+	b.now = func() time.Time { return now }
+	bad := b.Backends()[0]
+
+	// when
+	for i := 0; i < balancerMaxFails; i++ {
+		b.Acquire(bad)
+		b.Release(bad, true)
+	}
+
+	// then
+	for i := 0; i < 4; i++ {
+		if next := b.Next(nil); next == bad {
+			t.Error("ejected backend should not be picked")
+		}
+	}
+
+	// after the timeout it should come back
+	now = now.Add(balancerEjectTimeout + time.Second)
+	picked := false
+	for i := 0; i < 4; i++ {
+		if b.Next(nil) == bad {
+			picked = true
+		}
+	}
+	if !picked {
+		t.Error("backend should be picked again after the ejection expires")
+	}
+}
+
+func TestBalancerSetAddrsKeepsState(t *testing.T) {
+	// given
+	b := NewBalancer(BalanceLeastConn, []string{"a:1"})
+	a := b.Backends()[0]
+	b.Acquire(a)
+
+	// when
+	b.SetAddrs([]string{"a:1", "b:1"})
+
+	// then
+	backends := b.Backends()
+	if len(backends) != 2 {
+		t.Errorf("should have 2 backends, but it has %d", len(backends))
+	}
+	if backends[0] != a || backends[0].Active() != 1 {
+		t.Error("existing backend state should be preserved")
+	}
+}
@@ -0,0 +1,260 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// DNSRFC2136 dns-01 challenges published with RFC2136 dynamic updates
+	DNSRFC2136 = "rfc2136"
+	// DNSExec dns-01 challenges published by an external command
+	DNSExec = "exec"
+
+	dnsTimeout      = time.Second * 10
+	dnsOpcodeUpdate = 5
+	dnsTypeSOA      = 6
+	dnsTypeTXT      = 16
+	dnsTypeTSIG     = 250
+	dnsClassINET    = 1
+	dnsClassNONE    = 254
+	dnsClassANY     = 255
+	tsigFudge       = 300
+)
+
+var dnsRcodes = map[byte]string{
+	1:  "FORMERR",
+	2:  "SERVFAIL",
+	3:  "NXDOMAIN",
+	4:  "NOTIMP",
+	5:  "REFUSED",
+	9:  "NOTAUTH",
+	10: "NOTZONE",
+}
+
+// challengeRecord returns the TXT record name of the dns-01 challenge of domain
+func challengeRecord(domain string) string {
+	return "_acme-challenge." + strings.TrimPrefix(domain, "*.") + "."
+}
+
+//
+// RFC2136
+//
+
+// RFC2136Config configuration of the RFC2136 dynamic update provider
+type RFC2136Config struct {
+	// Server host:port of the primary name server
+	Server string
+	// Zone updated, e.g. the proxy domain
+	Zone string
+	// TTL of the challenge records
+	TTL int
+	// TSIGKey name of the key signing the updates.  Updates are not
+	// signed when empty.
+	TSIGKey string
+	// TSIGSecret base64 encoded secret of the key
+	TSIGSecret string
+	// TSIGAlgorithm hmac-sha256 (default), hmac-sha1 or hmac-sha512
+	TSIGAlgorithm string
+}
+
+type rfc2136Solver struct {
+	cfg    RFC2136Config
+	secret []byte
+	hash   func() hash.Hash
+}
+
+// NewRFC2136Solver constructor
+func NewRFC2136Solver(cfg RFC2136Config) (ChallengeSolver, error) {
+	s := &rfc2136Solver{cfg: cfg}
+	if cfg.Zone == "" || cfg.Server == "" {
+		return nil, fmt.Errorf("rfc2136 requires a server and a zone")
+	}
+	if cfg.TSIGKey == "" {
+		return s, nil
+	}
+	if s.cfg.TSIGAlgorithm == "" {
+		s.cfg.TSIGAlgorithm = "hmac-sha256"
+	}
+	switch strings.TrimSuffix(s.cfg.TSIGAlgorithm, ".") {
+	case "hmac-sha1":
+		s.hash = sha1.New
+	case "hmac-sha256":
+		s.hash = sha256.New
+	case "hmac-sha512":
+		s.hash = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported tsig algorithm %s", s.cfg.TSIGAlgorithm)
+	}
+	secret, err := base64.StdEncoding.DecodeString(cfg.TSIGSecret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tsig secret: %s", err)
+	}
+	s.secret = secret
+	return s, nil
+}
+
+func (s *rfc2136Solver) Present(domain, token, value string) error {
+	return s.update(challengeRecord(domain), value, false)
+}
+
+func (s *rfc2136Solver) CleanUp(domain, token, value string) error {
+	return s.update(challengeRecord(domain), value, true)
+}
+
+// update adds or removes the TXT record name with value
+func (s *rfc2136Solver) update(name, value string, remove bool) error {
+	var id [2]byte
+	_, _ = rand.Read(id[:])
+	msg, err := s.message(binary.BigEndian.Uint16(id[:]), name, value, remove, time.Now())
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("udp", s.cfg.Server, dnsTimeout)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	resp := make([]byte, 512)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return fmt.Errorf("no answer to the dns update of %s: %s", name, err)
+	}
+	if n < 12 || resp[0] != msg[0] || resp[1] != msg[1] || resp[2]&0x80 == 0 {
+		return fmt.Errorf("invalid answer to the dns update of %s", name)
+	}
+	if rcode := resp[3] & 0x0f; rcode != 0 {
+		text, ok := dnsRcodes[rcode]
+		if !ok {
+			text = fmt.Sprintf("rcode %d", rcode)
+		}
+		return fmt.Errorf("dns update of %s failed: %s", name, text)
+	}
+	return nil
+}
+
+// message returns the wire format of an update of zone adding or, when
+// remove is true, deleting the TXT record name with value
+func (s *rfc2136Solver) message(id uint16, name, value string, remove bool, now time.Time) ([]byte, error) {
+	if len(value) > 255 {
+		return nil, fmt.Errorf("txt record too long")
+	}
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], dnsOpcodeUpdate<<11)
+	binary.BigEndian.PutUint16(msg[4:], 1) // zone
+	binary.BigEndian.PutUint16(msg[8:], 1) // update
+
+	msg = appendDNSName(msg, s.cfg.Zone)
+	msg = appendUint16(msg, dnsTypeSOA, dnsClassINET)
+
+	class, ttl := uint16(dnsClassINET), uint32(s.cfg.TTL)
+	if remove {
+		class, ttl = dnsClassNONE, 0
+	}
+	msg = appendDNSName(msg, name)
+	msg = appendUint16(msg, dnsTypeTXT, class)
+	msg = appendUint32(msg, ttl)
+	msg = appendUint16(msg, uint16(len(value)+1))
+	msg = append(msg, byte(len(value)))
+	msg = append(msg, value...)
+
+	if s.cfg.TSIGKey == "" {
+		return msg, nil
+	}
+	return s.sign(msg, id, now), nil
+}
+
+// sign appends a TSIG record (RFC 8945) to msg
+func (s *rfc2136Solver) sign(msg []byte, id uint16, now time.Time) []byte {
+	algorithm := strings.TrimSuffix(s.cfg.TSIGAlgorithm, ".") + "."
+	timeSigned := make([]byte, 6)
+	binary.BigEndian.PutUint16(timeSigned[0:], uint16(now.Unix()>>32))
+	binary.BigEndian.PutUint32(timeSigned[2:], uint32(now.Unix()))
+
+	variables := appendDNSName(nil, s.cfg.TSIGKey)
+	variables = appendUint16(variables, dnsClassANY)
+	variables = appendUint32(variables, 0)
+	variables = appendDNSName(variables, algorithm)
+	variables = append(variables, timeSigned...)
+	variables = appendUint16(variables, tsigFudge, 0, 0) // fudge, error, other len
+
+	mac := hmac.New(s.hash, s.secret)
+	mac.Write(msg)
+	mac.Write(variables)
+	sum := mac.Sum(nil)
+
+	rdata := appendDNSName(nil, algorithm)
+	rdata = append(rdata, timeSigned...)
+	rdata = appendUint16(rdata, tsigFudge, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = appendUint16(rdata, id, 0, 0) // original id, error, other len
+
+	signed := append([]byte{}, msg...)
+	binary.BigEndian.PutUint16(signed[10:], 1) // additional
+	signed = appendDNSName(signed, s.cfg.TSIGKey)
+	signed = appendUint16(signed, dnsTypeTSIG, dnsClassANY)
+	signed = appendUint32(signed, 0)
+	signed = appendUint16(signed, uint16(len(rdata)))
+	return append(signed, rdata...)
+}
+
+func appendDNSName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.Trim(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, strings.ToLower(label)...)
+	}
+	return append(b, 0)
+}
+
+func appendUint16(b []byte, values ...uint16) []byte {
+	for _, v := range values {
+		b = append(b, byte(v>>8), byte(v))
+	}
+	return b
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+//
+// exec hook
+//
+
+type execSolver struct {
+	cmd string
+}
+
+// NewExecSolver constructor.  The command is called with
+// "present <fqdn> <value>" and "cleanup <fqdn> <value>", where fqdn
+// is the challenge record, e.g. _acme-challenge.example.com.
+func NewExecSolver(cmd string) ChallengeSolver {
+	return &execSolver{cmd: cmd}
+}
+
+func (s *execSolver) Present(domain, token, value string) error {
+	return runCommand(s.cmd, "present", challengeRecord(domain), value)
+}
+
+func (s *execSolver) CleanUp(domain, token, value string) error {
+	return runCommand(s.cmd, "cleanup", challengeRecord(domain), value)
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// fakeDNSServer answers every update with rcode and sends the
+// received messages to the returned channel
+func fakeDNSServer(t *testing.T, rcode byte) (string, chan []byte, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan []byte, 10)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			msg := append([]byte{}, buf[:n]...)
+			received <- msg
+			resp := append([]byte{}, msg[:12]...)
+			resp[2] |= 0x80
+			resp[3] = rcode
+			_, _ = conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), received, func() { _ = conn.Close() }
+}
+
+func TestRFC2136SolverPresentAndCleanUp(t *testing.T) {
+	// given
+	addr, received, stop := fakeDNSServer(t, 0)
+	defer stop()
+	s, err := NewRFC2136Solver(RFC2136Config{
+		Server:     addr,
+		Zone:       "example.com",
+		TTL:        60,
+		TSIGKey:    "one-acme",
+		TSIGSecret: "c2VjcmV0c2VjcmV0c2VjcmV0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// when
+	err = s.Present("*.example.com", "token", "txt-value")
+
+	// then
+	if err != nil {
+		t.Errorf("error presenting record: %s", err)
+	}
+	msg := <-received
+	if opcode := msg[2] >> 3 & 0x0f; opcode != dnsOpcodeUpdate {
+		t.Errorf("should send an update, but opcode was %d", opcode)
+	}
+	if msg[11] != 1 {
+		t.Error("update should be signed")
+	}
+	record := append(appendDNSName(nil, "_acme-challenge.example.com"), 0, dnsTypeTXT, 0, dnsClassINET)
+	if !bytes.Contains(msg, record) || !bytes.Contains(msg, []byte("\x09txt-value")) {
+		t.Errorf("update should add the challenge record: %q", msg)
+	}
+
+	// and when cleaned up
+	if err := s.CleanUp("*.example.com", "token", "txt-value"); err != nil {
+		t.Errorf("error removing record: %s", err)
+	}
+	msg = <-received
+	if !bytes.Contains(msg, append(appendDNSName(nil, "_acme-challenge.example.com"), 0, dnsTypeTXT, 0, dnsClassNONE)) {
+		t.Errorf("update should delete the challenge record: %q", msg)
+	}
+}
+
+func TestRFC2136SolverRefused(t *testing.T) {
+	// given
+	addr, _, stop := fakeDNSServer(t, 5)
+	defer stop()
+	s, _ := NewRFC2136Solver(RFC2136Config{Server: addr, Zone: "example.com"})
+
+	// when
+	err := s.Present("example.com", "token", "txt-value")
+
+	// then
+	if err == nil || !strings.Contains(err.Error(), "REFUSED") {
+		t.Errorf("refused update should fail, got %v", err)
+	}
+}
+
+func TestExecSolver(t *testing.T) {
+	// given
+	tmpDir, _ := ioutil.TempDir("", "testing-dns")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	out := path.Join(tmpDir, "calls")
+	hook := path.Join(tmpDir, "hook.sh")
+	_ = ioutil.WriteFile(hook, []byte("#!/bin/sh\necho \"$@\" >> "+out+"\n"), 0755)
+	s := NewExecSolver(hook)
+
+	// when
+	_ = s.Present("*.example.com", "token", "txt-value")
+	_ = s.CleanUp("*.example.com", "token", "txt-value")
+
+	// then
+	b, _ := ioutil.ReadFile(out)
+	expected := "present _acme-challenge.example.com. txt-value\ncleanup _acme-challenge.example.com. txt-value\n"
+	if string(b) != expected {
+		t.Errorf("unexpected hook calls %q", b)
+	}
+}
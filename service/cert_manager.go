@@ -0,0 +1,333 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libgolang/log"
+	"github.com/libgolang/one/model"
+	"github.com/libgolang/one/utils"
+)
+
+const (
+	certManagerTick = time.Hour
+	// certRetryInterval minimum time between failed renewal attempts
+	certRetryInterval = time.Hour * 6
+	// certStateFile file in the certificate dir holding the inventory
+	certStateFile = "one-certificates.json"
+)
+
+// CertManager keeps an inventory of the certificates served by the
+// proxy and renews them before they expire.  Certificates are stored
+// as <dir>/<domain>/{cert,chain,fullchain,privkey}.pem, with the
+// wildcard of *.example.com stored as _wildcard.example.com.
+type CertManager interface {
+	// Ensure issues a certificate for domain unless a certificate that
+	// has not expired exists
+	Ensure(domain string) error
+	// Has whether domain has a certificate that has not expired
+	Has(domain string) bool
+	// Files returns the certificate, private key and full chain files of domain
+	Files(domain string) (certFile, keyFile, chainFile string)
+	// Certificates returns the inventory sorted by domain
+	Certificates() []*model.Certificate
+	// Renew issues a new certificate for domain regardless of its expiry
+	Renew(domain string) (*model.Certificate, error)
+	// RenewExpiring renews every certificate inside the renewal window
+	RenewExpiring()
+	// OnRenew registers f to be called after a certificate is renewed
+	OnRenew(f func(domain string))
+}
+
+type certManager struct {
+	dir         string
+	provider    CertProvider
+	renewBefore time.Duration
+	now         func() time.Time
+
+	issueMu   sync.Mutex // serializes requests to the provider
+	mu        sync.Mutex
+	certs     map[string]*model.Certificate
+	listeners []func(domain string)
+}
+
+// NewCertManager constructor.  Certificates are issued by provider and
+// renewed when they expire in less than renewBefore.
+func NewCertManager(dir string, provider CertProvider, renewBefore time.Duration) CertManager {
+	m := &certManager{
+		dir:         dir,
+		provider:    provider,
+		renewBefore: renewBefore,
+		now:         time.Now,
+		certs:       make(map[string]*model.Certificate),
+	}
+	m.init()
+	return m
+}
+
+func (m *certManager) init() {
+	m.load()
+
+	timer := time.NewTicker(certManagerTick)
+	go func() {
+		for range timer.C {
+			m.RenewExpiring()
+		}
+	}()
+}
+
+func (m *certManager) Files(domain string) (certFile, keyFile, chainFile string) {
+	dir := path.Join(m.dir, certDirName(domain))
+	return path.Join(dir, "cert.pem"), path.Join(dir, "privkey.pem"), path.Join(dir, "fullchain.pem")
+}
+
+func (m *certManager) Has(domain string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cert, ok := m.certs[domain]
+	return ok && !cert.NotAfter.IsZero() && m.now().Before(cert.NotAfter)
+}
+
+func (m *certManager) Ensure(domain string) error {
+	if m.Has(domain) {
+		return nil
+	}
+	_, err := m.issue(domain, false)
+	return err
+}
+
+func (m *certManager) Renew(domain string) (*model.Certificate, error) {
+	return m.issue(domain, true)
+}
+
+func (m *certManager) RenewExpiring() {
+	now := m.now()
+	domains := make([]string, 0)
+	m.mu.Lock()
+	for domain, cert := range m.certs {
+		if cert.Error != "" && now.Sub(cert.LastAttempt) < certRetryInterval {
+			continue
+		}
+		if cert.NotAfter.Sub(now) < m.renewBefore {
+			domains = append(domains, domain)
+		}
+	}
+	m.mu.Unlock()
+	sort.Strings(domains)
+
+	for _, domain := range domains {
+		if _, err := m.issue(domain, true); err != nil {
+			log.Error("certificate renewal of %s failed: %s", domain, err)
+		}
+	}
+}
+
+func (m *certManager) OnRenew(f func(domain string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listeners = append(m.listeners, f)
+}
+
+func (m *certManager) Certificates() []*model.Certificate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]*model.Certificate, 0, len(m.certs))
+	for _, cert := range m.certs {
+		c := *cert
+		c.State = m.state(&c)
+		list = append(list, &c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Domain < list[j].Domain })
+	return list
+}
+
+func (m *certManager) state(cert *model.Certificate) string {
+	now := m.now()
+	switch {
+	case cert.NotAfter.IsZero():
+		return model.CertificateMissing
+	case !now.Before(cert.NotAfter):
+		return model.CertificateExpired
+	case cert.NotAfter.Sub(now) < m.renewBefore:
+		return model.CertificateExpiring
+	}
+	return model.CertificateValid
+}
+
+// issue obtains a certificate from the provider and stores it.  When
+// renew is true an existing certificate is only replaced by one that
+// expires later.  Listeners are notified of renewals.
+func (m *certManager) issue(domain string, renew bool) (*model.Certificate, error) {
+	m.issueMu.Lock()
+	defer m.issueMu.Unlock()
+
+	m.mu.Lock()
+	cert, ok := m.certs[domain]
+	if !ok {
+		cert = &model.Certificate{Domain: domain}
+		m.certs[domain] = cert
+	}
+	current := cert.NotAfter
+	m.mu.Unlock()
+
+	if !renew && !current.IsZero() && m.now().Before(current) {
+		return cert, nil // issued by a concurrent caller
+	}
+
+	log.Info("requesting %s certificate for %s...", m.provider.Name(), domain)
+	chainPEM, keyPEM, err := m.provider.Obtain(domain)
+	var leaf *x509.Certificate
+	if err == nil {
+		leaf, err = parseCertificate(chainPEM, keyPEM)
+	}
+	if err == nil && !current.IsZero() && !leaf.NotAfter.After(current) {
+		err = fmt.Errorf("provider %s returned no newer certificate", m.provider.Name())
+	}
+	if err == nil {
+		err = m.write(domain, chainPEM, keyPEM)
+	}
+
+	m.mu.Lock()
+	cert.Provider = m.provider.Name()
+	cert.LastAttempt = m.now()
+	cert.Error = ""
+	if err != nil {
+		cert.Error = err.Error()
+	} else {
+		setCertificateInfo(cert, leaf)
+		cert.LastRenewal = cert.LastAttempt
+	}
+	c := *cert
+	c.State = m.state(&c)
+	saveErr := m.save()
+	listeners := append([]func(string){}, m.listeners...)
+	m.mu.Unlock()
+
+	if err != nil {
+		return &c, fmt.Errorf("unable to issue certificate for %s: %s", domain, err)
+	}
+	if saveErr != nil {
+		log.Error("unable to save certificate inventory: %s", saveErr)
+	}
+	log.Info("...certificate for %s issued, expires %s", domain, c.NotAfter.Format(time.RFC3339))
+	if !current.IsZero() {
+		for _, f := range listeners {
+			f(domain)
+		}
+	}
+	return &c, nil
+}
+
+// write stores the key and certificate files of domain
+func (m *certManager) write(domain string, chainPEM, keyPEM []byte) error {
+	var leaf, chain []byte
+	rest := chainPEM
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if leaf == nil {
+			leaf = pem.EncodeToMemory(block)
+		} else {
+			chain = append(chain, pem.EncodeToMemory(block)...)
+		}
+	}
+
+	certFile, keyFile, chainFile := m.Files(domain)
+	utils.EnsureDir(path.Dir(certFile))
+	_ = os.Remove(keyFile + ".tmp")
+	if err := ioutil.WriteFile(keyFile+".tmp", keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(keyFile+".tmp", keyFile); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(certFile, leaf); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path.Join(path.Dir(certFile), "chain.pem"), chain); err != nil {
+		return err
+	}
+	return writeFileAtomic(chainFile, append(append([]byte{}, leaf...), chain...))
+}
+
+// load reads the inventory and refreshes it from the certificate files
+func (m *certManager) load() {
+	file := path.Join(m.dir, certStateFile)
+	if !utils.FileExists(file) {
+		return
+	}
+	b, err := ioutil.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(b, &m.certs)
+	}
+	if err != nil {
+		log.Error("unable to read certificate inventory %s: %s", file, err)
+		m.certs = make(map[string]*model.Certificate)
+		return
+	}
+	for domain, cert := range m.certs {
+		cert.Domain = domain
+		certFile, _, _ := m.Files(domain)
+		b, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			cert.NotAfter = time.Time{}
+			continue
+		}
+		if leaf, err := parseCertificate(b, nil); err == nil {
+			setCertificateInfo(cert, leaf)
+		}
+	}
+}
+
+// save writes the inventory.  It must be called with mu held.
+func (m *certManager) save() error {
+	b, err := json.MarshalIndent(m.certs, "", "  ")
+	if err != nil {
+		return err
+	}
+	utils.EnsureDir(m.dir)
+	return writeFileAtomic(path.Join(m.dir, certStateFile), b)
+}
+
+// certDirName returns the directory name of the certificate of domain
+func certDirName(domain string) string {
+	if strings.HasPrefix(domain, "*.") {
+		return "_wildcard" + domain[1:]
+	}
+	return domain
+}
+
+// parseCertificate returns the leaf of a PEM chain.  When keyPEM is
+// given it must be the private key of the leaf.
+func parseCertificate(chainPEM, keyPEM []byte) (*x509.Certificate, error) {
+	if keyPEM != nil {
+		if _, err := tls.X509KeyPair(chainPEM, keyPEM); err != nil {
+			return nil, err
+		}
+	}
+	block, _ := pem.Decode(chainPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func setCertificateInfo(cert *model.Certificate, leaf *x509.Certificate) {
+	cert.Issuer = leaf.Issuer.CommonName
+	cert.Serial = leaf.SerialNumber.Text(16)
+	cert.NotBefore = leaf.NotBefore
+	cert.NotAfter = leaf.NotAfter
+}
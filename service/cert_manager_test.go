@@ -0,0 +1,192 @@
+package service
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libgolang/one/model"
+)
+
+func TestCertManagerSelfSigned(t *testing.T) {
+	// given
+	tmpDir, _ := ioutil.TempDir("", "testing-certs")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	m := NewCertManager(path.Join(tmpDir, "certs"), NewSelfSignedProvider(path.Join(tmpDir, "ca"), time.Hour*24*90), time.Hour*24*30)
+
+	// when
+	err := m.Ensure("web.example.com")
+
+	// then
+	if err != nil {
+		t.Fatalf("error issuing certificate: %s", err)
+	}
+	certFile, keyFile, chainFile := m.Files("web.example.com")
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		t.Errorf("certificate and key should match: %s", err)
+	}
+	if _, err := tls.LoadX509KeyPair(chainFile, keyFile); err != nil {
+		t.Errorf("full chain and key should match: %s", err)
+	}
+	list := m.Certificates()
+	if len(list) != 1 || list[0].State != model.CertificateValid || list[0].Provider != CertSelfSigned || list[0].Issuer != "one internal CA" {
+		t.Errorf("unexpected inventory %+v", list[0])
+	}
+
+	// a valid certificate is not issued again
+	serial := list[0].Serial
+	_ = m.Ensure("web.example.com")
+	if m.Certificates()[0].Serial != serial {
+		t.Error("certificate should not have been issued again")
+	}
+
+	// the inventory survives a restart
+	m = NewCertManager(path.Join(tmpDir, "certs"), NewSelfSignedProvider(path.Join(tmpDir, "ca"), time.Hour), time.Hour)
+	if !m.Has("web.example.com") || m.Certificates()[0].Serial != serial {
+		t.Errorf("inventory should have been loaded, got %+v", m.Certificates())
+	}
+}
+
+func TestCertManagerRenewExpiring(t *testing.T) {
+	// given
+	tmpDir, _ := ioutil.TempDir("", "testing-certs")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	m := NewCertManager(path.Join(tmpDir, "certs"), NewSelfSignedProvider(path.Join(tmpDir, "ca"), time.Hour*24), time.Hour*48)
+	renewed := make([]string, 0)
+	m.OnRenew(func(domain string) { renewed = append(renewed, domain) })
+	_ = m.Ensure("web.example.com")
+	first := m.Certificates()[0]
+	if first.State != model.CertificateExpiring {
+		t.Errorf("certificate should be in the renewal window, but it is %s", first.State)
+	}
+	m.(*certManager).provider.(*selfSignedProvider).now = func() time.Time { return time.Now().Add(time.Minute) }
+
+	// when
+	m.RenewExpiring()
+
+	// then
+	second := m.Certificates()[0]
+	if second.Serial == first.Serial || !second.NotAfter.After(first.NotAfter) {
+		t.Errorf("certificate should have been renewed: %+v", second)
+	}
+	if len(renewed) != 1 || renewed[0] != "web.example.com" {
+		t.Errorf("listeners should have been notified, got %v", renewed)
+	}
+}
+
+func TestCertManagerManualProvider(t *testing.T) {
+	// given
+	tmpDir, _ := ioutil.TempDir("", "testing-certs")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	provided := path.Join(tmpDir, "provided")
+	m := NewCertManager(path.Join(tmpDir, "certs"), NewManualProvider(provided), time.Hour)
+
+	// when
+	err := m.Ensure("web.example.com")
+
+	// then
+	if err == nil {
+		t.Error("ensure should fail when no certificate is provided")
+	}
+	list := m.Certificates()
+	if len(list) != 1 || list[0].State != model.CertificateMissing || list[0].Error == "" {
+		t.Errorf("missing certificate should be in the inventory, got %+v", list)
+	}
+
+	// and when the administrator provides one
+	chain, key, _ := NewSelfSignedProvider(path.Join(tmpDir, "ca"), time.Hour*24).Obtain("web.example.com")
+	_ = os.MkdirAll(path.Join(provided, "web.example.com"), 0775)
+	_ = ioutil.WriteFile(path.Join(provided, "web.example.com", "fullchain.pem"), chain, 0644)
+	_ = ioutil.WriteFile(path.Join(provided, "web.example.com", "privkey.pem"), key, 0600)
+	if err := m.Ensure("web.example.com"); err != nil {
+		t.Errorf("provided certificate should have been installed: %s", err)
+	}
+	if state := m.Certificates()[0].State; state != model.CertificateValid {
+		t.Errorf("certificate should be valid, but it is %s", state)
+	}
+}
+
+// TestACMEProviderPebble runs against a local Pebble started with
+// PEBBLE_VA_ALWAYS_VALID=1, e.g.
+//
+//	ONE_TEST_ACME_DIRECTORY=https://127.0.0.1:14000/dir ONE_TEST_ACME_CA=pebble.minica.pem go test
+func TestACMEProviderPebble(t *testing.T) {
+	directory := os.Getenv("ONE_TEST_ACME_DIRECTORY")
+	if directory == "" {
+		t.Skip("ONE_TEST_ACME_DIRECTORY not set")
+	}
+
+	// given
+	tmpDir, _ := ioutil.TempDir("", "testing-acme")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	p := NewACMEProvider(ACMEConfig{
+		DirectoryURL:   directory,
+		Email:          "admin@example.com",
+		AccountKeyFile: path.Join(tmpDir, "account.key"),
+		CAFile:         os.Getenv("ONE_TEST_ACME_CA"),
+		HTTPSolver:     NewWebrootSolver(path.Join(tmpDir, "www")),
+	})
+
+	// when
+	chain, key, err := p.Obtain("web.example.com")
+
+	// then
+	if err != nil {
+		t.Fatalf("error obtaining certificate: %s", err)
+	}
+	if _, err := parseCertificate(chain, key); err != nil {
+		t.Errorf("invalid certificate: %s", err)
+	}
+}
+
+// recordingSolver remembers the published challenges
+type recordingSolver struct {
+	present []string
+}
+
+func (s *recordingSolver) Present(domain, token, keyAuth string) error {
+	s.present = append(s.present, challengeRecord(domain)+" "+keyAuth)
+	return nil
+}
+
+func (s *recordingSolver) CleanUp(domain, token, keyAuth string) error {
+	return nil
+}
+
+func TestACMEProviderPebbleWildcard(t *testing.T) {
+	directory := os.Getenv("ONE_TEST_ACME_DIRECTORY")
+	if directory == "" {
+		t.Skip("ONE_TEST_ACME_DIRECTORY not set")
+	}
+
+	// given
+	tmpDir, _ := ioutil.TempDir("", "testing-acme")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	dns := &recordingSolver{}
+	p := NewACMEProvider(ACMEConfig{
+		DirectoryURL:   directory,
+		AccountKeyFile: path.Join(tmpDir, "account.key"),
+		CAFile:         os.Getenv("ONE_TEST_ACME_CA"),
+		HTTPSolver:     NewWebrootSolver(path.Join(tmpDir, "www")),
+		DNSSolver:      dns,
+	})
+
+	// when
+	chain, key, err := p.Obtain("*.example.com")
+
+	// then
+	if err != nil {
+		t.Fatalf("error obtaining certificate: %s", err)
+	}
+	leaf, err := parseCertificate(chain, key)
+	if err != nil || len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != "*.example.com" {
+		t.Errorf("invalid wildcard certificate: %v %v", leaf, err)
+	}
+	if len(dns.present) != 1 || !strings.HasPrefix(dns.present[0], "_acme-challenge.example.com. ") {
+		t.Errorf("challenge should have been published in dns, got %v", dns.present)
+	}
+}
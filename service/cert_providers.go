@@ -0,0 +1,453 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/libgolang/one/utils"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// CertACME certificates issued by an ACME CA such as Let's Encrypt
+	CertACME = "acme"
+	// CertSelfSigned certificates issued by an internal CA
+	CertSelfSigned = "selfsigned"
+	// CertManual certificates provided by the administrator
+	CertManual = "manual"
+
+	acmeTimeout = time.Minute * 5
+)
+
+// CertProvider issues certificates
+type CertProvider interface {
+	// Name of the provider shown in the inventory
+	Name() string
+	// Obtain returns the PEM encoded certificate chain, leaf first,
+	// and the PEM encoded private key for domain
+	Obtain(domain string) (chainPEM, keyPEM []byte, err error)
+}
+
+// ChallengeSolver makes ACME challenge responses reachable by the CA.
+// keyAuth is the key authorization of http-01 challenges and the TXT
+// record value of dns-01 challenges.
+type ChallengeSolver interface {
+	Present(domain, token, keyAuth string) error
+	CleanUp(domain, token, keyAuth string) error
+}
+
+//
+// self signed
+//
+
+type selfSignedProvider struct {
+	dir      string
+	validity time.Duration
+	now      func() time.Time
+	mu       sync.Mutex
+	caCert   *x509.Certificate
+	caKey    crypto.Signer
+	caPEM    []byte
+}
+
+// NewSelfSignedProvider constructor.  Certificates are signed by an
+// internal CA that is created in dir (ca.pem, ca-key.pem) on first use.
+func NewSelfSignedProvider(dir string, validity time.Duration) CertProvider {
+	return &selfSignedProvider{dir: dir, validity: validity, now: time.Now}
+}
+
+func (p *selfSignedProvider) Name() string {
+	return CertSelfSigned
+}
+
+func (p *selfSignedProvider) Obtain(domain string) ([]byte, []byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.loadCA(); err != nil {
+		return nil, nil, err
+	}
+
+	key, keyPEM, err := newECKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := p.now()
+	tpl := &x509.Certificate{
+		SerialNumber: newSerial(),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(p.validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, p.caCert, key.Public(), p.caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return append(chain, p.caPEM...), keyPEM, nil
+}
+
+// loadCA reads the CA from dir or creates it.  It must be called with mu held.
+func (p *selfSignedProvider) loadCA() error {
+	if p.caCert != nil {
+		return nil
+	}
+	certFile, keyFile := path.Join(p.dir, "ca.pem"), path.Join(p.dir, "ca-key.pem")
+	if !utils.FileExists(certFile) {
+		key, keyPEM, err := newECKey()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		tpl := &x509.Certificate{
+			SerialNumber:          newSerial(),
+			Subject:               pkix.Name{CommonName: "one internal CA"},
+			NotBefore:             now.Add(-time.Hour),
+			NotAfter:              now.AddDate(10, 0, 0),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, key.Public(), key)
+		if err != nil {
+			return err
+		}
+		utils.EnsureDir(p.dir)
+		if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+			return err
+		}
+	}
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load internal CA: %s", err)
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("unsupported internal CA key")
+	}
+	if p.caCert, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+		return err
+	}
+	p.caKey = signer
+	p.caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pair.Certificate[0]})
+	return nil
+}
+
+//
+// bring your own
+//
+
+type manualProvider struct {
+	dir string
+}
+
+// NewManualProvider constructor.  Certificates are read from
+// <dir>/<domain>/fullchain.pem and <dir>/<domain>/privkey.pem, which
+// the administrator keeps up to date.  A wildcard is read from
+// <dir>/_wildcard.<domain>.
+func NewManualProvider(dir string) CertProvider {
+	return &manualProvider{dir: dir}
+}
+
+func (p *manualProvider) Name() string {
+	return CertManual
+}
+
+func (p *manualProvider) Obtain(domain string) ([]byte, []byte, error) {
+	dir := path.Join(p.dir, certDirName(domain))
+	chainFile, keyFile := path.Join(dir, "fullchain.pem"), path.Join(dir, "privkey.pem")
+	chainPEM, err := ioutil.ReadFile(chainFile)
+	if os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("no certificate provided for %s in %s", domain, path.Dir(chainFile))
+	} else if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return chainPEM, keyPEM, nil
+}
+
+//
+// ACME
+//
+
+// ACMEConfig configuration of the ACME provider
+type ACMEConfig struct {
+	// DirectoryURL of the CA.  Defaults to Let's Encrypt.
+	DirectoryURL string
+	// Email contact of the account
+	Email string
+	// AccountKeyFile where the account key is kept.  It is created on first use.
+	AccountKeyFile string
+	// CAFile optional PEM file with extra roots trusted to reach the
+	// directory, e.g. the Pebble test CA
+	CAFile string
+	// HTTPSolver answers http-01 challenges
+	HTTPSolver ChallengeSolver
+	// DNSSolver answers dns-01 challenges, required for wildcard
+	// certificates.  http-01 is preferred for the other domains.
+	DNSSolver ChallengeSolver
+	// DNSPropagation time to wait after publishing a dns-01 record
+	DNSPropagation time.Duration
+}
+
+type acmeProvider struct {
+	cfg    ACMEConfig
+	mu     sync.Mutex
+	client *acme.Client
+}
+
+// NewACMEProvider constructor
+func NewACMEProvider(cfg ACMEConfig) CertProvider {
+	if cfg.DirectoryURL == "" {
+		cfg.DirectoryURL = acme.LetsEncryptURL
+	}
+	return &acmeProvider{cfg: cfg}
+}
+
+func (p *acmeProvider) Name() string {
+	return CertACME
+}
+
+func (p *acmeProvider) Obtain(domain string) ([]byte, []byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), acmeTimeout)
+	defer cancel()
+
+	client, err := p.register(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, url := range order.AuthzURLs {
+		if err := p.authorize(ctx, client, url); err != nil {
+			return nil, nil, err
+		}
+	}
+	orderURL := order.URI // responses to polling requests do not carry the location
+	if order, err = client.WaitOrder(ctx, orderURL); err != nil {
+		return nil, nil, err
+	}
+
+	key, keyPEM, err := newECKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ders, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		// CAs may answer the finalize request of an order that is still
+		// processing without its location, so wait on the known order URL
+		o, waitErr := client.WaitOrder(ctx, orderURL)
+		if waitErr != nil || o.CertURL == "" {
+			return nil, nil, err
+		}
+		if ders, err = client.FetchCert(ctx, o.CertURL, true); err != nil {
+			return nil, nil, err
+		}
+	}
+	var chain []byte
+	for _, der := range ders {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return chain, keyPEM, nil
+}
+
+// authorize completes a pending authorization with an http-01 or a
+// dns-01 challenge
+func (p *acmeProvider) authorize(ctx context.Context, client *acme.Client, url string) error {
+	authz, err := client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	chalType, solver := "http-01", p.cfg.HTTPSolver
+	if authz.Wildcard || solver == nil {
+		chalType, solver = "dns-01", p.cfg.DNSSolver
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == chalType {
+			chal = c
+			break
+		}
+	}
+	if chal == nil || solver == nil {
+		return fmt.Errorf("no supported challenge for %s", authz.Identifier.Value)
+	}
+
+	var keyAuth string
+	if chalType == "dns-01" {
+		keyAuth, err = client.DNS01ChallengeRecord(chal.Token)
+	} else {
+		keyAuth, err = client.HTTP01ChallengeResponse(chal.Token)
+	}
+	if err != nil {
+		return err
+	}
+	domain := authz.Identifier.Value
+	if err := solver.Present(domain, chal.Token, keyAuth); err != nil {
+		return err
+	}
+	defer func() { _ = solver.CleanUp(domain, chal.Token, keyAuth) }()
+	if chalType == "dns-01" && p.cfg.DNSPropagation > 0 {
+		select {
+		case <-time.After(p.cfg.DNSPropagation):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// register returns a client with a registered account.  It must be
+// called with mu held.
+func (p *acmeProvider) register(ctx context.Context) (*acme.Client, error) {
+	if p.client != nil {
+		return p.client, nil
+	}
+	key, err := loadOrCreateECKey(p.cfg.AccountKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := http.DefaultClient
+	if p.cfg.CAFile != "" {
+		b, err := ioutil.ReadFile(p.cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s", p.cfg.CAFile)
+		}
+		httpClient = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}}
+	}
+
+	client := &acme.Client{Key: key, DirectoryURL: p.cfg.DirectoryURL, HTTPClient: httpClient}
+	account := &acme.Account{}
+	if p.cfg.Email != "" {
+		account.Contact = []string{"mailto:" + p.cfg.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, fmt.Errorf("unable to register acme account: %s", err)
+	}
+	p.client = client
+	return client, nil
+}
+
+//
+// challenges
+//
+
+type webrootSolver struct {
+	root string
+}
+
+// NewWebrootSolver constructor.  Challenge responses are written to
+// <root>/<domain>/htdocs/.well-known/acme-challenge, the directory
+// served on port 80 by the proxy site and challenge templates.
+func NewWebrootSolver(root string) ChallengeSolver {
+	return &webrootSolver{root: root}
+}
+
+func (s *webrootSolver) file(domain, token string) string {
+	return path.Join(s.root, domain, "htdocs", ".well-known", "acme-challenge", token)
+}
+
+func (s *webrootSolver) Present(domain, token, keyAuth string) error {
+	file := s.file(domain, token)
+	utils.EnsureDir(path.Dir(file))
+	return ioutil.WriteFile(file, []byte(keyAuth), 0644)
+}
+
+func (s *webrootSolver) CleanUp(domain, token, keyAuth string) error {
+	return os.Remove(s.file(domain, token))
+}
+
+//
+// keys
+//
+
+func newECKey() (*ecdsa.PrivateKey, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func loadOrCreateECKey(file string) (*ecdsa.PrivateKey, error) {
+	if b, err := ioutil.ReadFile(file); err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("no key found in %s", file)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, keyPEM, err := newECKey()
+	if err != nil {
+		return nil, err
+	}
+	utils.EnsureDir(path.Dir(file))
+	if err := ioutil.WriteFile(file, keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func newSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/libgolang/one/utils"
+)
+
+// CertService REST API of the certificate inventory
+type CertService interface {
+}
+
+type certService struct {
+	rs    RestServer
+	certs CertManager
+}
+
+// NewCertService constructor
+func NewCertService(rs RestServer, certs CertManager) CertService {
+	s := &certService{rs: rs, certs: certs}
+	s.init()
+	return s
+}
+
+func (s *certService) init() {
+	s.rs.HandleFunc("/master/certificates", func(w http.ResponseWriter, r *http.Request) RestResponse { return s.listCertificates(w, r) }).Methods("GET")
+	s.rs.HandleFunc("/master/certificates/{domain}", func(w http.ResponseWriter, r *http.Request) RestResponse { return s.getCertificate(w, r) }).Methods("GET")
+	s.rs.HandleFunc("/master/certificates/{domain}/renew", func(w http.ResponseWriter, r *http.Request) RestResponse { return s.renewCertificate(w, r) }).Methods("POST")
+}
+
+func (s *certService) listCertificates(w http.ResponseWriter, r *http.Request) RestResponse {
+	def := map[string]string{
+		"Domain":   "string",
+		"Provider": "string",
+		"State":    "string",
+		"NotAfter": "time",
+	}
+	list := s.certs.Certificates()
+	page, err := utils.RestList(def, "Domain", r, &list)
+	if err != nil {
+		return (&JSONResponse{}).SetStatus(400).SetBody(map[string]string{"error": err.Error()})
+	}
+	return listResponse(page)
+}
+
+func (s *certService) getCertificate(w http.ResponseWriter, r *http.Request) RestResponse {
+	domain := mux.Vars(r)["domain"]
+	for _, cert := range s.certs.Certificates() {
+		if cert.Domain == domain {
+			return (&JSONResponse{}).SetBody(cert)
+		}
+	}
+	return (&JSONResponse{}).SetStatus(404).SetBody(`{"error":"certificate not found"}`)
+}
+
+func (s *certService) renewCertificate(w http.ResponseWriter, r *http.Request) RestResponse {
+	domain := mux.Vars(r)["domain"]
+	found := false
+	for _, cert := range s.certs.Certificates() {
+		found = found || cert.Domain == domain
+	}
+	if !found {
+		return (&JSONResponse{}).SetStatus(404).SetBody(`{"error":"certificate not found"}`)
+	}
+	cert, err := s.certs.Renew(domain)
+	if err != nil {
+		return (&JSONResponse{}).SetStatus(502).SetBody(map[string]string{"error": err.Error()})
+	}
+	return (&JSONResponse{}).SetBody(cert)
+}
@@ -0,0 +1,908 @@
+package service
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libgolang/log"
+	"github.com/libgolang/one/model"
+	"github.com/libgolang/one/utils"
+	"golang.org/x/net/context"
+)
+
+const (
+	clusterTick      = time.Millisecond * 100
+	clusterHeartbeat = time.Millisecond * 300
+	// clusterElectionTimeout minimum time without a leader before an
+	// election starts.  Each member waits a random time between this
+	// and twice this.
+	clusterElectionTimeout = time.Millisecond * 1500
+	// clusterRequestTimeout longest wait for the answers of the peers to
+	// votes and appends, well below clusterElectionTimeout so a hung
+	// peer does not stall the leader
+	clusterRequestTimeout  = time.Millisecond * 500
+	clusterSnapshotTimeout = time.Second * 30
+	// clusterStateFile file in the var dir holding the term, vote and
+	// last entry of the member
+	clusterStateFile   = "one-cluster.json"
+	clusterTokenHeader = "X-One-Cluster-Token"
+)
+
+var errNotLeader = fmt.Errorf("this master is not the leader")
+
+// Cluster highly available masters.  Every master keeps a full copy of
+// the Db.  The members elect a leader by majority, the leader is the
+// only one accepting writes and it replicates them to the followers,
+// sending a full snapshot to followers that are new to its term or
+// fell behind.
+//
+// This is a simple leader based replication, not Raft: there is no
+// replicated log and a follower applies an entry as soon as it receives
+// it.  A write succeeds once a majority of the members has it.  The
+// leader undoes a write that does not reach a majority and cancels the
+// requests still carrying it, a follower that applied it nonetheless is
+// reset with a snapshot by the next write.  Should the leader fail
+// before that, such a follower may be elected and keep the write.
+// Writes acknowledged to clients survive the failure of a minority of
+// the members.
+type Cluster interface {
+	// IsLeader whether this master leads the cluster
+	IsLeader() bool
+	// Leader returns the name and client url of the leader, empty while
+	// no leader is known
+	Leader() (name, clientURL string)
+	// Members returns the state of every master sorted by name
+	Members() []*model.ClusterMember
+	// Db returns the replicated Db
+	Db() Db
+	// Stop leaves the cluster
+	Stop()
+}
+
+// ClusterConfig configuration of a cluster member
+type ClusterConfig struct {
+	// Name of this master, it must be one of Members
+	Name string
+	// PeerURL url other masters reach this master on.  Defaults to the
+	// entry of Name in Members.
+	PeerURL string
+	// ClientURL url nodes are redirected to while this master leads
+	ClientURL string
+	// Members peer url of every master by name
+	Members map[string]string
+	// Dir where the member state is stored
+	Dir string
+	// Token shared secret sent with every request between masters
+	Token string
+	// CertFile and KeyFile serve the peer url over TLS, required when
+	// it is an https url
+	CertFile string
+	KeyFile  string
+	// CAFile optional PEM file with extra roots trusted to reach the
+	// https peer urls
+	CAFile string
+}
+
+// ParseClusterMembers parses name=url pairs separated by commas, e.g.
+// master01=http://10.0.1.10:2380,master02=http://10.0.1.11:2380
+func ParseClusterMembers(str string) (map[string]string, error) {
+	members := make(map[string]string)
+	for _, pair := range strings.Split(str, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid cluster member %s, expected name=url", pair)
+		}
+		if _, err := url.Parse(parts[1]); err != nil {
+			return nil, fmt.Errorf("invalid url of cluster member %s: %s", parts[0], err)
+		}
+		members[parts[0]] = parts[1]
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("no cluster members")
+	}
+	return members, nil
+}
+
+type clusterPeer struct {
+	name        string
+	peerURL     string
+	clientURL   string
+	term        uint64
+	index       uint64
+	lastContact time.Time
+	reachable   bool
+	synced      bool // holds a snapshot of the current leader term
+	busy        bool // a request of the leader is in flight
+}
+
+type cluster struct {
+	cfg    ClusterConfig
+	local  Db
+	rs     RestServer
+	client *http.Client
+	stop   chan struct{}
+	peers  map[string]*clusterPeer
+
+	writeMu sync.Mutex // serializes the replication of the leader
+	dataMu  sync.Mutex // guards local, acquired before mu
+
+	mu          sync.Mutex
+	role        string
+	term        uint64
+	votedFor    string
+	leader      string
+	leaderURL   string
+	index       uint64 // last entry applied to local
+	indexTerm   uint64
+	lastContact time.Time // with the leader, or with a majority while leading
+	timeout     time.Duration
+}
+
+// clusterState persisted state of a member
+type clusterState struct {
+	Term      uint64 `json:"term"`
+	VotedFor  string `json:"votedFor"`
+	Index     uint64 `json:"index"`
+	IndexTerm uint64 `json:"indexTerm"`
+}
+
+type clusterVoteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	Index     uint64 `json:"index"`
+	IndexTerm uint64 `json:"indexTerm"`
+}
+
+type clusterAppendRequest struct {
+	Term      uint64        `json:"term"`
+	Leader    string        `json:"leader"`
+	LeaderURL string        `json:"leaderUrl"`
+	PrevIndex uint64        `json:"prevIndex"`
+	PrevTerm  uint64        `json:"prevTerm"`
+	Entry     *clusterEntry `json:"entry,omitempty"` // nil on heartbeats
+}
+
+type clusterSnapshot struct {
+	Term        uint64                       `json:"term"`
+	Leader      string                       `json:"leader"`
+	LeaderURL   string                       `json:"leaderUrl"`
+	Index       uint64                       `json:"index"`
+	IndexTerm   uint64                       `json:"indexTerm"`
+	Definitions map[string]*model.Definition `json:"definitions"`
+	Containers  map[string]*model.Container  `json:"containers"`
+	Nodes       map[string]*model.Node       `json:"nodes"`
+	Networks    map[string]*model.Network    `json:"networks"`
+	Registries  map[string]*model.Registry   `json:"registries"`
+	Vars        map[string]string            `json:"vars"`
+}
+
+// clusterResponse answer to votes, appends and snapshots
+type clusterResponse struct {
+	Term      uint64 `json:"term"`
+	Index     uint64 `json:"index"`
+	ClientURL string `json:"clientUrl"`
+	Success   bool   `json:"success"`
+}
+
+// NewCluster constructor.  local is the Db of this master, it must not
+// be written to but through Db().  The member listens for the other
+// masters on its peer url and takes part in elections right away.  A
+// token is required, the peers exchange the whole Db.
+func NewCluster(cfg ClusterConfig, local Db) Cluster {
+	if _, ok := cfg.Members[cfg.Name]; !ok {
+		panic(fmt.Sprintf("master %s is not a member of the cluster", cfg.Name))
+	}
+	if cfg.Token == "" {
+		panic("the cluster requires a token shared by the masters")
+	}
+	if cfg.PeerURL == "" {
+		cfg.PeerURL = cfg.Members[cfg.Name]
+	}
+	client, err := clusterClient(cfg.CAFile)
+	if err != nil {
+		panic(fmt.Sprintf("unable to trust the cluster CA: %s", err))
+	}
+	c := &cluster{
+		cfg:    cfg,
+		local:  local,
+		client: client,
+		stop:   make(chan struct{}),
+		peers:  make(map[string]*clusterPeer),
+		role:   model.ClusterFollower,
+	}
+	c.init()
+	return c
+}
+
+func (c *cluster) init() {
+	for name, peerURL := range c.cfg.Members {
+		if name != c.cfg.Name {
+			c.peers[name] = &clusterPeer{name: name, peerURL: strings.TrimSuffix(peerURL, "/")}
+		}
+	}
+	c.load()
+	c.timeout = electionTimeout()
+	if len(c.peers) > 0 {
+		c.lastContact = time.Now() // give a running leader the chance to reach us
+	}
+
+	u, err := url.Parse(c.cfg.PeerURL)
+	if err != nil {
+		panic(fmt.Sprintf("invalid peer url %s: %s", c.cfg.PeerURL, err))
+	}
+	if u.Scheme == "https" && (c.cfg.CertFile == "" || c.cfg.KeyFile == "") {
+		panic(fmt.Sprintf("peer url %s requires a certificate and key", c.cfg.PeerURL))
+	}
+	c.rs = NewRestServer(u.Host, c.cfg.CertFile, c.cfg.KeyFile)
+	c.rs.HandleFunc("/cluster/vote", func(w http.ResponseWriter, r *http.Request) RestResponse {
+		req := &clusterVoteRequest{}
+		return c.handle(r, req, func() *clusterResponse { return c.vote(req) })
+	}).Methods("POST")
+	c.rs.HandleFunc("/cluster/append", func(w http.ResponseWriter, r *http.Request) RestResponse {
+		req := &clusterAppendRequest{}
+		return c.handle(r, req, func() *clusterResponse { return c.append(r.Context(), req) })
+	}).Methods("POST")
+	c.rs.HandleFunc("/cluster/snapshot", func(w http.ResponseWriter, r *http.Request) RestResponse {
+		req := &clusterSnapshot{}
+		return c.handle(r, req, func() *clusterResponse { return c.install(req) })
+	}).Methods("POST")
+	c.rs.Start()
+
+	go c.run()
+}
+
+// clusterClient returns a client of the peers trusting the system roots
+// and those of caFile, if any
+func clusterClient(caFile string) (*http.Client, error) {
+	if caFile == "" {
+		return &http.Client{}, nil
+	}
+	b, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}}, nil
+}
+
+func electionTimeout() time.Duration {
+	return clusterElectionTimeout + time.Duration(rand.Int63n(int64(clusterElectionTimeout)))
+}
+
+func (c *cluster) Stop() {
+	close(c.stop)
+	c.rs.Stop()
+}
+
+func (c *cluster) Db() Db {
+	return &clusterDb{c: c}
+}
+
+func (c *cluster) IsLeader() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.role == model.ClusterLeader
+}
+
+func (c *cluster) Leader() (string, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leader, c.leaderURL
+}
+
+func (c *cluster) Members() []*model.ClusterMember {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	members := []*model.ClusterMember{{
+		Name:        c.cfg.Name,
+		PeerURL:     c.cfg.PeerURL,
+		ClientURL:   c.cfg.ClientURL,
+		Role:        c.role,
+		Term:        c.term,
+		Index:       c.index,
+		LastContact: c.lastContact,
+	}}
+	for _, p := range c.peers {
+		role := model.ClusterFollower
+		switch {
+		case !p.reachable:
+			role = model.ClusterUnreachable
+		case p.name == c.leader:
+			role = model.ClusterLeader
+		}
+		members = append(members, &model.ClusterMember{
+			Name:        p.name,
+			PeerURL:     p.peerURL,
+			ClientURL:   p.clientURL,
+			Role:        role,
+			Term:        p.term,
+			Index:       p.index,
+			LastContact: p.lastContact,
+		})
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members
+}
+
+func (c *cluster) majority() int {
+	return (len(c.peers)+1)/2 + 1
+}
+
+// run holds elections while there is no leader and sends heartbeats
+// while leading
+func (c *cluster) run() {
+	ticker := time.NewTicker(clusterTick)
+	defer ticker.Stop()
+	var lastHeartbeat time.Time
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		c.mu.Lock()
+		role := c.role
+		expired := time.Since(c.lastContact) > c.timeout
+		c.mu.Unlock()
+
+		switch {
+		case role == model.ClusterLeader:
+			if time.Since(lastHeartbeat) >= clusterHeartbeat {
+				lastHeartbeat = time.Now()
+				c.heartbeat()
+			}
+		case expired:
+			c.elect()
+			lastHeartbeat = time.Now()
+		}
+	}
+}
+
+// elect asks the other members to elect this member for a new term
+func (c *cluster) elect() {
+	c.mu.Lock()
+	c.term++
+	c.role = model.ClusterCandidate
+	c.votedFor = c.cfg.Name
+	c.leader, c.leaderURL = "", ""
+	c.lastContact = time.Now()
+	c.timeout = electionTimeout()
+	c.save()
+	term := c.term
+	req := &clusterVoteRequest{Term: c.term, Candidate: c.cfg.Name, Index: c.index, IndexTerm: c.indexTerm}
+	c.mu.Unlock()
+	log.Info("cluster: %s is candidate for term %d", c.cfg.Name, term)
+
+	votes := 1
+	var votesMu sync.Mutex
+	c.broadcast(func(p *clusterPeer) {
+		resp := &clusterResponse{}
+		if err := c.post(context.Background(), p, "/cluster/vote", clusterRequestTimeout, req, resp); err != nil {
+			return
+		}
+		if resp.Success {
+			votesMu.Lock()
+			votes++
+			votesMu.Unlock()
+		}
+	})
+
+	c.mu.Lock()
+	if c.role != model.ClusterCandidate || c.term != term || votes < c.majority() {
+		c.mu.Unlock()
+		return
+	}
+	c.role = model.ClusterLeader
+	c.leader, c.leaderURL = c.cfg.Name, c.cfg.ClientURL
+	for _, p := range c.peers {
+		p.synced = false
+	}
+	c.mu.Unlock()
+	log.Info("cluster: %s is the leader of term %d with %d votes", c.cfg.Name, term, votes)
+	c.heartbeat()
+}
+
+// heartbeat asserts the leadership, catching up followers in the
+// background.  The leader steps down when it can not reach a majority
+// for an election timeout.
+func (c *cluster) heartbeat() {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.mu.Lock()
+	prevIndex, prevTerm := c.index, c.indexTerm
+	c.mu.Unlock()
+	acks := c.replicate(prevIndex, prevTerm, nil)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.role != model.ClusterLeader {
+		return
+	}
+	if acks >= c.majority() {
+		c.lastContact = time.Now()
+	} else if time.Since(c.lastContact) > c.timeout {
+		log.Warn("cluster: %s lost the majority, stepping down", c.cfg.Name)
+		c.role = model.ClusterFollower
+		c.leader, c.leaderURL = "", ""
+		c.lastContact = time.Now()
+	}
+}
+
+// replicate sends entry, or a heartbeat when nil, to every follower
+// and returns the number of members holding it.  It returns once a
+// majority acked or after clusterRequestTimeout.  The requests still in
+// flight carry on in the background when the majority acked and are
+// cancelled otherwise, followers refuse requests that are cancelled.  A peer gets one request at a
+// time, peers busy with the previous one are skipped.  Followers that
+// miss the previous entry receive a snapshot in the background, it does
+// not count as an ack.  It must be called with writeMu held.
+func (c *cluster) replicate(prevIndex, prevTerm uint64, entry *clusterEntry) int {
+	c.mu.Lock()
+	if c.role != model.ClusterLeader {
+		c.mu.Unlock()
+		return 0
+	}
+	req := &clusterAppendRequest{
+		Term:      c.term,
+		Leader:    c.cfg.Name,
+		LeaderURL: c.cfg.ClientURL,
+		PrevIndex: prevIndex,
+		PrevTerm:  prevTerm,
+		Entry:     entry,
+	}
+	majority := c.majority()
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	answers := make(chan bool, len(c.peers))
+	for _, p := range c.peers {
+		c.mu.Lock()
+		busy, synced := p.busy, p.synced
+		p.busy = true
+		c.mu.Unlock()
+		if busy {
+			answers <- false
+			continue
+		}
+		wg.Add(1)
+		go func(p *clusterPeer, synced bool) {
+			defer func() {
+				c.mu.Lock()
+				p.busy = false
+				c.mu.Unlock()
+			}()
+			if synced {
+				resp := &clusterResponse{}
+				err := c.post(ctx, p, "/cluster/append", clusterRequestTimeout, req, resp)
+				wg.Done()
+				answers <- err == nil && resp.Success
+				if err != nil || resp.Success {
+					return
+				}
+			} else {
+				wg.Done()
+				answers <- false
+			}
+			c.sendSnapshot(p, req.Term)
+		}(p, synced)
+	}
+
+	acks := 1
+	timeout := time.NewTimer(clusterRequestTimeout)
+	defer timeout.Stop()
+wait:
+	for i := 0; i < len(c.peers) && acks < majority; i++ {
+		select {
+		case ok := <-answers:
+			if ok {
+				acks++
+			}
+		case <-timeout.C:
+			break wait
+		}
+	}
+	if acks < majority {
+		cancel()
+	} else {
+		go func() {
+			wg.Wait()
+			cancel()
+		}()
+	}
+	return acks
+}
+
+// sendSnapshot sends the whole Db to p
+func (c *cluster) sendSnapshot(p *clusterPeer, term uint64) bool {
+	snap := &clusterSnapshot{Term: term, Leader: c.cfg.Name, LeaderURL: c.cfg.ClientURL}
+	c.dataMu.Lock()
+	snap.Definitions = c.local.ListDefinitions()
+	snap.Containers = c.local.ListContainers()
+	snap.Nodes = c.local.ListNodes()
+	snap.Networks = c.local.ListNetworks()
+	snap.Registries = c.local.ListRegistries()
+	snap.Vars = c.local.GetVars(func(map[string]string) {})
+	c.mu.Lock()
+	snap.Index, snap.IndexTerm = c.index, c.indexTerm
+	c.mu.Unlock()
+	c.dataMu.Unlock()
+
+	log.Info("cluster: sending snapshot %d to %s", snap.Index, p.name)
+	resp := &clusterResponse{}
+	if err := c.post(context.Background(), p, "/cluster/snapshot", clusterSnapshotTimeout, snap, resp); err != nil || !resp.Success {
+		return false
+	}
+	c.mu.Lock()
+	p.synced = c.term == term
+	c.mu.Unlock()
+	return true
+}
+
+// broadcast calls f for every peer in parallel and waits for all calls
+func (c *cluster) broadcast(f func(p *clusterPeer)) {
+	var wg sync.WaitGroup
+	for _, p := range c.peers {
+		wg.Add(1)
+		go func(p *clusterPeer) {
+			defer wg.Done()
+			f(p)
+		}(p)
+	}
+	wg.Wait()
+}
+
+// post sends req to p and decodes its answer into resp, unless ctx is
+// cancelled first.  A member answering with a newer term turns this
+// member into a follower.
+func (c *cluster) post(ctx context.Context, p *clusterPeer, uri string, timeout time.Duration, req interface{}, resp *clusterResponse) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequest("POST", p.peerURL+uri, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	r = r.WithContext(ctx)
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(clusterTokenHeader, c.cfg.Token)
+
+	res, err := c.client.Do(r)
+	if err == nil {
+		defer func() { _ = res.Body.Close() }()
+		if res.StatusCode != http.StatusOK {
+			err = fmt.Errorf("%s%s returned %d status code", p.peerURL, uri, res.StatusCode)
+		} else {
+			err = json.NewDecoder(res.Body).Decode(resp)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		if p.reachable {
+			log.Warn("cluster: %s unreachable: %s", p.name, err)
+		}
+		p.reachable = false
+		return err
+	}
+	p.reachable = true
+	p.lastContact = time.Now()
+	p.term, p.index, p.clientURL = resp.Term, resp.Index, resp.ClientURL
+	if resp.Term > c.term {
+		c.follow(resp.Term, "", "")
+	}
+	return nil
+}
+
+// handle decodes a request of a peer into req and answers with f
+func (c *cluster) handle(r *http.Request, req interface{}, f func() *clusterResponse) RestResponse {
+	resp := &JSONResponse{}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(clusterTokenHeader)), []byte(c.cfg.Token)) != 1 {
+		return resp.SetStatus(403).SetBody(`{"error":"Invalid cluster token"}`)
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(b, req)
+	}
+	if err != nil {
+		return resp.SetStatus(400).SetBody(`{"error":"Unable to parse request"}`)
+	}
+	return resp.SetBody(f())
+}
+
+// follow makes this member a follower of leader in term.  It must be
+// called with mu held.
+func (c *cluster) follow(term uint64, leader, leaderURL string) {
+	if term > c.term {
+		c.term = term
+		c.votedFor = ""
+		c.save()
+	}
+	if c.role == model.ClusterLeader {
+		log.Warn("cluster: %s steps down, term %d started", c.cfg.Name, term)
+	}
+	if leader != "" && leader != c.leader {
+		log.Info("cluster: %s follows %s in term %d", c.cfg.Name, leader, term)
+	}
+	c.role = model.ClusterFollower
+	c.leader, c.leaderURL = leader, leaderURL
+	if leader != "" {
+		c.lastContact = time.Now()
+	}
+}
+
+func (c *cluster) response(success bool) *clusterResponse {
+	return &clusterResponse{Term: c.term, Index: c.index, ClientURL: c.cfg.ClientURL, Success: success}
+}
+
+// vote answers a candidate
+func (c *cluster) vote(req *clusterVoteRequest) *clusterResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if req.Term > c.term {
+		c.follow(req.Term, "", "")
+	}
+	if req.Term < c.term {
+		return c.response(false)
+	}
+	upToDate := req.IndexTerm > c.indexTerm || (req.IndexTerm == c.indexTerm && req.Index >= c.index)
+	if !upToDate || (c.votedFor != "" && c.votedFor != req.Candidate) {
+		return c.response(false)
+	}
+	c.votedFor = req.Candidate
+	c.lastContact = time.Now()
+	c.save()
+	return c.response(true)
+}
+
+// append applies an entry of the leader, unless the leader cancelled
+// the request meanwhile
+func (c *cluster) append(ctx context.Context, req *clusterAppendRequest) *clusterResponse {
+	c.dataMu.Lock()
+	defer c.dataMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ctx.Err() != nil {
+		return c.response(false)
+	}
+	if req.Term < c.term || (req.Term == c.term && c.role == model.ClusterLeader) {
+		return c.response(false)
+	}
+	c.follow(req.Term, req.Leader, req.LeaderURL)
+	if c.index != req.PrevIndex || c.indexTerm != req.PrevTerm {
+		return c.response(false)
+	}
+	if req.Entry != nil {
+		if err := req.Entry.apply(c.local); err != nil {
+			log.Error("cluster: unable to apply entry %d: %s", req.Entry.Index, err)
+			return c.response(false)
+		}
+		c.index, c.indexTerm = req.Entry.Index, req.Entry.Term
+		c.save()
+	}
+	return c.response(true)
+}
+
+// install replaces the local Db with a snapshot of the leader
+func (c *cluster) install(snap *clusterSnapshot) *clusterResponse {
+	c.dataMu.Lock()
+	defer c.dataMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if snap.Term < c.term || (snap.Term == c.term && c.role == model.ClusterLeader) {
+		return c.response(false)
+	}
+	c.follow(snap.Term, snap.Leader, snap.LeaderURL)
+
+	var err error
+	check := func(e error) {
+		if err == nil {
+			err = e
+		}
+	}
+	// objects are saved unconditionally, their contents yield the
+	// resource version of the leader
+	check(c.local.Trx(func(d Db) {
+		for name := range d.ListDefinitions() {
+			if _, ok := snap.Definitions[name]; !ok {
+				d.DeleteDefinition(name)
+			}
+		}
+		for _, def := range snap.Definitions {
+			def.ResourceVersion = ""
+			check(d.SaveDefinition(def))
+		}
+		for _, node := range snap.Nodes {
+			node.ResourceVersion = ""
+			check(d.SaveNode(node))
+		}
+		for _, network := range snap.Networks {
+			network.ResourceVersion = ""
+			check(d.SaveNetwork(network))
+		}
+		for _, registry := range snap.Registries {
+			registry.ResourceVersion = ""
+			check(d.SaveRegistry(registry))
+		}
+		for name := range d.ListContainers() {
+			if _, ok := snap.Containers[name]; !ok {
+				d.DeleteContainer(name)
+			}
+		}
+		for _, cont := range snap.Containers {
+			cont.ResourceVersion = ""
+			check(d.SaveContainer(cont))
+		}
+		d.GetVars(func(m map[string]string) {
+			for k := range m {
+				delete(m, k)
+			}
+			for k, v := range snap.Vars {
+				m[k] = v
+			}
+		})
+	}))
+	if err != nil {
+		log.Error("cluster: unable to install snapshot %d: %s", snap.Index, err)
+		return c.response(false)
+	}
+	log.Info("cluster: installed snapshot %d of %s", snap.Index, snap.Leader)
+	c.index, c.indexTerm = snap.Index, snap.IndexTerm
+	c.save()
+	return c.response(true)
+}
+
+// commit runs f on the local Db of the leader and replicates the
+// writes it made to the followers.  The writes are undone when they do
+// not reach a majority, the followers that may hold them get a snapshot.
+// Reads wait for the outcome.
+func (c *cluster) commit(f func(d Db)) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if !c.IsLeader() {
+		return errNotLeader
+	}
+	c.waitSynced()
+	c.dataMu.Lock()
+	defer c.dataMu.Unlock()
+
+	rec := &recordingDb{}
+	if err := c.local.Trx(func(d Db) {
+		rec.Db = d
+		f(rec)
+	}); err != nil {
+		return err
+	}
+	if len(rec.ops) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	prevIndex, prevTerm := c.index, c.indexTerm
+	entry := &clusterEntry{Term: c.term, Index: c.index + 1, Ops: rec.ops}
+	c.mu.Unlock()
+
+	if acks := c.replicate(prevIndex, prevTerm, entry); acks < c.majority() {
+		var err error
+		if terr := c.local.Trx(func(d Db) { err = rec.undo(d) }); terr != nil {
+			err = terr
+		}
+		if err != nil {
+			log.Error("cluster: unable to undo entry %d: %s", entry.Index, err)
+		}
+		c.mu.Lock()
+		for _, p := range c.peers {
+			p.synced = false
+		}
+		c.mu.Unlock()
+		return fmt.Errorf("entry %d reached %d of %d masters", entry.Index, acks, len(c.peers)+1)
+	}
+	c.mu.Lock()
+	c.index, c.indexTerm = entry.Index, entry.Term
+	c.save()
+	c.mu.Unlock()
+	return nil
+}
+
+// waitSynced waits up to clusterRequestTimeout for a majority of the
+// members to hold the state of the leader with no request in flight, so
+// the next entry can reach them.  Followers are busy with a snapshot
+// right after an election.
+func (c *cluster) waitSynced() {
+	deadline := time.Now().Add(clusterRequestTimeout)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		ready := 1
+		for _, p := range c.peers {
+			if p.synced && !p.busy {
+				ready++
+			}
+		}
+		majority := c.majority()
+		c.mu.Unlock()
+		if ready >= majority {
+			return
+		}
+		time.Sleep(clusterTick / 10)
+	}
+}
+
+// load reads the persisted state.  It is called before the member
+// takes part in the cluster.
+func (c *cluster) load() {
+	file := path.Join(c.cfg.Dir, clusterStateFile)
+	if !utils.FileExists(file) {
+		return
+	}
+	state := &clusterState{}
+	b, err := ioutil.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(b, state)
+	}
+	if err != nil {
+		panic(fmt.Sprintf("unable to read cluster state %s: %s", file, err))
+	}
+	c.term, c.votedFor, c.index, c.indexTerm = state.Term, state.VotedFor, state.Index, state.IndexTerm
+}
+
+// save persists the state.  It must be called with mu held.
+func (c *cluster) save() {
+	b, err := json.Marshal(&clusterState{Term: c.term, VotedFor: c.votedFor, Index: c.index, IndexTerm: c.indexTerm})
+	if err == nil {
+		utils.EnsureDir(c.cfg.Dir)
+		err = writeFileAtomic(path.Join(c.cfg.Dir, clusterStateFile), b)
+	}
+	if err != nil {
+		log.Error("cluster: unable to save state: %s", err)
+	}
+}
+
+// LeaderRedirect middleware redirecting the master API requests
+// received by a follower to the leader.  /master/cluster is answered
+// by every member.
+func LeaderRedirect(c Cluster) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasPrefix(r.URL.Path, "/master/") || r.URL.Path == "/master/cluster" || c.IsLeader() {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if _, leaderURL := c.Leader(); leaderURL != "" {
+				http.Redirect(w, r, strings.TrimSuffix(leaderURL, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(`{"error":"No leader elected"}`))
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package service
+
+import (
+	"net/http"
+
+	"github.com/libgolang/one/utils"
+)
+
+// ClusterService REST API of the cluster membership
+type ClusterService interface {
+}
+
+type clusterService struct {
+	rs      RestServer
+	cluster Cluster
+}
+
+// NewClusterService constructor
+func NewClusterService(rs RestServer, cluster Cluster) ClusterService {
+	s := &clusterService{rs: rs, cluster: cluster}
+	s.init()
+	return s
+}
+
+func (s *clusterService) init() {
+	s.rs.HandleFunc("/master/cluster", func(w http.ResponseWriter, r *http.Request) RestResponse { return s.listMembers(w, r) }).Methods("GET")
+}
+
+func (s *clusterService) listMembers(w http.ResponseWriter, r *http.Request) RestResponse {
+	def := map[string]string{
+		"Name":        "string",
+		"Role":        "string",
+		"LastContact": "time",
+	}
+	list := s.cluster.Members()
+	page, err := utils.RestList(def, "Name", r, &list)
+	if err != nil {
+		return (&JSONResponse{}).SetStatus(400).SetBody(map[string]string{"error": err.Error()})
+	}
+	return listResponse(page)
+}
@@ -0,0 +1,408 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libgolang/one/model"
+)
+
+// newTestCluster starts n members on free local ports
+func newTestCluster(t *testing.T, n int) ([]Cluster, string) {
+	return newTestClusterWith(t, n, nil)
+}
+
+// newTestClusterWith starts n members on free local ports, the members
+// of the cluster also include those listening on others
+func newTestClusterWith(t *testing.T, n int, others []net.Listener) ([]Cluster, string) {
+	tmpDir, _ := ioutil.TempDir("", "testing-cluster")
+	members := make(map[string]string)
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		members[fmt.Sprintf("master%02d", i+1)] = "http://" + l.Addr().String()
+		_ = l.Close()
+	}
+	for i, l := range others {
+		members[fmt.Sprintf("master%02d", n+i+1)] = "http://" + l.Addr().String()
+	}
+	list := make([]Cluster, 0, n)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("master%02d", i+1)
+		dir := path.Join(tmpDir, name)
+		list = append(list, NewCluster(ClusterConfig{
+			Name:      name,
+			ClientURL: "http://" + name + ":8080",
+			Members:   members,
+			Dir:       dir,
+			Token:     "secret",
+		}, NewDb(dir)))
+	}
+	return list, tmpDir
+}
+
+// waitLeader waits for one of the running members to lead and for the
+// others to follow it
+func waitLeader(t *testing.T, members []Cluster) Cluster {
+	deadline := time.Now().Add(clusterElectionTimeout * 10)
+	for time.Now().Before(deadline) {
+		for _, m := range members {
+			if !m.IsLeader() {
+				continue
+			}
+			name, _ := m.Leader()
+			agreed := true
+			for _, other := range members {
+				if n, _ := other.Leader(); n != name {
+					agreed = false
+				}
+			}
+			if agreed {
+				return m
+			}
+		}
+		time.Sleep(clusterTick)
+	}
+	t.Fatal("no leader elected")
+	return nil
+}
+
+func TestClusterReplication(t *testing.T) {
+	// given
+	members, tmpDir := newTestCluster(t, 3)
+	defer func() {
+		for _, m := range members {
+			m.Stop()
+		}
+		_ = os.RemoveAll(tmpDir)
+	}()
+	leader := waitLeader(t, members)
+
+	// when
+	err := leader.Db().SaveDefinition(&model.Definition{Name: "web", Image: "nginx"})
+	leader.Db().Trx(func(d Db) {
+		_ = d.SaveContainer(&model.Container{Name: "web-1", DefinitionName: "web", NodeName: "node01"})
+		d.NextAutoIncrement("def", "web")
+	})
+
+	// then
+	if err != nil {
+		t.Fatalf("leader should accept writes: %s", err)
+	}
+	for _, m := range members {
+		if m == leader {
+			continue
+		}
+		// the members beyond the majority catch up in the background
+		deadline := time.Now().Add(clusterElectionTimeout)
+		for len(m.Db().ListContainersByNode("node01")) == 0 && time.Now().Before(deadline) {
+			time.Sleep(clusterTick)
+		}
+		if def, err := m.Db().GetDefinition("web"); err != nil || def.Image != "nginx" {
+			t.Errorf("definition should be replicated: %v", err)
+		}
+		if len(m.Db().ListContainersByNode("node01")) != 1 {
+			t.Error("container should be replicated")
+		}
+		if vars := m.Db().GetVars(func(map[string]string) {}); vars["def.web"] != "1" {
+			t.Errorf("vars should be replicated: %v", vars)
+		}
+		if err := m.Db().SaveDefinition(&model.Definition{Name: "db"}); err != errNotLeader {
+			t.Errorf("follower should refuse writes, got %v", err)
+		}
+		if name, _ := m.Leader(); name == "" {
+			t.Error("follower should know the leader")
+		}
+	}
+}
+
+func TestClusterFailover(t *testing.T) {
+	// given
+	members, tmpDir := newTestCluster(t, 3)
+	defer func() {
+		for _, m := range members {
+			m.Stop()
+		}
+		_ = os.RemoveAll(tmpDir)
+	}()
+	leader := waitLeader(t, members)
+	_ = leader.Db().SaveDefinition(&model.Definition{Name: "web"})
+
+	// when
+	leader.Stop()
+	running := make([]Cluster, 0)
+	for _, m := range members {
+		if m != leader {
+			running = append(running, m)
+		}
+	}
+	members = running
+	next := waitLeader(t, running)
+
+	// then
+	if _, err := next.Db().GetDefinition("web"); err != nil {
+		t.Error("new leader should have the committed definition")
+	}
+	if err := next.Db().SaveDefinition(&model.Definition{Name: "db"}); err != nil {
+		t.Errorf("new leader should accept writes with a majority: %s", err)
+	}
+}
+
+func TestClusterWriteFailureIsUndone(t *testing.T) {
+	// given
+	members, tmpDir := newTestCluster(t, 3)
+	defer func() {
+		for _, m := range members {
+			m.Stop()
+		}
+		_ = os.RemoveAll(tmpDir)
+	}()
+	leader := waitLeader(t, members)
+	_ = leader.Db().SaveDefinition(&model.Definition{Name: "web", Image: "nginx"})
+	for _, m := range members {
+		if m != leader {
+			m.Stop()
+		}
+	}
+	members = []Cluster{leader}
+
+	// when
+	created := leader.Db().SaveDefinition(&model.Definition{Name: "db", Image: "postgres"})
+	updated := leader.Db().SaveDefinition(&model.Definition{Name: "web", Image: "httpd"})
+
+	// then
+	if created == nil || updated == nil {
+		t.Fatal("writes without a majority should fail")
+	}
+	if _, err := leader.Db().GetDefinition("db"); err == nil {
+		t.Error("the created definition should be undone")
+	}
+	if def, err := leader.Db().GetDefinition("web"); err != nil || def.Image != "nginx" {
+		t.Errorf("the updated definition should be restored, got %+v %v", def, err)
+	}
+}
+
+func TestClusterUncommittedWriteIsUnavailable(t *testing.T) {
+	// given a leader whose followers are gone
+	members, tmpDir := newTestCluster(t, 3)
+	defer func() {
+		for _, m := range members {
+			m.Stop()
+		}
+		_ = os.RemoveAll(tmpDir)
+	}()
+	leader := waitLeader(t, members)
+	for _, m := range members {
+		if m != leader {
+			m.Stop()
+		}
+	}
+	members = []Cluster{leader}
+	rs := NewRestServer("127.0.0.1:0", "", "").(*restServer)
+	m := NewMasterService(rs, NewFrontDb(leader.Db()), "example.com", leader, nil, "").(*masterService)
+	defer m.stop()
+
+	// when
+	trxErr := m.db.Trx(func(d Db) { _ = d.SaveDefinition(&model.Definition{Name: "db", Image: "postgres"}) })
+	rec := httptest.NewRecorder()
+	rs.router.ServeHTTP(rec, httptest.NewRequest("PUT", "/master/definitions/web", strings.NewReader(`{"image":"nginx"}`)))
+
+	// then
+	if trxErr == nil {
+		t.Error("a transaction without a majority should fail")
+	}
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("an uncommitted definition should answer 503, got %d: %s", rec.Code, rec.Body)
+	}
+	if _, err := leader.Db().GetDefinition("web"); err == nil {
+		t.Error("the uncommitted definition should be undone")
+	}
+}
+
+func TestClusterCancelledAppend(t *testing.T) {
+	// given
+	members, tmpDir := newTestCluster(t, 3)
+	defer func() {
+		for _, m := range members {
+			m.Stop()
+		}
+		_ = os.RemoveAll(tmpDir)
+	}()
+	leader := waitLeader(t, members)
+	var follower *cluster
+	for _, m := range members {
+		if m != leader {
+			follower = m.(*cluster)
+		}
+	}
+	follower.mu.Lock()
+	term, index, indexTerm := follower.term, follower.index, follower.indexTerm
+	follower.mu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	data, _ := json.Marshal(&model.Definition{Name: "web", Image: "nginx"})
+	entry := &clusterEntry{Term: term, Index: index + 1, Ops: []clusterOp{{Op: opDefinition, Name: "web", Data: data}}}
+
+	// when
+	resp := follower.append(ctx, &clusterAppendRequest{Term: term, PrevIndex: index, PrevTerm: indexTerm, Entry: entry})
+
+	// then
+	if resp.Success {
+		t.Error("a cancelled append should be refused")
+	}
+	if _, err := follower.local.GetDefinition("web"); err == nil {
+		t.Error("a cancelled entry should not be applied")
+	}
+}
+
+func TestClusterTLS(t *testing.T) {
+	// given masters reaching each other over https
+	tmpDir, _ := ioutil.TempDir("", "testing-cluster")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	chain, key, err := NewSelfSignedProvider(path.Join(tmpDir, "ca"), time.Hour).Obtain("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := path.Join(tmpDir, "peer.pem"), path.Join(tmpDir, "peer-key.pem")
+	_ = ioutil.WriteFile(certFile, chain, 0600)
+	_ = ioutil.WriteFile(keyFile, key, 0600)
+	members := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		members[fmt.Sprintf("master%02d", i+1)] = fmt.Sprintf("https://localhost:%d", l.Addr().(*net.TCPAddr).Port)
+		_ = l.Close()
+	}
+	list := make([]Cluster, 0, 2)
+	for name := range members {
+		dir := path.Join(tmpDir, name)
+		list = append(list, NewCluster(ClusterConfig{
+			Name:      name,
+			ClientURL: "http://" + name + ":8080",
+			Members:   members,
+			Dir:       dir,
+			Token:     "secret",
+			CertFile:  certFile,
+			KeyFile:   keyFile,
+			CAFile:    path.Join(tmpDir, "ca", "ca.pem"),
+		}, NewDb(dir)))
+	}
+	defer func() {
+		for _, m := range list {
+			m.Stop()
+		}
+	}()
+
+	// when
+	leader := waitLeader(t, list)
+	err = leader.Db().SaveDefinition(&model.Definition{Name: "web", Image: "nginx"})
+
+	// then
+	if err != nil {
+		t.Errorf("writes should be replicated over TLS: %s", err)
+	}
+}
+
+func TestClusterHungPeer(t *testing.T) {
+	// given a member accepting connections but never answering
+	hung, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conns := make([]net.Conn, 0)
+		for {
+			conn, err := hung.Accept()
+			if err != nil {
+				for _, c := range conns {
+					_ = c.Close()
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	members, tmpDir := newTestClusterWith(t, 2, []net.Listener{hung})
+	defer func() {
+		for _, m := range members {
+			m.Stop()
+		}
+		_ = hung.Close()
+		_ = os.RemoveAll(tmpDir)
+	}()
+	leader := waitLeader(t, members)
+	name, _ := leader.Leader()
+
+	// when
+	errs := make([]error, 0)
+	slowest := time.Duration(0)
+	for i := 0; i < 10; i++ {
+		start := time.Now()
+		errs = append(errs, leader.Db().SaveDefinition(&model.Definition{Name: fmt.Sprintf("web%d", i)}))
+		if elapsed := time.Since(start); elapsed > slowest {
+			slowest = elapsed
+		}
+		time.Sleep(clusterHeartbeat)
+	}
+
+	// then
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("write %d should succeed with a majority: %s", i, err)
+		}
+	}
+	if slowest >= clusterRequestTimeout {
+		t.Errorf("writes should not wait for the hung member, the slowest took %s", slowest)
+	}
+	for _, m := range members {
+		if n, _ := m.Leader(); n != name {
+			t.Errorf("leadership should stay with %s, %s follows %q", name, m.Members()[0].Name, n)
+		}
+	}
+}
+
+func TestLeaderRedirect(t *testing.T) {
+	// given
+	members, tmpDir := newTestCluster(t, 2)
+	defer func() {
+		for _, m := range members {
+			m.Stop()
+		}
+		_ = os.RemoveAll(tmpDir)
+	}()
+	leader := waitLeader(t, members)
+	follower := members[0]
+	if follower == leader {
+		follower = members[1]
+	}
+	handler := LeaderRedirect(follower)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// when
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/master/nodeinfo?x=1", nil))
+
+	// then
+	_, leaderURL := leader.Leader()
+	if rec.Code != http.StatusTemporaryRedirect || rec.Header().Get("Location") != leaderURL+"/master/nodeinfo?x=1" {
+		t.Errorf("follower should redirect to the leader, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/master/cluster", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("cluster status should be answered by followers, got %d", rec.Code)
+	}
+}
@@ -1,6 +1,8 @@
 package service
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -8,6 +10,7 @@ import (
 	"path"
 	"reflect"
 	"strconv"
+	"time"
 
 	"github.com/libgolang/log"
 	"github.com/libgolang/one/model"
@@ -21,56 +24,88 @@ const (
 	DefsDir = "defs"
 	// ContsDir constant holding the directory where container information is stored
 	ContsDir = "conts"
+	// NetworksDir constant holding the directory where network information is stored
+	NetworksDir = "networks"
+	// RegistriesDir constant holding the directory where registry information is stored
+	RegistriesDir = "registries"
 	// LocksDir constant holding the directory where locks are mantained
 	LocksDir = "locks"
+	// QuarantineDir constant holding the directory where unreadable records are moved
+	QuarantineDir = "quarantine"
+	// VarsFile constant holding the file where variables are stored
+	VarsFile = "vars.json"
 )
 
-// Db type
+// dirKinds kind of the objects stored in each directory
+var dirKinds = map[string]string{
+	DefsDir:       kindDefinition,
+	ContsDir:      kindContainer,
+	NodesDir:      kindNode,
+	NetworksDir:   kindNetwork,
+	RegistriesDir: kindRegistry,
+}
+
+// ConflictError returned by the Save methods of Db when an object is
+// saved with a ResourceVersion that is not the stored one
+type ConflictError struct {
+	Kind string
+	Name string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s %s was modified by someone else, resource version mismatch", e.Kind, e.Name)
+}
+
+// Db type.  Save methods are compare-and-swap: an object with a
+// ResourceVersion is only saved if it is the version stored, otherwise
+// a *ConflictError is returned.  Objects without ResourceVersion are
+// saved unconditionally.  On success the ResourceVersion of the object
+// is set to the version of its new contents and its SchemaVersion to
+// the current SchemaVersion.  Objects stored with an older schema
+// version are upgraded when read, see Migrator.  Trx runs its callback
+// in a transaction and returns an error when the writes could not be
+// committed, they are then discarded.
 type Db interface {
 	ListDefinitions() map[string]*model.Definition
 	ListContainers() map[string]*model.Container
+	ListContainersByDefinition(defName string) map[string]*model.Container
+	ListContainersByNode(nodeName string) map[string]*model.Container
 	ListNodes() map[string]*model.Node
 	GetNode(name string) (*model.Node, error)
 	SaveNode(node *model.Node) error
 	GetDefinition(name string) (*model.Definition, error)
+	SaveDefinition(def *model.Definition) error
+	DeleteDefinition(name string)
+	ListNetworks() map[string]*model.Network
+	GetNetwork(name string) (*model.Network, error)
+	SaveNetwork(network *model.Network) error
+	ListRegistries() map[string]*model.Registry
+	GetRegistry(name string) (*model.Registry, error)
+	SaveRegistry(registry *model.Registry) error
 	GetVars(func(map[string]string)) map[string]string
 	DeleteContainer(ID string)
 	NextAutoIncrement(ns string, name string) int
 	SaveContainer(cont *model.Container) error
-	Trx(func(d Db))
+	Trx(func(d Db)) error
 	Close()
 }
 
 type db struct {
 	dir string
-	/*
-		name       string
-		clientURLs string
-		peerURLs   string
-		cluster    string
-		etcd       *embed.Etcd
-		ecli       *clientv3.Client
-	*/
 }
 
 // NewDb Db constructor.
 // dir is the path to a directory for storage.
-func NewDb(dir /*, masterName, clientURLs, peerURLs, clusterStr*/ string) Db {
-	// masterName the name of the master node.  clientURLs comma separated urls to listen for client connections.  e.g. http://10.0.0.1:2380,http://127.0.0.1:2380.  peerURLs comma separated urls to listen for peer connections.  e.g. http://10.0.0.1:2380,http://127.0.0.1:2380.  clusterStr is the cluster connection string with all master server peer addresses of the form "master01=http://10.0.1.10:2380,master02=http://10.0.1.11:2380".
+func NewDb(dir string) Db {
 	d := &db{
 		dir: dir,
-		/*
-			name:       masterName,
-			clientURLs: clientURLs,
-			peerURLs:   peerURLs,
-			cluster:    clusterStr,
-		*/
 	}
 	return d
 }
 
-func (d *db) Trx(f func(d Db)) {
+func (d *db) Trx(f func(d Db)) error {
 	f(d)
+	return nil
 }
 
 func (d *db) init() {
@@ -93,6 +128,28 @@ func (d *db) ListNodes() map[string]*model.Node {
 	return result
 }
 
+func (d *db) ListNetworks() map[string]*model.Network {
+	result := make(map[string]*model.Network)
+	d.listFromDirGeneric(NetworksDir, reflect.TypeOf(model.Network{}), func(f string, it interface{}) bool {
+		if obj, ok := it.(*model.Network); ok {
+			result[obj.Name] = obj
+		}
+		return true // continue execution
+	})
+	return result
+}
+
+func (d *db) ListRegistries() map[string]*model.Registry {
+	result := make(map[string]*model.Registry)
+	d.listFromDirGeneric(RegistriesDir, reflect.TypeOf(model.Registry{}), func(f string, it interface{}) bool {
+		if obj, ok := it.(*model.Registry); ok {
+			result[obj.Name] = obj
+		}
+		return true // continue execution
+	})
+	return result
+}
+
 func (d *db) ListDefinitions() map[string]*model.Definition {
 	//defer d.Lock(DefsDir)()
 	result := make(map[string]*model.Definition)
@@ -117,6 +174,26 @@ func (d *db) ListContainers() map[string]*model.Container {
 	return result
 }
 
+func (d *db) ListContainersByDefinition(defName string) map[string]*model.Container {
+	result := make(map[string]*model.Container)
+	for name, cont := range d.ListContainers() {
+		if cont.DefinitionName == defName {
+			result[name] = cont
+		}
+	}
+	return result
+}
+
+func (d *db) ListContainersByNode(nodeName string) map[string]*model.Container {
+	result := make(map[string]*model.Container)
+	for name, cont := range d.ListContainers() {
+		if cont.NodeName == nodeName {
+			result[name] = cont
+		}
+	}
+	return result
+}
+
 func (d *db) GetDefinition(name string) (*model.Definition, error) {
 	//defer d.Lock(DefsDir)()
 	var found *model.Definition
@@ -144,31 +221,30 @@ func (d *db) GetDefinition(name string) (*model.Definition, error) {
 func (d *db) GetVars(cb func(map[string]string)) map[string]string {
 	//defer d.Lock("vars-json")()
 
-	varsFile := path.Join(d.dir, "vars.json")
+	varsFile := path.Join(d.dir, VarsFile)
 
 	// Read JSON from file
-	var bytes []byte
-	var err error
-	if _, err := os.Stat(varsFile); os.IsNotExist(err) {
-		bytes = []byte("{}") // empty map
-	} else {
-		bytes, err = ioutil.ReadFile(varsFile)
+	stored := &storedVars{}
+	if _, err := os.Stat(varsFile); !os.IsNotExist(err) {
+		bytes, err := ioutil.ReadFile(varsFile)
 		if err != nil {
 			panic(err)
 		}
+		if err = decodeStored(kindVars, bytes, stored); err != nil {
+			panic(fmt.Errorf("unable to read %s: %s", varsFile, err))
+		}
 	}
-
-	// Unmarshal
-	var values map[string]string
-	if err = json.Unmarshal(bytes, &values); err != nil {
-		panic(err)
+	values := stored.Vars
+	if values == nil {
+		values = make(map[string]string)
 	}
 
 	// pass to callback
 	cb(values)
 
 	// marshall back to file
-	if bytes, err = json.Marshal(values); err != nil {
+	bytes, err := json.Marshal(&storedVars{SchemaVersion: SchemaVersion, Vars: values})
+	if err != nil {
 		panic(err)
 	}
 	if err = ioutil.WriteFile(varsFile, bytes, 0664); err != nil {
@@ -182,6 +258,9 @@ func (d *db) DeleteContainer(name string) {
 	collector := func(file string, it interface{}) bool {
 		c, ok := it.(*model.Container)
 		if ok && c.Name == name {
+			if err := os.Remove(path.Join(d.dir, ContsDir, file)); err != nil {
+				log.Error("unable to delete container %s: %s", name, err)
+			}
 			return false
 		}
 		return true
@@ -189,7 +268,37 @@ func (d *db) DeleteContainer(name string) {
 	d.listFromDirGeneric(ContsDir, reflect.TypeOf(model.Container{}), collector)
 }
 
+func (d *db) DeleteDefinition(name string) {
+	if err := d.deleteObject(kindDefinition, name); err != nil {
+		log.Error("unable to delete definition %s: %s", name, err)
+	}
+}
+
+// objectDeleter Db removing stored objects of any kind, used to undo
+// the writes of a cluster transaction
+type objectDeleter interface {
+	deleteObject(kind, name string) error
+}
+
+func (d *db) deleteObject(kind, name string) error {
+	for dir, k := range dirKinds {
+		if k == kind {
+			err := os.Remove(path.Join(d.dir, dir, fmt.Sprintf("%s.json", name)))
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+	}
+	return fmt.Errorf("unknown kind %s", kind)
+}
+
 func (d *db) NextAutoIncrement(ns, name string) int {
+	return nextAutoIncrement(d, ns, name)
+}
+
+// nextAutoIncrement increments the counter ns.name kept in the vars of d
+func nextAutoIncrement(d Db, ns, name string) int {
 	key := fmt.Sprintf("%s.%s", ns, name)
 	m := d.GetVars(func(m map[string]string) {
 		str := m[key]
@@ -208,6 +317,15 @@ func (d *db) NextAutoIncrement(ns, name string) int {
 }
 
 func (d *db) SaveContainer(cont *model.Container) error {
+	stored, exists := d.ListContainers()[cont.Name]
+	current := ""
+	if exists {
+		current = stored.ResourceVersion
+	}
+	cont.SchemaVersion = SchemaVersion
+	if err := stampResourceVersion(kindContainer, cont.Name, &cont.ResourceVersion, current, exists, cont); err != nil {
+		return err
+	}
 	bytes, err := json.Marshal(cont)
 	if err != nil {
 		return err
@@ -220,6 +338,28 @@ func (d *db) SaveContainer(cont *model.Container) error {
 	return nil
 }
 
+func (d *db) SaveDefinition(def *model.Definition) error {
+	stored, err := d.GetDefinition(def.Name)
+	current := ""
+	if err == nil {
+		current = stored.ResourceVersion
+	}
+	def.SchemaVersion = SchemaVersion
+	if err := stampResourceVersion(kindDefinition, def.Name, &def.ResourceVersion, current, err == nil, def); err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(def)
+	if err != nil {
+		return err
+	}
+	dir := d.mkdirIfMissing(DefsDir)
+	fileName := path.Join(dir, fmt.Sprintf("%s.json", def.Name))
+	if err = ioutil.WriteFile(fileName, bytes, 0664); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (d *db) GetNode(name string) (*model.Node, error) {
 	nodes := d.ListNodes()
 	node, ok := nodes[name]
@@ -231,6 +371,15 @@ func (d *db) GetNode(name string) (*model.Node, error) {
 
 func (d *db) SaveNode(node *model.Node) error {
 	log.Info("SavingNode %s", node.Name)
+	stored, err := d.GetNode(node.Name)
+	current := ""
+	if err == nil {
+		current = stored.ResourceVersion
+	}
+	node.SchemaVersion = SchemaVersion
+	if err := stampResourceVersion(kindNode, node.Name, &node.ResourceVersion, current, err == nil, node); err != nil {
+		return err
+	}
 	bytes, err := json.Marshal(node)
 	if err != nil {
 		return err
@@ -243,6 +392,149 @@ func (d *db) SaveNode(node *model.Node) error {
 	return nil
 }
 
+func (d *db) GetNetwork(name string) (*model.Network, error) {
+	network, ok := d.ListNetworks()[name]
+	if !ok {
+		return nil, fmt.Errorf("Network %s not found", name)
+	}
+	return network, nil
+}
+
+func (d *db) SaveNetwork(network *model.Network) error {
+	stored, err := d.GetNetwork(network.Name)
+	current := ""
+	if err == nil {
+		current = stored.ResourceVersion
+	}
+	network.SchemaVersion = SchemaVersion
+	if err := stampResourceVersion(kindNetwork, network.Name, &network.ResourceVersion, current, err == nil, network); err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(network)
+	if err != nil {
+		return err
+	}
+	dir := d.mkdirIfMissing(NetworksDir)
+	fileName := path.Join(dir, fmt.Sprintf("%s.json", network.Name))
+	if err = ioutil.WriteFile(fileName, bytes, 0664); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *db) GetRegistry(name string) (*model.Registry, error) {
+	registry, ok := d.ListRegistries()[name]
+	if !ok {
+		return nil, fmt.Errorf("Registry %s not found", name)
+	}
+	return registry, nil
+}
+
+func (d *db) SaveRegistry(registry *model.Registry) error {
+	stored, err := d.GetRegistry(registry.Name)
+	current := ""
+	if err == nil {
+		current = stored.ResourceVersion
+	}
+	registry.SchemaVersion = SchemaVersion
+	if err := stampResourceVersion(kindRegistry, registry.Name, &registry.ResourceVersion, current, err == nil, registry); err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(registry)
+	if err != nil {
+		return err
+	}
+	dir := d.mkdirIfMissing(RegistriesDir)
+	fileName := path.Join(dir, fmt.Sprintf("%s.json", registry.Name))
+	if err = ioutil.WriteFile(fileName, bytes, 0664); err != nil {
+		return err
+	}
+	return nil
+}
+
+// stampResourceVersion checks the version of an object about to be
+// saved against current, the version stored, and replaces it with the
+// version of the contents of obj.  version points to the
+// ResourceVersion of obj.
+func stampResourceVersion(kind, name string, version *string, current string, exists bool, obj interface{}) error {
+	if *version != "" && (!exists || *version != current) {
+		return &ConflictError{Kind: kind, Name: name}
+	}
+	*version = ""
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(b)
+	*version = hex.EncodeToString(sum[:8])
+	return nil
+}
+
+// quarantine moves the unreadable file of subDir under QuarantineDir
+func (d *db) quarantine(subDir, fileName string, reason error) {
+	dir := d.mkdirIfMissing(path.Join(QuarantineDir, subDir))
+	to := path.Join(dir, fmt.Sprintf("%s.%d", fileName, time.Now().UnixNano()))
+	log.Error("Unable to read %s/%s, moving it to %s: %s", subDir, fileName, to, reason)
+	if err := os.Rename(path.Join(d.dir, subDir, fileName), to); err != nil {
+		log.Error("Unable to quarantine %s/%s: %s", subDir, fileName, err)
+	}
+}
+
+// Migrate rewrites the files of older schema versions, see Migrator.
+// Unreadable files, including vars.json, are moved to quarantine.
+func (d *db) Migrate() (map[string]int, error) {
+	stats := map[string]int{"current": 0, "migrated": 0, "quarantined": 0, "skipped": 0}
+	for _, subDir := range []string{DefsDir, ContsDir, NodesDir, NetworksDir, RegistriesDir} {
+		dir := d.mkdirIfMissing(subDir)
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return stats, err
+		}
+		for _, file := range files {
+			if file.IsDir() || path.Ext(file.Name()) != ".json" {
+				continue
+			}
+			migrated, err := d.migrateFile(subDir, file.Name(), dirKinds[subDir])
+			if err != nil {
+				return stats, err
+			}
+			stats[migrated]++
+		}
+	}
+	if utils.FileExists(path.Join(d.dir, VarsFile)) {
+		migrated, err := d.migrateFile("", VarsFile, kindVars)
+		if err != nil {
+			return stats, err
+		}
+		stats[migrated]++
+	}
+	return stats, nil
+}
+
+// migrateFile upgrades a single file.  It returns what was done:
+// current, migrated, quarantined or skipped for newer schema versions.
+func (d *db) migrateFile(subDir, fileName, kind string) (string, error) {
+	file := path.Join(d.dir, subDir, fileName)
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	upgraded, changed, err := upgrade(kind, contents)
+	if _, ok := err.(*newerSchemaError); ok {
+		log.Warn("Skipping %s: %s", file, err)
+		return "skipped", nil
+	}
+	if err != nil {
+		d.quarantine(subDir, fileName, err)
+		return "quarantined", nil
+	}
+	if !changed {
+		return "current", nil
+	}
+	log.Info("Migrated %s to schema version %d", file, SchemaVersion)
+	return "migrated", ioutil.WriteFile(file, upgraded, 0664)
+}
+
 func (d *db) mkdirIfMissing(subDir string) string {
 	dir := path.Join(d.dir, subDir)
 	if !utils.FileExists(dir) {
@@ -284,8 +576,12 @@ func (d *db) listFromDirGeneric(subDir string, elementType reflect.Type, collect
 		fileName := file.Name()
 		objPtr := reflect.New(elementType)
 		// Unmarshal to the dynamicly created type
-		if err := json.Unmarshal(contents, objPtr.Interface()); err != nil {
-			log.Warn("Unable to unmarshal definition: %s", fileName)
+		if err := decodeStored(dirKinds[subDir], contents, objPtr.Interface()); err != nil {
+			if _, ok := err.(*newerSchemaError); ok {
+				log.Warn("Skipping %s: %s", fullPath, err)
+			} else {
+				d.quarantine(subDir, fileName, err)
+			}
 			continue
 		}
 
@@ -0,0 +1,515 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/libgolang/log"
+	"github.com/libgolang/one/model"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// DbFile file based Db, one json file per object under var.dir
+	DbFile = "file"
+	// DbBolt transactional Db embedded in a single bbolt file
+	DbBolt = "bolt"
+)
+
+var (
+	boltDefinitions  = []byte("definitions")
+	boltContainers   = []byte("containers")
+	boltNodes        = []byte("nodes")
+	boltNetworks     = []byte("networks")
+	boltRegistries   = []byte("registries")
+	boltVars         = []byte("vars")
+	boltByDefinition = []byte("containers.definition") // <definition>\x00<container> -> ""
+	boltByNode       = []byte("containers.node")       // <node>\x00<container> -> ""
+	boltQuarantine   = []byte("quarantine")            // <bucket>/<name> -> unreadable json
+	boltBuckets      = [][]byte{boltDefinitions, boltContainers, boltNodes, boltNetworks, boltRegistries, boltVars, boltByDefinition, boltByNode, boltQuarantine}
+	boltKinds        = map[string]string{
+		string(boltDefinitions): kindDefinition,
+		string(boltContainers):  kindContainer,
+		string(boltNodes):       kindNode,
+		string(boltNetworks):    kindNetwork,
+		string(boltRegistries):  kindRegistry,
+	}
+)
+
+// boltDb Db stored in a bbolt file.  Objects are kept as json keyed by
+// name and containers are indexed by definition and node.  Every call
+// runs in its own transaction, except inside Trx where all calls share
+// a single read-write transaction that is rolled back on panic.
+type boltDb struct {
+	bolt *bolt.DB
+	tx   *bolt.Tx // set inside Trx
+}
+
+// NewBoltDb constructor.  file is the path of the bbolt database,
+// created when missing.
+func NewBoltDb(file string) Db {
+	b, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		panic(fmt.Errorf("unable to open %s: %s", file, err))
+	}
+	d := &boltDb{bolt: b}
+	d.init()
+	return d
+}
+
+func (d *boltDb) init() {
+	err := d.bolt.Update(func(tx *bolt.Tx) error {
+		for _, name := range boltBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (d *boltDb) Close() {
+	if err := d.bolt.Close(); err != nil {
+		log.Error("error closing db: %s", err)
+	}
+}
+
+func (d *boltDb) Trx(f func(d Db)) error {
+	if d.tx != nil {
+		f(d)
+		return nil
+	}
+	return d.bolt.Update(func(tx *bolt.Tx) error {
+		f(&boltDb{bolt: d.bolt, tx: tx})
+		return nil
+	})
+}
+
+// view runs f in the current transaction or in a new read-only one
+func (d *boltDb) view(f func(tx *bolt.Tx) error) error {
+	if d.tx != nil {
+		return f(d.tx)
+	}
+	return d.bolt.View(f)
+}
+
+// update runs f in the current transaction or in a new read-write one
+func (d *boltDb) update(f func(tx *bolt.Tx) error) error {
+	if d.tx != nil {
+		return f(d.tx)
+	}
+	return d.bolt.Update(f)
+}
+
+func (d *boltDb) ListDefinitions() map[string]*model.Definition {
+	result := make(map[string]*model.Definition)
+	_ = d.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDefinitions).ForEach(func(k, v []byte) error {
+			def := &model.Definition{}
+			if err := decodeStored(kindDefinition, v, def); err != nil {
+				log.Warn("Unable to unmarshal definition %s: %s", k, err)
+				return nil
+			}
+			result[def.Name] = def
+			return nil
+		})
+	})
+	return result
+}
+
+func (d *boltDb) ListContainers() map[string]*model.Container {
+	result := make(map[string]*model.Container)
+	_ = d.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltContainers).ForEach(func(k, v []byte) error {
+			if cont := unmarshalBoltContainer(k, v); cont != nil {
+				result[cont.Name] = cont
+			}
+			return nil
+		})
+	})
+	return result
+}
+
+func (d *boltDb) ListContainersByDefinition(defName string) map[string]*model.Container {
+	return d.listContainersByIndex(boltByDefinition, defName)
+}
+
+func (d *boltDb) ListContainersByNode(nodeName string) map[string]*model.Container {
+	return d.listContainersByIndex(boltByNode, nodeName)
+}
+
+func (d *boltDb) listContainersByIndex(index []byte, value string) map[string]*model.Container {
+	result := make(map[string]*model.Container)
+	prefix := append([]byte(value), 0)
+	_ = d.view(func(tx *bolt.Tx) error {
+		conts := tx.Bucket(boltContainers)
+		c := tx.Bucket(index).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			name := k[len(prefix):]
+			if cont := unmarshalBoltContainer(name, conts.Get(name)); cont != nil {
+				result[cont.Name] = cont
+			}
+		}
+		return nil
+	})
+	return result
+}
+
+func unmarshalBoltContainer(name, v []byte) *model.Container {
+	if v == nil {
+		return nil
+	}
+	cont := &model.Container{}
+	if err := decodeStored(kindContainer, v, cont); err != nil {
+		log.Warn("Unable to unmarshal container %s: %s", name, err)
+		return nil
+	}
+	return cont
+}
+
+func (d *boltDb) ListNodes() map[string]*model.Node {
+	result := make(map[string]*model.Node)
+	_ = d.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltNodes).ForEach(func(k, v []byte) error {
+			node := &model.Node{}
+			if err := decodeStored(kindNode, v, node); err != nil {
+				log.Warn("Unable to unmarshal node %s: %s", k, err)
+				return nil
+			}
+			result[node.Name] = node
+			return nil
+		})
+	})
+	return result
+}
+
+func (d *boltDb) ListNetworks() map[string]*model.Network {
+	result := make(map[string]*model.Network)
+	_ = d.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltNetworks).ForEach(func(k, v []byte) error {
+			network := &model.Network{}
+			if err := decodeStored(kindNetwork, v, network); err != nil {
+				log.Warn("Unable to unmarshal network %s: %s", k, err)
+				return nil
+			}
+			result[network.Name] = network
+			return nil
+		})
+	})
+	return result
+}
+
+func (d *boltDb) ListRegistries() map[string]*model.Registry {
+	result := make(map[string]*model.Registry)
+	_ = d.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRegistries).ForEach(func(k, v []byte) error {
+			registry := &model.Registry{}
+			if err := decodeStored(kindRegistry, v, registry); err != nil {
+				log.Warn("Unable to unmarshal registry %s: %s", k, err)
+				return nil
+			}
+			result[registry.Name] = registry
+			return nil
+		})
+	})
+	return result
+}
+
+func (d *boltDb) GetDefinition(name string) (*model.Definition, error) {
+	def := &model.Definition{}
+	if err := d.get(boltDefinitions, kindDefinition, name, def); err != nil {
+		return nil, fmt.Errorf("Definition %s not found", name)
+	}
+	return def, nil
+}
+
+func (d *boltDb) GetNode(name string) (*model.Node, error) {
+	node := &model.Node{}
+	if err := d.get(boltNodes, kindNode, name, node); err != nil {
+		return nil, fmt.Errorf("Node Not found")
+	}
+	return node, nil
+}
+
+func (d *boltDb) GetNetwork(name string) (*model.Network, error) {
+	network := &model.Network{}
+	if err := d.get(boltNetworks, kindNetwork, name, network); err != nil {
+		return nil, fmt.Errorf("Network %s not found", name)
+	}
+	return network, nil
+}
+
+func (d *boltDb) GetRegistry(name string) (*model.Registry, error) {
+	registry := &model.Registry{}
+	if err := d.get(boltRegistries, kindRegistry, name, registry); err != nil {
+		return nil, fmt.Errorf("Registry %s not found", name)
+	}
+	return registry, nil
+}
+
+func (d *boltDb) get(bucket []byte, kind, name string, obj interface{}) error {
+	return d.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucket).Get([]byte(name))
+		if v == nil {
+			return fmt.Errorf("%s not found", name)
+		}
+		return decodeStored(kind, v, obj)
+	})
+}
+
+// put saves obj as name after checking its version, which version
+// points to, against the stored one
+func (d *boltDb) put(bucket []byte, kind, name string, version *string, obj interface{}) error {
+	if name == "" {
+		return fmt.Errorf("name is required")
+	}
+	return d.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		stored := b.Get([]byte(name))
+		if err := stampResourceVersion(kind, name, version, boltVersion(stored), stored != nil, obj); err != nil {
+			return err
+		}
+		v, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), v)
+	})
+}
+
+// boltVersion returns the resource version of a stored object
+func boltVersion(v []byte) string {
+	obj := struct {
+		ResourceVersion string `json:"resourceVersion"`
+	}{}
+	if v != nil {
+		_ = json.Unmarshal(v, &obj)
+	}
+	return obj.ResourceVersion
+}
+
+func (d *boltDb) SaveDefinition(def *model.Definition) error {
+	def.SchemaVersion = SchemaVersion
+	return d.put(boltDefinitions, kindDefinition, def.Name, &def.ResourceVersion, def)
+}
+
+func (d *boltDb) SaveNode(node *model.Node) error {
+	log.Info("SavingNode %s", node.Name)
+	node.SchemaVersion = SchemaVersion
+	return d.put(boltNodes, kindNode, node.Name, &node.ResourceVersion, node)
+}
+
+func (d *boltDb) SaveNetwork(network *model.Network) error {
+	network.SchemaVersion = SchemaVersion
+	return d.put(boltNetworks, kindNetwork, network.Name, &network.ResourceVersion, network)
+}
+
+func (d *boltDb) SaveRegistry(registry *model.Registry) error {
+	registry.SchemaVersion = SchemaVersion
+	return d.put(boltRegistries, kindRegistry, registry.Name, &registry.ResourceVersion, registry)
+}
+
+func (d *boltDb) SaveContainer(cont *model.Container) error {
+	if cont.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	return d.update(func(tx *bolt.Tx) error {
+		conts := tx.Bucket(boltContainers)
+		stored := conts.Get([]byte(cont.Name))
+		cont.SchemaVersion = SchemaVersion
+		if err := stampResourceVersion(kindContainer, cont.Name, &cont.ResourceVersion, boltVersion(stored), stored != nil, cont); err != nil {
+			return err
+		}
+		b, err := json.Marshal(cont)
+		if err != nil {
+			return err
+		}
+		if previous := unmarshalBoltContainer([]byte(cont.Name), stored); previous != nil {
+			if err := deleteBoltIndexes(tx, previous); err != nil {
+				return err
+			}
+		}
+		if err := conts.Put([]byte(cont.Name), b); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltByDefinition).Put(boltIndexKey(cont.DefinitionName, cont.Name), []byte{}); err != nil {
+			return err
+		}
+		return tx.Bucket(boltByNode).Put(boltIndexKey(cont.NodeName, cont.Name), []byte{})
+	})
+}
+
+func (d *boltDb) DeleteContainer(name string) {
+	err := d.update(func(tx *bolt.Tx) error {
+		conts := tx.Bucket(boltContainers)
+		previous := unmarshalBoltContainer([]byte(name), conts.Get([]byte(name)))
+		if previous == nil {
+			return nil
+		}
+		if err := deleteBoltIndexes(tx, previous); err != nil {
+			return err
+		}
+		return conts.Delete([]byte(name))
+	})
+	if err != nil {
+		log.Error("unable to delete container %s: %s", name, err)
+	}
+}
+
+func (d *boltDb) DeleteDefinition(name string) {
+	if err := d.deleteObject(kindDefinition, name); err != nil {
+		log.Error("unable to delete definition %s: %s", name, err)
+	}
+}
+
+func (d *boltDb) deleteObject(kind, name string) error {
+	for bucket, k := range boltKinds {
+		if k == kind {
+			return d.update(func(tx *bolt.Tx) error {
+				return tx.Bucket([]byte(bucket)).Delete([]byte(name))
+			})
+		}
+	}
+	return fmt.Errorf("unknown kind %s", kind)
+}
+
+func boltIndexKey(value, name string) []byte {
+	return append(append([]byte(value), 0), name...)
+}
+
+func deleteBoltIndexes(tx *bolt.Tx, cont *model.Container) error {
+	if err := tx.Bucket(boltByDefinition).Delete(boltIndexKey(cont.DefinitionName, cont.Name)); err != nil {
+		return err
+	}
+	return tx.Bucket(boltByNode).Delete(boltIndexKey(cont.NodeName, cont.Name))
+}
+
+// deleteBoltIndexesByName removes the index entries of a container
+// that cannot be read
+func deleteBoltIndexesByName(tx *bolt.Tx, name string) error {
+	suffix := append([]byte{0}, name...)
+	for _, index := range [][]byte{boltByDefinition, boltByNode} {
+		keys := make([][]byte, 0)
+		_ = tx.Bucket(index).ForEach(func(k, v []byte) error {
+			if bytes.HasSuffix(k, suffix) {
+				keys = append(keys, append([]byte{}, k...))
+			}
+			return nil
+		})
+		for _, k := range keys {
+			if err := tx.Bucket(index).Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *boltDb) GetVars(cb func(map[string]string)) map[string]string {
+	values := make(map[string]string)
+	err := d.update(func(tx *bolt.Tx) error {
+		vars := tx.Bucket(boltVars)
+		_ = vars.ForEach(func(k, v []byte) error {
+			values[string(k)] = string(v)
+			return nil
+		})
+		previous := make(map[string]string, len(values))
+		for k, v := range values {
+			previous[k] = v
+		}
+
+		cb(values)
+
+		for k := range previous {
+			if _, ok := values[k]; !ok {
+				if err := vars.Delete([]byte(k)); err != nil {
+					return err
+				}
+			}
+		}
+		for k, v := range values {
+			if old, ok := previous[k]; ok && old == v {
+				continue
+			}
+			if err := vars.Put([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return values
+}
+
+// Migrate rewrites the objects of older schema versions, see Migrator.
+// Unreadable objects are moved to the quarantine bucket.  Variables are
+// plain strings and have no schema version.
+func (d *boltDb) Migrate() (map[string]int, error) {
+	stats := map[string]int{"current": 0, "migrated": 0, "quarantined": 0, "skipped": 0}
+	err := d.update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltDefinitions, boltContainers, boltNodes, boltNetworks, boltRegistries} {
+			b := tx.Bucket(bucket)
+			kind := boltKinds[string(bucket)]
+			upgraded := make(map[string][]byte)
+			unreadable := make(map[string][]byte)
+			err := b.ForEach(func(k, v []byte) error {
+				u, changed, err := upgrade(kind, v)
+				if _, ok := err.(*newerSchemaError); ok {
+					log.Warn("Skipping %s %s: %s", kind, k, err)
+					stats["skipped"]++
+					return nil
+				}
+				if err != nil {
+					log.Error("Unable to read %s %s, moving it to quarantine: %s", kind, k, err)
+					unreadable[string(k)] = append([]byte{}, v...)
+					return nil
+				}
+				if changed {
+					upgraded[string(k)] = u
+				} else {
+					stats["current"]++
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			// buckets are not modified while iterated
+			for name, v := range upgraded {
+				if err := b.Put([]byte(name), v); err != nil {
+					return err
+				}
+				stats["migrated"]++
+			}
+			for name, v := range unreadable {
+				key := fmt.Sprintf("%s/%s.%d", bucket, name, time.Now().UnixNano())
+				if err := tx.Bucket(boltQuarantine).Put([]byte(key), v); err != nil {
+					return err
+				}
+				if err := b.Delete([]byte(name)); err != nil {
+					return err
+				}
+				if bytes.Equal(bucket, boltContainers) {
+					if err := deleteBoltIndexesByName(tx, name); err != nil {
+						return err
+					}
+				}
+				stats["quarantined"]++
+			}
+		}
+		return nil
+	})
+	return stats, err
+}
+
+func (d *boltDb) NextAutoIncrement(ns, name string) int {
+	return nextAutoIncrement(d, ns, name)
+}
@@ -0,0 +1,198 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/libgolang/one/model"
+)
+
+func newTestBoltDb() (Db, string) {
+	tmpDir, _ := ioutil.TempDir("", "testing-bolt")
+	return NewBoltDb(path.Join(tmpDir, "one.db")), tmpDir
+}
+
+func TestBoltSaveAndGet(t *testing.T) {
+	// given
+	d, tmpDir := newTestBoltDb()
+	defer func() {
+		d.Close()
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	// when
+	_ = d.SaveDefinition(&model.Definition{Name: "web", Image: "nginx"})
+	_ = d.SaveNode(&model.Node{Name: "node01"})
+	_ = d.SaveNetwork(&model.Network{Name: "backend"})
+	err := d.SaveDefinition(&model.Definition{})
+
+	// then
+	if err == nil {
+		t.Error("definition without a name should not be saved")
+	}
+	def, err := d.GetDefinition("web")
+	if err != nil || def.Image != "nginx" {
+		t.Errorf("definition web not found: %v", err)
+	}
+	if _, err := d.GetDefinition("missing"); err == nil {
+		t.Error("missing definition should not be found")
+	}
+	if _, err := d.GetNode("node01"); err != nil {
+		t.Errorf("node01 not found: %s", err)
+	}
+	if len(d.ListDefinitions()) != 1 || len(d.ListNodes()) != 1 {
+		t.Error("should list one definition and one node")
+	}
+	if _, err := d.GetNetwork("backend"); err != nil || len(d.ListNetworks()) != 1 {
+		t.Errorf("network backend not found: %v", err)
+	}
+}
+
+func TestBoltContainerIndexes(t *testing.T) {
+	// given
+	d, tmpDir := newTestBoltDb()
+	defer func() {
+		d.Close()
+		_ = os.RemoveAll(tmpDir)
+	}()
+	_ = d.SaveContainer(&model.Container{Name: "web-1", DefinitionName: "web", NodeName: "node01"})
+	_ = d.SaveContainer(&model.Container{Name: "web-2", DefinitionName: "web", NodeName: "node01"})
+	_ = d.SaveContainer(&model.Container{Name: "web10-1", DefinitionName: "web10", NodeName: "node02"})
+
+	// when
+	_ = d.SaveContainer(&model.Container{Name: "web-2", DefinitionName: "web", NodeName: "node02"})
+
+	// then
+	if conts := d.ListContainersByDefinition("web"); len(conts) != 2 {
+		t.Errorf("web should have 2 containers, but has %d", len(conts))
+	}
+	if conts := d.ListContainersByNode("node01"); len(conts) != 1 || conts["web-1"] == nil {
+		t.Errorf("node01 should only have web-1: %v", conts)
+	}
+	if conts := d.ListContainersByNode("node02"); len(conts) != 2 || conts["web-2"] == nil {
+		t.Errorf("node02 should have web-2 and web10-1: %v", conts)
+	}
+
+	// and when deleted
+	d.DeleteContainer("web-1")
+	if len(d.ListContainers()) != 2 || len(d.ListContainersByNode("node01")) != 0 {
+		t.Error("web-1 should be removed from the containers and indexes")
+	}
+}
+
+func TestBoltTrxRollback(t *testing.T) {
+	// given
+	d, tmpDir := newTestBoltDb()
+	defer func() {
+		d.Close()
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	// when
+	func() {
+		defer func() { _ = recover() }()
+		d.Trx(func(d Db) {
+			_ = d.SaveDefinition(&model.Definition{Name: "web"})
+			if _, err := d.GetDefinition("web"); err != nil {
+				t.Error("definition should be visible inside the transaction")
+			}
+			panic("abort")
+		})
+	}()
+
+	// then
+	if _, err := d.GetDefinition("web"); err == nil {
+		t.Error("definition should be rolled back")
+	}
+}
+
+func TestBoltVarsAndAutoIncrement(t *testing.T) {
+	// given
+	d, tmpDir := newTestBoltDb()
+	defer func() {
+		d.Close()
+		_ = os.RemoveAll(tmpDir)
+	}()
+	d.GetVars(func(m map[string]string) {
+		m["xyz1"] = "xyz1"
+		m["xyz2"] = "xyz2"
+	})
+
+	// when
+	m := d.GetVars(func(m map[string]string) {
+		delete(m, "xyz1")
+	})
+	d.NextAutoIncrement("def", "web")
+	n := d.NextAutoIncrement("def", "web")
+
+	// then
+	if _, ok := m["xyz1"]; ok || m["xyz2"] != "xyz2" {
+		t.Errorf("unexpected vars %v", m)
+	}
+	if n != 2 {
+		t.Errorf("auto increment should be 2, but was %d", n)
+	}
+}
+
+func TestImportDb(t *testing.T) {
+	// given
+	fileDir, _ := ioutil.TempDir("", "testing-db")
+	from := NewDb(fileDir)
+	d, tmpDir := newTestBoltDb()
+	defer func() {
+		d.Close()
+		_ = os.RemoveAll(tmpDir)
+		_ = os.RemoveAll(fileDir)
+	}()
+	_ = from.SaveDefinition(&model.Definition{Name: "web"})
+	_ = from.SaveContainer(&model.Container{Name: "web-1", DefinitionName: "web", NodeName: "node01"})
+	_ = from.SaveNode(&model.Node{Name: "node01"})
+	from.NextAutoIncrement("def", "web")
+
+	// when
+	stats, err := ImportDb(from, d)
+
+	// then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["definitions"] != 1 || stats["containers"] != 1 || stats["nodes"] != 1 || stats["vars"] != 1 {
+		t.Errorf("unexpected import stats %v", stats)
+	}
+	if len(d.ListContainersByNode("node01")) != 1 {
+		t.Error("imported container should be indexed")
+	}
+	if n := d.NextAutoIncrement("def", "web"); n != 2 {
+		t.Errorf("auto increment should continue at 2, but was %d", n)
+	}
+}
+
+func TestBoltResourceVersion(t *testing.T) {
+	// given
+	d, tmpDir := newTestBoltDb()
+	defer func() {
+		d.Close()
+		_ = os.RemoveAll(tmpDir)
+	}()
+	cont := &model.Container{Name: "web-1", DefinitionName: "web", NodeName: "node01"}
+	_ = d.SaveContainer(cont)
+	stale := cont.ResourceVersion
+
+	// when
+	cont.NodeName = "node02"
+	err := d.SaveContainer(cont)
+	staleErr := d.SaveContainer(&model.Container{Name: "web-1", DefinitionName: "web", NodeName: "node03", ResourceVersion: stale})
+
+	// then
+	if err != nil {
+		t.Errorf("save with the stored version should succeed: %s", err)
+	}
+	if _, ok := staleErr.(*ConflictError); !ok {
+		t.Errorf("save with a stale version should conflict, got %v", staleErr)
+	}
+	if len(d.ListContainersByNode("node03")) != 0 || len(d.ListContainersByNode("node02")) != 1 {
+		t.Error("stale save should not touch the container or its indexes")
+	}
+}
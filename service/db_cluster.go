@@ -0,0 +1,440 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/libgolang/log"
+	"github.com/libgolang/one/model"
+)
+
+// cluster entry operations
+const (
+	opDefinition       = "definition"
+	opContainer        = "container"
+	opNode             = "node"
+	opNetwork          = "network"
+	opRegistry         = "registry"
+	opDeleteContainer  = "deleteContainer"
+	opDeleteDefinition = "deleteDefinition"
+	opVars             = "vars" // replaces every variable
+)
+
+// clusterEntry writes of a transaction of the leader
+type clusterEntry struct {
+	Term  uint64      `json:"term"`
+	Index uint64      `json:"index"`
+	Ops   []clusterOp `json:"ops"`
+}
+
+type clusterOp struct {
+	Op   string          `json:"op"`
+	Name string          `json:"name,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// apply runs the operations of e on d in a single transaction.  Objects
+// are saved unconditionally, their contents yield the same resource
+// version on every member.
+func (e *clusterEntry) apply(d Db) error {
+	var err error
+	if terr := d.Trx(func(d Db) {
+		for _, op := range e.Ops {
+			if err = op.apply(d); err != nil {
+				return
+			}
+		}
+	}); terr != nil {
+		return terr
+	}
+	return err
+}
+
+func (op *clusterOp) apply(d Db) error {
+	switch op.Op {
+	case opDefinition:
+		def := &model.Definition{}
+		if err := json.Unmarshal(op.Data, def); err != nil {
+			return err
+		}
+		def.ResourceVersion = ""
+		return d.SaveDefinition(def)
+	case opContainer:
+		cont := &model.Container{}
+		if err := json.Unmarshal(op.Data, cont); err != nil {
+			return err
+		}
+		cont.ResourceVersion = ""
+		return d.SaveContainer(cont)
+	case opNode:
+		node := &model.Node{}
+		if err := json.Unmarshal(op.Data, node); err != nil {
+			return err
+		}
+		node.ResourceVersion = ""
+		return d.SaveNode(node)
+	case opNetwork:
+		network := &model.Network{}
+		if err := json.Unmarshal(op.Data, network); err != nil {
+			return err
+		}
+		network.ResourceVersion = ""
+		return d.SaveNetwork(network)
+	case opRegistry:
+		registry := &model.Registry{}
+		if err := json.Unmarshal(op.Data, registry); err != nil {
+			return err
+		}
+		registry.ResourceVersion = ""
+		return d.SaveRegistry(registry)
+	case opDeleteContainer:
+		d.DeleteContainer(op.Name)
+		return nil
+	case opDeleteDefinition:
+		d.DeleteDefinition(op.Name)
+		return nil
+	case opVars:
+		values := make(map[string]string)
+		if err := json.Unmarshal(op.Data, &values); err != nil {
+			return err
+		}
+		d.GetVars(func(m map[string]string) {
+			for k := range m {
+				delete(m, k)
+			}
+			for k, v := range values {
+				m[k] = v
+			}
+		})
+		return nil
+	}
+	return fmt.Errorf("unknown operation %s", op.Op)
+}
+
+// recordingDb Db keeping the writes made to the wrapped Db as cluster
+// operations, and the objects they replaced so they can be undone
+type recordingDb struct {
+	Db
+	ops    []clusterOp
+	priors []clusterPrior
+	conts  map[string]*model.Container // as the transaction started, read on the first container write
+}
+
+// clusterPrior object as it was before the first write of a
+// transaction.  op restores it, it is nil when the object did not
+// exist.
+type clusterPrior struct {
+	kind string
+	name string
+	op   *clusterOp
+}
+
+func newClusterOp(op, name string, obj interface{}) clusterOp {
+	var data json.RawMessage
+	if obj != nil {
+		b, err := json.Marshal(obj)
+		if err != nil {
+			panic(err)
+		}
+		data = b
+	}
+	return clusterOp{Op: op, Name: name, Data: data}
+}
+
+func (r *recordingDb) record(op, name string, obj interface{}) {
+	r.ops = append(r.ops, newClusterOp(op, name, obj))
+}
+
+// keep remembers the object kind name read by get before its first
+// write, op being the operation saving it
+func (r *recordingDb) keep(kind, op, name string, get func() (interface{}, error)) {
+	for _, p := range r.priors {
+		if p.kind == kind && p.name == name {
+			return
+		}
+	}
+	prior := clusterPrior{kind: kind, name: name}
+	if obj, err := get(); err == nil {
+		restore := newClusterOp(op, name, obj)
+		prior.op = &restore
+	}
+	r.priors = append(r.priors, prior)
+}
+
+// undo restores in d the objects written through r as they were before
+func (r *recordingDb) undo(d Db) error {
+	for i := len(r.priors) - 1; i >= 0; i-- {
+		p := r.priors[i]
+		var err error
+		switch {
+		case p.op != nil:
+			err = p.op.apply(d)
+		case p.kind == kindContainer:
+			d.DeleteContainer(p.name)
+		default:
+			deleter, ok := d.(objectDeleter)
+			if !ok {
+				return fmt.Errorf("unable to delete %s %s", p.kind, p.name)
+			}
+			err = deleter.deleteObject(p.kind, p.name)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to restore %s %s: %s", p.kind, p.name, err)
+		}
+	}
+	return nil
+}
+
+func (r *recordingDb) Trx(f func(d Db)) error {
+	f(r)
+	return nil
+}
+
+func (r *recordingDb) SaveDefinition(def *model.Definition) error {
+	r.keep(kindDefinition, opDefinition, def.Name, func() (interface{}, error) { return r.Db.GetDefinition(def.Name) })
+	if err := r.Db.SaveDefinition(def); err != nil {
+		return err
+	}
+	r.record(opDefinition, def.Name, def)
+	return nil
+}
+
+func (r *recordingDb) SaveContainer(cont *model.Container) error {
+	r.keep(kindContainer, opContainer, cont.Name, func() (interface{}, error) { return r.getContainer(cont.Name) })
+	if err := r.Db.SaveContainer(cont); err != nil {
+		return err
+	}
+	r.record(opContainer, cont.Name, cont)
+	return nil
+}
+
+func (r *recordingDb) SaveNode(node *model.Node) error {
+	r.keep(kindNode, opNode, node.Name, func() (interface{}, error) { return r.Db.GetNode(node.Name) })
+	if err := r.Db.SaveNode(node); err != nil {
+		return err
+	}
+	r.record(opNode, node.Name, node)
+	return nil
+}
+
+func (r *recordingDb) SaveNetwork(network *model.Network) error {
+	r.keep(kindNetwork, opNetwork, network.Name, func() (interface{}, error) { return r.Db.GetNetwork(network.Name) })
+	if err := r.Db.SaveNetwork(network); err != nil {
+		return err
+	}
+	r.record(opNetwork, network.Name, network)
+	return nil
+}
+
+func (r *recordingDb) SaveRegistry(registry *model.Registry) error {
+	r.keep(kindRegistry, opRegistry, registry.Name, func() (interface{}, error) { return r.Db.GetRegistry(registry.Name) })
+	if err := r.Db.SaveRegistry(registry); err != nil {
+		return err
+	}
+	r.record(opRegistry, registry.Name, registry)
+	return nil
+}
+
+func (r *recordingDb) DeleteDefinition(name string) {
+	r.keep(kindDefinition, opDefinition, name, func() (interface{}, error) { return r.Db.GetDefinition(name) })
+	r.Db.DeleteDefinition(name)
+	r.record(opDeleteDefinition, name, nil)
+}
+
+func (r *recordingDb) DeleteContainer(name string) {
+	r.keep(kindContainer, opContainer, name, func() (interface{}, error) { return r.getContainer(name) })
+	r.Db.DeleteContainer(name)
+	r.record(opDeleteContainer, name, nil)
+}
+
+func (r *recordingDb) GetVars(cb func(map[string]string)) map[string]string {
+	changed := false
+	before := make(map[string]string)
+	values := r.Db.GetVars(func(m map[string]string) {
+		for k, v := range m {
+			before[k] = v
+		}
+		cb(m)
+		changed = !reflect.DeepEqual(before, m)
+	})
+	if changed {
+		r.keep(kindVars, opVars, "", func() (interface{}, error) { return before, nil })
+		r.record(opVars, "", values)
+	}
+	return values
+}
+
+// getContainer returns the container name as the transaction started,
+// the Db has no lookup by name.  It is only asked before the first write
+// of each container.
+func (r *recordingDb) getContainer(name string) (*model.Container, error) {
+	if r.conts == nil {
+		r.conts = r.Db.ListContainers()
+	}
+	cont, ok := r.conts[name]
+	if !ok {
+		return nil, fmt.Errorf("Container %s not found", name)
+	}
+	return cont, nil
+}
+
+func (r *recordingDb) NextAutoIncrement(ns, name string) int {
+	return nextAutoIncrement(r, ns, name)
+}
+
+// clusterDb Db replicated by a cluster.  Reads are answered by the
+// local Db, writes fail unless this master is the leader.
+type clusterDb struct {
+	c *cluster
+}
+
+func (d *clusterDb) read(f func(local Db)) {
+	d.c.dataMu.Lock()
+	defer d.c.dataMu.Unlock()
+	f(d.c.local)
+}
+
+func (d *clusterDb) Close() {
+	d.c.local.Close()
+}
+
+// Trx runs f on the leader and replicates its writes as one entry.  It
+// fails on followers and when the entry misses a majority.
+func (d *clusterDb) Trx(f func(d Db)) error {
+	return d.c.commit(f)
+}
+
+func (d *clusterDb) ListDefinitions() (list map[string]*model.Definition) {
+	d.read(func(local Db) { list = local.ListDefinitions() })
+	return
+}
+
+func (d *clusterDb) ListContainers() (list map[string]*model.Container) {
+	d.read(func(local Db) { list = local.ListContainers() })
+	return
+}
+
+func (d *clusterDb) ListContainersByDefinition(defName string) (list map[string]*model.Container) {
+	d.read(func(local Db) { list = local.ListContainersByDefinition(defName) })
+	return
+}
+
+func (d *clusterDb) ListContainersByNode(nodeName string) (list map[string]*model.Container) {
+	d.read(func(local Db) { list = local.ListContainersByNode(nodeName) })
+	return
+}
+
+func (d *clusterDb) ListNodes() (list map[string]*model.Node) {
+	d.read(func(local Db) { list = local.ListNodes() })
+	return
+}
+
+func (d *clusterDb) ListNetworks() (list map[string]*model.Network) {
+	d.read(func(local Db) { list = local.ListNetworks() })
+	return
+}
+
+func (d *clusterDb) GetNetwork(name string) (network *model.Network, err error) {
+	d.read(func(local Db) { network, err = local.GetNetwork(name) })
+	return
+}
+
+func (d *clusterDb) ListRegistries() (list map[string]*model.Registry) {
+	d.read(func(local Db) { list = local.ListRegistries() })
+	return
+}
+
+func (d *clusterDb) GetRegistry(name string) (registry *model.Registry, err error) {
+	d.read(func(local Db) { registry, err = local.GetRegistry(name) })
+	return
+}
+
+func (d *clusterDb) GetNode(name string) (node *model.Node, err error) {
+	d.read(func(local Db) { node, err = local.GetNode(name) })
+	return
+}
+
+func (d *clusterDb) GetDefinition(name string) (def *model.Definition, err error) {
+	d.read(func(local Db) { def, err = local.GetDefinition(name) })
+	return
+}
+
+func (d *clusterDb) SaveNode(node *model.Node) error {
+	var err error
+	if cerr := d.c.commit(func(db Db) { err = db.SaveNode(node) }); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (d *clusterDb) SaveDefinition(def *model.Definition) error {
+	var err error
+	if cerr := d.c.commit(func(db Db) { err = db.SaveDefinition(def) }); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (d *clusterDb) SaveNetwork(network *model.Network) error {
+	var err error
+	if cerr := d.c.commit(func(db Db) { err = db.SaveNetwork(network) }); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (d *clusterDb) SaveRegistry(registry *model.Registry) error {
+	var err error
+	if cerr := d.c.commit(func(db Db) { err = db.SaveRegistry(registry) }); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (d *clusterDb) SaveContainer(cont *model.Container) error {
+	var err error
+	if cerr := d.c.commit(func(db Db) { err = db.SaveContainer(cont) }); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (d *clusterDb) DeleteDefinition(name string) {
+	if err := d.c.commit(func(db Db) { db.DeleteDefinition(name) }); err != nil {
+		log.Error("cluster: unable to delete definition %s: %s", name, err)
+	}
+}
+
+func (d *clusterDb) DeleteContainer(name string) {
+	if err := d.c.commit(func(db Db) { db.DeleteContainer(name) }); err != nil {
+		log.Error("cluster: unable to delete container %s: %s", name, err)
+	}
+}
+
+// GetVars on a follower calls cb with a copy of the variables and
+// discards its changes
+func (d *clusterDb) GetVars(cb func(map[string]string)) map[string]string {
+	var values map[string]string
+	err := d.c.commit(func(db Db) { values = db.GetVars(cb) })
+	if err == errNotLeader {
+		d.read(func(local Db) { values = local.GetVars(func(map[string]string) {}) })
+		cb(values)
+		return values
+	}
+	if err != nil {
+		log.Error("cluster: unable to replicate vars: %s", err)
+	}
+	return values
+}
+
+// NextAutoIncrement returns 0 when the increment is not committed, use
+// it in a Trx to learn why
+func (d *clusterDb) NextAutoIncrement(ns, name string) int {
+	var n int
+	if err := d.c.commit(func(db Db) { n = db.NextAutoIncrement(ns, name) }); err != nil {
+		log.Error("cluster: unable to replicate auto increment %s.%s: %s", ns, name, err)
+		return 0
+	}
+	return n
+}
@@ -1,10 +1,14 @@
 package service
 
 import (
+	"time"
+
 	"github.com/libgolang/log"
 	"github.com/libgolang/one/model"
 )
 
+var metricFrontWait = metrics.histogram("one_db_queue_wait_seconds", "Time transactions wait in the front Db queue before they run.", nil)
+
 type front struct {
 	db   Db
 	jobs chan func(d Db)
@@ -32,9 +36,22 @@ func (f *front) init() {
 	}()
 }
 
-func (f *front) Trx(cb func(d Db)) {
+// Trx runs cb in a transaction of the wrapped Db, queued behind the
+// other calls
+func (f *front) Trx(cb func(d Db)) error {
+	var err error
+	f.run(func(d Db) {
+		err = d.Trx(cb)
+	})
+	return err
+}
+
+// run queues cb and waits for it to be called with the wrapped Db
+func (f *front) run(cb func(d Db)) {
 	done := make(chan int)
+	queued := time.Now()
 	f.jobs <- func(d Db) {
+		metricFrontWait.since(queued)
 		cb(d)
 		done <- 1
 	}
@@ -47,7 +64,7 @@ func (f *front) Close() {
 
 func (f *front) ListNodes() map[string]*model.Node {
 	var list map[string]*model.Node
-	f.Trx(func(d Db) {
+	f.run(func(d Db) {
 		list = d.ListNodes()
 	})
 	return list
@@ -55,7 +72,7 @@ func (f *front) ListNodes() map[string]*model.Node {
 
 func (f *front) ListDefinitions() map[string]*model.Definition {
 	var list map[string]*model.Definition
-	f.Trx(func(d Db) {
+	f.run(func(d Db) {
 		list = d.ListDefinitions()
 	})
 	return list
@@ -63,25 +80,99 @@ func (f *front) ListDefinitions() map[string]*model.Definition {
 
 func (f *front) ListContainers() map[string]*model.Container {
 	var list map[string]*model.Container
-	f.Trx(func(d Db) {
+	f.run(func(d Db) {
 		list = d.ListContainers()
 	})
 	return list
 }
 
+func (f *front) ListContainersByDefinition(defName string) map[string]*model.Container {
+	var list map[string]*model.Container
+	f.run(func(d Db) {
+		list = d.ListContainersByDefinition(defName)
+	})
+	return list
+}
+
+func (f *front) ListContainersByNode(nodeName string) map[string]*model.Container {
+	var list map[string]*model.Container
+	f.run(func(d Db) {
+		list = d.ListContainersByNode(nodeName)
+	})
+	return list
+}
+
 func (f *front) GetDefinition(name string) (*model.Definition, error) {
 	var list *model.Definition
 	var err error
-	f.Trx(func(d Db) {
+	f.run(func(d Db) {
 		list, err = d.GetDefinition(name)
 	})
 	return list, err
 }
 
+func (f *front) SaveDefinition(def *model.Definition) error {
+	var err error
+	f.run(func(d Db) {
+		err = d.SaveDefinition(def)
+	})
+	return err
+}
+
+func (f *front) ListNetworks() map[string]*model.Network {
+	var list map[string]*model.Network
+	f.run(func(d Db) {
+		list = d.ListNetworks()
+	})
+	return list
+}
+
+func (f *front) GetNetwork(name string) (*model.Network, error) {
+	var network *model.Network
+	var err error
+	f.run(func(d Db) {
+		network, err = d.GetNetwork(name)
+	})
+	return network, err
+}
+
+func (f *front) SaveNetwork(network *model.Network) error {
+	var err error
+	f.run(func(d Db) {
+		err = d.SaveNetwork(network)
+	})
+	return err
+}
+
+func (f *front) ListRegistries() map[string]*model.Registry {
+	var list map[string]*model.Registry
+	f.run(func(d Db) {
+		list = d.ListRegistries()
+	})
+	return list
+}
+
+func (f *front) GetRegistry(name string) (*model.Registry, error) {
+	var registry *model.Registry
+	var err error
+	f.run(func(d Db) {
+		registry, err = d.GetRegistry(name)
+	})
+	return registry, err
+}
+
+func (f *front) SaveRegistry(registry *model.Registry) error {
+	var err error
+	f.run(func(d Db) {
+		err = d.SaveRegistry(registry)
+	})
+	return err
+}
+
 func (f *front) GetVars(cb func(map[string]string)) map[string]string {
 	log.Debug("Front GetVars Start")
 	var res map[string]string
-	f.Trx(func(d Db) {
+	f.run(func(d Db) {
 		log.Debug("db GetVars Start")
 		res = d.GetVars(cb)
 		log.Debug("db GetVars Start")
@@ -90,15 +181,21 @@ func (f *front) GetVars(cb func(map[string]string)) map[string]string {
 	return res
 }
 
+func (f *front) DeleteDefinition(name string) {
+	f.run(func(d Db) {
+		d.DeleteDefinition(name)
+	})
+}
+
 func (f *front) DeleteContainer(name string) {
-	f.Trx(func(d Db) {
+	f.run(func(d Db) {
 		d.DeleteContainer(name)
 	})
 }
 
 func (f *front) NextAutoIncrement(ns, name string) int {
 	var res int
-	f.Trx(func(d Db) {
+	f.run(func(d Db) {
 		res = d.NextAutoIncrement(ns, name)
 	})
 	return res
@@ -106,7 +203,7 @@ func (f *front) NextAutoIncrement(ns, name string) int {
 
 func (f *front) SaveContainer(cont *model.Container) error {
 	var err error
-	f.Trx(func(d Db) {
+	f.run(func(d Db) {
 		err = d.SaveContainer(cont)
 	})
 	return err
@@ -115,7 +212,7 @@ func (f *front) SaveContainer(cont *model.Container) error {
 func (f *front) GetNode(name string) (*model.Node, error) {
 	var node *model.Node
 	var err error
-	f.Trx(func(d Db) {
+	f.run(func(d Db) {
 		node, err = d.GetNode(name)
 	})
 	return node, err
@@ -123,7 +220,7 @@ func (f *front) GetNode(name string) (*model.Node, error) {
 
 func (f *front) SaveNode(node *model.Node) error {
 	var err error
-	f.Trx(func(d Db) {
+	f.run(func(d Db) {
 		err = d.SaveNode(node)
 	})
 	return err
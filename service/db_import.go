@@ -0,0 +1,106 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/libgolang/one/model"
+)
+
+// importAbort carries the error that rolls back an import
+type importAbort struct {
+	err error
+}
+
+// dbContent every object of a Db
+type dbContent struct {
+	Definitions map[string]*model.Definition
+	Containers  map[string]*model.Container
+	Nodes       map[string]*model.Node
+	Networks    map[string]*model.Network
+	Registries  map[string]*model.Registry
+	Vars        map[string]string
+}
+
+// readContent reads every object of d.  d must be the Db passed to a
+// transaction for the content to be consistent.
+func readContent(d Db) *dbContent {
+	return &dbContent{
+		Definitions: d.ListDefinitions(),
+		Containers:  d.ListContainers(),
+		Nodes:       d.ListNodes(),
+		Networks:    d.ListNetworks(),
+		Registries:  d.ListRegistries(),
+		Vars:        d.GetVars(func(map[string]string) {}),
+	}
+}
+
+// stats counts the objects of c by kind
+func (c *dbContent) stats() map[string]int {
+	return map[string]int{
+		"definitions": len(c.Definitions),
+		"containers":  len(c.Containers),
+		"nodes":       len(c.Nodes),
+		"networks":    len(c.Networks),
+		"registries":  len(c.Registries),
+		"vars":        len(c.Vars),
+	}
+}
+
+// ImportDb copies every definition, container, node, network, registry
+// and variable of from into to in a single transaction of to.  Objects of
+// to with the same names are replaced regardless of their resource
+// version.  to must not be a front Db since a failed import is rolled
+// back by panicking inside the transaction.
+func ImportDb(from, to Db) (stats map[string]int, err error) {
+	content := readContent(from)
+	if err = importContent(content, to); err != nil {
+		return nil, err
+	}
+	return content.stats(), nil
+}
+
+// importContent saves content into to in a single transaction, see
+// ImportDb
+func importContent(content *dbContent, to Db) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			abort, ok := r.(importAbort)
+			if !ok {
+				panic(r)
+			}
+			err = abort.err
+		}
+	}()
+	return to.Trx(func(d Db) {
+		check := func(kind, name string, err error) {
+			if err != nil {
+				panic(importAbort{fmt.Errorf("unable to import %s %s: %s", kind, name, err)})
+			}
+		}
+		for name, def := range content.Definitions {
+			def.ResourceVersion = ""
+			check("definition", name, d.SaveDefinition(def))
+		}
+		for name, cont := range content.Containers {
+			cont.ResourceVersion = ""
+			check("container", name, d.SaveContainer(cont))
+		}
+		for name, node := range content.Nodes {
+			node.ResourceVersion = ""
+			check("node", name, d.SaveNode(node))
+		}
+		for name, network := range content.Networks {
+			network.ResourceVersion = ""
+			check("network", name, d.SaveNetwork(network))
+		}
+		for name, registry := range content.Registries {
+			registry.ResourceVersion = ""
+			check("registry", name, d.SaveRegistry(registry))
+		}
+		d.GetVars(func(m map[string]string) {
+			for k, v := range content.Vars {
+				m[k] = v
+			}
+		})
+	})
+}
@@ -68,6 +68,46 @@ func TestListContainers(t *testing.T) {
 	}
 }
 
+func TestDeleteContainer(t *testing.T) {
+	// given
+	tmpDir, _ := ioutil.TempDir("", "testing-db")
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	d := NewDb(tmpDir)
+	_ = d.SaveContainer(&model.Container{Name: "web-1", DefinitionName: "web"})
+	_ = d.SaveContainer(&model.Container{Name: "web-2", DefinitionName: "web"})
+
+	// when
+	d.DeleteContainer("web-1")
+
+	// then
+	containers := d.ListContainers()
+	if _, ok := containers["web-1"]; ok || len(containers) != 1 {
+		t.Errorf("web-1 should be deleted, got %v", containers)
+	}
+}
+
+func TestDeleteDefinition(t *testing.T) {
+	// given
+	tmpDir, _ := ioutil.TempDir("", "testing-db")
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	d := NewDb(tmpDir)
+	_ = d.SaveDefinition(&model.Definition{Name: "web"})
+	_ = d.SaveDefinition(&model.Definition{Name: "db"})
+
+	// when
+	d.DeleteDefinition("web")
+	d.DeleteDefinition("missing")
+
+	// then
+	if defs := d.ListDefinitions(); defs["web"] != nil || len(defs) != 1 {
+		t.Errorf("web should be deleted, got %v", defs)
+	}
+}
+
 func TestListNodes(t *testing.T) {
 	// given
 	tmpDir, _ := ioutil.TempDir("", "testing-db")
@@ -92,3 +132,37 @@ func TestListNodes(t *testing.T) {
 		t.Error("Should have one node")
 	}
 }
+
+func TestSaveDefinitionResourceVersion(t *testing.T) {
+	// given
+	tmpDir, _ := ioutil.TempDir("", "testing-db")
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	d := NewDb(tmpDir)
+	def := &model.Definition{Name: "web", Image: "nginx"}
+	_ = d.SaveDefinition(def)
+	stale := def.ResourceVersion
+
+	// when
+	def.Image = "nginx:1.15"
+	err := d.SaveDefinition(def)
+	staleErr := d.SaveDefinition(&model.Definition{Name: "web", Image: "httpd", ResourceVersion: stale})
+
+	// then
+	if err != nil {
+		t.Errorf("save with the stored version should succeed: %s", err)
+	}
+	if def.ResourceVersion == "" || def.ResourceVersion == stale {
+		t.Error("save should set a new resource version")
+	}
+	if _, ok := staleErr.(*ConflictError); !ok {
+		t.Errorf("save with a stale version should conflict, got %v", staleErr)
+	}
+	if stored, _ := d.GetDefinition("web"); stored.Image != "nginx:1.15" || stored.ResourceVersion != def.ResourceVersion {
+		t.Errorf("stale save should not be stored: %v", stored)
+	}
+	if err := d.SaveDefinition(&model.Definition{Name: "db", ResourceVersion: stale}); err == nil {
+		t.Error("save of a missing object with a version should conflict")
+	}
+}
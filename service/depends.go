@@ -0,0 +1,208 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/libgolang/log"
+	"github.com/libgolang/one/model"
+)
+
+// validateDependencies checks the names and conditions of the
+// dependencies of def
+func validateDependencies(def *model.Definition) error {
+	seen := make(map[string]bool)
+	for _, dep := range def.DependsOn {
+		if dep.Name == "" {
+			return fmt.Errorf("dependsOn requires the name of a definition")
+		}
+		if dep.Name == def.Name {
+			return fmt.Errorf("definition %s cannot depend on itself", def.Name)
+		}
+		if seen[dep.Name] {
+			return fmt.Errorf("dependency %s is listed twice", dep.Name)
+		}
+		seen[dep.Name] = true
+		switch dep.DependencyCondition() {
+		case model.DependencyStarted, model.DependencyHealthy, model.DependencyCompleted:
+		default:
+			return fmt.Errorf("unknown condition %q of dependency %s, use %s, %s or %s", dep.Condition, dep.Name, model.DependencyStarted, model.DependencyHealthy, model.DependencyCompleted)
+		}
+	}
+	return nil
+}
+
+// dependencyCycle returns the names along a cycle of dependencies of the
+// definitions of defMap, first and last being the same, or nil when
+// there is none.  Dependencies on missing definitions are ignored.
+func dependencyCycle(defMap map[string]*model.Definition) []string {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int)
+	path := make([]string, 0)
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		switch state[name] {
+		case done:
+			return nil
+		case visiting:
+			for i, n := range path {
+				if n == name {
+					return append(append([]string{}, path[i:]...), name)
+				}
+			}
+		}
+		def, ok := defMap[name]
+		if !ok {
+			return nil
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for _, dep := range def.DependsOn {
+			if cycle := visit(dep.Name); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = done
+		return nil
+	}
+
+	// sorted so the same cycle is always reported
+	names := make([]string, 0, len(defMap))
+	for name := range defMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if cycle := visit(name); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// dependencyCycleError returns an error naming the cycle def would close
+// among the stored definitions, nil when there is none
+func dependencyCycleError(def *model.Definition, stored map[string]*model.Definition) error {
+	defMap := make(map[string]*model.Definition, len(stored)+1)
+	for name, d := range stored {
+		defMap[name] = d
+	}
+	defMap[def.Name] = def
+	if cycle := dependencyCycle(defMap); cycle != nil {
+		return fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+	}
+	return nil
+}
+
+// dependencyWaiting returns why the containers of def cannot be created
+// yet, empty when every dependency meets its condition.  defContMapList
+// holds the containers desired running by definition.
+func dependencyWaiting(def *model.Definition, defMap map[string]*model.Definition, defContMapList map[string][]*model.Container) string {
+	for _, dep := range def.DependsOn {
+		other, ok := defMap[dep.Name]
+		if !ok {
+			return fmt.Sprintf("dependency %s not found", dep.Name)
+		}
+		if !dependencyMet(dep.DependencyCondition(), other, defContMapList[dep.Name]) {
+			return fmt.Sprintf("waiting for %s to be %s", dep.Name, dep.DependencyCondition())
+		}
+	}
+	return ""
+}
+
+// dependencyMet returns whether the definition other with the containers
+// conts meets condition
+func dependencyMet(condition string, other *model.Definition, conts []*model.Container) bool {
+	if condition == model.DependencyCompleted {
+		if other.Status == nil {
+			return false
+		}
+		for _, job := range other.Status.Jobs {
+			if job.State == model.JobComplete {
+				return true
+			}
+		}
+		return false
+	}
+	for _, cont := range conts {
+		if cont.State != model.ContainerRunning {
+			continue
+		}
+		if condition == model.DependencyStarted || cont.Health == "" || cont.Health == "healthy" {
+			return true
+		}
+	}
+	return false
+}
+
+// dependentsRemaining returns the names of the definitions depending on
+// def that still have containers, in any state.  The containers of def
+// are removed after theirs.
+func dependentsRemaining(def *model.Definition, defMap map[string]*model.Definition, contMap map[string]*model.Container) []string {
+	dependents := make(map[string]bool)
+	for _, other := range defMap {
+		for _, dep := range other.DependsOn {
+			if dep.Name == def.Name {
+				dependents[other.Name] = true
+			}
+		}
+	}
+	remaining := make(map[string]bool)
+	for _, cont := range contMap {
+		if dependents[cont.DefinitionName] {
+			remaining[cont.DefinitionName] = true
+		}
+	}
+	names := make([]string, 0, len(remaining))
+	for name := range remaining {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tearingDown returns whether def keeps none of its containers, global
+// definitions when no node of nodeMap is eligible and the others when
+// scaled to zero
+func tearingDown(def *model.Definition, nodeMap map[string]*model.Node) bool {
+	if def.WorkloadMode() == model.ModeGlobal {
+		return len(eligibleNodes(def, nodeMap)) == 0
+	}
+	return def.Count == 0
+}
+
+// setWaiting records why the containers of def are held back, empty
+// when they are not.  It returns whether the status of def changed.
+func setWaiting(def *model.Definition, waiting string) bool {
+	current := ""
+	if def.Status != nil {
+		current = def.Status.Waiting
+	}
+	if current == waiting {
+		return false
+	}
+	if def.Status == nil {
+		def.Status = &model.DefinitionStatus{}
+	}
+	def.Status.Waiting = waiting
+	if waiting != "" {
+		log.Info("Definition %s is %s", def.Name, waiting)
+	}
+	return true
+}
+
+// definitionDeleting returns whether def is marked for removal
+func definitionDeleting(def *model.Definition) bool {
+	return def.Status != nil && def.Status.Deleting
+}
+
+// definitionWaiting returns whether the containers of def are held back
+// by its dependencies
+func definitionWaiting(def *model.Definition) bool {
+	return def.Status != nil && def.Status.Waiting != ""
+}
@@ -1,17 +1,24 @@
 package service
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/libgolang/log"
 	"github.com/libgolang/one/model"
+	"github.com/libgolang/one/utils"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/network"
+	volumetypes "github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
 	"golang.org/x/net/context"
@@ -22,6 +29,15 @@ const (
 	initID   = 0
 )
 
+// labels of the docker containers of sidecars, see model.Sidecar
+const (
+	labelSidecars = "one.sidecars" // names of the sidecars of a main container, comma separated
+	labelGroup    = "one.group"    // name of the main container of a sidecar
+	labelSidecar  = "one.sidecar"  // name of the sidecar in its definition
+)
+
+var metricImagePull = metrics.histogram("one_node_image_pull_duration_seconds", "Time to pull container images.", []float64{.5, 1, 5, 10, 30, 60, 120, 300, 600})
+
 // Docker interface
 type Docker interface {
 	ContainerList() []model.Container
@@ -30,12 +46,27 @@ type Docker interface {
 	ContainerExists(defName string) bool
 	ContainerRemove(defName string)
 	ContainerRemoveByName(defName string)
+	// ContainerRemoveListed kills and removes a container returned by
+	// ContainerList, without listing the containers again
+	ContainerRemoveListed(cont *model.Container)
 	ContainerGetByDefName(defName string) *model.Container
 	ContainerGetByName(name string) *model.Container
 	ContainerRunByDefinition(def *model.Definition) *model.Container
-	ContainerRun(def *model.Container)
+	ContainerRun(cont *model.Container) error
+	// ContainerStats samples the resource usage of a running container
+	ContainerStats(cont *model.Container) (*model.ContainerStats, error)
 	ContainerStopByDefName(defName string)
 	ContainerRemoveByDefName(defName string)
+	// NetworkEnsure creates the docker network of network unless it exists
+	NetworkEnsure(network model.Network) error
+	// NetworkPrune removes the managed networks not in keep, those still
+	// joined by a container are removed on a later call
+	NetworkPrune(keep map[string]bool)
+	// VolumeList returns the docker volumes of the node
+	VolumeList() []model.VolumeInfo
+	// SetRegistryAuths replaces the registry credentials sent by the
+	// master, used before those of the docker config of the node
+	SetRegistryAuths(auths []model.RegistryAuth)
 }
 
 type docker struct {
@@ -43,6 +74,7 @@ type docker struct {
 	ctx    context.Context
 	cli    *client.Client
 	db     Db
+	auths  map[string]model.RegistryAuth // by registry host
 }
 
 // NewDocker Docker constructor host is the ip or host name
@@ -58,7 +90,7 @@ func NewDocker(host /*, apiHost, apiVersion*/ string, db Db) Docker {
 		panic(err)
 	}
 
-	return &docker{host, ctx, cli, db}
+	return &docker{hostIP: host, ctx: ctx, cli: cli, db: db}
 }
 
 func (d *docker) ContainerRemove(name string) {
@@ -69,20 +101,35 @@ func (d *docker) ContainerRemove(name string) {
 	}
 }
 
-// ContainerRemoveByName kill and remove container
+// ContainerRemoveByName kill and remove container, its sidecars first
 func (d *docker) ContainerRemoveByName(name string) {
 	log.Info("ContainerRemove(%s)", name)
-	c := d.ContainerGetByName(name)
-	if c != nil {
-		log.Info("Sending SIGINT to container %s", c.ContainerID)
-		if err := d.cli.ContainerKill(d.ctx, c.ContainerID, "SIGINT"); err != nil {
-			log.Error("Error killing container: %s", err)
-		}
-		log.Info("Removing container %s", c.ContainerID)
-		if err := d.cli.ContainerRemove(d.ctx, c.ContainerID, types.ContainerRemoveOptions{}); err != nil {
-			log.Error("Error Removing container: %s", err)
+	if c := d.ContainerGetByName(name); c != nil {
+		d.ContainerRemoveListed(c)
+	}
+}
+
+// ContainerRemoveListed kill and remove cont, its sidecars first
+func (d *docker) ContainerRemoveListed(cont *model.Container) {
+	for i := len(cont.SidecarStates) - 1; i >= 0; i-- {
+		if id := cont.SidecarStates[i].ContainerID; id != "" {
+			d.killAndRemove(id)
 		}
 	}
+	if cont.ContainerID != "" {
+		d.killAndRemove(cont.ContainerID)
+	}
+}
+
+func (d *docker) killAndRemove(id string) {
+	log.Info("Sending SIGINT to container %s", id)
+	if err := d.cli.ContainerKill(d.ctx, id, "SIGINT"); err != nil {
+		log.Error("Error killing container: %s", err)
+	}
+	log.Info("Removing container %s", id)
+	if err := d.cli.ContainerRemove(d.ctx, id, types.ContainerRemoveOptions{}); err != nil {
+		log.Error("Error Removing container: %s", err)
+	}
 }
 
 // ContainerGetByDefName gets a container or nil if not found
@@ -123,15 +170,161 @@ func (d *docker) ContainerList() []model.Container {
 				Image:          cont.Image,
 				Labels:         cont.Labels,
 				DefinitionName: cont.Labels["one.definitionName"],
+				RestartPolicy:  cont.Labels["one.restartPolicy"],
 				Running:        cont.State == "running",
 			}
+			d.inspectState(&modelContainer)
 			//log.Debug("Found: %s", modelContainer)
 			result = append(result, modelContainer)
 		}
 	}
+	return groupSidecars(result)
+}
+
+// groupSidecars folds the docker containers of sidecars into the states
+// of their main container.  A group runs only when all its containers
+// do.  Sidecars whose main container is gone are reported as a dead
+// group of that name, so the node removes them.
+func groupSidecars(list []model.Container) []model.Container {
+	sidecars := make(map[string]map[string]model.Container)
+	result := make([]model.Container, 0, len(list))
+	for _, cont := range list {
+		group := cont.Labels[labelGroup]
+		if group == "" {
+			result = append(result, cont)
+			continue
+		}
+		if sidecars[group] == nil {
+			sidecars[group] = make(map[string]model.Container)
+		}
+		sidecars[group][cont.Labels[labelSidecar]] = cont
+	}
+	for i := range result {
+		cont := &result[i]
+		for _, name := range strings.Split(cont.Labels[labelSidecars], ",") {
+			if name == "" {
+				continue
+			}
+			sc, ok := sidecars[cont.Name][name]
+			cont.SidecarStates = append(cont.SidecarStates, sidecarState(name, sc))
+			switch {
+			case !cont.Running:
+			case !ok:
+				cont.Running = false
+				cont.Message = fmt.Sprintf("sidecar %s is missing", name)
+			case !sc.Running:
+				cont.Running = false
+				cont.Message = fmt.Sprintf("sidecar %s exited with code %d", name, sc.ExitCode)
+			}
+		}
+		delete(sidecars, cont.Name)
+	}
+	for group, byName := range sidecars {
+		names := make([]string, 0, len(byName))
+		for name := range byName {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		orphan := model.Container{Name: group, Message: "main container is missing"}
+		for _, name := range names {
+			orphan.DefinitionName = byName[name].DefinitionName
+			orphan.SidecarStates = append(orphan.SidecarStates, sidecarState(name, byName[name]))
+		}
+		result = append(result, orphan)
+	}
 	return result
 }
 
+func sidecarState(name string, sc model.Container) model.SidecarState {
+	return model.SidecarState{
+		Name:         name,
+		ContainerID:  sc.ContainerID,
+		Running:      sc.Running,
+		ExitCode:     sc.ExitCode,
+		RestartCount: sc.RestartCount,
+	}
+}
+
+// inspectState fills the observed state docker does not list
+func (d *docker) inspectState(cont *model.Container) {
+	inspect, err := d.cli.ContainerInspect(d.ctx, cont.ContainerID)
+	if err != nil {
+		log.Error("Unable to inspect container %s(%s): %s", cont.Name, cont.ContainerID, err)
+		return
+	}
+	cont.RestartCount = inspect.RestartCount
+	if inspect.State == nil {
+		return
+	}
+	cont.ExitCode = inspect.State.ExitCode
+	if inspect.State.Health != nil && inspect.State.Health.Status != types.NoHealthcheck {
+		cont.Health = inspect.State.Health.Status
+	}
+	if t, err := time.Parse(time.RFC3339Nano, inspect.State.StartedAt); err == nil {
+		cont.StartedAt = t
+	}
+	if t, err := time.Parse(time.RFC3339Nano, inspect.State.FinishedAt); err == nil && !cont.Running {
+		cont.FinishedAt = t
+	}
+}
+
+func (d *docker) ContainerStats(cont *model.Container) (*model.ContainerStats, error) {
+	resp, err := d.cli.ContainerStats(d.ctx, cont.ContainerID, false)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read stats of container %s: %s", cont.Name, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	s := &types.StatsJSON{}
+	if err := json.NewDecoder(resp.Body).Decode(s); err != nil {
+		return nil, fmt.Errorf("unable to decode stats of container %s: %s", cont.Name, err)
+	}
+	return convertStats(s), nil
+}
+
+// convertStats computes the usage the way docker stats shows it: CPU
+// between the two samples of s and memory without the page cache
+func convertStats(s *types.StatsJSON) *model.ContainerStats {
+	stats := &model.ContainerStats{Time: s.Read}
+	cpuDelta := float64(s.CPUStats.CPUUsage.TotalUsage) - float64(s.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(s.CPUStats.SystemUsage) - float64(s.PreCPUStats.SystemUsage)
+	if cpuDelta > 0 && systemDelta > 0 {
+		cpus := float64(len(s.CPUStats.CPUUsage.PercpuUsage))
+		if cpus == 0 {
+			cpus = 1
+		}
+		stats.CPUPercent = cpuDelta / systemDelta * cpus * 100
+	}
+
+	stats.MemoryUsage = s.MemoryStats.Usage
+	cache, ok := s.MemoryStats.Stats["total_inactive_file"] // cgroup v1
+	if !ok {
+		cache = s.MemoryStats.Stats["inactive_file"] // cgroup v2
+	}
+	if cache < stats.MemoryUsage {
+		stats.MemoryUsage -= cache
+	}
+	stats.MemoryLimit = s.MemoryStats.Limit
+	if stats.MemoryLimit > 0 {
+		stats.MemoryPercent = float64(stats.MemoryUsage) / float64(stats.MemoryLimit) * 100
+	}
+
+	for _, n := range s.Networks {
+		stats.NetworkRx += n.RxBytes
+		stats.NetworkTx += n.TxBytes
+	}
+	for _, e := range s.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(e.Op) {
+		case "read":
+			stats.BlockRead += e.Value
+		case "write":
+			stats.BlockWrite += e.Value
+		}
+	}
+	return stats
+}
+
 func (d *docker) IsRunningByDefName(defName string) bool {
 	list := d.ContainerList()
 	for _, cont := range list {
@@ -177,7 +370,9 @@ func (d *docker) ContainerRunByDefinition(def *model.Definition) *model.Containe
 	cont.Name = fmt.Sprintf("%s-%d", def.Name, d.db.NextAutoIncrement("inc.container", def.Name))
 	cont.Running = false
 
-	d.ContainerRun(cont)
+	if err := d.ContainerRun(cont); err != nil {
+		log.Error("%s", err)
+	}
 	return cont
 }
 
@@ -256,7 +451,9 @@ func (d *docker) getNextID() int {
 	return id
 }
 
-func (d *docker) ContainerRun(cont *model.Container) {
+// ContainerRun pulls the image of cont and starts it.  The error
+// explains why the container is not running.
+func (d *docker) ContainerRun(cont *model.Container) error {
 	log.Info("ContainerRun(%s)", cont)
 
 	//
@@ -264,15 +461,19 @@ func (d *docker) ContainerRun(cont *model.Container) {
 	//
 	name := cont.Name
 
-	// labels
-	labels := make(map[string]string)
+	// labels, the user labels cannot take the reserved prefix
+	labels := utils.CopyStringStringMap(cont.Labels)
 	labels["one.definitionName"] = cont.DefinitionName
 	labels["one.managed"] = "true"
-
-	// caps
-	env := make([]string, 0)
-	for k, v := range cont.Env {
-		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	if cont.RestartPolicy != "" {
+		labels["one.restartPolicy"] = cont.RestartPolicy
+	}
+	if len(cont.Sidecars) > 0 {
+		names := make([]string, len(cont.Sidecars))
+		for i, sc := range cont.Sidecars {
+			names[i] = sc.Name
+		}
+		labels[labelSidecars] = strings.Join(names, ",")
 	}
 
 	// porMap : type PortMap map[Port][]PortBinding
@@ -299,50 +500,232 @@ func (d *docker) ContainerRun(cont *model.Container) {
 		portMap[port] = append([]nat.PortBinding{}, nat.PortBinding{HostIP: d.hostIP, HostPort: strconv.Itoa(cont.NodeHTTPPort)})
 	}
 
-	// volumes
-	volumes := make([]string, 0)
-	for hostDir, contDir := range cont.Volumes {
-		hostDir = strings.TrimSpace(hostDir)
-		contDir = strings.TrimSpace(contDir)
-		volumes = append(volumes, fmt.Sprintf("%s:%s", hostDir, contDir))
-	}
-
 	config := &container.Config{}
 	config.Image = cont.Image
-	config.Env = env
+	config.Env = dockerEnv(cont.Env)
 	config.Cmd = cont.Cmd
 	config.Labels = labels
 	hostConfig := &container.HostConfig{}
 	hostConfig.CapAdd = cont.Caps
 	hostConfig.PortBindings = portMap
-	hostConfig.Binds = volumes
-	netConfig := &network.NetworkingConfig{}
+	hostConfig.Binds = dockerBinds(cont.Volumes)
 
-	_, err := d.cli.ImagePull(d.ctx, cont.Image, types.ImagePullOptions{})
+	// named volumes are created with their driver before they are mounted
+	for _, v := range cont.NamedVolumes {
+		if err := d.volumeEnsure(cont, v); err != nil {
+			return err
+		}
+		bind := fmt.Sprintf("%s:%s", v.Name, v.Path)
+		if v.ReadOnly {
+			bind += ":ro"
+		}
+		hostConfig.Binds = append(hostConfig.Binds, bind)
+	}
+
+	id, err := d.pullAndStart(name, config, hostConfig, cont.Networks, []string{cont.DefinitionName})
 	if err != nil {
-		log.Error("Unable to pull image %s: %s", cont.Image, err)
-		return
+		return err
 	}
-	//_, _ = io.Copy(os.Stdout, reader)
 
+	// sidecars join the network and volumes of the main container, the
+	// group is removed when one of them cannot start
+	for _, sc := range cont.Sidecars {
+		if err := d.sidecarRun(cont, sc, id); err != nil {
+			d.ContainerRemoveByName(name)
+			return err
+		}
+	}
+
+	cont.ContainerID = id
+	cont.Running = true
+	return nil
+}
+
+// sidecarRun starts the sidecar sc of cont, whose docker container is
+// mainID
+func (d *docker) sidecarRun(cont *model.Container, sc model.Sidecar, mainID string) error {
+	log.Info("Running sidecar %s of container %s", sc.Name, cont.Name)
+	labels := utils.CopyStringStringMap(cont.Labels)
+	labels["one.definitionName"] = cont.DefinitionName
+	labels["one.managed"] = "true"
+	labels[labelGroup] = cont.Name
+	labels[labelSidecar] = sc.Name
+	if cont.RestartPolicy != "" {
+		labels["one.restartPolicy"] = cont.RestartPolicy
+	}
+
+	config := &container.Config{}
+	config.Image = sc.Image
+	config.Env = dockerEnv(sc.Env)
+	config.Cmd = sc.Cmd
+	config.Labels = labels
+	hostConfig := &container.HostConfig{}
+	hostConfig.CapAdd = sc.Caps
+	hostConfig.Binds = dockerBinds(sc.Volumes)
+	hostConfig.NetworkMode = container.NetworkMode("container:" + mainID)
+	hostConfig.VolumesFrom = []string{mainID}
+
+	_, err := d.pullAndStart(fmt.Sprintf("%s.%s", cont.Name, sc.Name), config, hostConfig, nil, nil)
+	return err
+}
+
+// pullAndStart pulls the image of config, then creates and starts the
+// container name connected to networks with aliases, or to the default
+// bridge when there is none.  It returns the docker id of the running
+// container.
+func (d *docker) pullAndStart(name string, config *container.Config, hostConfig *container.HostConfig, networks, aliases []string) (string, error) {
+	// the pull completes as its progress is read
+	pullStart := time.Now()
+	auth, err := d.registryAuth(config.Image)
+	if err != nil {
+		log.Warn("Pulling image %s without credentials: %s", config.Image, err)
+	}
+	reader, err := d.cli.ImagePull(d.ctx, config.Image, types.ImagePullOptions{RegistryAuth: auth})
+	if err != nil {
+		return "", fmt.Errorf("unable to pull image %s: %s", config.Image, err)
+	}
+	_, err = io.Copy(ioutil.Discard, reader)
+	_ = reader.Close()
+	metricImagePull.since(pullStart)
+	if err != nil {
+		return "", fmt.Errorf("unable to pull image %s: %s", config.Image, err)
+	}
+
+	// docker creates a container with a single network, the others are
+	// connected before it starts
+	netConfig := &network.NetworkingConfig{}
+	if len(networks) > 0 {
+		hostConfig.NetworkMode = container.NetworkMode(networks[0])
+		netConfig.EndpointsConfig = map[string]*network.EndpointSettings{networks[0]: {Aliases: aliases}}
+	}
 	created, err := d.cli.ContainerCreate(d.ctx, config, hostConfig, netConfig, name)
 	if err != nil {
-		log.Error("Unable to create container %s: %s", name, err)
-		return
+		return "", fmt.Errorf("unable to create container %s: %s", name, err)
+	}
+	for i := 1; i < len(networks); i++ {
+		if err := d.cli.NetworkConnect(d.ctx, networks[i], created.ID, &network.EndpointSettings{Aliases: aliases}); err != nil {
+			return "", fmt.Errorf("unable to connect container %s to network %s: %s", name, networks[i], err)
+		}
 	}
 	if err = d.cli.ContainerStart(d.ctx, created.ID, types.ContainerStartOptions{}); err != nil {
-		log.Error("Unable to start container %s: %s", name, err)
-		return
+		return "", fmt.Errorf("unable to start container %s: %s", name, err)
 	}
 
 	if inspect, err := d.cli.ContainerInspect(d.ctx, created.ID); err != nil {
-		log.Error("Unable to inspect container %s(): %s", name, created.ID, err)
-		return
+		return "", fmt.Errorf("unable to inspect container %s(%s): %s", name, created.ID, err)
 	} else if !inspect.State.Running {
-		log.Error("Container %s(%s) not running: %s", name, created.ID, err)
+		return "", fmt.Errorf("container %s(%s) not running, exit code %d", name, created.ID, inspect.State.ExitCode)
+	}
+	return created.ID, nil
+}
+
+// dockerEnv formats env as KEY=value
+func dockerEnv(env map[string]string) []string {
+	result := make([]string, 0, len(env))
+	for k, v := range env {
+		result = append(result, fmt.Sprintf("%s=%s", k, v))
+	}
+	return result
+}
+
+// dockerBinds formats volumes, host dir to container dir, as binds
+func dockerBinds(volumes map[string]string) []string {
+	result := make([]string, 0, len(volumes))
+	for hostDir, contDir := range volumes {
+		hostDir = strings.TrimSpace(hostDir)
+		contDir = strings.TrimSpace(contDir)
+		result = append(result, fmt.Sprintf("%s:%s", hostDir, contDir))
+	}
+	return result
+}
+
+// NetworkEnsure creates network unless a docker network of that name
+// exists.  Networks created are labeled as managed so NetworkPrune can
+// remove them.
+func (d *docker) NetworkEnsure(net model.Network) error {
+	list, err := d.cli.NetworkList(d.ctx, types.NetworkListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list networks: %s", err)
+	}
+	for _, existing := range list {
+		if existing.Name == net.Name {
+			return nil
+		}
+	}
+	labels := utils.CopyStringStringMap(net.Labels)
+	labels["one.managed"] = "true"
+	options := types.NetworkCreate{
+		CheckDuplicate: true,
+		Driver:         net.Driver,
+		Internal:       net.Internal,
+		Labels:         labels,
+	}
+	if net.Subnet != "" {
+		options.IPAM = &network.IPAM{Config: []network.IPAMConfig{{Subnet: net.Subnet}}}
+	}
+	log.Info("Creating network %s", net.Name)
+	if _, err := d.cli.NetworkCreate(d.ctx, net.Name, options); err != nil {
+		return fmt.Errorf("unable to create network %s: %s", net.Name, err)
+	}
+	return nil
+}
+
+func (d *docker) NetworkPrune(keep map[string]bool) {
+	args := filters.NewArgs()
+	args.Add("label", "one.managed=true")
+	list, err := d.cli.NetworkList(d.ctx, types.NetworkListOptions{Filters: args})
+	if err != nil {
+		log.Error("Unable to list networks: %s", err)
 		return
 	}
+	for _, net := range list {
+		if keep[net.Name] {
+			continue
+		}
+		log.Info("Removing network %s", net.Name)
+		if err := d.cli.NetworkRemove(d.ctx, net.ID); err != nil {
+			log.Warn("Unable to remove network %s, retrying later: %s", net.Name, err)
+		}
+	}
+}
 
-	cont.ContainerID = created.ID
-	cont.Running = true
+// volumeEnsure creates the named volume v of cont, docker keeps an
+// existing volume of the same name and driver as it is
+func (d *docker) volumeEnsure(cont *model.Container, v model.NamedVolume) error {
+	driver := v.Driver
+	if driver == "" {
+		driver = "local"
+	}
+	body := volumetypes.VolumesCreateBody{
+		Name:       v.Name,
+		Driver:     driver,
+		DriverOpts: v.Options,
+		Labels: map[string]string{
+			"one.managed":        "true",
+			"one.definitionName": cont.DefinitionName,
+			"one.index":          strconv.Itoa(cont.Index),
+		},
+	}
+	if _, err := d.cli.VolumeCreate(d.ctx, body); err != nil {
+		return fmt.Errorf("unable to create volume %s: %s", v.Name, err)
+	}
+	return nil
+}
+
+func (d *docker) VolumeList() []model.VolumeInfo {
+	result := make([]model.VolumeInfo, 0)
+	list, err := d.cli.VolumeList(d.ctx, filters.NewArgs())
+	if err != nil {
+		log.Error("Error listing volumes from docker daemon: %s", err)
+		return result
+	}
+	for _, v := range list.Volumes {
+		info := model.VolumeInfo{Name: v.Name, Driver: v.Driver, Scope: v.Scope}
+		if _, ok := v.Labels["one.managed"]; ok {
+			info.DefinitionName = v.Labels["one.definitionName"]
+			info.Index, _ = strconv.Atoi(v.Labels["one.index"])
+		}
+		result = append(result, info)
+	}
+	return result
 }
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/libgolang/one/model"
+)
+
+// dockerHubServer key of Docker Hub in the docker config and its
+// credential helpers
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// dockerConfig credentials of the config.json of the docker cli
+type dockerConfig struct {
+	Auths       map[string]dockerConfigAuth `json:"auths"`
+	CredsStore  string                      `json:"credsStore"`  // credential helper of every registry
+	CredHelpers map[string]string           `json:"credHelpers"` // credential helper by registry host
+}
+
+type dockerConfigAuth struct {
+	Auth          string `json:"auth"` // base64 of username:password
+	IdentityToken string `json:"identitytoken"`
+}
+
+func (d *docker) SetRegistryAuths(auths []model.RegistryAuth) {
+	d.auths = make(map[string]model.RegistryAuth, len(auths))
+	for _, auth := range auths {
+		d.auths[auth.Host] = auth
+	}
+}
+
+// registryAuth returns the credentials to pull image with, encoded as
+// docker expects them, empty when there are none.  The credentials sent
+// by the master come first, then those of the docker config of the node.
+func (d *docker) registryAuth(image string) (string, error) {
+	host := imageHost(image)
+	if auth, ok := d.auths[host]; ok {
+		return encodeRegistryAuth(types.AuthConfig{Username: auth.Username, Password: auth.Password, ServerAddress: host})
+	}
+	auth, ok, err := dockerConfigCredentials(dockerConfigPath(), host)
+	if err != nil || !ok {
+		return "", err
+	}
+	return encodeRegistryAuth(auth)
+}
+
+func encodeRegistryAuth(auth types.AuthConfig) (string, error) {
+	b, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+// dockerConfigPath returns the config.json of the docker cli of the
+// node, in $DOCKER_CONFIG or ~/.docker
+func dockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".docker", "config.json")
+}
+
+// dockerConfigCredentials returns the credentials of the registry host
+// in the docker config file, asking its credential helper for them when
+// it has one.  It returns false when there are none.
+func dockerConfigCredentials(file, host string) (types.AuthConfig, bool, error) {
+	none := types.AuthConfig{}
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return none, false, nil
+	}
+	if err != nil {
+		return none, false, err
+	}
+	cfg := &dockerConfig{}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return none, false, fmt.Errorf("invalid %s: %s", file, err)
+	}
+
+	server := host
+	if host == dockerHubHost {
+		server = dockerHubServer
+	}
+	helper := cfg.CredHelpers[host]
+	if helper == "" {
+		helper = cfg.CredsStore
+	}
+	if helper != "" {
+		return credentialHelper(helper, server)
+	}
+
+	for _, key := range []string{server, host, "https://" + host, "http://" + host} {
+		entry, ok := cfg.Auths[key]
+		if !ok {
+			continue
+		}
+		auth := types.AuthConfig{ServerAddress: server, IdentityToken: entry.IdentityToken}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return none, false, fmt.Errorf("invalid auth of %s in %s: %s", key, file, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return none, false, fmt.Errorf("invalid auth of %s in %s: expected username:password", key, file)
+			}
+			auth.Username, auth.Password = parts[0], parts[1]
+		}
+		return auth, true, nil
+	}
+	return none, false, nil
+}
+
+// credentialHelper asks the docker credential helper named helper for
+// the credentials of server.  Servers unknown to the helper have none.
+func credentialHelper(helper, server string) (types.AuthConfig, bool, error) {
+	none := types.AuthConfig{}
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	out, err := cmd.Output()
+	if err != nil {
+		if strings.Contains(string(out), "credentials not found") {
+			return none, false, nil
+		}
+		return none, false, fmt.Errorf("credential helper %s failed: %s", helper, err)
+	}
+	creds := struct {
+		Username string
+		Secret   string
+	}{}
+	if err := json.Unmarshal(out, &creds); err != nil {
+		return none, false, fmt.Errorf("invalid output of credential helper %s: %s", helper, err)
+	}
+	auth := types.AuthConfig{ServerAddress: server}
+	if creds.Username == "<token>" {
+		auth.IdentityToken = creds.Secret
+	} else {
+		auth.Username, auth.Password = creds.Username, creds.Secret
+	}
+	return auth, true, nil
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/libgolang/one/model"
+)
+
+func TestGroupSidecars(t *testing.T) {
+	// given
+	main := func(name string, running bool, sidecars string) model.Container {
+		return model.Container{Name: name, DefinitionName: "web", ContainerID: name, Running: running, Labels: map[string]string{labelSidecars: sidecars}}
+	}
+	sidecar := func(group, name string, running bool, exitCode int) model.Container {
+		return model.Container{Name: group + "." + name, DefinitionName: "web", ContainerID: group + "." + name, Running: running, ExitCode: exitCode,
+			Labels: map[string]string{labelGroup: group, labelSidecar: name}}
+	}
+	list := []model.Container{
+		main("web-1", true, "cache,tls"),
+		sidecar("web-1", "tls", true, 0),
+		sidecar("web-1", "cache", true, 0),
+		main("web-2", true, "cache,tls"),
+		sidecar("web-2", "cache", false, 137),
+		main("web-3", true, "cache"),
+		sidecar("web-4", "cache", true, 0),
+		main("db-1", true, ""),
+	}
+
+	// when
+	groups := make(map[string]model.Container)
+	for _, cont := range groupSidecars(list) {
+		groups[cont.Name] = cont
+	}
+
+	// then
+	if len(groups) != 5 {
+		t.Fatalf("sidecars should be folded into their groups, got %v", groups)
+	}
+	if g := groups["web-1"]; !g.Running || len(g.SidecarStates) != 2 || g.SidecarStates[0].Name != "cache" || g.SidecarStates[1].ContainerID != "web-1.tls" {
+		t.Errorf("web-1 should run with its sidecars in order, got %+v", g)
+	}
+	if g := groups["web-2"]; g.Running || g.Message != "sidecar cache exited with code 137" || g.SidecarStates[1].ContainerID != "" {
+		t.Errorf("web-2 should be dead with an exited and a missing sidecar, got %+v", g)
+	}
+	if g := groups["web-3"]; g.Running || g.Message != "sidecar cache is missing" {
+		t.Errorf("web-3 should be dead without its sidecar, got %+v", g)
+	}
+	if g := groups["web-4"]; g.Running || g.ContainerID != "" || len(g.SidecarStates) != 1 || g.SidecarStates[0].ContainerID != "web-4.cache" {
+		t.Errorf("sidecars of a missing container should be a dead group, got %+v", g)
+	}
+	if g := groups["db-1"]; !g.Running || len(g.SidecarStates) != 0 {
+		t.Errorf("containers without sidecars should be unchanged, got %+v", g)
+	}
+}
+
+func TestDockerConfigCredentials(t *testing.T) {
+	// given
+	tmpDir, _ := ioutil.TempDir("", "testing-docker")
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	file := path.Join(tmpDir, "config.json")
+	_ = ioutil.WriteFile(file, []byte(`{"auths":{"https://index.docker.io/v1/":{"auth":"aHViOnNlY3JldA=="},"registry.example.com":{"identitytoken":"tok"}}}`), 0600)
+
+	// when
+	hub, hubOk, hubErr := dockerConfigCredentials(file, imageHost("library/nginx:1.25"))
+	private, privateOk, _ := dockerConfigCredentials(file, imageHost("registry.example.com/team/app"))
+	_, otherOk, _ := dockerConfigCredentials(file, imageHost("localhost:5000/app"))
+	_, missingOk, missingErr := dockerConfigCredentials(path.Join(tmpDir, "missing.json"), dockerHubHost)
+
+	// then
+	if hubErr != nil || !hubOk || hub.Username != "hub" || hub.Password != "secret" || hub.ServerAddress != dockerHubServer {
+		t.Errorf("Docker Hub credentials should be read, got %+v %v", hub, hubErr)
+	}
+	if !privateOk || private.IdentityToken != "tok" {
+		t.Errorf("identity token of registry.example.com should be read, got %+v", private)
+	}
+	if otherOk || missingOk || missingErr != nil {
+		t.Errorf("registries without credentials should have none, got %v %v %v", otherOk, missingOk, missingErr)
+	}
+}
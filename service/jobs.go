@@ -0,0 +1,337 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/libgolang/log"
+	"github.com/libgolang/one/model"
+	"github.com/libgolang/one/utils"
+)
+
+// jobRunsLimit finished containers kept in the results of a job
+const jobRunsLimit = 50
+
+// cronCatchUpLimit schedules skipped at most when a cron job missed
+// several, only the latest missed one is run
+const cronCatchUpLimit = 10000
+
+// validateJobSpecs checks the job and cron job specs of def
+func validateJobSpecs(def *model.Definition) error {
+	if job := def.Job; job != nil {
+		if job.Completions < 0 || job.Parallelism < 0 || job.BackoffLimit < 0 || job.ActiveDeadlineSeconds < 0 {
+			return fmt.Errorf("job completions, parallelism, backoffLimit and activeDeadlineSeconds cannot be negative")
+		}
+	}
+	if def.WorkloadMode() != model.ModeCronJob {
+		return nil
+	}
+	if def.CronJob == nil {
+		return fmt.Errorf("cronJob is required by the cronjob mode")
+	}
+	if _, err := utils.ParseCron(def.CronJob.Schedule); err != nil {
+		return err
+	}
+	switch def.CronJobSpec().ConcurrencyPolicy {
+	case model.ConcurrencyAllow, model.ConcurrencyForbid, model.ConcurrencyReplace:
+	default:
+		return fmt.Errorf("unknown concurrencyPolicy %q, use %s, %s or %s", def.CronJob.ConcurrencyPolicy, model.ConcurrencyAllow, model.ConcurrencyForbid, model.ConcurrencyReplace)
+	}
+	return nil
+}
+
+// allocateJobs starts the runs of the job and cron job definitions and
+// their containers, records the results of the finished containers and
+// removes them.  defContMapList holds the containers desired running by
+// definition.  Definitions waiting for their dependencies start no
+// container.
+func (m *masterService) allocateJobs(defMap map[string]*model.Definition, defContMapList map[string][]*model.Container, nodeMap map[string]*model.Node, nodeContMap map[string][]*model.Container, now time.Time) {
+	for name, def := range defMap {
+		mode := def.WorkloadMode()
+		if mode != model.ModeJob && mode != model.ModeCronJob || definitionDeleting(def) {
+			continue
+		}
+		if def.Status == nil {
+			def.Status = &model.DefinitionStatus{}
+		}
+		changed := false
+		waiting := definitionWaiting(def)
+		if mode == model.ModeJob && len(def.Status.Jobs) == 0 && !waiting {
+			def.Status.Jobs = append(def.Status.Jobs, &model.Job{Name: def.Name, DefinitionName: def.Name, State: model.JobActive, StartedAt: now})
+			changed = true
+		}
+		if mode == model.ModeCronJob {
+			changed = scheduleCronJob(def, now) || changed
+		}
+
+		// containers by run, those of forgotten runs are removed
+		jobConts := make(map[string][]*model.Container)
+		terminate := make([]*model.Container, 0)
+		for _, cont := range defContMapList[name] {
+			jobConts[cont.JobName] = append(jobConts[cont.JobName], cont)
+		}
+		create := make(map[string]int)
+		spec := def.JobSpec()
+		if waiting {
+			// runs keep their containers but start no new one
+			spec.Parallelism = 0
+		}
+		for _, job := range def.Status.Jobs {
+			finished, toCreate, jobChanged := reconcileJob(spec, job, jobConts[job.Name], now)
+			terminate = append(terminate, finished...)
+			create[job.Name] = toCreate
+			changed = changed || jobChanged
+			delete(jobConts, job.Name)
+		}
+		for _, conts := range jobConts {
+			terminate = append(terminate, conts...)
+		}
+
+		// the results are saved before the containers are removed
+		if changed {
+			if err := m.db.SaveDefinition(def); err != nil {
+				log.Error("Error saving status of job %s: %s", def.Name, err)
+				continue
+			}
+		}
+		for _, cont := range terminate {
+			m.terminateContainer(cont)
+		}
+		eligible := eligibleNodes(def, nodeMap)
+		for _, job := range def.Status.Jobs {
+			for i := 0; i < create[job.Name]; i++ {
+				m.createContainer(def, job.Name, nodeContMap, eligible)
+			}
+		}
+	}
+}
+
+// reconcileJob records the results of the finished containers of job,
+// moves it to Complete or Failed and computes the containers to start.
+// It returns the containers to remove, the number of containers to
+// create and whether job changed.
+func reconcileJob(spec model.JobSpec, job *model.Job, conts []*model.Container, now time.Time) ([]*model.Container, int, bool) {
+	before := model.Job{State: job.State, Active: job.Active, Succeeded: job.Succeeded, Failed: job.Failed}
+	terminate := make([]*model.Container, 0)
+	active := 0
+	for _, cont := range conts {
+		if !cont.Finished() {
+			active++
+			continue
+		}
+		terminate = append(terminate, cont)
+		if jobRecorded(job, cont.Name) {
+			continue
+		}
+		run := model.JobRun{
+			Container:  cont.Name,
+			NodeName:   cont.NodeName,
+			State:      cont.State,
+			ExitCode:   cont.ExitCode,
+			StartedAt:  cont.StartedAt,
+			FinishedAt: cont.FinishedAt,
+			Message:    cont.Message,
+		}
+		if cont.State == model.ContainerSucceeded {
+			job.Succeeded++
+		} else {
+			job.Failed++
+			job.LastFailure = now
+		}
+		job.Runs = append(job.Runs, run)
+		if len(job.Runs) > jobRunsLimit {
+			job.Runs = job.Runs[len(job.Runs)-jobRunsLimit:]
+		}
+	}
+
+	if !job.Finished() {
+		switch {
+		case job.Succeeded >= spec.Completions:
+			job.State = model.JobComplete
+		case job.Failed > spec.BackoffLimit:
+			job.State = model.JobFailed
+			job.Message = fmt.Sprintf("backoff limit of %d failed containers exceeded", spec.BackoffLimit)
+		case spec.ActiveDeadlineSeconds > 0 && now.Sub(job.StartedAt) > time.Duration(spec.ActiveDeadlineSeconds)*time.Second:
+			job.State = model.JobFailed
+			job.Message = fmt.Sprintf("active deadline of %ds exceeded", spec.ActiveDeadlineSeconds)
+		}
+		if job.Finished() {
+			job.CompletedAt = now
+			log.Info("Job %s %s: %d succeeded, %d failed %s", job.Name, job.State, job.Succeeded, job.Failed, job.Message)
+		}
+	}
+
+	create := 0
+	if job.Finished() {
+		// finished jobs keep no container
+		for _, cont := range conts {
+			if !cont.Finished() {
+				terminate = append(terminate, cont)
+			}
+		}
+		active = 0
+	} else {
+		create = spec.Parallelism - active
+		if remaining := spec.Completions - job.Succeeded - active; create > remaining {
+			create = remaining
+		}
+		if job.Failed > 0 && now.Before(job.LastFailure.Add(model.JobBackoff(job.Failed))) {
+			create = 0
+		}
+		if create < 0 {
+			create = 0
+		}
+	}
+	job.Active = active + create
+	changed := before.State != job.State || before.Active != job.Active || before.Succeeded != job.Succeeded || before.Failed != job.Failed
+	return terminate, create, changed
+}
+
+// jobReplicasDesired returns the containers the unfinished runs of the
+// job or cron job def want running
+func jobReplicasDesired(def *model.Definition) int {
+	desired := 0
+	if def.Status == nil {
+		return desired
+	}
+	for _, job := range def.Status.Jobs {
+		if !job.Finished() {
+			desired += job.Active
+		}
+	}
+	return desired
+}
+
+func jobRecorded(job *model.Job, container string) bool {
+	for _, run := range job.Runs {
+		if run.Container == container {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduleCronJob starts a run of the cron job def when its schedule is
+// due and forgets the oldest finished runs beyond the history limits.
+// Only the latest of several missed schedules is run.  It returns
+// whether the status of def changed.
+func scheduleCronJob(def *model.Definition, now time.Time) bool {
+	spec := def.CronJobSpec()
+	status := def.Status
+	changed := pruneCronJobHistory(status, spec)
+	if status.LastSchedule.IsZero() {
+		// schedules start when the cron job is first seen
+		status.LastSchedule = now
+		return true
+	}
+	schedule, err := utils.ParseCron(spec.Schedule)
+	if err != nil {
+		log.Error("Cron job %s has an invalid schedule: %s", def.Name, err)
+		return changed
+	}
+	// a stored time keeps its offset but not its zone, the schedule
+	// follows the daylight saving changes of the master
+	due := schedule.Next(status.LastSchedule.In(time.Local))
+	if due.IsZero() || due.After(now) {
+		return changed
+	}
+	for i := 0; i < cronCatchUpLimit; i++ {
+		next := schedule.Next(due)
+		if next.IsZero() || next.After(now) {
+			break
+		}
+		due = next
+	}
+	status.LastSchedule = due
+	if spec.Suspend {
+		return true
+	}
+
+	active := make([]*model.Job, 0)
+	for _, job := range status.Jobs {
+		if !job.Finished() {
+			active = append(active, job)
+		}
+	}
+	switch {
+	case len(active) > 0 && spec.ConcurrencyPolicy == model.ConcurrencyForbid:
+		log.Info("Cron job %s skips the run due at %s, a run is still active", def.Name, due)
+		return true
+	case spec.ConcurrencyPolicy == model.ConcurrencyReplace:
+		for _, job := range active {
+			job.State = model.JobFailed
+			job.CompletedAt = now
+			job.Message = "replaced by a newer run"
+		}
+	}
+	name := fmt.Sprintf("%s-%d", def.Name, due.Unix())
+	log.Info("Cron job %s starts run %s", def.Name, name)
+	status.Jobs = append(status.Jobs, &model.Job{Name: name, DefinitionName: def.Name, State: model.JobActive, StartedAt: now})
+	return true
+}
+
+// pruneCronJobHistory forgets the oldest finished runs beyond the history
+// limits, their containers are removed with them
+func pruneCronJobHistory(status *model.DefinitionStatus, spec model.CronJobSpec) bool {
+	keep := map[string]int{model.JobComplete: spec.SuccessfulJobsHistoryLimit, model.JobFailed: spec.FailedJobsHistoryLimit}
+	jobs := make([]*model.Job, 0, len(status.Jobs))
+	for i := len(status.Jobs) - 1; i >= 0; i-- {
+		job := status.Jobs[i]
+		if job.Finished() {
+			if keep[job.State] == 0 {
+				continue
+			}
+			keep[job.State]--
+		}
+		jobs = append(jobs, job)
+	}
+	if len(jobs) == len(status.Jobs) {
+		return false
+	}
+	// back to oldest first
+	for i, j := 0, len(jobs)-1; i < j; i, j = i+1, j-1 {
+		jobs[i], jobs[j] = jobs[j], jobs[i]
+	}
+	status.Jobs = jobs
+	return true
+}
+
+func (m *masterService) listJobs(w http.ResponseWriter, r *http.Request) RestResponse {
+	def := map[string]string{
+		"Name":           "string",
+		"DefinitionName": "string",
+		"State":          "string",
+		"StartedAt":      "time",
+		"CompletedAt":    "time",
+		"Succeeded":      "int",
+		"Failed":         "int",
+	}
+	list := make([]*model.Job, 0)
+	for _, d := range m.db.ListDefinitions() {
+		if d.Status != nil {
+			list = append(list, d.Status.Jobs...)
+		}
+	}
+	page, err := utils.RestList(def, "Name", r, &list)
+	if err != nil {
+		return (&JSONResponse{}).SetStatus(400).SetBody(map[string]string{"error": err.Error()})
+	}
+	return listResponse(page)
+}
+
+func (m *masterService) getJob(w http.ResponseWriter, r *http.Request) RestResponse {
+	name := mux.Vars(r)["name"]
+	for _, d := range m.db.ListDefinitions() {
+		if d.Status == nil {
+			continue
+		}
+		for _, job := range d.Status.Jobs {
+			if job.Name == name {
+				return (&JSONResponse{}).SetBody(job)
+			}
+		}
+	}
+	return (&JSONResponse{}).SetStatus(404).SetBody(`{"error":"job not found"}`)
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/libgolang/one/model"
+)
+
+func TestJobRunsToCompletion(t *testing.T) {
+	// given
+	m, db, call := newTestMaster(t)
+	invalid := call("PUT", "/master/definitions/bad", `{"image":"busybox","mode":"cronjob","cronJob":{"schedule":"61 * * * *"}}`)
+	call("PUT", "/master/definitions/migrate", `{"image":"busybox","cmd":["true"],"mode":"job","job":{"completions":2,"parallelism":2}}`)
+	call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"}}`)
+	m.allocateContainers()
+
+	// when the containers exit
+	call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"},"containers":[
+		{"name":"migrate-1","running":false,"exitCode":0,"restartPolicy":"Never"},
+		{"name":"migrate-2","running":false,"exitCode":0,"restartPolicy":"Never"}]}`)
+	m.allocateContainers()
+	m.allocateContainers()
+
+	// then
+	if invalid.Code != http.StatusBadRequest {
+		t.Errorf("invalid schedule should be refused, got %d", invalid.Code)
+	}
+	rec := call("GET", "/master/jobs/migrate", "")
+	job := &model.Job{}
+	_ = json.Unmarshal(rec.Body.Bytes(), job)
+	if job.State != model.JobComplete || job.Succeeded != 2 || len(job.Runs) != 2 || job.Runs[0].State != model.ContainerSucceeded {
+		t.Errorf("job should be complete with the results of its containers, got %s", rec.Body.String())
+	}
+	for _, cont := range db.ListContainers() {
+		if cont.Desired() != model.ContainerTerminated {
+			t.Errorf("finished container %s should be removed", cont.Name)
+		}
+		if cont.Cmd[0] != "true" || cont.RestartPolicy != model.RestartNever || cont.JobName != "migrate" {
+			t.Errorf("container should run the command of the job once, got %+v", cont)
+		}
+	}
+	if _, ok := db.ListContainers()["migrate-3"]; ok {
+		t.Error("a complete job should start no more containers")
+	}
+	saved := call("PUT", "/master/definitions/migrate", `{"image":"busybox","mode":"job"}`)
+	if def, _ := db.GetDefinition("migrate"); saved.Code != http.StatusOK || def.Status == nil || def.Status.Jobs[0].State != model.JobComplete {
+		t.Error("saving the definition should keep the status of the job")
+	}
+}
+
+func TestJobBackoffLimit(t *testing.T) {
+	// given
+	now := time.Now()
+	job := &model.Job{Name: "report", State: model.JobActive, StartedAt: now}
+	spec := model.JobSpec{Completions: 1, Parallelism: 1, BackoffLimit: 1}
+	failed := func(name string) *model.Container {
+		return &model.Container{Name: name, State: model.ContainerFailed, RestartPolicy: model.RestartNever, ExitCode: 3, Message: "exited with code 3"}
+	}
+
+	// when
+	_, first, _ := reconcileJob(spec, job, nil, now)
+	_, afterFailure, _ := reconcileJob(spec, job, []*model.Container{failed("report-1")}, now)
+	_, afterBackoff, _ := reconcileJob(spec, job, nil, now.Add(time.Minute))
+	terminate, _, changed := reconcileJob(spec, job, []*model.Container{failed("report-2"), {Name: "report-3", State: model.ContainerRunning}}, now.Add(2*time.Minute))
+
+	// then
+	if first != 1 || afterFailure != 0 || afterBackoff != 1 {
+		t.Errorf("a failed container should be replaced after the backoff, got %d %d %d", first, afterFailure, afterBackoff)
+	}
+	if !changed || job.State != model.JobFailed || job.Failed != 2 || job.Runs[1].ExitCode != 3 || len(terminate) != 2 {
+		t.Errorf("job should fail past its backoff limit and remove its containers, got %+v", job)
+	}
+}
+
+func TestCronJobSchedule(t *testing.T) {
+	// given
+	start := time.Date(2024, time.March, 1, 10, 2, 0, 0, time.UTC)
+	def := &model.Definition{Name: "report", Mode: model.ModeCronJob, Status: &model.DefinitionStatus{},
+		CronJob: &model.CronJobSpec{Schedule: "*/5 * * * *", ConcurrencyPolicy: model.ConcurrencyForbid, SuccessfulJobsHistoryLimit: 1}}
+
+	// when
+	scheduleCronJob(def, start)
+	notDue := scheduleCronJob(def, start.Add(2*time.Minute))
+	scheduleCronJob(def, start.Add(4*time.Minute))
+	scheduleCronJob(def, start.Add(9*time.Minute)) // forbidden, the first run is active
+	forbidden := len(def.Status.Jobs)
+	def.Status.Jobs[0].State = model.JobComplete
+	scheduleCronJob(def, start.Add(30*time.Minute)) // several schedules missed
+	def.Status.Jobs[1].State = model.JobComplete
+	def.CronJob.ConcurrencyPolicy = model.ConcurrencyReplace
+	scheduleCronJob(def, start.Add(35*time.Minute))
+	scheduleCronJob(def, start.Add(40*time.Minute))
+
+	// then
+	if notDue || forbidden != 1 {
+		t.Errorf("runs should start when due and not overlap when forbidden, got %v %d", notDue, forbidden)
+	}
+	jobs := def.Status.Jobs
+	if len(jobs) != 3 || jobs[0].Name != "report-1709289000" || jobs[0].State != model.JobComplete {
+		t.Fatalf("only the last complete run should be kept, got %d runs", len(jobs))
+	}
+	if jobs[1].State != model.JobFailed || jobs[1].Message != "replaced by a newer run" || jobs[2].State != model.JobActive {
+		t.Errorf("the active run should be replaced, got %+v %+v", jobs[1], jobs[2])
+	}
+}
+
+func TestCronJobScheduleDaylightSaving(t *testing.T) {
+	// given a run stored before the clocks moved forward
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	local := time.Local
+	time.Local = loc
+	defer func() { time.Local = local }()
+	stored := time.Date(2024, time.March, 9, 9, 0, 0, 0, loc)
+	stored = stored.In(time.FixedZone("", -5*3600)) // the zone is lost when stored
+	def := &model.Definition{Name: "report", Mode: model.ModeCronJob, Status: &model.DefinitionStatus{LastSchedule: stored},
+		CronJob: &model.CronJobSpec{Schedule: "0 9 * * *"}}
+
+	// when
+	early := scheduleCronJob(def, time.Date(2024, time.March, 10, 8, 30, 0, 0, loc))
+	due := scheduleCronJob(def, time.Date(2024, time.March, 10, 9, 0, 0, 0, loc))
+
+	// then
+	if early || !due {
+		t.Errorf("the run should be due at 9:00 local time, got %v %v", early, due)
+	}
+}
@@ -1,6 +1,9 @@
 package service
 
 import (
+	"net"
+	"strconv"
+
 	"github.com/libgolang/one/model"
 
 	"github.com/libgolang/log"
@@ -42,7 +45,9 @@ func (c *cycle) Stop(def *model.Definition) {
 	}
 
 	//
-	c.p.RemoveDockerProxy(def.Name)
+	if err := c.p.Remove(def.Name); err != nil {
+		log.Error("Unable to remove proxy for %s: %s", def.Name, err)
+	}
 }
 
 func (c *cycle) Start(def *model.Definition) {
@@ -54,6 +59,12 @@ func (c *cycle) Start(def *model.Definition) {
 	//
 	log.Debug("container http port: %d", cont.HTTPPort)
 	if cont.HTTPPort > 0 {
-		c.p.AddDockerProxySsl(def.Name, c.hostIP, cont.HTTPPort)
+		site := &ProxySite{
+			Name:     def.Name,
+			Backends: []string{net.JoinHostPort(c.hostIP, strconv.Itoa(cont.HTTPPort))},
+		}
+		if err := c.p.Apply(site); err != nil {
+			log.Error("Unable to add proxy for %s: %s", def.Name, err)
+		}
 	}
 }
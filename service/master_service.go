@@ -1,16 +1,21 @@
 package service
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"regexp"
+	"sort"
+	"strings"
 
 	"encoding/json"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/libgolang/log"
+	"github.com/libgolang/one/clients"
 	"github.com/libgolang/one/model"
 	"github.com/libgolang/one/utils"
 )
@@ -18,6 +23,26 @@ import (
 const (
 	masterTick  = time.Second * 10
 	minHTTPPort = 11000
+	// nodeStaleAfter nodes that did not report for longer are counted
+	// as stale
+	nodeStaleAfter = time.Minute
+)
+
+// node states of the metrics
+const (
+	nodeReady    = "ready"
+	nodeStale    = "stale"
+	nodeDisabled = "disabled"
+)
+
+// sidecarNameRegexp names of sidecars, part of the docker container names
+var sidecarNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+var (
+	metricNodes              = metrics.gauge("one_master_nodes", "Nodes by state: ready, stale or disabled.", "state")
+	metricReplicasDesired    = metrics.gauge("one_master_replicas_desired", "Replicas requested by each definition, the active containers of the runs of jobs.", "definition")
+	metricReplicasRunning    = metrics.gauge("one_master_replicas_running", "Replicas reported running for each definition.", "definition")
+	metricAllocationDuration = metrics.histogram("one_master_allocation_duration_seconds", "Duration of the container allocation loop.", nil)
 )
 
 // MasterService interface
@@ -25,13 +50,26 @@ type MasterService interface {
 }
 
 type masterService struct {
-	db Db
-	rs RestServer
+	db          Db
+	rs          RestServer
+	baseDomain  string
+	cluster     Cluster
+	stats       *statsHistory // resource usage reported by the nodes
+	registryKey []byte        // encrypts the registry passwords
+	nodeToken   string        // nodes presenting it receive the registry credentials
+	ticker      *time.Ticker  // allocates the containers
+	done        chan struct{} // closed by stop
 }
 
-// NewMasterService constructor of Master REST API.
-func NewMasterService(rs RestServer, db Db) MasterService {
-	master := &masterService{rs: rs, db: db}
+// NewMasterService constructor of Master REST API.  baseDomain is
+// the proxy domain used to resolve the default route of definitions.
+// cluster is nil unless the master is one of several masters, in which
+// case only the leader allocates containers.  registryKey encrypts the
+// registry passwords, none can be saved when it is nil.  The passwords
+// are only sent over TLS to the nodes presenting nodeToken, to none when
+// it is empty.
+func NewMasterService(rs RestServer, db Db, baseDomain string, cluster Cluster, registryKey []byte, nodeToken string) MasterService {
+	master := &masterService{rs: rs, db: db, baseDomain: baseDomain, cluster: cluster, stats: newStatsHistory(statsHistoryLen), registryKey: registryKey, nodeToken: nodeToken}
 	master.init()
 	return master
 }
@@ -39,28 +77,65 @@ func NewMasterService(rs RestServer, db Db) MasterService {
 func (m *masterService) init() {
 	// api
 	m.rs.HandleFunc("/master/containers", func(w http.ResponseWriter, r *http.Request) RestResponse { return m.listContainers(w, r) }).Methods("GET")
+	m.rs.HandleFunc("/master/containers/{name}", func(w http.ResponseWriter, r *http.Request) RestResponse { return m.getContainer(w, r) }).Methods("GET")
+	m.rs.HandleFunc("/master/containers/{name}/stats", func(w http.ResponseWriter, r *http.Request) RestResponse { return m.getContainerStats(w, r) }).Methods("GET")
 	m.rs.HandleFunc("/master/nodes", func(w http.ResponseWriter, r *http.Request) RestResponse { return m.listNodes(w, r) }).Methods("GET")
+	m.rs.HandleFunc("/master/nodes/{name}", func(w http.ResponseWriter, r *http.Request) RestResponse { return m.getNode(w, r) }).Methods("GET")
+	m.rs.HandleFunc("/master/nodes/{name}", func(w http.ResponseWriter, r *http.Request) RestResponse { return m.saveNode(w, r) }).Methods("PUT")
 	m.rs.HandleFunc("/master/nodeinfo", func(w http.ResponseWriter, r *http.Request) RestResponse { return m.pingNodeInfo(w, r) }).Methods("POST")
+	m.rs.HandleFunc("/master/definitions", func(w http.ResponseWriter, r *http.Request) RestResponse { return m.listDefinitions(w, r) }).Methods("GET")
 	m.rs.HandleFunc("/master/definitions/{name}", func(w http.ResponseWriter, r *http.Request) RestResponse { return m.getDefinition(w, r) }).Methods("GET")
+	m.rs.HandleFunc("/master/definitions/{name}", func(w http.ResponseWriter, r *http.Request) RestResponse { return m.saveDefinition(w, r) }).Methods("PUT")
+	m.rs.HandleFunc("/master/definitions/{name}", func(w http.ResponseWriter, r *http.Request) RestResponse { return m.deleteDefinition(w, r) }).Methods("DELETE")
+	m.rs.HandleFunc("/master/definitions/{name}/replicas/{index}/release", func(w http.ResponseWriter, r *http.Request) RestResponse { return m.releaseReplica(w, r) }).Methods("POST")
+	m.rs.HandleFunc("/master/volumes", func(w http.ResponseWriter, r *http.Request) RestResponse { return m.listVolumes(w, r) }).Methods("GET")
+	m.rs.HandleFunc("/master/networks", func(w http.ResponseWriter, r *http.Request) RestResponse { return m.listNetworks(w, r) }).Methods("GET")
+	m.rs.HandleFunc("/master/networks/{name}", func(w http.ResponseWriter, r *http.Request) RestResponse { return m.getNetwork(w, r) }).Methods("GET")
+	m.rs.HandleFunc("/master/networks/{name}", func(w http.ResponseWriter, r *http.Request) RestResponse { return m.saveNetwork(w, r) }).Methods("PUT")
+	m.rs.HandleFunc("/master/registries", func(w http.ResponseWriter, r *http.Request) RestResponse { return m.listRegistries(w, r) }).Methods("GET")
+	m.rs.HandleFunc("/master/registries/{name}", func(w http.ResponseWriter, r *http.Request) RestResponse { return m.getRegistry(w, r) }).Methods("GET")
+	m.rs.HandleFunc("/master/registries/{name}", func(w http.ResponseWriter, r *http.Request) RestResponse { return m.saveRegistry(w, r) }).Methods("PUT")
+	m.rs.HandleFunc("/master/jobs", func(w http.ResponseWriter, r *http.Request) RestResponse { return m.listJobs(w, r) }).Methods("GET")
+	m.rs.HandleFunc("/master/jobs/{name}", func(w http.ResponseWriter, r *http.Request) RestResponse { return m.getJob(w, r) }).Methods("GET")
 
 	// process definitions
-	timer := time.NewTicker(masterTick)
+	m.ticker = time.NewTicker(masterTick)
+	m.done = make(chan struct{})
 	go func() {
-		for range timer.C {
+		for {
+			select {
+			case <-m.done:
+				return
+			case <-m.ticker.C:
+			}
+			if m.cluster != nil && !m.cluster.IsLeader() {
+				continue
+			}
 			m.allocateContainers()
 			log.Info("Tick")
 		}
 	}()
 }
 
+// stop ends the allocation of the containers
+func (m *masterService) stop() {
+	m.ticker.Stop()
+	close(m.done)
+}
+
 func (m *masterService) listNodes(w http.ResponseWriter, r *http.Request) RestResponse {
 	def := map[string]string{
-		"Name":    "string",
-		"Enabled": "bool",
+		"Name":        "string",
+		"Enabled":     "bool",
+		"LastUpdated": "time",
+		"Labels":      "map",
 	}
 	list := m.db.ListNodes()
-	utils.RestFilterReduce(def, r, &list)
-	return (&JSONResponse{}).SetBody(list)
+	page, err := utils.RestList(def, "Name", r, &list)
+	if err != nil {
+		return (&JSONResponse{}).SetStatus(400).SetBody(map[string]string{"error": err.Error()})
+	}
+	return listResponse(page)
 }
 
 func (m *masterService) pingNodeInfo(w http.ResponseWriter, r *http.Request) RestResponse {
@@ -83,8 +158,12 @@ func (m *masterService) pingNodeInfo(w http.ResponseWriter, r *http.Request) Res
 		return resp.SetStatus(400).SetBody(`{"error":"Invalid Node Information"}`)
 	}
 
-	// Register / Update Nodes
-	m.db.Trx(func(db Db) {
+	// Register / Update Nodes and reconcile the containers assigned to
+	// the node with the containers it reports
+	containers := make([]model.Container, 0)
+	var networks []model.Network
+	var registries []model.RegistryAuth
+	if terr := m.db.Trx(func(db Db) {
 		log.Debug("#############################################################")
 		node, err := db.GetNode(nfo.Node.Name)
 		if err != nil {
@@ -95,46 +174,140 @@ func (m *masterService) pingNodeInfo(w http.ResponseWriter, r *http.Request) Res
 		}
 		node.LastUpdated = time.Now()
 		node.Addr = nfo.Node.Addr
+		node.Volumes = nfo.Volumes
 
 		err = db.SaveNode(node)
 		if err != nil {
 			log.Error("%s", err)
 		}
-		log.Debug("#############################################################")
-	})
 
-	// Make sure containers match
-	officialContainers := m.db.ListContainers()
-	for _, cont := range nfo.Containers {
-		_, ok := officialContainers[cont.Name]
-		if !ok {
-			log.Warn("Node %s has an unknown container %s", nfo.Node.Name, cont.Name)
+		reported := make(map[string]*model.Container)
+		for i := range nfo.Containers {
+			reported[nfo.Containers[i].Name] = &nfo.Containers[i]
 		}
+		assigned := db.ListContainersByNode(node.Name)
+		for name := range reported {
+			if _, ok := assigned[name]; !ok {
+				log.Warn("Node %s has an unknown container %s", node.Name, name)
+			}
+		}
+		for name, cont := range assigned {
+			if !observeContainer(cont, reported[name], nfo.Errors[name], node.LastUpdated) {
+				continue
+			}
+			if cont.State == model.ContainerTerminated {
+				log.Info("Container %s removed from node %s", name, node.Name)
+				db.DeleteContainer(name)
+				m.stats.remove(name)
+				continue
+			}
+			if stats, ok := nfo.Stats[name]; ok && cont.Running {
+				cont.Stats = &stats
+				m.stats.add(name, stats)
+			} else {
+				cont.Stats = nil
+			}
+			cont.ResourceVersion = ""
+			if err := db.SaveContainer(cont); err != nil {
+				log.Error("Error saving container %s: %s", name, err)
+			}
+			if cont.Desired() == model.ContainerRunning {
+				containers = append(containers, *cont)
+			}
+		}
+		networks = containerNetworks(containers, db.ListNetworks())
+		registries = containerRegistries(containers, db.ListRegistries(), m.registryKey)
+		if len(registries) > 0 && !m.trustedNode(r) {
+			log.Warn("Not sending registry credentials to node %s, it needs TLS and the node token", node.Name)
+			registries = nil
+		}
+		log.Debug("#############################################################")
+	}); terr != nil {
+		return unavailableResponse(terr)
 	}
 
-	// Respond with the list of containers in file
-	node := nfo.Node
-	containers := make([]model.Container, 0)
-	for _, cont := range m.db.ListContainers() {
-		if node.Name == cont.NodeName {
-			containers = append(containers, *cont)
+	// Respond with the list of containers the node should run
+	return resp.SetBody(&model.NodeInfoResponse{Containers: containers, Networks: networks, Registries: registries})
+}
+
+// trustedNode returns whether the node sending r may receive registry
+// credentials: r came over TLS with the node token
+func (m *masterService) trustedNode(r *http.Request) bool {
+	token := r.Header.Get(clients.NodeTokenHeader)
+	return r.TLS != nil && m.nodeToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(m.nodeToken)) == 1
+}
+
+// observeContainer moves cont to the state matching the report of its
+// node.  observed is nil when the node does not run the container and
+// runErr is the error of the node starting it, if any.  It returns
+// false when the node has not been asked to run or remove cont yet.
+func observeContainer(cont, observed *model.Container, runErr string, now time.Time) bool {
+	if cont.State == model.ContainerPending {
+		return false
+	}
+	cont.ObservedAt = now
+	if observed == nil && cont.Finished() && cont.Desired() == model.ContainerRunning {
+		// the exited container of a job is gone, its result stays
+		return true
+	}
+	if observed != nil {
+		cont.ContainerID = observed.ContainerID
+		cont.Running = observed.Running
+		cont.StartedAt = observed.StartedAt
+		cont.FinishedAt = observed.FinishedAt
+		cont.ExitCode = observed.ExitCode
+		cont.RestartCount = observed.RestartCount
+		cont.Health = observed.Health
+		cont.SidecarStates = observed.SidecarStates
+	} else {
+		cont.ContainerID = ""
+		cont.Running = false
+		cont.SidecarStates = nil
+	}
+	cont.Message = ""
+	switch {
+	case cont.Desired() == model.ContainerTerminated && observed == nil:
+		cont.State = model.ContainerTerminated
+	case cont.Desired() == model.ContainerTerminated:
+		cont.State = model.ContainerTerminating
+	case observed != nil && observed.Running:
+		cont.State = model.ContainerRunning
+	case observed != nil && observed.ExitCode == 0 && cont.RestartPolicy == model.RestartNever:
+		cont.State = model.ContainerSucceeded
+	case observed != nil:
+		cont.State = model.ContainerFailed
+		cont.Message = observed.Message
+		if cont.Message == "" {
+			cont.Message = fmt.Sprintf("exited with code %d", observed.ExitCode)
 		}
+	case runErr != "":
+		cont.State = model.ContainerFailed
+		cont.Message = runErr
+	default:
+		cont.State = model.ContainerStarting
 	}
-	return resp.SetBody(&model.NodeInfoResponse{Containers: containers})
+	return true
 }
 
 // This looks at the definitions and containers and makes sure that
-// all the container records are distributed evenly among all nodes
+// all the container records are distributed evenly among all nodes.
+// Containers being terminated no longer count, their records are
+// deleted once their node confirms the removal.
 func (m *masterService) allocateContainers() {
+	defer metricAllocationDuration.since(time.Now())
 	defMap := m.db.ListDefinitions()
 	contMap := m.db.ListContainers()
 	nodeMap := m.db.ListNodes()
+	updateMasterMetrics(defMap, contMap, nodeMap, time.Now())
 
 	//
 	// definition -> container map
 	//
 	defContMapList := make(map[string][]*model.Container)
 	for _, cont := range contMap {
+		if cont.Desired() != model.ContainerRunning {
+			continue
+		}
 		conts := defContMapList[cont.DefinitionName]
 		conts = append(conts, cont)
 		defContMapList[cont.DefinitionName] = conts
@@ -147,19 +320,75 @@ func (m *masterService) allocateContainers() {
 	for nodeName := range nodeMap {
 		conts := make([]*model.Container, 0)
 		for _, cont := range contMap {
-			if cont.NodeName == nodeName {
+			if cont.NodeName == nodeName && cont.Desired() == model.ContainerRunning {
 				conts = append(conts, cont)
 			}
 		}
 		nodeContMap[nodeName] = conts
 	}
 
+	// assign a node to the containers still waiting for one
+	for _, cont := range contMap {
+		if cont.State != model.ContainerPending || cont.Desired() != model.ContainerRunning {
+			continue
+		}
+		def := defMap[cont.DefinitionName]
+		if m.scheduleContainer(cont, nodeContMap, pinnedNodes(def, cont.Index, eligibleNodes(def, nodeMap))) {
+			if err := m.db.SaveContainer(cont); err != nil {
+				log.Error("Error saving container %s: %s", cont.Name, err)
+			}
+		}
+	}
+
+	// hold back the definitions whose dependencies are not met and pin
+	// the replicas with local volumes to their node
+	for _, def := range defMap {
+		changed := setWaiting(def, dependencyWaiting(def, defMap, defContMapList))
+		changed = pinReplicas(def, defContMapList[def.Name]) || changed
+		if !changed {
+			continue
+		}
+		if err := m.db.SaveDefinition(def); err != nil {
+			log.Error("Error saving status of definition %s: %s", def.Name, err)
+		}
+	}
+
 	//
 	// todo
 	//
 	for k, def := range defMap {
 		conts := defContMapList[k]
+		if definitionDeleting(def) {
+			m.removeDefinition(def, conts, defMap, contMap)
+			continue
+		}
+		for _, cont := range conts {
+			if copyDefinitionLabels(def, cont) {
+				log.Info("Updating labels of container %s", cont.Name)
+				if err := m.db.SaveContainer(cont); err != nil {
+					log.Error("Error saving container %s: %s", cont.Name, err)
+				}
+			}
+		}
+		mode := def.WorkloadMode()
+		if mode != model.ModeReplicated && mode != model.ModeStateful && mode != model.ModeGlobal {
+			continue
+		}
 		n := len(conts)
+		if n > 0 && tearingDown(def, nodeMap) {
+			if dependents := dependentsRemaining(def, defMap, contMap); len(dependents) > 0 {
+				log.Info("Definition %s keeps its containers until %s are removed", def.Name, strings.Join(dependents, ", "))
+				continue
+			}
+		}
+		if mode == model.ModeGlobal {
+			m.allocateGlobal(def, conts, nodeMap, nodeContMap)
+			continue
+		}
+		if mode == model.ModeStateful {
+			m.allocateStateful(def, conts, contMap, nodeContMap, eligibleNodes(def, nodeMap))
+			continue
+		}
 		if def.Count < n {
 			// deallocate some containers for definition
 			diff := n - def.Count
@@ -168,55 +397,284 @@ func (m *masterService) allocateContainers() {
 				idx := rand.Intn(len(conts))
 				cont := conts[idx]
 				conts = append(conts[:idx], conts[idx+1:]...)
-				log.Info("Deleting container id %s/%s", cont.ContainerID, cont.Name)
-				m.db.DeleteContainer(cont.ContainerID)
+				m.terminateContainer(cont)
 			}
-		} else if def.Count > n {
+		} else if def.Count > n && !definitionWaiting(def) {
 			// allocate more containers for definition
 			diff := def.Count - n
 			log.Info("Adjusting container count (%d delta)", diff)
 			for i := 0; i < diff; i++ {
-				c := &model.Container{}
-				c.Name = fmt.Sprintf("%s-%d", def.Name, m.db.NextAutoIncrement("inc.container", def.Name))
-				c.DefinitionName = def.Name
-
-				//
-				// find node with least numbers of containers
-				//
-				currentN := 999999999
-				var currentNodeName string
-				log.Debug("nodeContMap: %s", nodeContMap)
-				for nodeName, contSlice := range nodeContMap {
-					n := len(contSlice)
-					log.Debug("checking node for number of containers (%d) less than %d", n, currentN)
-					if currentN > n {
-						currentNodeName = nodeName
-						currentN = n
-					}
+				m.createContainer(def, "", nodeContMap, eligibleNodes(def, nodeMap))
+			}
+		}
+	}
 
-				}
-				if currentNodeName == "" {
-					log.Warn("Not able to create node %s...no nodes available!", c.Name)
-					continue
-				}
-				c.NodeName = currentNodeName
-
-				//
-				c.Image = def.Image
-				c.Running = false
-				c.HTTPPort = def.HTTPPort
-				// generate a mapping nodeHttpPort -> httpPort
-				if c.HTTPPort > 0 {
-					c.NodeHTTPPort = minHTTPPort + m.db.NextAutoIncrement("http.port", "http.port")
-				}
-				log.Info("Creating container id %s/%s", c.ContainerID, c.Name)
-				if err := m.db.SaveContainer(c); err != nil {
-					log.Error("Error saving container %s", c.Name)
-				} else {
-					nodeContMap[c.NodeName] = append(nodeContMap[c.NodeName], c)
-				}
+	m.allocateJobs(defMap, defContMapList, nodeMap, nodeContMap, time.Now())
+}
+
+// createContainer saves a new container of def scheduled on the eligible
+// node with the fewest containers, Pending when there is none.
+// Containers of the job run jobName are never restarted.  Nothing is
+// created, and nil returned, when the name is already taken or the
+// container could not be committed.
+func (m *masterService) createContainer(def *model.Definition, jobName string, nodeContMap map[string][]*model.Container, eligible map[string]bool) *model.Container {
+	c := &model.Container{}
+	var taken bool
+	// the names and ports are committed with the container, or not at all
+	if err := m.db.Trx(func(db Db) {
+		c.DefinitionName = def.Name
+		c.Index = freeReplicaIndex(db.ListContainersByDefinition(def.Name))
+		if def.WorkloadMode() == model.ModeStateful {
+			c.Name = statefulName(def, c.Index)
+		} else {
+			c.Name = fmt.Sprintf("%s-%d", def.Name, db.NextAutoIncrement("inc.container", def.Name))
+		}
+		if _, taken = db.ListContainers()[c.Name]; taken {
+			return
+		}
+		c.DesiredState = model.ContainerRunning
+		c.State = model.ContainerPending
+		if jobName != "" {
+			c.JobName = jobName
+			c.RestartPolicy = model.RestartNever
+		}
+		m.scheduleContainer(c, nodeContMap, pinnedNodes(def, c.Index, eligible))
+
+		//
+		c.Image = def.Image
+		c.Running = false
+		copyDefinitionLabels(def, c)
+		c.Env = utils.CopyStringStringMap(def.Env)
+		c.Volumes = utils.CopyStringStringMap(def.Volumes)
+		c.Ports = def.Ports
+		c.Cmd = def.Cmd
+		c.Caps = def.Caps
+		c.Sidecars = def.Sidecars
+		c.Networks = def.Networks
+		c.Registry = def.Registry
+		c.NamedVolumes = resolveNamedVolumes(def, c.Index)
+		c.HTTPPort = def.HTTPPort
+		// generate a mapping nodeHttpPort -> httpPort
+		if c.HTTPPort > 0 {
+			c.NodeHTTPPort = minHTTPPort + db.NextAutoIncrement("http.port", "http.port")
+		}
+		log.Info("Creating container %s (%s)", c.Name, c.State)
+		if err := db.SaveContainer(c); err != nil {
+			log.Error("Error saving container %s", c.Name)
+		}
+	}); err != nil {
+		log.Error("Unable to create a container of definition %s: %s", def.Name, err)
+		return nil
+	}
+	if taken {
+		log.Error("Not creating container %s of definition %s, the name is taken", c.Name, def.Name)
+		return nil
+	}
+	return c
+}
+
+// allocateGlobal keeps exactly one of the containers conts of the global
+// definition def on every eligible node, preferring running ones, and
+// removes the others.  No container is created while def waits for its
+// dependencies.
+func (m *masterService) allocateGlobal(def *model.Definition, conts []*model.Container, nodeMap map[string]*model.Node, nodeContMap map[string][]*model.Container) {
+	eligible := eligibleNodes(def, nodeMap)
+	byNode := make(map[string][]*model.Container)
+	for _, cont := range conts {
+		byNode[cont.NodeName] = append(byNode[cont.NodeName], cont)
+	}
+	for nodeName, nodeConts := range byNode {
+		keep := 0
+		if eligible[nodeName] {
+			keep = 1
+		}
+		sort.SliceStable(nodeConts, func(i, j int) bool {
+			return nodeConts[i].State == model.ContainerRunning && nodeConts[j].State != model.ContainerRunning
+		})
+		for _, cont := range nodeConts[keep:] {
+			log.Info("Node %s is not eligible for another container of global definition %s", nodeName, def.Name)
+			m.terminateContainer(cont)
+		}
+	}
+	if definitionWaiting(def) {
+		return
+	}
+	for nodeName := range eligible {
+		if len(byNode[nodeName]) == 0 {
+			m.createContainer(def, "", nodeContMap, map[string]bool{nodeName: true})
+		}
+	}
+}
+
+// removeDefinition tears down the definition def marked for removal.
+// Its containers conts are terminated once those of its dependents are
+// gone, and def is deleted once none of its own is left.
+func (m *masterService) removeDefinition(def *model.Definition, conts []*model.Container, defMap map[string]*model.Definition, contMap map[string]*model.Container) {
+	for _, cont := range contMap {
+		if cont.DefinitionName == def.Name {
+			if dependents := dependentsRemaining(def, defMap, contMap); len(dependents) > 0 {
+				log.Info("Definition %s keeps its containers until %s are removed", def.Name, strings.Join(dependents, ", "))
+				return
 			}
+			for _, cont := range conts {
+				m.terminateContainer(cont)
+			}
+			return
+		}
+	}
+	log.Info("Deleting definition %s", def.Name)
+	m.db.DeleteDefinition(def.Name)
+}
+
+// eligibleNodes returns the enabled nodes matching the node selector of
+// def, any enabled node when def is nil
+func eligibleNodes(def *model.Definition, nodeMap map[string]*model.Node) map[string]bool {
+	selector := model.LabelSelector{}
+	if def != nil {
+		var err error
+		if selector, err = model.ParseLabelSelector(def.NodeSelector); err != nil {
+			log.Error("Definition %s has an invalid node selector: %s", def.Name, err)
+			return nil
+		}
+	}
+	eligible := make(map[string]bool)
+	for name, node := range nodeMap {
+		if node.Enabled && selector.Matches(node.Labels) {
+			eligible[name] = true
+		}
+	}
+	return eligible
+}
+
+// validateWorkload checks the mode of def, its node selector and the
+// specs of its mode
+func validateWorkload(def *model.Definition) error {
+	if _, err := model.ParseLabelSelector(def.NodeSelector); err != nil {
+		return fmt.Errorf("invalid nodeSelector: %s", err)
+	}
+	switch def.WorkloadMode() {
+	case model.ModeReplicated, model.ModeGlobal, model.ModeStateful:
+		return nil
+	case model.ModeJob, model.ModeCronJob:
+		return validateJobSpecs(def)
+	}
+	return fmt.Errorf("unknown mode %q, use %s, %s, %s, %s or %s", def.Mode, model.ModeReplicated, model.ModeStateful, model.ModeGlobal, model.ModeJob, model.ModeCronJob)
+}
+
+// validateSidecars checks the names and images of the sidecars of def
+func validateSidecars(def *model.Definition) error {
+	seen := make(map[string]bool)
+	for _, sc := range def.Sidecars {
+		if !sidecarNameRegexp.MatchString(sc.Name) {
+			return fmt.Errorf("invalid sidecar name %q: lower case letters, digits and - starting and ending with a letter or digit", sc.Name)
+		}
+		if seen[sc.Name] {
+			return fmt.Errorf("sidecar %s is listed twice", sc.Name)
+		}
+		seen[sc.Name] = true
+		if sc.Image == "" {
+			return fmt.Errorf("sidecar %s requires an image", sc.Name)
+		}
+	}
+	return nil
+}
+
+// copyDefinitionLabels copies the labels and annotations of def to
+// cont, returning false when they were the same already.  The docker
+// container gets the new labels when it is next started.
+func copyDefinitionLabels(def *model.Definition, cont *model.Container) bool {
+	if utils.EqualStringStringMap(def.Labels, cont.Labels) && utils.EqualStringStringMap(def.Annotations, cont.Annotations) {
+		return false
+	}
+	cont.Labels = utils.CopyStringStringMap(def.Labels)
+	cont.Annotations = utils.CopyStringStringMap(def.Annotations)
+	return true
+}
+
+// updateMasterMetrics sets the gauges of the master from the state read
+// by an allocation
+func updateMasterMetrics(defMap map[string]*model.Definition, contMap map[string]*model.Container, nodeMap map[string]*model.Node, now time.Time) {
+	states := map[string]int{nodeReady: 0, nodeStale: 0, nodeDisabled: 0}
+	for _, node := range nodeMap {
+		switch {
+		case !node.Enabled:
+			states[nodeDisabled]++
+		case now.Sub(node.LastUpdated) > nodeStaleAfter:
+			states[nodeStale]++
+		default:
+			states[nodeReady]++
+		}
+	}
+	for state, n := range states {
+		metricNodes.set(float64(n), state)
+	}
+
+	running := make(map[string]int)
+	for _, cont := range contMap {
+		if cont.Desired() == model.ContainerRunning && cont.State == model.ContainerRunning {
+			running[cont.DefinitionName]++
+		}
+	}
+	// definitions may have been removed
+	metricReplicasDesired.reset()
+	metricReplicasRunning.reset()
+	for name, def := range defMap {
+		desired := def.Count
+		switch def.WorkloadMode() {
+		case model.ModeGlobal:
+			desired = len(eligibleNodes(def, nodeMap))
+		case model.ModeJob, model.ModeCronJob:
+			desired = jobReplicasDesired(def)
 		}
+		metricReplicasDesired.set(float64(desired), name)
+		metricReplicasRunning.set(float64(running[name]), name)
+	}
+}
+
+// scheduleContainer assigns the eligible node with the least containers
+// to cont and moves it to Scheduled.  It returns false and leaves cont
+// Pending when there are no eligible nodes.
+func (m *masterService) scheduleContainer(cont *model.Container, nodeContMap map[string][]*model.Container, eligible map[string]bool) bool {
+	//
+	// find node with least numbers of containers
+	//
+	currentN := 999999999
+	var currentNodeName string
+	log.Debug("nodeContMap: %s", nodeContMap)
+	for nodeName, contSlice := range nodeContMap {
+		if !eligible[nodeName] {
+			continue
+		}
+		n := len(contSlice)
+		log.Debug("checking node for number of containers (%d) less than %d", n, currentN)
+		if currentN > n {
+			currentNodeName = nodeName
+			currentN = n
+		}
+	}
+	if currentNodeName == "" {
+		log.Warn("Not able to schedule container %s...no nodes available!", cont.Name)
+		return false
+	}
+	cont.NodeName = currentNodeName
+	cont.State = model.ContainerScheduled
+	nodeContMap[currentNodeName] = append(nodeContMap[currentNodeName], cont)
+	return true
+}
+
+// terminateContainer asks the node of cont to remove it.  Containers
+// that never reached a node are deleted right away.
+func (m *masterService) terminateContainer(cont *model.Container) {
+	if cont.NodeName == "" {
+		log.Info("Deleting container %s", cont.Name)
+		m.db.DeleteContainer(cont.Name)
+		return
+	}
+	log.Info("Terminating container %s on node %s", cont.Name, cont.NodeName)
+	cont.DesiredState = model.ContainerTerminated
+	cont.State = model.ContainerTerminating
+	if err := m.db.SaveContainer(cont); err != nil {
+		log.Error("Error saving container %s: %s", cont.Name, err)
 	}
 }
 
@@ -228,11 +686,19 @@ func (m *masterService) listContainers(w http.ResponseWriter, r *http.Request) R
 		"HTTPPort":       "int",
 		"DefinitionName": "string",
 		"NodeName":       "string",
+		"DesiredState":   "string",
+		"State":          "string",
+		"RestartCount":   "int",
+		"StartedAt":      "time",
+		"ObservedAt":     "time",
+		"Labels":         "map",
 	}
 	containers := m.db.ListContainers()
-	utils.RestFilterReduce(def, r, &containers)
-	resp := (&JSONResponse{}).SetBody(containers)
-	return resp
+	page, err := utils.RestList(def, "Name", r, &containers)
+	if err != nil {
+		return (&JSONResponse{}).SetStatus(400).SetBody(map[string]string{"error": err.Error()})
+	}
+	return listResponse(page)
 }
 
 func (m *masterService) getDefinition(w http.ResponseWriter, r *http.Request) RestResponse {
@@ -249,5 +715,254 @@ func (m *masterService) getDefinition(w http.ResponseWriter, r *http.Request) Re
 		return resp.SetStatus(404).SetBody(`{"error":"definition not found"}`)
 	}
 
-	return resp.SetBody(defPtr)
+	return resp.SetETag(defPtr.ResourceVersion).SetBody(defPtr)
+}
+
+func (m *masterService) listDefinitions(w http.ResponseWriter, r *http.Request) RestResponse {
+	def := map[string]string{
+		"Name":     "string",
+		"Image":    "string",
+		"Count":    "int",
+		"HTTPPort": "int",
+		"Labels":   "map",
+	}
+	defs := m.db.ListDefinitions()
+	page, err := utils.RestList(def, "Name", r, &defs)
+	if err != nil {
+		return (&JSONResponse{}).SetStatus(400).SetBody(map[string]string{"error": err.Error()})
+	}
+	return listResponse(page)
+}
+
+func (m *masterService) saveDefinition(w http.ResponseWriter, r *http.Request) RestResponse {
+	resp := &JSONResponse{}
+	name := mux.Vars(r)["name"]
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error("error reading body: %s", err)
+		return resp.SetStatus(400).SetBody(`{"error":"Unable to read request"}`)
+	}
+	def := &model.Definition{}
+	if err = json.Unmarshal(b, def); err != nil {
+		log.Error("error decoding json: %s", err)
+		return resp.SetStatus(400).SetBody(`{"error":"Unable to parse request"}`)
+	}
+	if def.Name == "" {
+		def.Name = name
+	}
+	if def.Name != name {
+		return resp.SetStatus(400).SetBody(`{"error":"Name does not match the url"}`)
+	}
+	if def.Image == "" {
+		return resp.SetStatus(400).SetBody(`{"error":"Image is required"}`)
+	}
+	if err := model.ValidateLabels(def.Labels); err != nil {
+		return resp.SetStatus(400).SetBody(map[string]string{"error": err.Error()})
+	}
+	if err := model.ValidateAnnotations(def.Annotations); err != nil {
+		return resp.SetStatus(400).SetBody(map[string]string{"error": err.Error()})
+	}
+	if err := validateWorkload(def); err != nil {
+		return resp.SetStatus(400).SetBody(map[string]string{"error": err.Error()})
+	}
+	if err := validateDependencies(def); err != nil {
+		return resp.SetStatus(400).SetBody(map[string]string{"error": err.Error()})
+	}
+	if err := validateSidecars(def); err != nil {
+		return resp.SetStatus(400).SetBody(map[string]string{"error": err.Error()})
+	}
+	if err := validateNamedVolumes(def); err != nil {
+		return resp.SetStatus(400).SetBody(map[string]string{"error": err.Error()})
+	}
+
+	// check routes and save in the same transaction so that two
+	// definitions claiming the same route cannot both be accepted
+	var conflict, invalid error
+	if terr := m.db.Trx(func(db Db) {
+		if err = matchVersion(r, &def.ResourceVersion, func() (string, error) {
+			stored, err := db.GetDefinition(name)
+			if err != nil {
+				return "", &ConflictError{Kind: "definition", Name: name}
+			}
+			return stored.ResourceVersion, nil
+		}); err != nil {
+			return
+		}
+		// the status belongs to the master
+		def.Status = nil
+		if stored, err := db.GetDefinition(name); err == nil {
+			if definitionDeleting(stored) {
+				conflict = fmt.Errorf("definition %s is being deleted", name)
+				return
+			}
+			def.Status = stored.Status
+			if conflict = modeChangeError(stored, def, db.ListContainersByDefinition(name)); conflict != nil {
+				return
+			}
+		}
+		if invalid = validateDefinitionNetworks(def, db.ListNetworks()); invalid != nil {
+			return
+		}
+		if _, ok := db.ListRegistries()[def.Registry]; def.Registry != "" && !ok {
+			invalid = fmt.Errorf("registry %s not found", def.Registry)
+			return
+		}
+		stored := db.ListDefinitions()
+		if conflict = model.RouteConflict(def, stored, m.baseDomain); conflict == nil {
+			conflict = dependencyCycleError(def, stored)
+		}
+		if conflict == nil {
+			err = db.SaveDefinition(def)
+		}
+	}); terr != nil {
+		return unavailableResponse(terr)
+	}
+	if invalid != nil {
+		return resp.SetStatus(400).SetBody(map[string]string{"error": invalid.Error()})
+	}
+	if conflict != nil {
+		return resp.SetStatus(409).SetBody(map[string]string{"error": conflict.Error()})
+	}
+	if _, ok := err.(*ConflictError); ok {
+		return conflictResponse(r, err)
+	}
+	if err != nil {
+		log.Error("error saving definition %s: %s", name, err)
+		return resp.SetStatus(500).SetBody(`{"error":"Unable to save definition"}`)
+	}
+	return resp.SetETag(def.ResourceVersion).SetBody(def)
+}
+
+// deleteDefinition marks the definition for removal, see
+// removeDefinition.  It is kept until its containers are gone.
+func (m *masterService) deleteDefinition(w http.ResponseWriter, r *http.Request) RestResponse {
+	resp := &JSONResponse{}
+	name := mux.Vars(r)["name"]
+
+	var def *model.Definition
+	var err error
+	if terr := m.db.Trx(func(db Db) {
+		if def, err = db.GetDefinition(name); err != nil {
+			return
+		}
+		if err = matchVersion(r, &def.ResourceVersion, func() (string, error) { return def.ResourceVersion, nil }); err != nil {
+			return
+		}
+		if def.Status == nil {
+			def.Status = &model.DefinitionStatus{}
+		}
+		def.Status.Deleting = true
+		err = db.SaveDefinition(def)
+	}); terr != nil {
+		return unavailableResponse(terr)
+	}
+	if _, ok := err.(*ConflictError); ok {
+		return conflictResponse(r, err)
+	}
+	if def == nil {
+		return resp.SetStatus(404).SetBody(`{"error":"definition not found"}`)
+	}
+	if err != nil {
+		log.Error("error deleting definition %s: %s", name, err)
+		return resp.SetStatus(500).SetBody(`{"error":"Unable to delete definition"}`)
+	}
+	return resp.SetStatus(http.StatusAccepted).SetETag(def.ResourceVersion).SetBody(def)
+}
+
+func (m *masterService) getContainer(w http.ResponseWriter, r *http.Request) RestResponse {
+	resp := &JSONResponse{}
+	cont, ok := m.db.ListContainers()[mux.Vars(r)["name"]]
+	if !ok {
+		return resp.SetStatus(404).SetBody(`{"error":"container not found"}`)
+	}
+	return resp.SetETag(cont.ResourceVersion).SetBody(cont)
+}
+
+func (m *masterService) getContainerStats(w http.ResponseWriter, r *http.Request) RestResponse {
+	name := mux.Vars(r)["name"]
+	cont, ok := m.db.ListContainers()[name]
+	if !ok {
+		return (&JSONResponse{}).SetStatus(404).SetBody(`{"error":"container not found"}`)
+	}
+	return (&JSONResponse{}).SetBody(&model.ContainerStatsHistory{Name: name, Current: cont.Stats, History: m.stats.get(name)})
+}
+
+func (m *masterService) getNode(w http.ResponseWriter, r *http.Request) RestResponse {
+	resp := &JSONResponse{}
+	node, err := m.db.GetNode(mux.Vars(r)["name"])
+	if err != nil {
+		return resp.SetStatus(404).SetBody(`{"error":"node not found"}`)
+	}
+	return resp.SetETag(node.ResourceVersion).SetBody(node)
+}
+
+// saveNode updates a registered node.  Only enabled and the labels can
+// be changed, the rest is reported by the node itself.
+func (m *masterService) saveNode(w http.ResponseWriter, r *http.Request) RestResponse {
+	resp := &JSONResponse{}
+	name := mux.Vars(r)["name"]
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error("error reading body: %s", err)
+		return resp.SetStatus(400).SetBody(`{"error":"Unable to read request"}`)
+	}
+	req := &model.Node{}
+	if err = json.Unmarshal(b, req); err != nil {
+		log.Error("error decoding json: %s", err)
+		return resp.SetStatus(400).SetBody(`{"error":"Unable to parse request"}`)
+	}
+	if req.Name != "" && req.Name != name {
+		return resp.SetStatus(400).SetBody(`{"error":"Name does not match the url"}`)
+	}
+	if err := model.ValidateLabels(req.Labels); err != nil {
+		return resp.SetStatus(400).SetBody(map[string]string{"error": err.Error()})
+	}
+
+	var node *model.Node
+	if terr := m.db.Trx(func(db Db) {
+		if node, err = db.GetNode(name); err != nil {
+			return
+		}
+		current := node.ResourceVersion
+		node.ResourceVersion = req.ResourceVersion
+		if err = matchVersion(r, &node.ResourceVersion, func() (string, error) { return current, nil }); err != nil {
+			return
+		}
+		node.Enabled = req.Enabled
+		node.Labels = req.Labels
+		err = db.SaveNode(node)
+	}); terr != nil {
+		return unavailableResponse(terr)
+	}
+	if node == nil {
+		return resp.SetStatus(404).SetBody(`{"error":"node not found"}`)
+	}
+	if _, ok := err.(*ConflictError); ok {
+		return conflictResponse(r, err)
+	}
+	if err != nil {
+		log.Error("error saving node %s: %s", name, err)
+		return resp.SetStatus(500).SetBody(`{"error":"Unable to save node"}`)
+	}
+	return resp.SetETag(node.ResourceVersion).SetBody(node)
+}
+
+// matchVersion sets version to the one required by the If-Match header
+// of r, if any.  For "*" the object must exist and current returns its
+// version.
+func matchVersion(r *http.Request, version *string, current func() (string, error)) error {
+	switch v := ifMatch(r); v {
+	case "":
+	case "*":
+		stored, err := current()
+		if err != nil {
+			return err
+		}
+		*version = stored
+	default:
+		*version = v
+	}
+	return nil
 }
@@ -0,0 +1,707 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/libgolang/one/clients"
+	"github.com/libgolang/one/model"
+)
+
+// newTestMaster returns a master on a file db in a temporary directory
+// and call, serving a request on the routes of the master.  The master
+// is stopped and the directory removed when the test ends.
+func newTestMaster(t *testing.T) (*masterService, Db, func(method, url, body string) *httptest.ResponseRecorder) {
+	tmpDir, err := ioutil.TempDir("", "testing-master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRestServer("127.0.0.1:0", "", "").(*restServer)
+	db := NewFrontDb(NewDb(tmpDir))
+	m := NewMasterService(rs, db, "example.com", nil, nil, "").(*masterService)
+	t.Cleanup(func() {
+		m.stop()
+		_ = os.RemoveAll(tmpDir)
+	})
+	call := func(method, url, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		rs.router.ServeHTTP(rec, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return rec
+	}
+	return m, db, call
+}
+
+func TestDefinitionETag(t *testing.T) {
+	// given
+	m, _, _ := newTestMaster(t)
+	call := func(method, url, body, match string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if match != "" {
+			req.Header.Set("If-Match", match)
+		}
+		rec := httptest.NewRecorder()
+		m.rs.(*restServer).router.ServeHTTP(rec, req)
+		return rec
+	}
+	created := call("PUT", "/master/definitions/web", `{"image":"nginx"}`, "")
+	etag := created.Header().Get("ETag")
+
+	// when
+	updated := call("PUT", "/master/definitions/web", `{"image":"nginx:1.15"}`, etag)
+	staleHeader := call("PUT", "/master/definitions/web", `{"image":"httpd"}`, etag)
+	staleBody := call("PUT", "/master/definitions/web", `{"image":"httpd","resourceVersion":`+etag+`}`, "")
+	missing := call("PUT", "/master/definitions/db", `{"image":"postgres"}`, "*")
+
+	// then
+	if created.Code != http.StatusOK || etag == "" {
+		t.Fatalf("create should return an ETag, got %d %q", created.Code, etag)
+	}
+	if updated.Code != http.StatusOK || updated.Header().Get("ETag") == etag {
+		t.Errorf("update with the current ETag should succeed with a new ETag, got %d", updated.Code)
+	}
+	if staleHeader.Code != http.StatusPreconditionFailed {
+		t.Errorf("stale If-Match should return 412, got %d", staleHeader.Code)
+	}
+	if staleBody.Code != http.StatusConflict {
+		t.Errorf("stale body version should return 409, got %d", staleBody.Code)
+	}
+	if missing.Code != http.StatusPreconditionFailed {
+		t.Errorf("If-Match * of a missing definition should return 412, got %d", missing.Code)
+	}
+	if got := call("GET", "/master/definitions/web", "", ""); got.Header().Get("ETag") != updated.Header().Get("ETag") {
+		t.Errorf("GET should return the current ETag, got %q", got.Header().Get("ETag"))
+	}
+}
+
+func TestContainerLifecycle(t *testing.T) {
+	// given
+	m, db, call := newTestMaster(t)
+	ping := func(body string) *model.NodeInfoResponse {
+		res := &model.NodeInfoResponse{}
+		_ = json.Unmarshal(call("POST", "/master/nodeinfo", body).Body.Bytes(), res)
+		return res
+	}
+	state := func(name string) string {
+		if cont, ok := db.ListContainers()[name]; ok {
+			return cont.State
+		}
+		return "deleted"
+	}
+	_ = db.SaveDefinition(&model.Definition{Name: "web", Image: "nginx", Count: 1})
+
+	// when no node is known
+	m.allocateContainers()
+
+	// then
+	if got := state("web-1"); got != model.ContainerPending {
+		t.Fatalf("container without node should be Pending, got %s", got)
+	}
+
+	// when a node registers
+	ping(`{"node":{"name":"node01","addr":"10.0.0.1"}}`)
+	m.allocateContainers()
+
+	// then
+	if got := state("web-1"); got != model.ContainerScheduled {
+		t.Fatalf("container should be Scheduled, got %s", got)
+	}
+
+	// when the node has not started it yet
+	res := ping(`{"node":{"name":"node01","addr":"10.0.0.1"}}`)
+
+	// then
+	if got := state("web-1"); got != model.ContainerStarting || len(res.Containers) != 1 {
+		t.Fatalf("container should be Starting and sent to the node, got %s %v", got, res.Containers)
+	}
+
+	// when the node fails to start it
+	ping(`{"node":{"name":"node01","addr":"10.0.0.1"},"errors":{"web-1":"unable to pull image nginx"}}`)
+
+	// then
+	if cont := db.ListContainers()["web-1"]; cont.State != model.ContainerFailed || cont.Message != "unable to pull image nginx" {
+		t.Fatalf("container should be Failed with the node error, got %s %q", cont.State, cont.Message)
+	}
+
+	// when the node runs it
+	ping(`{"node":{"name":"node01","addr":"10.0.0.1"},"containers":[{"name":"web-1","containerId":"abc","running":true,"restartCount":2}]}`)
+
+	// then
+	if cont := db.ListContainers()["web-1"]; cont.State != model.ContainerRunning || cont.ContainerID != "abc" || cont.RestartCount != 2 {
+		t.Fatalf("container should be Running with the observed fields, got %+v", cont)
+	}
+
+	// when the definition is scaled down
+	def, _ := db.GetDefinition("web")
+	def.Count = 0
+	_ = db.SaveDefinition(def)
+	m.allocateContainers()
+	res = ping(`{"node":{"name":"node01","addr":"10.0.0.1"},"containers":[{"name":"web-1","containerId":"abc","running":true}]}`)
+
+	// then
+	if got := state("web-1"); got != model.ContainerTerminating || len(res.Containers) != 0 {
+		t.Fatalf("container should be Terminating until removed, got %s %v", got, res.Containers)
+	}
+
+	// when the node removed it
+	ping(`{"node":{"name":"node01","addr":"10.0.0.1"}}`)
+
+	// then
+	if got := state("web-1"); got != "deleted" {
+		t.Errorf("container should be deleted once the node removed it, got %s", got)
+	}
+}
+
+func TestContainerStats(t *testing.T) {
+	// given
+	_, db, call := newTestMaster(t)
+	_ = db.SaveContainer(&model.Container{Name: "web-1", DefinitionName: "web", NodeName: "node01", State: model.ContainerScheduled})
+
+	// when
+	for _, cpu := range []string{"12.5", "50"} {
+		call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"},
+			"containers":[{"name":"web-1","running":true}],
+			"stats":{"web-1":{"cpuPercent":`+cpu+`,"memoryUsage":1024}}}`)
+	}
+	rec := call("GET", "/master/containers/web-1/stats", "")
+	missing := call("GET", "/master/containers/web-9/stats", "")
+
+	// then
+	history := &model.ContainerStatsHistory{}
+	_ = json.Unmarshal(rec.Body.Bytes(), history)
+	if rec.Code != http.StatusOK || history.Current == nil || history.Current.CPUPercent != 50 || len(history.History) != 2 {
+		t.Errorf("stats should hold the current sample and the history, got %d %s", rec.Code, rec.Body.String())
+	}
+	if missing.Code != http.StatusNotFound {
+		t.Errorf("stats of an unknown container should return 404, got %d", missing.Code)
+	}
+	if cont := db.ListContainers()["web-1"]; cont.Stats == nil || cont.Stats.MemoryUsage != 1024 {
+		t.Error("the container should carry its current stats")
+	}
+}
+
+func TestDefinitionLabels(t *testing.T) {
+	// given
+	m, db, call := newTestMaster(t)
+	call("PUT", "/master/definitions/web", `{"image":"nginx","count":1,"labels":{"app":"web","tier":"front"},"annotations":{"owner":"Web Team"}}`)
+	call("PUT", "/master/definitions/db", `{"image":"postgres","count":1,"labels":{"app":"db"}}`)
+	m.allocateContainers()
+
+	// when
+	reserved := call("PUT", "/master/definitions/web", `{"image":"nginx","labels":{"one.managed":"false"}}`)
+	selected := call("GET", "/master/containers?selector=app+in+(web,cache),tier!=db", "")
+	_ = db.SaveDefinition(&model.Definition{Name: "db", Image: "postgres", Count: 1, Labels: map[string]string{"app": "db", "tier": "back"}})
+	m.allocateContainers()
+
+	// then
+	if reserved.Code != http.StatusBadRequest {
+		t.Errorf("labels of the reserved prefix should be refused, got %d", reserved.Code)
+	}
+	conts := make(map[string]*model.Container)
+	_ = json.Unmarshal(selected.Body.Bytes(), &conts)
+	if len(conts) != 1 || conts["web-1"] == nil || conts["web-1"].Annotations["owner"] != "Web Team" {
+		t.Errorf("the selector should match web-1 with the definition labels, got %s", selected.Body.String())
+	}
+	if cont := db.ListContainers()["db-1"]; cont == nil || cont.Labels["tier"] != "back" {
+		t.Errorf("new labels of the definition should be copied to its containers, got %+v", cont)
+	}
+}
+
+func TestGlobalDefinition(t *testing.T) {
+	// given
+	m, db, call := newTestMaster(t)
+	byNode := func() map[string]int {
+		result := make(map[string]int)
+		for _, cont := range db.ListContainers() {
+			if cont.Desired() == model.ContainerRunning {
+				result[cont.NodeName]++
+			}
+		}
+		return result
+	}
+	for _, node := range []string{"node01", "node02", "node03"} {
+		call("POST", "/master/nodeinfo", `{"node":{"name":"`+node+`","addr":"10.0.0.1"}}`)
+	}
+	call("PUT", "/master/nodes/node03", `{"enabled":true,"labels":{"role":"edge"}}`)
+	invalid := call("PUT", "/master/definitions/bad", `{"image":"busybox","mode":"global","nodeSelector":"role in edge"}`)
+	call("PUT", "/master/definitions/exporter", `{"image":"node-exporter","mode":"global","count":1}`)
+	call("PUT", "/master/definitions/shipper", `{"image":"shipper","mode":"global","nodeSelector":"role!=edge"}`)
+
+	// when
+	m.allocateContainers()
+	m.allocateContainers()
+	first := byNode()
+	call("PUT", "/master/nodes/node01", `{"enabled":false}`)
+	call("PUT", "/master/nodes/node02", `{"enabled":true,"labels":{"role":"edge"}}`)
+	call("POST", "/master/nodeinfo", `{"node":{"name":"node04","addr":"10.0.0.4"}}`)
+	m.allocateContainers()
+
+	// then
+	if invalid.Code != http.StatusBadRequest {
+		t.Errorf("invalid node selector should be refused, got %d", invalid.Code)
+	}
+	if first["node01"] != 2 || first["node02"] != 2 || first["node03"] != 1 {
+		t.Errorf("every eligible node should run one container of each global definition, got %v", first)
+	}
+	if then := byNode(); then["node01"] != 0 || then["node02"] != 1 || then["node03"] != 1 || then["node04"] != 2 {
+		t.Errorf("containers should follow the nodes and their labels, got %v", then)
+	}
+}
+
+func TestDefinitionDependencies(t *testing.T) {
+	// given
+	m, db, call := newTestMaster(t)
+	state := func(name string) string {
+		if cont, ok := db.ListContainers()[name]; ok {
+			return cont.State
+		}
+		return "deleted"
+	}
+	call("PUT", "/master/definitions/db", `{"image":"postgres","count":1}`)
+	call("PUT", "/master/definitions/web", `{"image":"nginx","count":1,"dependsOn":[{"name":"db","condition":"healthy"}]}`)
+	self := call("PUT", "/master/definitions/loop", `{"image":"busybox","dependsOn":[{"name":"loop"}]}`)
+	cycle := call("PUT", "/master/definitions/db", `{"image":"postgres","count":1,"dependsOn":[{"name":"web"}]}`)
+	call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"}}`)
+
+	// when the dependency starts but is not healthy yet
+	m.allocateContainers()
+	call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"},"containers":[{"name":"db-1","running":true,"health":"starting"}]}`)
+	m.allocateContainers()
+
+	// then
+	if self.Code != http.StatusBadRequest {
+		t.Errorf("a definition depending on itself should be refused, got %d", self.Code)
+	}
+	cycleErr := map[string]string{}
+	_ = json.Unmarshal(cycle.Body.Bytes(), &cycleErr)
+	if cycle.Code != http.StatusConflict || cycleErr["error"] != "dependency cycle: db -> web -> db" {
+		t.Errorf("a dependency cycle should be refused, got %d %s", cycle.Code, cycle.Body.String())
+	}
+	if got := state("web-1"); got != "deleted" {
+		t.Fatalf("web should wait for db to be healthy, got %s", got)
+	}
+	if def, _ := db.GetDefinition("web"); def.Status == nil || def.Status.Waiting != "waiting for db to be healthy" {
+		t.Errorf("web should record why it waits, got %+v", def.Status)
+	}
+
+	// when the dependency is healthy
+	call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"},"containers":[{"name":"db-1","running":true,"health":"healthy"}]}`)
+	m.allocateContainers()
+
+	// then
+	if got := state("web-1"); got != model.ContainerScheduled {
+		t.Fatalf("web should start once db is healthy, got %s", got)
+	}
+	if def, _ := db.GetDefinition("web"); def.Status.Waiting != "" {
+		t.Errorf("web should no longer wait, got %q", def.Status.Waiting)
+	}
+
+	// when both are scaled down
+	call("PUT", "/master/definitions/db", `{"image":"postgres","count":0}`)
+	call("PUT", "/master/definitions/web", `{"image":"nginx","count":0,"dependsOn":[{"name":"db","condition":"healthy"}]}`)
+	m.allocateContainers()
+
+	// then
+	if state("web-1") != model.ContainerTerminating || state("db-1") != model.ContainerRunning {
+		t.Fatalf("web should be removed before db, got web %s db %s", state("web-1"), state("db-1"))
+	}
+
+	// when the node removed web
+	call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"},"containers":[{"name":"db-1","running":true,"health":"healthy"}]}`)
+	m.allocateContainers()
+
+	// then
+	if got := state("db-1"); got != model.ContainerTerminating {
+		t.Errorf("db should be removed after web, got %s", got)
+	}
+}
+
+func TestGlobalDependencyTeardown(t *testing.T) {
+	// given
+	m, db, call := newTestMaster(t)
+	desired := func(defName string) int {
+		n := 0
+		for _, cont := range db.ListContainersByDefinition(defName) {
+			if cont.Desired() == model.ContainerRunning {
+				n++
+			}
+		}
+		return n
+	}
+	call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"}}`)
+	call("PUT", "/master/definitions/agent", `{"image":"agent","mode":"global"}`)
+	call("PUT", "/master/definitions/web", `{"image":"nginx","count":1,"dependsOn":[{"name":"agent"}]}`)
+	m.allocateContainers()
+	for name := range db.ListContainersByDefinition("agent") {
+		call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"},"containers":[{"name":"`+name+`","running":true}]}`)
+	}
+	m.allocateContainers()
+
+	// when no node is eligible for the global definition anymore
+	call("PUT", "/master/definitions/agent", `{"image":"agent","mode":"global","nodeSelector":"role=edge"}`)
+	call("PUT", "/master/definitions/web", `{"image":"nginx","count":0,"dependsOn":[{"name":"agent"}]}`)
+	m.allocateContainers()
+
+	// then
+	if desired("web") != 0 || desired("agent") != 1 {
+		t.Fatalf("web should be removed before agent, got web %d agent %d", desired("web"), desired("agent"))
+	}
+
+	// when the node removed web
+	call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"}}`)
+	m.allocateContainers()
+
+	// then
+	if desired("agent") != 0 {
+		t.Errorf("agent should be removed after web, got %d", desired("agent"))
+	}
+}
+
+func TestDefinitionDelete(t *testing.T) {
+	// given
+	m, db, call := newTestMaster(t)
+	state := func(name string) string {
+		if cont, ok := db.ListContainers()[name]; ok {
+			return cont.State
+		}
+		return "deleted"
+	}
+	call("PUT", "/master/definitions/db", `{"image":"postgres","count":1}`)
+	call("PUT", "/master/definitions/web", `{"image":"nginx","count":1,"dependsOn":[{"name":"db"}]}`)
+	call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"}}`)
+	m.allocateContainers()
+	call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"},"containers":[{"name":"db-1","running":true}]}`)
+	m.allocateContainers()
+	call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"},"containers":[{"name":"db-1","running":true},{"name":"web-1","running":true}]}`)
+
+	// when both are deleted
+	missing := call("DELETE", "/master/definitions/missing", "")
+	deleted := call("DELETE", "/master/definitions/db", "")
+	call("DELETE", "/master/definitions/web", "")
+	updated := call("PUT", "/master/definitions/db", `{"image":"postgres","count":2}`)
+	m.allocateContainers()
+
+	// then
+	if missing.Code != http.StatusNotFound || deleted.Code != http.StatusAccepted {
+		t.Errorf("delete should answer 404 for a missing definition and 202 otherwise, got %d and %d", missing.Code, deleted.Code)
+	}
+	if updated.Code != http.StatusConflict {
+		t.Errorf("a definition being deleted should not be updated, got %d", updated.Code)
+	}
+	if state("web-1") != model.ContainerTerminating || state("db-1") != model.ContainerRunning {
+		t.Fatalf("web should be removed before db, got web %s db %s", state("web-1"), state("db-1"))
+	}
+
+	// when the node removed web, then db
+	call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"},"containers":[{"name":"db-1","running":true}]}`)
+	m.allocateContainers()
+	removing := state("db-1")
+	call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"}}`)
+	m.allocateContainers()
+
+	// then
+	if removing != model.ContainerTerminating {
+		t.Errorf("db should be removed after web, got %s", removing)
+	}
+	if defs := db.ListDefinitions(); len(defs) != 0 {
+		t.Errorf("definitions should be deleted with their containers, got %v", defs)
+	}
+}
+
+func TestDefinitionSidecars(t *testing.T) {
+	// given
+	m, db, call := newTestMaster(t)
+	invalid := call("PUT", "/master/definitions/bad", `{"image":"nginx","sidecars":[{"name":"Cache","image":"redis"}]}`)
+	twice := call("PUT", "/master/definitions/bad", `{"image":"nginx","sidecars":[{"name":"cache","image":"redis"},{"name":"cache","image":"memcached"}]}`)
+	call("PUT", "/master/definitions/web", `{"image":"nginx","count":1,"sidecars":[{"name":"cache","image":"redis"},{"name":"tls","image":"stunnel"}]}`)
+	call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"}}`)
+	m.allocateContainers()
+
+	// when the node reports a dead sidecar
+	rec := call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"},"containers":[
+		{"name":"web-1","running":false,"message":"sidecar tls exited with code 1","sidecarStates":[{"name":"cache","running":true},{"name":"tls","exitCode":1}]}]}`)
+	res := &model.NodeInfoResponse{}
+	_ = json.Unmarshal(rec.Body.Bytes(), res)
+
+	// then
+	if invalid.Code != http.StatusBadRequest || twice.Code != http.StatusBadRequest {
+		t.Errorf("invalid sidecars should be refused, got %d and %d", invalid.Code, twice.Code)
+	}
+	if len(res.Containers) != 1 || len(res.Containers[0].Sidecars) != 2 || res.Containers[0].Sidecars[1].Image != "stunnel" {
+		t.Fatalf("the node should be sent the container with its sidecars, got %+v", res.Containers)
+	}
+	cont := db.ListContainers()["web-1"]
+	if cont.State != model.ContainerFailed || cont.Message != "sidecar tls exited with code 1" || len(cont.SidecarStates) != 2 {
+		t.Errorf("the group should be Failed with the state of its sidecars, got %+v", cont)
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	// given
+	m, _, call := newTestMaster(t)
+	badSubnet := call("PUT", "/master/networks/backend", `{"subnet":"10.0.0.0/33"}`)
+	reserved := call("PUT", "/master/networks/host", `{}`)
+	saved := call("PUT", "/master/networks/backend", `{"subnet":"10.10.0.0/24","internal":true}`)
+	call("PUT", "/master/networks/unused", `{}`)
+	unknown := call("PUT", "/master/definitions/api", `{"image":"api","count":1,"networks":["frontend"]}`)
+	call("PUT", "/master/definitions/api", `{"image":"api","count":1,"networks":["backend"]}`)
+	call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"}}`)
+	m.allocateContainers()
+
+	// when
+	rec := call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"}}`)
+	res := &model.NodeInfoResponse{}
+	_ = json.Unmarshal(rec.Body.Bytes(), res)
+
+	// then
+	if badSubnet.Code != http.StatusBadRequest || reserved.Code != http.StatusBadRequest {
+		t.Errorf("invalid networks should be refused, got %d and %d", badSubnet.Code, reserved.Code)
+	}
+	if saved.Code != http.StatusOK || saved.Header().Get("ETag") == "" {
+		t.Errorf("network should be saved with an ETag, got %d", saved.Code)
+	}
+	if unknown.Code != http.StatusBadRequest {
+		t.Errorf("a definition joining an undeclared network should be refused, got %d", unknown.Code)
+	}
+	if len(res.Containers) != 1 || len(res.Containers[0].Networks) != 1 || res.Containers[0].Networks[0] != "backend" {
+		t.Fatalf("the container should join the networks of its definition, got %+v", res.Containers)
+	}
+	if len(res.Networks) != 1 || res.Networks[0].Name != "backend" || res.Networks[0].Subnet != "10.10.0.0/24" {
+		t.Errorf("the node should be sent only the networks of its containers, got %+v", res.Networks)
+	}
+	if list := call("GET", "/master/networks?internal=true&fields=name&output=array", ""); list.Body.String() != `[{"name":"backend"}]` {
+		t.Errorf("networks should be listed and filtered, got %s", list.Body.String())
+	}
+}
+
+func TestNamedVolumes(t *testing.T) {
+	// given
+	m, db, call := newTestMaster(t)
+	call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"}}`)
+	call("POST", "/master/nodeinfo", `{"node":{"name":"node02","addr":"10.0.0.2"}}`)
+	invalid := call("PUT", "/master/definitions/bad", `{"image":"postgres","namedVolumes":[{"name":"data-{{.Index","path":"/data"}]}`)
+	call("PUT", "/master/definitions/db", `{"image":"postgres","count":1,"namedVolumes":[{"name":"data-{{.Index}}","path":"/var/lib/postgresql"}]}`)
+
+	// when
+	m.allocateContainers()
+	m.allocateContainers()
+
+	// then
+	if invalid.Code != http.StatusBadRequest {
+		t.Errorf("an invalid volume name should be refused, got %d", invalid.Code)
+	}
+	first, ok := db.ListContainers()["db-1"]
+	if !ok || first.Index != 0 || len(first.NamedVolumes) != 1 || first.NamedVolumes[0].Name != "data-0" {
+		t.Fatalf("the first replica should mount data-0, got %+v", first)
+	}
+	def, _ := db.GetDefinition("db")
+	if def.Status == nil || def.Status.Pins[0] != first.NodeName {
+		t.Fatalf("replica 0 should be pinned to %s, got %+v", first.NodeName, def.Status)
+	}
+
+	// when the node of the replica is disabled while it is recreated
+	call("PUT", "/master/definitions/db", `{"image":"postgres","count":0,"namedVolumes":[{"name":"data-{{.Index}}","path":"/var/lib/postgresql"}]}`)
+	m.allocateContainers()
+	call("POST", "/master/nodeinfo", `{"node":{"name":"`+first.NodeName+`","addr":"10.0.0.1"}}`)
+	call("PUT", "/master/nodes/"+first.NodeName, `{"enabled":false}`)
+	call("PUT", "/master/definitions/db", `{"image":"postgres","count":1,"namedVolumes":[{"name":"data-{{.Index}}","path":"/var/lib/postgresql"}]}`)
+	m.allocateContainers()
+
+	// then
+	second, ok := db.ListContainers()["db-2"]
+	if !ok || second.Index != 0 || second.State != model.ContainerPending {
+		t.Fatalf("replica 0 should wait for its node, got %+v", second)
+	}
+
+	// when the replica is released
+	notPinned := call("POST", "/master/definitions/db/replicas/1/release", "")
+	released := call("POST", "/master/definitions/db/replicas/0/release", "")
+	m.allocateContainers()
+	call("POST", "/master/nodeinfo", `{"node":{"name":"node02","addr":"10.0.0.2"},"volumes":[{"name":"data-0","driver":"local","scope":"local","definitionName":"db","index":0}]}`)
+
+	// then
+	if notPinned.Code != http.StatusNotFound || released.Code != http.StatusOK {
+		t.Errorf("only pinned replicas should be released, got %d and %d", notPinned.Code, released.Code)
+	}
+	if second = db.ListContainers()["db-2"]; second.NodeName == first.NodeName || second.State == model.ContainerPending {
+		t.Errorf("the released replica should run on another node, got %+v", second)
+	}
+	if list := call("GET", "/master/volumes?fields=name,nodeName&output=array", ""); list.Body.String() != `[{"name":"data-0","nodeName":"node02"}]` {
+		t.Errorf("volumes of the nodes should be listed, got %s", list.Body.String())
+	}
+}
+
+func TestStatefulDefinition(t *testing.T) {
+	// given
+	m, db, call := newTestMaster(t)
+	report := func(names ...string) {
+		conts := make([]string, len(names))
+		for i, name := range names {
+			conts[i] = `{"name":"` + name + `","running":true}`
+		}
+		call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"},"containers":[`+strings.Join(conts, ",")+`]}`)
+	}
+	state := func(name string) string {
+		if cont, ok := db.ListContainers()[name]; ok {
+			return cont.State
+		}
+		return "deleted"
+	}
+	report()
+	call("PUT", "/master/definitions/db", `{"image":"postgres","mode":"stateful","count":3}`)
+
+	// when
+	m.allocateContainers()
+	m.allocateContainers()
+
+	// then
+	if state("db-0") != model.ContainerScheduled || state("db-1") != "deleted" {
+		t.Fatalf("db-1 should wait for db-0 to run, got db-0 %s db-1 %s", state("db-0"), state("db-1"))
+	}
+
+	// when the ordinals start in order
+	report("db-0")
+	m.allocateContainers()
+	report("db-0", "db-1")
+	m.allocateContainers()
+	report("db-0", "db-1", "db-2")
+
+	// then
+	for i, name := range []string{"db-0", "db-1", "db-2"} {
+		if cont, ok := db.ListContainers()[name]; !ok || cont.Index != i || cont.State != model.ContainerRunning {
+			t.Fatalf("%s should run with ordinal %d, got %+v", name, i, cont)
+		}
+	}
+
+	// when scaled down
+	call("PUT", "/master/definitions/db", `{"image":"postgres","mode":"stateful","count":1}`)
+	m.allocateContainers()
+	m.allocateContainers()
+
+	// then
+	if state("db-2") != model.ContainerTerminating || state("db-1") != model.ContainerRunning {
+		t.Fatalf("db-2 should be removed before db-1, got db-1 %s db-2 %s", state("db-1"), state("db-2"))
+	}
+
+	// when db-2 is gone and db-1 is scaled back up after its removal
+	report("db-0", "db-1")
+	m.allocateContainers()
+	removing := state("db-1")
+	report("db-0")
+	call("PUT", "/master/definitions/db", `{"image":"postgres","mode":"stateful","count":2}`)
+	m.allocateContainers()
+
+	// then
+	if removing != model.ContainerTerminating || state("db-2") != "deleted" {
+		t.Errorf("db-1 should be removed after db-2, got db-1 %s db-2 %s", removing, state("db-2"))
+	}
+	if state("db-1") != model.ContainerScheduled {
+		t.Errorf("ordinal 1 should be created again as db-1, got %s", state("db-1"))
+	}
+}
+
+func TestStatefulFailedOrdinal(t *testing.T) {
+	// given
+	m, db, call := newTestMaster(t)
+	report := func(conts string) {
+		call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"},"containers":[`+conts+`]}`)
+	}
+	report("")
+	call("PUT", "/master/definitions/db", `{"image":"postgres","mode":"stateful","count":2}`)
+	m.allocateContainers()
+
+	// when ordinal 0 fails
+	report(`{"name":"db-0","running":false,"exitCode":1}`)
+	m.allocateContainers()
+	replaced := db.ListContainers()["db-0"]
+	report("")
+	m.allocateContainers()
+
+	// then
+	if replaced.Desired() != model.ContainerTerminated {
+		t.Errorf("the failed ordinal should be removed, got %+v", replaced)
+	}
+	if cont, ok := db.ListContainers()["db-0"]; !ok || cont.Index != 0 || cont.State != model.ContainerScheduled {
+		t.Errorf("ordinal 0 should be created again as db-0, got %+v", cont)
+	}
+	if _, ok := db.ListContainers()["db-1"]; ok {
+		t.Error("db-1 should wait for db-0 to run")
+	}
+}
+
+func TestStatefulModeChange(t *testing.T) {
+	// given
+	m, db, call := newTestMaster(t)
+	call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"}}`)
+	call("PUT", "/master/definitions/web", `{"image":"nginx","count":1}`)
+	m.allocateContainers()
+	_ = db.SaveContainer(&model.Container{Name: "db-0", DefinitionName: "legacy", DesiredState: model.ContainerRunning, State: model.ContainerRunning})
+	call("PUT", "/master/definitions/db", `{"image":"postgres","mode":"stateful","count":1}`)
+
+	// when
+	changed := call("PUT", "/master/definitions/web", `{"image":"nginx","mode":"stateful","count":1}`)
+	m.allocateContainers()
+
+	// then
+	if changed.Code != http.StatusConflict {
+		t.Errorf("mode change to stateful should be refused while containers remain, got %d", changed.Code)
+	}
+	if cont := db.ListContainers()["db-0"]; cont == nil || cont.DefinitionName != "legacy" || cont.Image != "" {
+		t.Errorf("an existing container should never be overwritten, got %+v", cont)
+	}
+}
+
+func TestRegistries(t *testing.T) {
+	// given
+	m, db, call := newTestMaster(t)
+	m.registryKey = []byte("0123456789abcdef0123456789abcdef")
+	m.nodeToken = "node-secret"
+	badHost := call("PUT", "/master/registries/private", `{"host":"https://registry.example.com/v2"}`)
+	saved := call("PUT", "/master/registries/private", `{"host":"registry.example.com","username":"ci","password":"s3cret"}`)
+	call("PUT", "/master/registries/private", `{"host":"registry.example.com","username":"deploy"}`)
+	sameHost := call("PUT", "/master/registries/other", `{"host":"registry.example.com"}`)
+	unknown := call("PUT", "/master/definitions/api", `{"image":"api","count":1,"registry":"missing"}`)
+	call("PUT", "/master/definitions/api", `{"image":"registry.example.com/team/api:1.0","count":1}`)
+	call("PUT", "/master/definitions/web", `{"image":"nginx","count":1}`)
+	call("POST", "/master/nodeinfo", `{"node":{"name":"node01","addr":"10.0.0.1"}}`)
+	m.allocateContainers()
+
+	ping := func(url, token string) *model.NodeInfoResponse {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", url, strings.NewReader(`{"node":{"name":"node01","addr":"10.0.0.1"}}`))
+		req.Header.Set(clients.NodeTokenHeader, token)
+		m.rs.(*restServer).router.ServeHTTP(rec, req)
+		res := &model.NodeInfoResponse{}
+		_ = json.Unmarshal(rec.Body.Bytes(), res)
+		return res
+	}
+
+	// when
+	res := ping("https://master/master/nodeinfo", "node-secret")
+	plain := ping("http://master/master/nodeinfo", "node-secret")
+	untrusted := ping("https://master/master/nodeinfo", "guess")
+
+	// then
+	if badHost.Code != http.StatusBadRequest || sameHost.Code != http.StatusBadRequest || unknown.Code != http.StatusBadRequest {
+		t.Errorf("invalid registries and references should be refused, got %d, %d and %d", badHost.Code, sameHost.Code, unknown.Code)
+	}
+	if saved.Code != http.StatusOK || strings.Contains(saved.Body.String(), "s3cret") {
+		t.Errorf("registry should be saved without returning its password, got %d %s", saved.Code, saved.Body.String())
+	}
+	if stored, _ := db.GetRegistry("private"); stored.Password != "" || stored.EncryptedPassword == "" {
+		t.Errorf("password should be stored encrypted, got %+v", stored)
+	}
+	if len(res.Registries) != 1 || res.Registries[0] != (model.RegistryAuth{Host: "registry.example.com", Username: "deploy", Password: "s3cret"}) {
+		t.Errorf("the node should be sent the credentials of the registries of its images, got %+v", res.Registries)
+	}
+	if len(plain.Registries) != 0 || len(untrusted.Registries) != 0 {
+		t.Errorf("credentials should only be sent over TLS with the node token, got %+v and %+v", plain.Registries, untrusted.Registries)
+	}
+	if list := call("GET", "/master/registries?output=array", ""); strings.Contains(list.Body.String(), "assword") {
+		t.Errorf("registries should be listed without passwords, got %s", list.Body.String())
+	}
+}
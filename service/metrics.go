@@ -0,0 +1,242 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libgolang/log"
+)
+
+// metric types of the Prometheus text format
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+// labelEscaper escapes label values as the text format requires
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// defaultBuckets upper bounds in seconds of the latency histograms
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metrics every metric of the process.  Master and node metrics are
+// registered by the files that update them.
+var metrics = newMetricsRegistry()
+
+// metricsRegistry metrics written in the Prometheus text exposition
+// format
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{}
+}
+
+// metric family of series with the same name and label names
+type metric struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+	series  map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels []string
+	value  float64  // counters and gauges
+	counts []uint64 // histogram observations by bucket
+	sum    float64
+	count  uint64
+}
+
+func (r *metricsRegistry) register(m *metric) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m.series = make(map[string]*metricSeries)
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+// counter registers a counter with the given label names
+func (r *metricsRegistry) counter(name, help string, labels ...string) *metric {
+	return r.register(&metric{name: name, help: help, typ: metricCounter, labels: labels})
+}
+
+// gauge registers a gauge with the given label names
+func (r *metricsRegistry) gauge(name, help string, labels ...string) *metric {
+	return r.register(&metric{name: name, help: help, typ: metricGauge, labels: labels})
+}
+
+// histogram registers a histogram with the given bucket upper bounds,
+// defaultBuckets when nil, and label names
+func (r *metricsRegistry) histogram(name, help string, buckets []float64, labels ...string) *metric {
+	if buckets == nil {
+		buckets = defaultBuckets
+	}
+	return r.register(&metric{name: name, help: help, typ: metricHistogram, labels: labels, buckets: buckets})
+}
+
+// get returns the series of the label values, creating it when missing.
+// It must be called with m.mu held.
+func (m *metric) get(values []string) *metricSeries {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s takes %d labels, got %d", m.name, len(m.labels), len(values)))
+	}
+	key := strings.Join(values, "\x00")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labels: append([]string{}, values...)}
+		if m.typ == metricHistogram {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// inc adds one to a counter or gauge
+func (m *metric) inc(labels ...string) {
+	m.add(1, labels...)
+}
+
+// add adds v to a counter or gauge
+func (m *metric) add(v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labels).value += v
+}
+
+// set sets a gauge
+func (m *metric) set(v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labels).value = v
+}
+
+// reset removes every series, used by gauges computed from scratch
+func (m *metric) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.series = make(map[string]*metricSeries)
+}
+
+// observe records v in a histogram
+func (m *metric) observe(v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labels)
+	for i, le := range m.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// since records the seconds elapsed since start in a histogram
+func (m *metric) since(start time.Time, labels ...string) {
+	m.observe(time.Since(start).Seconds(), labels...)
+}
+
+// write writes every metric of r in the text exposition format
+func (r *metricsRegistry) write(out io.Writer) error {
+	r.mu.Lock()
+	list := append([]*metric{}, r.metrics...)
+	r.mu.Unlock()
+
+	w := bufio.NewWriter(out)
+	for _, m := range list {
+		m.write(w)
+	}
+	return w.Flush()
+}
+
+func (m *metric) write(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, strings.Replace(m.help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.typ != metricHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, m.labelPairs(s.labels, ""), formatMetricValue(s.value))
+			continue
+		}
+		for i, le := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelPairs(s.labels, formatMetricValue(le)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelPairs(s.labels, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, m.labelPairs(s.labels, ""), formatMetricValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, m.labelPairs(s.labels, ""), s.count)
+	}
+}
+
+// labelPairs formats the labels of a series, le is the bucket label of
+// histograms
+func (m *metric) labelPairs(values []string, le string) string {
+	pairs := make([]string, 0, len(values)+1)
+	for i, name := range m.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i])))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=%q", le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// MetricsService serves the metrics of the process on /metrics in the
+// Prometheus text exposition format
+type MetricsService interface {
+}
+
+type metricsService struct {
+	rs RestServer
+}
+
+// NewMetricsService constructor
+func NewMetricsService(rs RestServer) MetricsService {
+	s := &metricsService{rs: rs}
+	s.init()
+	return s
+}
+
+func (s *metricsService) init() {
+	s.rs.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) RestResponse { return s.serveMetrics(w, r) }).Methods("GET")
+}
+
+func (s *metricsService) serveMetrics(w http.ResponseWriter, r *http.Request) RestResponse {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := metrics.write(w); err != nil {
+		log.Error("unable to write metrics: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package service
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libgolang/one/model"
+)
+
+func TestMetricsTextFormat(t *testing.T) {
+	// given
+	r := newMetricsRegistry()
+	requests := r.counter("test_requests_total", "Requests.", "route")
+	latency := r.histogram("test_latency_seconds", "Latency.", []float64{.1, 1})
+
+	// when
+	requests.inc(`/a"b`)
+	requests.add(2, `/a"b`)
+	latency.observe(.05)
+	latency.observe(.5)
+	latency.observe(5)
+	buf := &bytes.Buffer{}
+	_ = r.write(buf)
+
+	// then
+	expected := `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{route="/a\"b"} 3
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 1
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 5.55
+test_latency_seconds_count 3
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestMasterMetrics(t *testing.T) {
+	// given
+	m, db, call := newTestMaster(t)
+	NewMetricsService(m.rs)
+	_ = db.SaveDefinition(&model.Definition{Name: "web", Image: "nginx", Count: 2})
+	_ = db.SaveDefinition(&model.Definition{Name: "batch", Image: "busybox", Count: 5, Mode: model.ModeJob, Job: &model.JobSpec{Completions: 3, Parallelism: 2}})
+	_ = db.SaveNode(&model.Node{Name: "node01", Enabled: true, LastUpdated: time.Now()})
+	_ = db.SaveNode(&model.Node{Name: "node02", Enabled: true})
+	_ = db.SaveNode(&model.Node{Name: "node03"})
+
+	// when
+	m.allocateContainers()
+	m.allocateContainers()
+	call("GET", "/master/definitions", "")
+	rec := call("GET", "/metrics", "")
+
+	// then
+	body := rec.Body.String()
+	for _, line := range []string{
+		`one_master_nodes{state="ready"} 1`,
+		`one_master_nodes{state="stale"} 1`,
+		`one_master_nodes{state="disabled"} 1`,
+		`one_master_replicas_desired{definition="web"} 2`,
+		`one_master_replicas_running{definition="web"} 0`,
+		`one_master_replicas_desired{definition="batch"} 2`,
+		`one_master_allocation_duration_seconds_count`,
+		`one_db_queue_wait_seconds_count`,
+		`one_rest_request_duration_seconds_count{route="/master/definitions",method="GET",code="200"}`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("metrics should contain %s", line)
+		}
+	}
+}
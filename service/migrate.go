@@ -0,0 +1,158 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/libgolang/one/model"
+)
+
+// SchemaVersion version of the stored objects written by this
+// release.  Objects of older versions are upgraded by the migrations
+// when read and rewritten by Migrate.
+const SchemaVersion = 1
+
+// kinds of stored objects
+const (
+	kindDefinition = "definition"
+	kindContainer  = "container"
+	kindNode       = "node"
+	kindNetwork    = "network"
+	kindRegistry   = "registry"
+	kindVars       = "vars"
+)
+
+// Migrator Db whose stored objects can be upgraded in place
+type Migrator interface {
+	// Migrate rewrites every object stored with an older schema version
+	// and moves the objects that cannot be read to quarantine.  It
+	// returns the number of objects current, migrated, quarantined and
+	// skipped because a newer release wrote them.
+	Migrate() (stats map[string]int, err error)
+}
+
+// migration upgrades the json of a stored object of kind from version
+// from to from+1
+type migration struct {
+	kind    string
+	from    int
+	migrate func(obj map[string]interface{}) error
+}
+
+// migrations in the order they are applied
+var migrations = []migration{
+	// version 1 adds the schema version and the container states
+	{kind: kindDefinition, from: 0, migrate: func(obj map[string]interface{}) error { return nil }},
+	{kind: kindNode, from: 0, migrate: func(obj map[string]interface{}) error { return nil }},
+	{kind: kindContainer, from: 0, migrate: migrateContainerStates},
+	{kind: kindVars, from: 0, migrate: migrateVarsWrap},
+}
+
+// migrateContainerStates derives the desired and lifecycle states of
+// containers saved before they existed
+func migrateContainerStates(obj map[string]interface{}) error {
+	if s, _ := obj["desiredState"].(string); s == "" {
+		obj["desiredState"] = model.ContainerRunning
+	}
+	if s, _ := obj["state"].(string); s != "" {
+		return nil
+	}
+	node, _ := obj["nodeName"].(string)
+	switch {
+	case obj["running"] == true:
+		obj["state"] = model.ContainerRunning
+	case node != "":
+		obj["state"] = model.ContainerScheduled
+	default:
+		obj["state"] = model.ContainerPending
+	}
+	return nil
+}
+
+// migrateVarsWrap moves the variables, stored as a flat object, under
+// the vars key of a versioned document
+func migrateVarsWrap(obj map[string]interface{}) error {
+	values := make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("variable %s is not a string", k)
+		}
+		values[k] = v
+		delete(obj, k)
+	}
+	obj["vars"] = values
+	return nil
+}
+
+// storedVars document of the variables
+type storedVars struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	Vars          map[string]string `json:"vars"`
+}
+
+// newerSchemaError returned when reading an object written by a newer
+// release.  Such objects are skipped but never quarantined.
+type newerSchemaError struct {
+	kind    string
+	version int
+}
+
+func (e *newerSchemaError) Error() string {
+	return fmt.Sprintf("%s has schema version %d, this release reads up to %d", e.kind, e.version, SchemaVersion)
+}
+
+// upgrade applies the migrations to the stored json b of kind.  It
+// returns the json of the current schema version and whether it
+// differs from b.
+func upgrade(kind string, b []byte) ([]byte, bool, error) {
+	obj := make(map[string]interface{})
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return nil, false, err
+	}
+	if obj == nil {
+		return nil, false, fmt.Errorf("empty %s", kind)
+	}
+	version := 0
+	if v, ok := obj["schemaVersion"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 0 || f != float64(int(f)) {
+			return nil, false, fmt.Errorf("invalid schema version %v", v)
+		}
+		version = int(f)
+		delete(obj, "schemaVersion")
+	}
+	if version > SchemaVersion {
+		return nil, false, &newerSchemaError{kind: kind, version: version}
+	}
+	if version == SchemaVersion {
+		return b, false, nil
+	}
+	for _, m := range migrations {
+		if m.kind != kind || m.from != version {
+			continue
+		}
+		if err := m.migrate(obj); err != nil {
+			return nil, false, fmt.Errorf("migration of %s from version %d: %s", kind, version, err)
+		}
+		version++
+	}
+	if version != SchemaVersion {
+		return nil, false, fmt.Errorf("no migration of %s from version %d", kind, version)
+	}
+	obj["schemaVersion"] = SchemaVersion
+	out, err := json.Marshal(obj)
+	if err != nil {
+		return nil, false, err
+	}
+	return out, true, nil
+}
+
+// decodeStored upgrades the stored json b of kind and decodes it into
+// obj
+func decodeStored(kind string, b []byte, obj interface{}) error {
+	b, _, err := upgrade(kind, b)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, obj)
+}
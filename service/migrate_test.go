@@ -0,0 +1,119 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/libgolang/one/model"
+	"github.com/libgolang/one/utils"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestMigrateFileDb(t *testing.T) {
+	// given
+	tmpDir, _ := ioutil.TempDir("", "testing-migrate")
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	write := func(file, contents string) {
+		_ = os.MkdirAll(path.Join(tmpDir, path.Dir(file)), 0775)
+		_ = ioutil.WriteFile(path.Join(tmpDir, file), []byte(contents), 0664)
+	}
+	write("defs/web.json", `{"name":"web","image":"nginx","count":1}`)
+	write("conts/web-1.json", `{"name":"web-1","definitionName":"web","nodeName":"node01","running":true}`)
+	write("conts/web-2.json", `{"name":"web-2","definitionName":"web"`)
+	write("nodes/node01.json", `{"name":"node01","schemaVersion":99}`)
+	write("vars.json", `{"inc.container.web":"2"}`)
+	d := NewDb(tmpDir)
+
+	// when
+	stats, err := d.(Migrator).Migrate()
+
+	// then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["migrated"] != 3 || stats["quarantined"] != 1 || stats["skipped"] != 1 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+	cont := d.ListContainers()["web-1"]
+	if cont == nil || cont.SchemaVersion != SchemaVersion || cont.State != model.ContainerRunning || cont.Desired() != model.ContainerRunning {
+		t.Errorf("container should be migrated, got %+v", cont)
+	}
+	if b, _ := ioutil.ReadFile(path.Join(tmpDir, "defs/web.json")); !strings.Contains(string(b), `"schemaVersion":1`) {
+		t.Errorf("definition file should be rewritten, got %s", b)
+	}
+	if vars := d.GetVars(func(map[string]string) {}); vars["inc.container.web"] != "2" {
+		t.Errorf("vars should be migrated, got %v", vars)
+	}
+	if files, _ := ioutil.ReadDir(path.Join(tmpDir, QuarantineDir, ContsDir)); len(files) != 1 {
+		t.Error("unreadable container should be quarantined")
+	}
+	if !utils.FileExists(path.Join(tmpDir, "nodes/node01.json")) {
+		t.Error("node of a newer schema version should be left alone")
+	}
+	if again, _ := d.(Migrator).Migrate(); again["migrated"] != 0 || again["current"] != 3 {
+		t.Errorf("second migration should find every object current, got %v", again)
+	}
+}
+
+func TestFileDbQuarantinesOnRead(t *testing.T) {
+	// given
+	tmpDir, _ := ioutil.TempDir("", "testing-migrate")
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	d := NewDb(tmpDir)
+	_ = d.SaveDefinition(&model.Definition{Name: "web", Image: "nginx"})
+	_ = ioutil.WriteFile(path.Join(tmpDir, DefsDir, "broken.json"), []byte(`{"name":"broken","count":"two"}`), 0664)
+
+	// when
+	defs := d.ListDefinitions()
+
+	// then
+	if len(defs) != 1 || defs["web"] == nil {
+		t.Errorf("readable definitions should be listed, got %v", defs)
+	}
+	if utils.FileExists(path.Join(tmpDir, DefsDir, "broken.json")) {
+		t.Error("unreadable definition should be moved to quarantine")
+	}
+}
+
+func TestMigrateBoltDb(t *testing.T) {
+	// given
+	tmpDir, _ := ioutil.TempDir("", "testing-migrate")
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	file := path.Join(tmpDir, "one.db")
+	d := NewBoltDb(file)
+	_ = d.SaveContainer(&model.Container{Name: "web-2", DefinitionName: "web", NodeName: "node01"})
+	_ = d.(*boltDb).bolt.Update(func(tx *bolt.Tx) error {
+		_ = tx.Bucket(boltContainers).Put([]byte("web-1"), []byte(`{"name":"web-1","definitionName":"web","nodeName":"node01"}`))
+		_ = tx.Bucket(boltContainers).Put([]byte("web-2"), []byte(`not json`))
+		return tx.Bucket(boltDefinitions).Put([]byte("web"), []byte(`{"name":"web","image":"nginx"}`))
+	})
+	defer d.Close()
+
+	// when
+	stats, err := d.(Migrator).Migrate()
+
+	// then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["migrated"] != 2 || stats["quarantined"] != 1 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+	conts := d.ListContainers()
+	if len(conts) != 1 || conts["web-1"].State != model.ContainerScheduled || len(d.ListContainersByNode("node01")) != 0 {
+		t.Errorf("web-1 should be migrated and web-2 quarantined, got %v", conts)
+	}
+	if def, err := d.GetDefinition("web"); err != nil || def.SchemaVersion != SchemaVersion {
+		t.Errorf("definition should be migrated: %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"github.com/libgolang/log"
+	"github.com/libgolang/one/model"
+	"github.com/libgolang/one/utils"
+)
+
+var (
+	networkNameRegexp  = regexp.MustCompile(`^[A-Za-z0-9][-A-Za-z0-9_.]{0,62}$`)
+	dockerDriverRegexp = regexp.MustCompile(`^[a-z0-9][-a-z0-9_.]*$`)
+)
+
+// dockerNetworks networks of every docker daemon, they cannot be
+// declared
+var dockerNetworks = map[string]bool{"bridge": true, "host": true, "none": true}
+
+// validateNetwork checks the name, driver, subnet and labels of network
+func validateNetwork(network *model.Network) error {
+	if !networkNameRegexp.MatchString(network.Name) {
+		return fmt.Errorf("invalid network name %q: up to 63 letters, digits, -, _ or . starting with a letter or digit", network.Name)
+	}
+	if dockerNetworks[network.Name] {
+		return fmt.Errorf("network %s is a docker network and cannot be declared", network.Name)
+	}
+	if network.Driver != "" && !dockerDriverRegexp.MatchString(network.Driver) {
+		return fmt.Errorf("invalid network driver %q", network.Driver)
+	}
+	if network.Subnet != "" {
+		if _, _, err := net.ParseCIDR(network.Subnet); err != nil {
+			return fmt.Errorf("invalid subnet %q: %s", network.Subnet, err)
+		}
+	}
+	return model.ValidateLabels(network.Labels)
+}
+
+// validateDefinitionNetworks checks the networks of def are declared in
+// networks and listed once
+func validateDefinitionNetworks(def *model.Definition, networks map[string]*model.Network) error {
+	seen := make(map[string]bool)
+	for _, name := range def.Networks {
+		if _, ok := networks[name]; !ok {
+			return fmt.Errorf("network %s not found", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("network %s is listed twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// containerNetworks returns the networks joined by conts, sorted by
+// name.  Networks no longer declared are left out.
+func containerNetworks(conts []model.Container, networks map[string]*model.Network) []model.Network {
+	names := make(map[string]bool)
+	for _, cont := range conts {
+		for _, name := range cont.Networks {
+			names[name] = true
+		}
+	}
+	result := make([]model.Network, 0, len(names))
+	for name := range names {
+		if network, ok := networks[name]; ok {
+			result = append(result, *network)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func (m *masterService) listNetworks(w http.ResponseWriter, r *http.Request) RestResponse {
+	def := map[string]string{
+		"Name":     "string",
+		"Driver":   "string",
+		"Internal": "bool",
+		"Subnet":   "string",
+		"Labels":   "map",
+	}
+	list := m.db.ListNetworks()
+	page, err := utils.RestList(def, "Name", r, &list)
+	if err != nil {
+		return (&JSONResponse{}).SetStatus(400).SetBody(map[string]string{"error": err.Error()})
+	}
+	return listResponse(page)
+}
+
+func (m *masterService) getNetwork(w http.ResponseWriter, r *http.Request) RestResponse {
+	resp := &JSONResponse{}
+	network, err := m.db.GetNetwork(mux.Vars(r)["name"])
+	if err != nil {
+		return resp.SetStatus(404).SetBody(`{"error":"network not found"}`)
+	}
+	return resp.SetETag(network.ResourceVersion).SetBody(network)
+}
+
+// saveNetwork declares or updates a network.  Nodes create it as it is
+// when a container first joins it, changes apply to the docker networks
+// created afterwards.
+func (m *masterService) saveNetwork(w http.ResponseWriter, r *http.Request) RestResponse {
+	resp := &JSONResponse{}
+	name := mux.Vars(r)["name"]
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error("error reading body: %s", err)
+		return resp.SetStatus(400).SetBody(`{"error":"Unable to read request"}`)
+	}
+	network := &model.Network{}
+	if err = json.Unmarshal(b, network); err != nil {
+		log.Error("error decoding json: %s", err)
+		return resp.SetStatus(400).SetBody(`{"error":"Unable to parse request"}`)
+	}
+	if network.Name == "" {
+		network.Name = name
+	}
+	if network.Name != name {
+		return resp.SetStatus(400).SetBody(`{"error":"Name does not match the url"}`)
+	}
+	if err := validateNetwork(network); err != nil {
+		return resp.SetStatus(400).SetBody(map[string]string{"error": err.Error()})
+	}
+
+	if terr := m.db.Trx(func(db Db) {
+		if err = matchVersion(r, &network.ResourceVersion, func() (string, error) {
+			stored, err := db.GetNetwork(name)
+			if err != nil {
+				return "", &ConflictError{Kind: "network", Name: name}
+			}
+			return stored.ResourceVersion, nil
+		}); err != nil {
+			return
+		}
+		err = db.SaveNetwork(network)
+	}); terr != nil {
+		return unavailableResponse(terr)
+	}
+	if _, ok := err.(*ConflictError); ok {
+		return conflictResponse(r, err)
+	}
+	if err != nil {
+		log.Error("error saving network %s: %s", name, err)
+		return resp.SetStatus(500).SetBody(`{"error":"Unable to save network"}`)
+	}
+	return resp.SetETag(network.ResourceVersion).SetBody(network)
+}
@@ -1,14 +1,25 @@
 package service
 
 import (
+	"fmt"
+	"net/http"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/libgolang/log"
 	"github.com/libgolang/one/clients"
 	"github.com/libgolang/one/model"
 	"github.com/libgolang/one/utils"
 )
 
+var (
+	metricReconcileDuration = metrics.histogram("one_node_reconcile_duration_seconds", "Duration of the reconciliation of the node with the master.", nil)
+	metricPingFailures      = metrics.counter("one_node_master_ping_failures_total", "Node reports the master did not answer.")
+	metricContainerStarts   = metrics.counter("one_node_container_starts_total", "Containers started by the node.")
+	metricContainerFailures = metrics.counter("one_node_container_failures_total", "Containers the node failed to start.")
+	metricHookFailures      = metrics.counter("one_node_hook_failures_total", "Run hooks that failed, by hook.", "hook")
+)
+
 // NodeService interface
 type NodeService interface {
 }
@@ -21,18 +32,30 @@ type nodeService struct {
 	nodeAddr       string
 	preRunHookCfg  string
 	postRunHookCfg string
+	errors         map[string]string // last error running each container
+	restarts       map[string]int    // dead containers replaced, by name
+	stats          *statsHistory
 }
 
-// NewNodeService NodeService constructor
-func NewNodeService(masterAddr string, docker Docker, nodeName, nodeAddr, preRunHookCfg, postRunHookCfg string) NodeService {
+// NewNodeService NodeService constructor.  The recent resource usage
+// of the containers is served on rs unless it is nil.  nodeToken is
+// presented to the master to receive the credentials of private
+// registries.
+func NewNodeService(masterAddr, nodeToken string, docker Docker, nodeName, nodeAddr, preRunHookCfg, postRunHookCfg string, rs RestServer) NodeService {
 	ns := &nodeService{}
 	ns.ticker = time.NewTicker(20 * time.Second)
 	ns.preRunHookCfg = preRunHookCfg
 	ns.postRunHookCfg = postRunHookCfg
-	ns.masterClient = clients.NewMasterClient(masterAddr)
+	ns.masterClient = clients.NewMasterClient(masterAddr, nodeToken)
 	ns.nodeName = nodeName
 	ns.nodeAddr = nodeAddr
 	ns.docker = docker
+	ns.errors = make(map[string]string)
+	ns.restarts = make(map[string]int)
+	ns.stats = newStatsHistory(statsHistoryLen)
+	if rs != nil {
+		rs.HandleFunc("/node/containers/{name}/stats", func(w http.ResponseWriter, r *http.Request) RestResponse { return ns.containerStats(w, r) }).Methods("GET")
+	}
 	ns.checkNode()
 	go func() {
 		for range ns.ticker.C {
@@ -44,17 +67,33 @@ func NewNodeService(masterAddr string, docker Docker, nodeName, nodeAddr, preRun
 
 func (n *nodeService) checkNode() {
 	log.Info("checkNode()")
+	defer metricReconcileDuration.since(time.Now())
 
 	node := model.Node{}
 	node.Name = n.nodeName
 	node.Addr = n.nodeAddr
 	currentNfo := model.NodeInfo{}
 	currentNfo.Containers = n.docker.ContainerList()
+	for i := range currentNfo.Containers {
+		currentNfo.Containers[i].RestartCount += n.restarts[currentNfo.Containers[i].Name]
+	}
 	currentNfo.Node = node
+	currentNfo.Errors = n.errors
+	currentNfo.Volumes = n.docker.VolumeList()
+	currentNfo.Stats = sampleStats(n.docker, currentNfo.Containers)
+	names := make(map[string]bool)
+	for _, cont := range currentNfo.Containers {
+		names[cont.Name] = true
+	}
+	n.stats.retain(names)
+	for name, s := range currentNfo.Stats {
+		n.stats.add(name, s)
+	}
 
 	infoFromMaster, err := n.masterClient.PingNodeInfo(currentNfo)
 	if err != nil {
 		log.Error("error contacting master: %s", err)
+		metricPingFailures.inc()
 		return
 	}
 
@@ -62,10 +101,11 @@ func (n *nodeService) checkNode() {
 	serverMap := make(map[string]model.Container)
 
 	for _, cont := range currentNfo.Containers {
-		// remove dead container
-		localCont := n.docker.ContainerGetByName(cont.Name)
-		if localCont != nil && !localCont.Running {
-			n.docker.ContainerRemoveByName(cont.Name)
+		// remove dead container, the exited containers of jobs are kept
+		// until the master has their result
+		if !cont.Running && cont.RestartPolicy != model.RestartNever {
+			n.docker.ContainerRemoveListed(&cont)
+			n.restarts[cont.Name]++
 			continue // continue
 		}
 		currentMap[cont.Name] = cont
@@ -74,14 +114,35 @@ func (n *nodeService) checkNode() {
 	for _, cont := range infoFromMaster.Containers {
 		serverMap[cont.Name] = cont
 	}
+
+	// forget containers the master no longer assigns
+	for name := range n.restarts {
+		if _, ok := serverMap[name]; !ok {
+			delete(n.restarts, name)
+		}
+	}
+	errors := make(map[string]string)
+
+	n.docker.SetRegistryAuths(infoFromMaster.Registries)
+
+	// the networks are created before the containers joining them
+	networkErrors := make(map[string]string)
+	keepNetworks := make(map[string]bool)
+	for _, net := range infoFromMaster.Networks {
+		keepNetworks[net.Name] = true
+		if err := n.docker.NetworkEnsure(net); err != nil {
+			log.Error("%s", err)
+			networkErrors[net.Name] = err.Error()
+		}
+	}
 	//log.Debug("%s", serverMap)
 	//log.Debug("%s", currentMap)
 
 	// stop containers in currentMap that are not in serverMap
-	for name := range currentMap {
+	for name, cont := range currentMap {
 		if _, ok := serverMap[name]; !ok {
 			log.Info("Remove Container %s", name)
-			n.docker.ContainerRemoveByName(name)
+			n.docker.ContainerRemoveListed(&cont)
 		}
 	}
 
@@ -91,22 +152,60 @@ func (n *nodeService) checkNode() {
 		if _, ok := currentMap[name]; !ok {
 			// run
 			log.Info("Running container %s", cont.Name)
+			if err := containerNetworkError(cont, networkErrors); err != "" {
+				metricContainerFailures.inc()
+				errors[name] = err
+				continue
+			}
 
 			//
 			if err := n.preRunHook(cont); err != nil {
 				log.Error("preRunHook returned error, not running containers: %s", err)
+				metricHookFailures.inc("pre")
+				errors[name] = fmt.Sprintf("preRunHook: %s", err)
 				continue
 			}
 
 			//
-			n.docker.ContainerRun(&cont)
+			if err := n.docker.ContainerRun(&cont); err != nil {
+				log.Error("%s", err)
+				metricContainerFailures.inc()
+				errors[name] = err.Error()
+				continue
+			}
+			metricContainerStarts.inc()
 
 			//
 			if err := n.postRunHook(cont); err != nil {
 				log.Error("postRunHook returned error: %s", err)
+				metricHookFailures.inc("post")
 			}
 		}
 	}
+	n.errors = errors
+
+	// networks no container joins any more
+	n.docker.NetworkPrune(keepNetworks)
+}
+
+// containerNetworkError returns the error of the first network of cont
+// that could not be created, empty when there is none
+func containerNetworkError(cont model.Container, networkErrors map[string]string) string {
+	for _, net := range cont.Networks {
+		if err, ok := networkErrors[net]; ok {
+			return err
+		}
+	}
+	return ""
+}
+
+func (n *nodeService) containerStats(w http.ResponseWriter, r *http.Request) RestResponse {
+	name := mux.Vars(r)["name"]
+	history := n.stats.get(name)
+	if len(history) == 0 {
+		return (&JSONResponse{}).SetStatus(404).SetBody(`{"error":"no stats for container"}`)
+	}
+	return (&JSONResponse{}).SetBody(&model.ContainerStatsHistory{Name: name, Current: &history[len(history)-1], History: history})
 }
 
 func (n *nodeService) preRunHook(cont model.Container) error {
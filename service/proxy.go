@@ -1,208 +1,645 @@
 package service
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 
+	"github.com/libgolang/one/model"
 	"github.com/libgolang/one/utils"
 
 	"github.com/libgolang/log"
 )
 
+// proxySitesFile file in the driver config dir holding the applied sites
+const proxySitesFile = "one-sites.json"
+
+const (
+	// ProxyApache apache2 driver (a2ensite/a2dissite)
+	ProxyApache = "apache"
+	// ProxyNginx nginx driver (sites-available/sites-enabled)
+	ProxyNginx = "nginx"
+	// ProxyHAProxy haproxy driver (one backend file per host plus a host map)
+	ProxyHAProxy = "haproxy"
+	// ProxyCaddy caddy driver (caddy obtains its own certificates)
+	ProxyCaddy = "caddy"
+)
+
 var (
-	htmlTemplate        = utils.NewTemplate(htmlTemplateString)
-	vhostTemplate       = utils.NewTemplate(vhostTemplateString)
-	dockerProxyTemplate = utils.NewTemplate(dockerProxyTemplateString)
+	htmlTemplate      = utils.NewTemplate(htmlTemplateString)
+	nonAlphaNumRegexp = regexp.MustCompile(`[^a-zA-Z0-9]+`)
 )
 
-// Proxy interface for proxy
+// Proxy driver interface.  Implementations write the proxy
+// configuration of a site, test it and reload the proxy.
 type Proxy interface {
-	AddDockerProxySsl(name, hostIP string, httpRandPort int)
-	RemoveDockerProxy(name string)
+	// Apply creates or updates the configuration of a site
+	Apply(site *ProxySite) error
+	// Remove removes the configuration of the site with the given name
+	Remove(name string) error
+	// Sites returns the sites currently configured by name, as they
+	// were applied with their routes resolved
+	Sites() (map[string]*ProxySite, error)
 }
 
-type proxy struct {
-	publicIP   string
-	privateIP  string
-	baseDomain string
+// ProxySite a public site served by the proxy
+type ProxySite struct {
+	Name     string        `json:"name"`     // definition name
+	Routes   []model.Route `json:"routes"`   // defaults to <name>.<baseDomain>
+	Backends []string      `json:"backends"` // host:port of every replica
 }
 
-// NewProxy constructor
-func NewProxy(publicIP, privateIP, baseDomain string) Proxy {
-	return &proxy{publicIP, privateIP, baseDomain}
+// ProxyConfig configuration of a file based proxy driver.  Empty
+// values are replaced by the driver defaults.
+type ProxyConfig struct {
+	PublicIP   string
+	PrivateIP  string
+	BaseDomain string
+	AdminEmail string
+	// ConfigDir directory where site configuration files are written
+	ConfigDir string
+	// EnabledDir when set, sites are enabled by symlinking into this directory
+	EnabledDir string
+	// EnableCmd and DisableCmd are called with the site file name (no extension)
+	EnableCmd  string
+	DisableCmd string
+	// TestCmd validates the configuration before reloading
+	TestCmd   string
+	ReloadCmd string
+	// SiteTemplate and ChallengeTemplate are paths to template files
+	// that override the driver templates
+	SiteTemplate      string
+	ChallengeTemplate string
+	// WebRoot holds the per domain htdocs used for http-01 challenges
+	WebRoot string
+	// Certs issues the certificate of every host.  Required by the
+	// drivers that read certificate files (apache and nginx).
+	Certs CertManager
+	// WildcardCert serves the hosts directly under BaseDomain with a
+	// single *.<BaseDomain> certificate
+	WildcardCert bool
 }
 
-func (p *proxy) RemoveDockerProxy(name string) {
-	domain := fmt.Sprintf("%s.%s", name, p.baseDomain)
-	availConfig := fmt.Sprintf("/etc/apache2/sites-enabled/%s.conf", domain)
-	config := fmt.Sprintf("/etc/apache2/sites-available/%s.conf", domain)
+// fileProxy writes one configuration file per host.  A host may serve
+// several definitions under different path prefixes, so the applied
+// sites are kept in one-sites.json to render every host from scratch.
+type fileProxy struct {
+	driver    string
+	ext       string
+	cfg       ProxyConfig
+	site      utils.Template
+	challenge utils.Template // nil when the driver does not need a certificate
+	// afterWrite is called after host files are written or removed
+	afterWrite func(p *fileProxy) error
+
+	mu    sync.Mutex
+	sites map[string]*ProxySite
+}
+
+// proxyLocation template view of a path prefix routed to a definition
+type proxyLocation struct {
+	Name        string
+	Upstream    string // unique name for the backend group
+	Prefix      string // "/" or "/v2"
+	PrefixSlash string // "/" or "/v2/"
+	Root        bool
+	StripPrefix bool
+	AllowHTTP   bool
+	Backends    []string
+}
 
-	// a2dissite
-	if utils.FileExists(availConfig) {
-		_ = utils.ExecSilent("a2dissite", domain)
-		p.restartApache()
+// NewProxy constructor.  driver is one of ProxyApache, ProxyNginx,
+// ProxyHAProxy or ProxyCaddy.
+func NewProxy(driver string, cfg ProxyConfig) Proxy {
+	p := &fileProxy{driver: driver}
+	var defaults ProxyConfig
+	var siteTpl, challengeTpl string
+	switch driver {
+	case ProxyApache:
+		p.ext = ".conf"
+		siteTpl, challengeTpl = apacheSiteTemplateString, apacheChallengeTemplateString
+		defaults = ProxyConfig{
+			ConfigDir:  "/etc/apache2/sites-available",
+			EnableCmd:  "a2ensite",
+			DisableCmd: "a2dissite",
+			TestCmd:    "apache2ctl configtest",
+			ReloadCmd:  "systemctl reload apache2.service",
+		}
+	case ProxyNginx:
+		p.ext = ".conf"
+		siteTpl, challengeTpl = nginxSiteTemplateString, nginxChallengeTemplateString
+		defaults = ProxyConfig{
+			ConfigDir:  "/etc/nginx/sites-available",
+			EnabledDir: "/etc/nginx/sites-enabled",
+			TestCmd:    "nginx -t",
+			ReloadCmd:  "systemctl reload nginx.service",
+		}
+	case ProxyHAProxy:
+		p.ext = ".cfg"
+		siteTpl = haproxySiteTemplateString
+		p.afterWrite = writeHAProxyHostMap
+		defaults = ProxyConfig{
+			ConfigDir: "/etc/haproxy/one",
+			TestCmd:   "haproxy -c -f /etc/haproxy/haproxy.cfg -f /etc/haproxy/one",
+			ReloadCmd: "systemctl reload haproxy.service",
+		}
+	case ProxyCaddy:
+		p.ext = ".caddy"
+		siteTpl = caddySiteTemplateString
+		defaults = ProxyConfig{
+			ConfigDir: "/etc/caddy/sites",
+			TestCmd:   "caddy validate --config /etc/caddy/Caddyfile --adapter caddyfile",
+			ReloadCmd: "systemctl reload caddy.service",
+		}
+	default:
+		panic(fmt.Sprintf("unknown proxy driver %s", driver))
 	}
+	defaults.WebRoot = "/var/www/virtual"
+	p.cfg = mergeProxyConfig(cfg, defaults)
 
-	// remove config and restart
-	if utils.FileExists(config) {
-		utils.Remove(config)
+	p.site = utils.NewTemplate(loadTemplate(p.cfg.SiteTemplate, siteTpl))
+	if challengeTpl != "" {
+		if p.cfg.Certs == nil {
+			panic(fmt.Sprintf("proxy driver %s requires a certificate manager", driver))
+		}
+		p.challenge = utils.NewTemplate(loadTemplate(p.cfg.ChallengeTemplate, challengeTpl))
+		p.cfg.Certs.OnRenew(func(domain string) {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if err := p.reload(); err != nil {
+				log.Error("unable to reload %s after renewing %s: %s", p.driver, domain, err)
+			}
+		})
 	}
+	return p
 }
 
-func (p *proxy) AddDockerProxySsl(name, host string, port int) {
-	domain := fmt.Sprintf("%s.%s", name, p.baseDomain)
-	log.Info("Adding SSL Proxy for %s -> %s:%d", domain, host, port)
+// mergeProxyConfig returns cfg with empty values taken from defaults
+func mergeProxyConfig(cfg, defaults ProxyConfig) ProxyConfig {
+	set := func(v *string, def string) {
+		if *v == "" {
+			*v = def
+		}
+	}
+	set(&cfg.ConfigDir, defaults.ConfigDir)
+	set(&cfg.EnabledDir, defaults.EnabledDir)
+	set(&cfg.EnableCmd, defaults.EnableCmd)
+	set(&cfg.DisableCmd, defaults.DisableCmd)
+	set(&cfg.TestCmd, defaults.TestCmd)
+	set(&cfg.ReloadCmd, defaults.ReloadCmd)
+	set(&cfg.WebRoot, defaults.WebRoot)
+	return cfg
+}
 
-	p.requestSslCertificate(domain)
+// loadTemplate returns the contents of file, or def when file is empty
+func loadTemplate(file, def string) string {
+	if file == "" {
+		return def
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		panic(fmt.Errorf("unable to read proxy template %s: %s", file, err))
+	}
+	return string(b)
+}
 
-	log.Info("Creating proxy...")
-	tpl := dockerProxyTemplate.Context().
-		Set("listenIp", p.privateIP).
-		Set("domain", domain).
-		Set("host", host).
-		Set("port", port).
-		Parse()
+func (p *fileProxy) hostFile(host string) string {
+	return path.Join(p.cfg.ConfigDir, host+p.ext)
+}
 
-	file := fmt.Sprintf("/etc/apache2/sites-available/%s.conf", domain)
-	log.Debug("file: %s; tpl:%s\n", file, tpl)
-	if err := ioutil.WriteFile(file, tpl, 0755); err != nil {
-		panic(err)
+func (p *fileProxy) Sites() (map[string]*ProxySite, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sites, err := p.loadSites()
+	if err != nil {
+		return nil, err
 	}
-	_ = utils.ExecSilent("a2ensite", domain)
-	p.restartApache()
+	return copySites(sites), nil
 }
-func (p *proxy) requestSslCertificate(domain string) {
-	log.Info("requesting ssl certificate for %s...", domain)
 
-	//
-	keyFile := fmt.Sprintf("/etc/letsencrypt/live/%s/privkey.pem", domain)
-	/*
-		certFile := fmt.Sprintf("/etc/letsencrypt/live/%s/cert.pem", domain)
-		chainFile := fmt.Sprintf("/etc/letsencrypt/live/%s/fullchain.pem", domain)
-	*/
+func (p *fileProxy) Apply(site *ProxySite) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sites, err := p.loadSites()
+	if err != nil {
+		return err
+	}
+
+	resolved := &ProxySite{
+		Name:     site.Name,
+		Routes:   model.ResolveRoutes(site.Name, site.Routes, p.cfg.BaseDomain),
+		Backends: site.Backends,
+	}
+	if err := model.ValidateRoutes(resolved.Routes); err != nil {
+		return err
+	}
+	log.Info("Applying %s proxy for %s -> %s", p.driver, site.Name, site.Backends)
 
-	// if file already exists, then bail out
-	if _, err := os.Stat(keyFile); !os.IsNotExist(err) {
-		log.Info("...certificate already exists")
-		return
+	hosts := siteHosts(sites[site.Name])
+	for _, h := range siteHosts(resolved) {
+		hosts = appendMissing(hosts, h)
 	}
 
-	//
-	p.addVirtualHost(domain)
+	next := copySites(sites)
+	next[site.Name] = resolved
 
-	//
-	log.Info("...certbot...")
-	err := utils.Exec("certbot", "certonly", "--webroot", "-w", fmt.Sprintf("/var/www/virtual/%s/htdocs", domain), "-d", domain)
+	if p.challenge != nil {
+		for _, h := range siteHosts(resolved) {
+			if err := p.ensureCertificate(h); err != nil {
+				return err
+			}
+		}
+	}
+	return p.sync(next, hosts)
+}
+
+func (p *fileProxy) Remove(name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sites, err := p.loadSites()
 	if err != nil {
-		panic(fmt.Errorf("Unable to request ssl certificate: %s", err))
+		return err
+	}
+	site, ok := sites[name]
+	if !ok {
+		return nil
 	}
-	log.Info("...cert bot done")
-	p.removeVirtualHost(domain)
+	log.Info("Removing %s proxy for %s", p.driver, name)
+
+	next := copySites(sites)
+	delete(next, name)
+	return p.sync(next, siteHosts(site))
 }
 
-func (p *proxy) addVirtualHost(domain string) {
-	dir := fmt.Sprintf("/var/www/virtual/%s/htdocs", domain)
+// sync renders the given hosts from sites, tests the configuration
+// and reloads the proxy.  When the test fails every file is restored.
+func (p *fileProxy) sync(sites map[string]*ProxySite, hosts []string) error {
+	utils.EnsureDir(p.cfg.ConfigDir)
+
+	type backup struct {
+		contents []byte
+		existed  bool
+	}
+	backups := make(map[string]backup)
+	changed := false
+	for _, host := range hosts {
+		file := p.hostFile(host)
+		previous, err := ioutil.ReadFile(file)
+		existed := err == nil
+		backups[host] = backup{previous, existed}
 
-	//
-	fmt.Printf("\tcreating vhost dir %s\n", dir)
+		locations := hostLocations(sites, host)
+		if len(locations) == 0 {
+			if existed {
+				if err := p.disable(host); err != nil {
+					return err
+				}
+				if err := os.Remove(file); err != nil {
+					return err
+				}
+				changed = true
+			}
+			continue
+		}
 
-	//
-	if err := utils.Exec("mkdir", "-p", dir); err != nil {
-		panic(err)
+		contents := p.renderHost(host, locations)
+		if existed && string(previous) == string(contents) {
+			continue
+		}
+		if err := writeFileAtomic(file, contents); err != nil {
+			return err
+		}
+		if !existed {
+			if err := p.enable(host); err != nil {
+				return err
+			}
+		}
+		changed = true
 	}
 
-	//
-	byteArr := htmlTemplate.Context().Set("Domain", domain).Parse()
-	if err := ioutil.WriteFile(path.Join(dir, "index.html"), byteArr, 0755); err != nil {
-		panic(err)
+	previousSites := p.sites
+	p.sites = sites
+	if !changed {
+		return p.saveSites()
+	}
+	if p.afterWrite != nil {
+		if err := p.afterWrite(p); err != nil {
+			return err
+		}
+	}
+
+	if err := p.test(); err != nil {
+		log.Error("proxy config test failed for %s, rolling back: %s", hosts, err)
+		for host, b := range backups {
+			if b.existed {
+				_ = writeFileAtomic(p.hostFile(host), b.contents)
+				_ = p.enable(host)
+			} else if utils.FileExists(p.hostFile(host)) {
+				_ = p.disable(host)
+				_ = os.Remove(p.hostFile(host))
+			}
+		}
+		p.sites = previousSites
+		if p.afterWrite != nil {
+			_ = p.afterWrite(p)
+		}
+		return err
 	}
+	if err := p.saveSites(); err != nil {
+		return err
+	}
+	return p.reload()
+}
 
-	//
-	vhostConfig := fmt.Sprintf("/etc/apache2/sites-available/%s.conf", domain)
-	tpl := vhostTemplate.Context().Set("domain", domain).Set("listenIp", p.publicIP).Parse()
-	if err := ioutil.WriteFile(vhostConfig, tpl, 0755); err != nil {
-		panic(err)
+func (p *fileProxy) renderHost(host string, locations []*proxyLocation) []byte {
+	allowHTTP := true
+	for _, l := range locations {
+		allowHTTP = allowHTTP && l.AllowHTTP
 	}
-	fmt.Printf("\tenabling site %s\n", domain)
-	if err := utils.ExecSilent("a2ensite", domain); err != nil {
-		panic(err)
+	var certFile, keyFile, chainFile string
+	if p.cfg.Certs != nil {
+		certFile, keyFile, chainFile = p.cfg.Certs.Files(p.certDomain(host))
 	}
-	p.restartApache()
+	return p.site.Context().
+		Set("domain", host).
+		Set("locations", locations).
+		Set("allowHttp", allowHTTP).
+		Set("listenIp", p.cfg.PrivateIP).
+		Set("publicIp", p.cfg.PublicIP).
+		Set("adminEmail", p.cfg.AdminEmail).
+		Set("certFile", certFile).
+		Set("keyFile", keyFile).
+		Set("chainFile", chainFile).
+		Set("webRoot", p.webRoot(host)).
+		Parse()
+}
+
+// webRoot returns the directory served on port 80 of host for http-01 challenges
+func (p *fileProxy) webRoot(host string) string {
+	return path.Join(p.cfg.WebRoot, host, "htdocs")
 }
 
-func (p *proxy) removeVirtualHost(domain string) {
-	fmt.Printf("\tdisabling site %s\n", domain)
-	if err := utils.ExecSilent("a2dissite", domain); err != nil {
-		panic(err)
+// loadSites returns the applied sites.  It must be called with mu held.
+func (p *fileProxy) loadSites() (map[string]*ProxySite, error) {
+	if p.sites != nil {
+		return p.sites, nil
 	}
-	/*
-		if removeHostingDir {
-			dir := fmt.Sprintf("/var/www/virtual/%s", domain);
-			fmt.Printf("\tremoving dir %s\n", dir);
-			utils.Exec("rm", "-fr", dir)
+	sites := make(map[string]*ProxySite)
+	file := path.Join(p.cfg.ConfigDir, proxySitesFile)
+	if utils.FileExists(file) {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &sites); err != nil {
+			return nil, fmt.Errorf("unable to read %s: %s", file, err)
 		}
-	*/
-	file := fmt.Sprintf("/etc/apache2/sites-available/%s.conf", domain)
-	fmt.Printf("\tremoving file %s\n", file)
-	if err := os.Remove(file); err != nil {
-		panic(err)
 	}
-	p.restartApache()
+	p.sites = sites
+	return sites, nil
 }
 
-func (p *proxy) restartApache() {
-	log.Info("reloading apache")
-	if err := utils.Exec("systemctl", "reload", "apache2.service"); err != nil {
-		panic(err)
+func (p *fileProxy) saveSites() error {
+	b, err := json.MarshalIndent(p.sites, "", "  ")
+	if err != nil {
+		return err
 	}
+	return writeFileAtomic(path.Join(p.cfg.ConfigDir, proxySitesFile), b)
 }
 
-const (
-	htmlTemplateString = `<html>
-<head>
-<title>{{.Domain}}</title>
-</head>
-<body>
-<h3>{{.Domain}}</h3>
-</body>
-</html>
-`
-
-	vhostTemplateString = `<VirtualHost {{.listenIp}}:80>
-	ServerAdmin ricardo@rhamerica.com
-	ServerName {{.domain}}
-	ServerAlias {{.domain}}
-	DocumentRoot /var/www/virtual/{{.domain}}/htdocs
-	<Directory /var/www/virtual/{{.domain}}>
-		#Options Indexes FollowSymLinks MultiViews
-		Options FollowSymLinks MultiViews
-		AllowOverride All
-		Order allow,deny
-		allow from all
-	</Directory>
-</VirtualHost>
-`
-
-	dockerProxyTemplateString = `<VirtualHost {{.listenIp}}:80>
-	ServerAdmin ricardo@rhamerica.com
-	ServerName {{.domain}}
-	RewriteEngine On 
-	RewriteCond %{HTTPS}  !=on 
-	RewriteRule ^/?(.*) https://%{SERVER_NAME}/$1 [R,L] 
-</VirtualHost>
-<VirtualHost {{.listenIp}}:443>
-	ServerAdmin ricardo@rhamerica.com
-	ServerName {{.domain}}
-	AllowEncodedSlashes NoDecode
-	ProxyPreserveHost On
-	ProxyPass "/"  "http://{{.host}}:{{.port}}/"
-	ProxyPassReverse "/"  "http://{{.host}}:{{.port}}/"
-	SSLEngine on
-	SSLCertificateFile    /etc/letsencrypt/live/{{.domain}}/cert.pem
-	SSLCertificateKeyFile /etc/letsencrypt/live/{{.domain}}/privkey.pem
-	SSLCACertificateFile  /etc/letsencrypt/live/{{.domain}}/fullchain.pem
-</VirtualHost>
-`
-)
+func (p *fileProxy) enable(host string) error {
+	if p.cfg.EnabledDir != "" {
+		link := path.Join(p.cfg.EnabledDir, host+p.ext)
+		if utils.FileExists(link) {
+			return nil
+		}
+		return os.Symlink(p.hostFile(host), link)
+	}
+	if p.cfg.EnableCmd != "" {
+		return runCommand(p.cfg.EnableCmd, host)
+	}
+	return nil
+}
+
+func (p *fileProxy) disable(host string) error {
+	if p.cfg.EnabledDir != "" {
+		link := path.Join(p.cfg.EnabledDir, host+p.ext)
+		if _, err := os.Lstat(link); err == nil {
+			return os.Remove(link)
+		}
+		return nil
+	}
+	if p.cfg.DisableCmd != "" {
+		return runCommand(p.cfg.DisableCmd, host)
+	}
+	return nil
+}
+
+func (p *fileProxy) test() error {
+	if p.cfg.TestCmd == "" {
+		return nil
+	}
+	return runCommand(p.cfg.TestCmd)
+}
+
+func (p *fileProxy) reload() error {
+	log.Info("reloading %s", p.driver)
+	if p.cfg.ReloadCmd == "" {
+		return nil
+	}
+	return runCommand(p.cfg.ReloadCmd)
+}
+
+// certDomain returns the domain of the certificate that serves host
+func (p *fileProxy) certDomain(host string) string {
+	if p.cfg.WildcardCert && p.cfg.BaseDomain != "" {
+		label := strings.TrimSuffix(host, "."+p.cfg.BaseDomain)
+		if label != host && !strings.Contains(label, ".") {
+			return "*." + p.cfg.BaseDomain
+		}
+	}
+	return host
+}
+
+// ensureCertificate obtains a certificate for host from the certificate
+// manager.  Until a certificate of its own is issued the host file only
+// serves the challenge directory.
+func (p *fileProxy) ensureCertificate(host string) error {
+	if domain := p.certDomain(host); domain != host {
+		return p.cfg.Certs.Ensure(domain)
+	}
+	if p.cfg.Certs.Has(host) {
+		return nil
+	}
+
+	dir := p.webRoot(host)
+	utils.EnsureDir(dir)
+	index := htmlTemplate.Context().Set("Domain", host).Parse()
+	if err := ioutil.WriteFile(path.Join(dir, "index.html"), index, 0644); err != nil {
+		return err
+	}
+
+	file := p.hostFile(host)
+	existed := utils.FileExists(file)
+	tpl := p.challenge.Context().
+		Set("domain", host).
+		Set("listenIp", p.cfg.PublicIP).
+		Set("adminEmail", p.cfg.AdminEmail).
+		Set("webRoot", dir).
+		Parse()
+	utils.EnsureDir(p.cfg.ConfigDir)
+	if err := writeFileAtomic(file, tpl); err != nil {
+		return err
+	}
+	if !existed {
+		if err := p.enable(host); err != nil {
+			return err
+		}
+	}
+	if err := p.test(); err != nil {
+		_ = p.disable(host)
+		_ = os.Remove(file)
+		return err
+	}
+	if err := p.reload(); err != nil {
+		return err
+	}
+	return p.cfg.Certs.Ensure(host)
+}
+
+// hostLocations returns the locations of host sorted by longest
+// prefix first, the order in which proxies must match them
+func hostLocations(sites map[string]*ProxySite, host string) []*proxyLocation {
+	locations := make([]*proxyLocation, 0)
+	for _, site := range sites {
+		if len(site.Backends) == 0 {
+			continue
+		}
+		for _, r := range site.Routes {
+			for _, h := range r.Hosts {
+				if h != host {
+					continue
+				}
+				prefixSlash := r.PathPrefix
+				if prefixSlash != "/" {
+					prefixSlash += "/"
+				}
+				locations = append(locations, &proxyLocation{
+					Name:        site.Name,
+					Upstream:    strings.Trim(nonAlphaNumRegexp.ReplaceAllString(host+"_"+site.Name+r.PathPrefix, "_"), "_"),
+					Prefix:      r.PathPrefix,
+					PrefixSlash: prefixSlash,
+					Root:        r.PathPrefix == "/",
+					StripPrefix: r.StripPrefix && r.PathPrefix != "/",
+					AllowHTTP:   r.AllowHTTP,
+					Backends:    site.Backends,
+				})
+			}
+		}
+	}
+	sort.Slice(locations, func(i, j int) bool {
+		if len(locations[i].Prefix) != len(locations[j].Prefix) {
+			return len(locations[i].Prefix) > len(locations[j].Prefix)
+		}
+		return locations[i].Name < locations[j].Name
+	})
+	return locations
+}
+
+// siteHosts returns every host the site is served on
+func siteHosts(site *ProxySite) []string {
+	hosts := make([]string, 0)
+	if site == nil {
+		return hosts
+	}
+	for _, r := range site.Routes {
+		for _, h := range r.Hosts {
+			hosts = appendMissing(hosts, h)
+		}
+	}
+	return hosts
+}
+
+func appendMissing(list []string, s string) []string {
+	for _, it := range list {
+		if it == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+func copySites(sites map[string]*ProxySite) map[string]*ProxySite {
+	c := make(map[string]*ProxySite, len(sites))
+	for k, v := range sites {
+		c[k] = v
+	}
+	return c
+}
+
+// writeHAProxyHostMap writes hosts.map with one "<regex> <backend>" line
+// per location, longest prefix first.  haproxy.cfg is expected to route with
+//
+//	use_backend %[base,map_reg(/etc/haproxy/one/hosts.map)]
+func writeHAProxyHostMap(p *fileProxy) error {
+	hosts := make([]string, 0)
+	for _, site := range p.sites {
+		for _, h := range siteHosts(site) {
+			hosts = appendMissing(hosts, h)
+		}
+	}
+	sort.Strings(hosts)
+
+	lines := make([]*proxyLocation, 0)
+	keys := make(map[*proxyLocation]string)
+	for _, host := range hosts {
+		for _, l := range hostLocations(p.sites, host) {
+			key := "^" + regexp.QuoteMeta(host) + "(:[0-9]+)?" + regexp.QuoteMeta(l.Prefix)
+			if l.Root {
+				key += ".*"
+			} else {
+				key += "(/|$)"
+			}
+			keys[l] = key
+			lines = append(lines, l)
+		}
+	}
+	// root locations go last so that prefixes of other hosts match first
+	sort.SliceStable(lines, func(i, j int) bool {
+		return !lines[i].Root && lines[j].Root
+	})
+
+	var buf strings.Builder
+	for _, l := range lines {
+		buf.WriteString(fmt.Sprintf("%s %s\n", keys[l], l.Upstream))
+	}
+	return ioutil.WriteFile(path.Join(p.cfg.ConfigDir, "hosts.map"), []byte(buf.String()), 0644)
+}
+
+// writeFileAtomic writes to a temporary file and renames it over file
+func writeFileAtomic(file string, contents []byte) error {
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, contents, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// runCommand runs a command line split on white space with extra args appended
+func runCommand(cmdLine string, args ...string) error {
+	parts := append(strings.Fields(cmdLine), args...)
+	if len(parts) == 0 {
+		return nil
+	}
+	if _, err := exec.LookPath(parts[0]); err != nil {
+		return err
+	}
+	return utils.ExecSilent(parts...)
+}
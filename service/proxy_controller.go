@@ -0,0 +1,197 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libgolang/log"
+	"github.com/libgolang/one/model"
+)
+
+const proxyControllerTick = time.Second * 30
+
+// ProxyController keeps the proxy sites in sync with the definitions
+// and containers stored in the master
+type ProxyController interface {
+	// Reconcile creates, updates and removes proxy sites.  It returns
+	// the drift found before the changes were made.
+	Reconcile() *model.ProxyDrift
+	// Drift compares the desired and the configured sites without
+	// changing anything
+	Drift() *model.ProxyDrift
+}
+
+type proxyController struct {
+	db         Db
+	rs         RestServer
+	p          Proxy
+	baseDomain string
+	runMu      sync.Mutex // serializes Reconcile, held while certificates are issued
+	mu         sync.Mutex // guards errors and lastRun
+	errors     map[string]string
+	lastRun    time.Time
+}
+
+// NewProxyController constructor.  rs may be nil when the drift
+// should not be exposed through the REST API.
+func NewProxyController(rs RestServer, db Db, p Proxy, baseDomain string) ProxyController {
+	c := &proxyController{
+		db:         db,
+		rs:         rs,
+		p:          p,
+		baseDomain: baseDomain,
+		errors:     make(map[string]string),
+	}
+	c.init()
+	return c
+}
+
+func (c *proxyController) init() {
+	if c.rs != nil {
+		c.rs.HandleFunc("/master/proxy", func(w http.ResponseWriter, r *http.Request) RestResponse {
+			return (&JSONResponse{}).SetBody(c.Drift())
+		}).Methods("GET")
+		c.rs.HandleFunc("/master/proxy/reconcile", func(w http.ResponseWriter, r *http.Request) RestResponse {
+			return (&JSONResponse{}).SetBody(c.Reconcile())
+		}).Methods("POST")
+	}
+
+	timer := time.NewTicker(proxyControllerTick)
+	go func() {
+		for range timer.C {
+			c.Reconcile()
+		}
+	}()
+}
+
+func (c *proxyController) Drift() *model.ProxyDrift {
+	drift, _, err := c.drift()
+	if err != nil {
+		drift.Errors[""] = err.Error()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, v := range c.errors {
+		drift.Errors[k] = v
+	}
+	drift.LastRun = c.lastRun
+	return drift
+}
+
+// Reconcile applies the sites without holding mu, applying a site may
+// wait for its certificate to be issued
+func (c *proxyController) Reconcile() *model.ProxyDrift {
+	c.runMu.Lock()
+	defer c.runMu.Unlock()
+
+	drift, desired, err := c.drift()
+	drift.LastRun = time.Now()
+	defer func() {
+		c.mu.Lock()
+		c.lastRun = drift.LastRun
+		c.errors = drift.Errors
+		c.mu.Unlock()
+	}()
+	if err != nil {
+		log.Error("proxy controller: unable to list configured sites: %s", err)
+		drift.Errors[""] = err.Error()
+		return drift
+	}
+
+	for _, name := range append(append([]string{}, drift.Missing...), drift.Outdated...) {
+		if err := c.p.Apply(desired[name]); err != nil {
+			log.Error("proxy controller: unable to apply %s: %s", name, err)
+			drift.Errors[name] = err.Error()
+		}
+	}
+
+	for _, name := range drift.Orphaned {
+		if err := c.p.Remove(name); err != nil {
+			log.Error("proxy controller: unable to remove %s: %s", name, err)
+			drift.Errors[name] = err.Error()
+		}
+	}
+
+	if !drift.InSync() {
+		log.Info("proxy controller: %d missing, %d outdated, %d orphaned", len(drift.Missing), len(drift.Outdated), len(drift.Orphaned))
+	}
+	return drift
+}
+
+// drift computes the differences between the desired sites and the
+// sites configured in the proxy.  The configured sites are read from
+// the proxy, so the drift survives restarts and leader changes.
+func (c *proxyController) drift() (*model.ProxyDrift, map[string]*ProxySite, error) {
+	drift := &model.ProxyDrift{
+		Missing:  make([]string, 0),
+		Orphaned: make([]string, 0),
+		Outdated: make([]string, 0),
+		Errors:   make(map[string]string),
+	}
+	desired, conflicts := c.desired()
+	for name, err := range conflicts {
+		drift.Errors[name] = err.Error()
+	}
+
+	configured, err := c.p.Sites()
+	if err != nil {
+		return drift, desired, err
+	}
+	for name, site := range configured {
+		want, ok := desired[name]
+		if !ok {
+			drift.Orphaned = append(drift.Orphaned, name)
+		} else if c.signature(want) != c.signature(site) {
+			drift.Outdated = append(drift.Outdated, name)
+		}
+	}
+	for name := range desired {
+		if _, ok := configured[name]; !ok {
+			drift.Missing = append(drift.Missing, name)
+		}
+	}
+
+	sort.Strings(drift.Missing)
+	sort.Strings(drift.Orphaned)
+	sort.Strings(drift.Outdated)
+	return drift, desired, nil
+}
+
+// desired returns a site for every definition with an http port and at
+// least one replica placed on an enabled node, unless it is being
+// deleted.  Definitions whose routes conflict with another definition
+// are left out and returned as errors.
+func (c *proxyController) desired() (map[string]*ProxySite, map[string]error) {
+	defs := c.db.ListDefinitions()
+	conflicts := model.RouteConflicts(defs, c.baseDomain)
+	backends := backendsByDefinition(c.db.ListContainers(), c.db.ListNodes())
+	sites := make(map[string]*ProxySite)
+	for name, def := range defs {
+		if def.HTTPPort == 0 || definitionDeleting(def) {
+			continue
+		}
+		if _, ok := conflicts[name]; ok {
+			continue
+		}
+		addrs, ok := backends[name]
+		if !ok || len(addrs) == 0 {
+			continue
+		}
+		sites[name] = &ProxySite{Name: name, Routes: def.Routes, Backends: addrs}
+	}
+	return sites, conflicts
+}
+
+// signature identifies the contents of a site to detect changes, its
+// routes are resolved the way the proxy stores them
+func (c *proxyController) signature(site *ProxySite) string {
+	b, _ := json.Marshal(&ProxySite{
+		Name:     site.Name,
+		Routes:   model.ResolveRoutes(site.Name, site.Routes, c.baseDomain),
+		Backends: site.Backends,
+	})
+	return string(b)
+}
@@ -0,0 +1,142 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/libgolang/one/model"
+)
+
+type fakeProxy struct {
+	sites   map[string]*ProxySite
+	applied int
+}
+
+func (f *fakeProxy) Apply(site *ProxySite) error {
+	f.sites[site.Name] = site
+	f.applied++
+	return nil
+}
+
+func (f *fakeProxy) Remove(name string) error {
+	delete(f.sites, name)
+	return nil
+}
+
+func (f *fakeProxy) Sites() (map[string]*ProxySite, error) {
+	return copySites(f.sites), nil
+}
+
+func saveTestDefinition(t *testing.T, dir string, def *model.Definition) {
+	_ = os.MkdirAll(path.Join(dir, DefsDir), 0775)
+	b, _ := json.Marshal(def)
+	if err := ioutil.WriteFile(path.Join(dir, DefsDir, def.Name+".json"), b, 0664); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProxyControllerReconcile(t *testing.T) {
+	// given
+	tmpDir, _ := ioutil.TempDir("", "testing-db")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	d := NewDb(tmpDir)
+	saveTestDefinition(t, tmpDir, &model.Definition{Name: "web", HTTPPort: 80, Count: 1})
+	saveTestDefinition(t, tmpDir, &model.Definition{Name: "worker", Count: 1})
+	_ = d.SaveNode(&model.Node{Name: "n1", Addr: "10.0.0.1", Enabled: true})
+	_ = d.SaveContainer(&model.Container{Name: "web-1", DefinitionName: "web", NodeName: "n1", HTTPPort: 80, NodeHTTPPort: 11001})
+	_ = d.SaveContainer(&model.Container{Name: "worker-1", DefinitionName: "worker", NodeName: "n1"})
+
+	p := &fakeProxy{sites: map[string]*ProxySite{"old": {Name: "old"}}}
+	c := NewProxyController(nil, d, p, "example.com")
+
+	// when
+	drift := c.Reconcile()
+
+	// then
+	if len(drift.Missing) != 1 || drift.Missing[0] != "web" {
+		t.Errorf("web should be missing, got %v", drift.Missing)
+	}
+	if len(drift.Orphaned) != 1 || drift.Orphaned[0] != "old" {
+		t.Errorf("old should be orphaned, got %v", drift.Orphaned)
+	}
+	if _, ok := p.sites["old"]; ok {
+		t.Error("orphaned site should have been removed")
+	}
+	web, ok := p.sites["web"]
+	if !ok || len(web.Backends) != 1 || web.Backends[0] != "10.0.0.1:11001" {
+		t.Errorf("web should be configured with its replica, got %v", web)
+	}
+
+	// a second pass does not change anything
+	if drift := c.Reconcile(); !drift.InSync() {
+		t.Errorf("proxy should be in sync, got %+v", drift)
+	}
+	if p.applied != 1 {
+		t.Errorf("site should be applied once, but was applied %d times", p.applied)
+	}
+
+	// a new replica makes the site outdated
+	_ = d.SaveContainer(&model.Container{Name: "web-2", DefinitionName: "web", NodeName: "n1", HTTPPort: 80, NodeHTTPPort: 11002})
+	if drift := c.Drift(); len(drift.Outdated) != 1 {
+		t.Errorf("web should be outdated, got %+v", drift)
+	}
+	c.Reconcile()
+	if len(p.sites["web"].Backends) != 2 {
+		t.Errorf("web should have two backends, got %v", p.sites["web"].Backends)
+	}
+}
+
+func TestProxyControllerSkipsConflictingRoutes(t *testing.T) {
+	// given
+	tmpDir, _ := ioutil.TempDir("", "testing-db")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	d := NewDb(tmpDir)
+	routes := []model.Route{{Hosts: []string{"www.customer.com"}}}
+	saveTestDefinition(t, tmpDir, &model.Definition{Name: "a", HTTPPort: 80, Routes: routes})
+	saveTestDefinition(t, tmpDir, &model.Definition{Name: "b", HTTPPort: 80, Routes: routes})
+	_ = d.SaveNode(&model.Node{Name: "n1", Addr: "10.0.0.1", Enabled: true})
+	_ = d.SaveContainer(&model.Container{Name: "a-1", DefinitionName: "a", NodeName: "n1", NodeHTTPPort: 11001})
+	_ = d.SaveContainer(&model.Container{Name: "b-1", DefinitionName: "b", NodeName: "n1", NodeHTTPPort: 11002})
+
+	p := &fakeProxy{sites: map[string]*ProxySite{}}
+	c := NewProxyController(nil, d, p, "example.com")
+
+	// when
+	drift := c.Reconcile()
+
+	// then
+	if _, ok := p.sites["a"]; !ok {
+		t.Error("a should keep the route")
+	}
+	if _, ok := p.sites["b"]; ok {
+		t.Error("b should not be applied")
+	}
+	if _, ok := drift.Errors["b"]; !ok {
+		t.Errorf("the conflict should be reported, got %v", drift.Errors)
+	}
+}
+
+func TestProxyControllerRestart(t *testing.T) {
+	// given sites applied by a previous master
+	dbDir, _ := ioutil.TempDir("", "testing-db")
+	defer func() { _ = os.RemoveAll(dbDir) }()
+	d := NewDb(dbDir)
+	saveTestDefinition(t, dbDir, &model.Definition{Name: "web", HTTPPort: 80, Count: 1, Routes: []model.Route{{Hosts: []string{"WWW.customer.com"}, PathPrefix: "v2/"}}})
+	_ = d.SaveNode(&model.Node{Name: "n1", Addr: "10.0.0.1", Enabled: true})
+	_ = d.SaveContainer(&model.Container{Name: "web-1", DefinitionName: "web", NodeName: "n1", HTTPPort: 80, NodeHTTPPort: 11001})
+	p, tmpDir := newTestProxy(t, ProxyNginx, "true")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	NewProxyController(nil, d, p, "example.com").Reconcile()
+
+	// when
+	restarted := NewProxy(ProxyNginx, p.(*fileProxy).cfg)
+	drift := NewProxyController(nil, d, restarted, "example.com").Drift()
+
+	// then
+	if !drift.InSync() {
+		t.Errorf("sites applied before the restart should be in sync, got %+v", drift)
+	}
+}
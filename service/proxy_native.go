@@ -0,0 +1,345 @@
+package service
+
+import (
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libgolang/log"
+	"github.com/libgolang/one/clients"
+	"github.com/libgolang/one/model"
+	"golang.org/x/net/context"
+)
+
+const (
+	nativeProxyTick    = time.Second * 10
+	nativeProxyRetries = 3
+)
+
+// NativeProxy is a load balancing reverse proxy that routes the hosts
+// and path prefixes of a definition (<definition>.<baseDomain> by
+// default) to every replica of the definition.
+// It also implements Proxy so it can be used in place of the file
+// based drivers.
+type NativeProxy interface {
+	Proxy
+	http.Handler
+	Start()
+	Stop()
+	// SetSites replaces the routing table
+	SetSites(sites map[string]*ProxySite)
+}
+
+type nativeProxy struct {
+	listenAddr string
+	baseDomain string
+	strategy   string
+	master     clients.MasterClient
+	transport  http.RoundTripper
+	srv        *http.Server
+	ticker     *time.Ticker
+
+	mu     sync.RWMutex
+	sites  map[string]*ProxySite     // definition -> resolved site
+	pools  map[string]Balancer       // definition -> backends
+	routes map[string][]*nativeRoute // host -> routes, longest prefix first
+}
+
+type nativeRoute struct {
+	name   string // definition name
+	prefix string
+	strip  bool
+}
+
+// NewNativeProxy constructor.  listenAddr is the address to serve
+// on (e.g. :80), strategy is BalanceRoundRobin or BalanceLeastConn and
+// master is used to refresh the routing table.  master may be nil,
+// in which case routes are only set through SetSites or Apply.
+func NewNativeProxy(listenAddr, baseDomain, strategy string, master clients.MasterClient) NativeProxy {
+	return &nativeProxy{
+		listenAddr: listenAddr,
+		baseDomain: strings.ToLower(baseDomain),
+		strategy:   strategy,
+		master:     master,
+		transport:  http.DefaultTransport,
+		sites:      make(map[string]*ProxySite),
+		pools:      make(map[string]Balancer),
+		routes:     make(map[string][]*nativeRoute),
+	}
+}
+
+func (p *nativeProxy) Start() {
+	p.srv = &http.Server{Addr: p.listenAddr, Handler: p}
+	go func() {
+		log.Info("Native proxy listening on %s", p.listenAddr)
+		if err := p.srv.ListenAndServe(); err != nil {
+			log.Warn("%s", err)
+		}
+	}()
+
+	if p.master == nil {
+		return
+	}
+	p.refresh()
+	p.ticker = time.NewTicker(nativeProxyTick)
+	go func() {
+		for range p.ticker.C {
+			p.refresh()
+		}
+	}()
+}
+
+func (p *nativeProxy) Stop() {
+	if p.ticker != nil {
+		p.ticker.Stop()
+	}
+	if p.srv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := p.srv.Shutdown(ctx); err != nil {
+		log.Error("error shutting down native proxy: %s", err)
+	}
+}
+
+func (p *nativeProxy) Apply(site *ProxySite) error {
+	routes := model.ResolveRoutes(site.Name, site.Routes, p.baseDomain)
+	if err := model.ValidateRoutes(routes); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.setSite(site.Name, routes, site.Backends)
+	p.sortRoutes()
+	return nil
+}
+
+func (p *nativeProxy) Remove(name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.removeSite(name)
+	return nil
+}
+
+func (p *nativeProxy) Sites() (map[string]*ProxySite, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return copySites(p.sites), nil
+}
+
+func (p *nativeProxy) SetSites(sites map[string]*ProxySite) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for name := range p.pools {
+		if _, ok := sites[name]; !ok {
+			log.Info("Removing routes of %s", name)
+			p.removeSite(name)
+		}
+	}
+	for name, site := range sites {
+		routes := model.ResolveRoutes(name, site.Routes, p.baseDomain)
+		if err := model.ValidateRoutes(routes); err != nil {
+			log.Error("proxy: ignoring routes of %s: %s", name, err)
+			continue
+		}
+		p.setSite(name, routes, site.Backends)
+	}
+	p.sortRoutes()
+}
+
+// setSite replaces the routes and backends of a definition.
+// It must be called with mu held.
+func (p *nativeProxy) setSite(name string, routes []model.Route, backends []string) {
+	p.sites[name] = &ProxySite{Name: name, Routes: routes, Backends: backends}
+	if pool, ok := p.pools[name]; ok {
+		pool.SetAddrs(backends)
+	} else {
+		log.Info("Adding routes of %s -> %s", name, backends)
+		p.pools[name] = NewBalancer(p.strategy, backends)
+	}
+	p.removeRoutes(name)
+	for _, r := range routes {
+		for _, h := range r.Hosts {
+			p.routes[h] = append(p.routes[h], &nativeRoute{
+				name:   name,
+				prefix: r.PathPrefix,
+				strip:  r.StripPrefix && r.PathPrefix != "/",
+			})
+		}
+	}
+}
+
+func (p *nativeProxy) removeSite(name string) {
+	delete(p.sites, name)
+	delete(p.pools, name)
+	p.removeRoutes(name)
+}
+
+func (p *nativeProxy) removeRoutes(name string) {
+	for host, routes := range p.routes {
+		kept := make([]*nativeRoute, 0, len(routes))
+		for _, r := range routes {
+			if r.name != name {
+				kept = append(kept, r)
+			}
+		}
+		if len(kept) == 0 {
+			delete(p.routes, host)
+		} else {
+			p.routes[host] = kept
+		}
+	}
+}
+
+// sortRoutes sorts the routes of every host longest prefix first
+func (p *nativeProxy) sortRoutes() {
+	for _, routes := range p.routes {
+		sort.SliceStable(routes, func(i, j int) bool {
+			return len(routes[i].prefix) > len(routes[j].prefix)
+		})
+	}
+}
+
+// refresh rebuilds the routing table from the definitions and
+// containers known to the master.
+func (p *nativeProxy) refresh() {
+	defs, err := p.master.ListDefinitions()
+	if err != nil {
+		log.Error("proxy: unable to list definitions: %s", err)
+		return
+	}
+	containers, err := p.master.ListContainers()
+	if err != nil {
+		log.Error("proxy: unable to list containers: %s", err)
+		return
+	}
+	nodes, err := p.master.ListNodes()
+	if err != nil {
+		log.Error("proxy: unable to list nodes: %s", err)
+		return
+	}
+
+	backends := backendsByDefinition(containers, nodes)
+	conflicts := model.RouteConflicts(defs, p.baseDomain)
+	sites := make(map[string]*ProxySite)
+	for name, def := range defs {
+		if err, ok := conflicts[name]; ok {
+			log.Warn("proxy: not routing %s: %s", name, err)
+			continue
+		}
+		if addrs, ok := backends[name]; ok {
+			sites[name] = &ProxySite{Name: name, Routes: def.Routes, Backends: addrs}
+		}
+	}
+	p.SetSites(sites)
+}
+
+// backendsByDefinition maps each definition to the node addresses of its
+// running replicas.  Replicas that stop after their node reported them
+// are ejected passively by the balancer once requests to them fail.
+func backendsByDefinition(containers map[string]*model.Container, nodes map[string]*model.Node) map[string][]string {
+	backends := make(map[string][]string)
+	for _, cont := range containers {
+		if cont.NodeHTTPPort == 0 || cont.DefinitionName == "" {
+			continue
+		}
+		// containers saved without a state are assumed to be running
+		if cont.Desired() != model.ContainerRunning || (cont.State != "" && cont.State != model.ContainerRunning) {
+			continue
+		}
+		node, ok := nodes[cont.NodeName]
+		if !ok || !node.Enabled {
+			continue
+		}
+		addr := net.JoinHostPort(nodeHost(node.Addr), strconv.Itoa(cont.NodeHTTPPort))
+		backends[cont.DefinitionName] = append(backends[cont.DefinitionName], addr)
+	}
+	for _, addrs := range backends {
+		sort.Strings(addrs)
+	}
+	return backends
+}
+
+// nodeHost returns the host part of a node address that
+// may or may not contain a port
+func nodeHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// match returns the route and pool serving the host and path
+func (p *nativeProxy) match(host, urlPath string) (*nativeRoute, Balancer, bool) {
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, r := range p.routes[host] {
+		if r.prefix == "/" || urlPath == r.prefix || strings.HasPrefix(urlPath, r.prefix+"/") {
+			pool, ok := p.pools[r.name]
+			return r, pool, ok
+		}
+	}
+	return nil, nil, false
+}
+
+func (p *nativeProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route, pool, ok := p.match(r.Host, r.URL.Path)
+	if !ok {
+		http.Error(w, "Unknown host", http.StatusNotFound)
+		return
+	}
+	// only requests without a body can be replayed on another backend
+	attempts := 1
+	if r.Body == nil || r.Body == http.NoBody {
+		attempts = nativeProxyRetries
+	}
+
+	tried := make(map[*Backend]bool)
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		be := pool.Next(tried)
+		if be == nil {
+			break
+		}
+		tried[be] = true
+
+		failed := false
+		rp := &httputil.ReverseProxy{
+			Director: func(req *http.Request) {
+				req.URL.Scheme = "http"
+				req.URL.Host = be.Addr
+				if route.strip {
+					req.URL.Path = "/" + strings.TrimLeft(strings.TrimPrefix(req.URL.Path, route.prefix), "/")
+					req.URL.RawPath = ""
+				}
+				req.Header.Set("X-Forwarded-Host", r.Host)
+			},
+			Transport: p.transport,
+			ErrorHandler: func(_ http.ResponseWriter, _ *http.Request, err error) {
+				failed = true
+				lastErr = err
+			},
+		}
+
+		pool.Acquire(be)
+		rp.ServeHTTP(w, r)
+		pool.Release(be, failed)
+		if !failed {
+			return
+		}
+		log.Warn("proxy: backend %s failed for %s: %s", be.Addr, r.Host, lastErr)
+	}
+
+	http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+}
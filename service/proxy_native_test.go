@@ -0,0 +1,147 @@
+package service
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/libgolang/one/model"
+)
+
+func TestNativeProxyRoutesByHost(t *testing.T) {
+	// given
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("web:" + r.Host))
+	}))
+	defer backend.Close()
+
+	p := NewNativeProxy(":0", "example.com", BalanceRoundRobin, nil)
+	p.SetSites(map[string]*ProxySite{"web": {Name: "web", Backends: []string{strings.TrimPrefix(backend.URL, "http://")}}})
+
+	// when
+	r := httptest.NewRequest("GET", "http://web.example.com:8080/", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+
+	// then
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	if w.Code != 200 {
+		t.Errorf("should return 200, but returned %d", w.Code)
+	}
+	if string(body) != "web:web.example.com:8080" {
+		t.Errorf("host should be preserved, body was %s", body)
+	}
+
+	// unknown hosts are not proxied
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "http://db.example.com/", nil))
+	if w.Code != 404 {
+		t.Errorf("should return 404 for unknown definition, but returned %d", w.Code)
+	}
+}
+
+func TestNativeProxyRetriesFailedBackend(t *testing.T) {
+	// given
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	deadAddr := strings.TrimPrefix(dead.URL, "http://")
+	dead.Close()
+
+	p := NewNativeProxy(":0", "example.com", BalanceRoundRobin, nil)
+	p.SetSites(map[string]*ProxySite{"web": {Name: "web", Backends: []string{deadAddr, strings.TrimPrefix(backend.URL, "http://")}}})
+
+	// when / then
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "http://web.example.com/", nil))
+		if w.Code != 200 {
+			t.Errorf("request %d should have been retried on the live backend, but returned %d", i, w.Code)
+		}
+	}
+}
+
+func TestNativeProxyPathRoutes(t *testing.T) {
+	// given
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name + ":" + r.URL.Path))
+		}
+	}
+	web := httptest.NewServer(handler("web"))
+	defer web.Close()
+	api := httptest.NewServer(handler("api"))
+	defer api.Close()
+
+	p := NewNativeProxy(":0", "example.com", BalanceRoundRobin, nil)
+	p.SetSites(map[string]*ProxySite{
+		"web": {
+			Name:     "web",
+			Routes:   []model.Route{{Hosts: []string{"www.customer.com", "customer.com"}}},
+			Backends: []string{strings.TrimPrefix(web.URL, "http://")},
+		},
+		"api": {
+			Name:     "api",
+			Routes:   []model.Route{{Hosts: []string{"www.customer.com"}, PathPrefix: "/v2/", StripPrefix: true}},
+			Backends: []string{strings.TrimPrefix(api.URL, "http://")},
+		},
+	})
+
+	cases := map[string]string{
+		"http://www.customer.com/":         "web:/",
+		"http://customer.com/index.html":   "web:/index.html",
+		"http://www.customer.com/v2":       "api:/",
+		"http://www.customer.com/v2/users": "api:/users",
+		"http://www.customer.com/v20":      "web:/v20",
+	}
+	for url, expected := range cases {
+		// when
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+
+		// then
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		if string(body) != expected {
+			t.Errorf("%s should return %s, but returned %s", url, expected, body)
+		}
+	}
+
+	// the default route is replaced by the explicit hosts
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "http://web.example.com/", nil))
+	if w.Code != 404 {
+		t.Errorf("default host should not be routed, but returned %d", w.Code)
+	}
+}
+
+func TestBackendsByDefinition(t *testing.T) {
+	// given
+	nodes := map[string]*model.Node{
+		"n1": {Name: "n1", Addr: "10.0.0.1", Enabled: true},
+		"n2": {Name: "n2", Addr: "10.0.0.2:8080", Enabled: true},
+		"n3": {Name: "n3", Addr: "10.0.0.3", Enabled: false},
+	}
+	containers := map[string]*model.Container{
+		"web-1": {Name: "web-1", DefinitionName: "web", NodeName: "n1", NodeHTTPPort: 11001},
+		"web-2": {Name: "web-2", DefinitionName: "web", NodeName: "n2", NodeHTTPPort: 11002},
+		"web-3": {Name: "web-3", DefinitionName: "web", NodeName: "n3", NodeHTTPPort: 11003},
+		"web-4": {Name: "web-4", DefinitionName: "web", NodeName: "n1", NodeHTTPPort: 11004, State: model.ContainerTerminating},
+		"db-1":  {Name: "db-1", DefinitionName: "db", NodeName: "n1"},
+	}
+
+	// when
+	routes := backendsByDefinition(containers, nodes)
+
+	// then
+	if len(routes) != 1 {
+		t.Errorf("only web should be routed, got %v", routes)
+	}
+	web := routes["web"]
+	if len(web) != 2 || web[0] != "10.0.0.1:11001" || web[1] != "10.0.0.2:11002" {
+		t.Errorf("unexpected backends %v", web)
+	}
+}
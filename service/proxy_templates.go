@@ -0,0 +1,192 @@
+package service
+
+// Default proxy templates.  Any of the site and challenge templates
+// can be overridden with proxy.template and proxy.template.challenge.
+//
+// Site templates render one host and receive: domain (the host),
+// locations, allowHttp (true when every location allows plain http),
+// listenIp, publicIp, adminEmail, certFile, keyFile, chainFile and
+// webRoot (the directory of http-01 challenge responses, which must be
+// served on port 80 so certificates can be renewed).
+// Each location has Name, Upstream, Prefix, PrefixSlash, Root,
+// StripPrefix, AllowHTTP and Backends (host:port list) and locations
+// are sorted longest prefix first.  Prefixes used in regular
+// expressions must be escaped with quoteMeta.
+//
+// Challenge templates receive: domain, listenIp, adminEmail and webRoot.
+const (
+	htmlTemplateString = `<html>
+<head>
+<title>{{.Domain}}</title>
+</head>
+<body>
+<h3>{{.Domain}}</h3>
+</body>
+</html>
+`
+
+	apacheChallengeTemplateString = `<VirtualHost {{.listenIp}}:80>
+{{- if .adminEmail}}
+	ServerAdmin {{.adminEmail}}
+{{- end}}
+	ServerName {{.domain}}
+	ServerAlias {{.domain}}
+	DocumentRoot {{.webRoot}}
+	<Directory {{.webRoot}}>
+		Options FollowSymLinks MultiViews
+		AllowOverride All
+		Require all granted
+	</Directory>
+</VirtualHost>
+`
+
+	apacheSiteTemplateString = `{{define "balancers"}}
+{{- range .}}
+	<Proxy "balancer://{{.Upstream}}">
+{{- range .Backends}}
+		BalancerMember "http://{{.}}"
+{{- end}}
+	</Proxy>
+{{- end}}
+{{- end}}
+{{- define "proxy"}}
+	{{- if not .Root}}
+	RedirectMatch 301 ^{{quoteMeta .Prefix}}$ {{.PrefixSlash}}
+	{{- end}}
+	{{- if .StripPrefix}}
+	ProxyPass "{{.PrefixSlash}}"  "balancer://{{.Upstream}}/"
+	ProxyPassReverse "{{.PrefixSlash}}"  "balancer://{{.Upstream}}/"
+	{{- else}}
+	ProxyPass "{{.PrefixSlash}}"  "balancer://{{.Upstream}}{{.PrefixSlash}}"
+	ProxyPassReverse "{{.PrefixSlash}}"  "balancer://{{.Upstream}}{{.PrefixSlash}}"
+	{{- end}}
+{{- end -}}
+<VirtualHost {{.listenIp}}:80>
+{{- if .adminEmail}}
+	ServerAdmin {{.adminEmail}}
+{{- end}}
+	ServerName {{.domain}}
+	AllowEncodedSlashes NoDecode
+	ProxyPreserveHost On
+	RewriteEngine On
+	Alias /.well-known/acme-challenge/ {{.webRoot}}/.well-known/acme-challenge/
+	<Directory {{.webRoot}}/.well-known/acme-challenge>
+		Require all granted
+	</Directory>
+	ProxyPass /.well-known/acme-challenge/ !
+	RewriteRule ^/.well-known/acme-challenge/ - [L]
+{{- template "balancers" .locations}}
+{{- range .locations}}
+{{- if .AllowHTTP}}
+	RewriteRule ^{{quoteMeta .PrefixSlash}} - [L]
+{{- template "proxy" .}}
+{{- else}}
+	RewriteCond %{HTTPS}  !=on
+	RewriteRule ^{{quoteMeta .PrefixSlash}}?(.*) https://%{SERVER_NAME}{{.PrefixSlash}}$1 [R,L]
+{{- end}}
+{{- end}}
+</VirtualHost>
+<VirtualHost {{.listenIp}}:443>
+{{- if .adminEmail}}
+	ServerAdmin {{.adminEmail}}
+{{- end}}
+	ServerName {{.domain}}
+	AllowEncodedSlashes NoDecode
+	ProxyPreserveHost On
+{{- template "balancers" .locations}}
+{{- range .locations}}
+{{- template "proxy" .}}
+{{- end}}
+	SSLEngine on
+	SSLCertificateFile    {{.certFile}}
+	SSLCertificateKeyFile {{.keyFile}}
+	SSLCACertificateFile  {{.chainFile}}
+</VirtualHost>
+`
+
+	nginxChallengeTemplateString = `server {
+	listen {{.listenIp}}:80;
+	server_name {{.domain}};
+	root {{.webRoot}};
+}
+`
+
+	nginxSiteTemplateString = `{{define "proxy"}}
+		proxy_pass http://{{.Upstream}}{{if .StripPrefix}}/{{end}};
+		proxy_set_header Host $host;
+		proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+		proxy_set_header X-Forwarded-Proto $scheme;
+{{- end -}}
+{{- range .locations}}
+upstream {{.Upstream}} {
+{{- range .Backends}}
+	server {{.}};
+{{- end}}
+}
+{{- end}}
+server {
+	listen {{.listenIp}}:80;
+	server_name {{.domain}};
+	location /.well-known/acme-challenge/ {
+		root {{.webRoot}};
+	}
+{{- range .locations}}
+	location {{.PrefixSlash}} {
+{{- if .AllowHTTP}}
+{{- template "proxy" .}}
+{{- else}}
+		return 301 https://$host$request_uri;
+{{- end}}
+	}
+{{- end}}
+}
+server {
+	listen {{.listenIp}}:443 ssl;
+	server_name {{.domain}};
+	ssl_certificate     {{.chainFile}};
+	ssl_certificate_key {{.keyFile}};
+{{- range .locations}}
+	location {{.PrefixSlash}} {
+{{- template "proxy" .}}
+	}
+{{- end}}
+}
+`
+
+	haproxySiteTemplateString = `{{- range .locations}}
+backend {{.Upstream}}
+	balance roundrobin
+	http-request set-header X-Forwarded-Proto https if { ssl_fc }
+{{- if not .AllowHTTP}}
+	http-request redirect scheme https unless { ssl_fc }
+{{- end}}
+{{- if .StripPrefix}}
+	http-request set-path %[path,regsub(^{{quoteMeta .Prefix}}/?,/)]
+{{- end}}
+{{- range $i, $backend := .Backends}}
+	server s{{$i}} {{$backend}} check
+{{- end}}
+{{end}}`
+
+	caddySiteTemplateString = `{{if .allowHttp}}http://{{.domain}}, {{end}}{{.domain}} {
+{{- if .adminEmail}}
+	tls {{.adminEmail}}
+{{- end}}
+{{- range .locations}}
+{{- if .Root}}
+	handle {
+{{- else}}
+	@{{.Upstream}} path {{.Prefix}} {{.PrefixSlash}}*
+	handle @{{.Upstream}} {
+{{- if .StripPrefix}}
+		uri strip_prefix {{.Prefix}}
+{{- end}}
+{{- end}}
+		reverse_proxy{{range .Backends}} {{.}}{{end}} {
+			lb_policy round_robin
+		}
+	}
+{{- end}}
+}
+`
+)
@@ -0,0 +1,231 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libgolang/one/model"
+)
+
+func newTestProxy(t *testing.T, driver, testCmd string) (Proxy, string) {
+	tmpDir, _ := ioutil.TempDir("", "testing-proxy")
+	p := NewProxy(driver, ProxyConfig{
+		BaseDomain: "example.com",
+		PrivateIP:  "10.0.0.1",
+		ConfigDir:  path.Join(tmpDir, "available"),
+		EnabledDir: path.Join(tmpDir, "enabled"),
+		EnableCmd:  "true",
+		DisableCmd: "true",
+		TestCmd:    testCmd,
+		ReloadCmd:  "true",
+		WebRoot:    path.Join(tmpDir, "www"),
+		Certs:      NewCertManager(path.Join(tmpDir, "certs"), NewSelfSignedProvider(path.Join(tmpDir, "ca"), time.Hour), time.Minute),
+	})
+	_ = os.MkdirAll(path.Join(tmpDir, "enabled"), 0775)
+	return p, tmpDir
+}
+
+func TestProxyNginxApplyAndRemove(t *testing.T) {
+	// given
+	p, tmpDir := newTestProxy(t, ProxyNginx, "true")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	// when
+	err := p.Apply(&ProxySite{Name: "web", Backends: []string{"10.0.0.2:11001", "10.0.0.3:11002"}})
+
+	// then
+	if err != nil {
+		t.Errorf("error applying site: %s", err)
+	}
+	b, err := ioutil.ReadFile(path.Join(tmpDir, "available", "web.example.com.conf"))
+	if err != nil {
+		t.Errorf("site file should exist: %s", err)
+	}
+	if !strings.Contains(string(b), "server 10.0.0.2:11001;") || !strings.Contains(string(b), "server 10.0.0.3:11002;") {
+		t.Errorf("every backend should be in the upstream:\n%s", b)
+	}
+	if !strings.Contains(string(b), path.Join(tmpDir, "certs", "web.example.com", "fullchain.pem")) {
+		t.Errorf("the issued certificate should be configured:\n%s", b)
+	}
+	if _, err := os.Lstat(path.Join(tmpDir, "enabled", "web.example.com.conf")); err != nil {
+		t.Errorf("site should be enabled: %s", err)
+	}
+
+	// and when removed
+	if err := p.Remove("web"); err != nil {
+		t.Errorf("error removing site: %s", err)
+	}
+	if _, err := os.Lstat(path.Join(tmpDir, "enabled", "web.example.com.conf")); !os.IsNotExist(err) {
+		t.Error("site should be disabled")
+	}
+}
+
+func TestProxyRollbackOnFailedTest(t *testing.T) {
+	// given
+	p, tmpDir := newTestProxy(t, ProxyHAProxy, "false")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	// when
+	err := p.Apply(&ProxySite{Name: "web", Backends: []string{"10.0.0.2:11001"}})
+
+	// then
+	if err == nil {
+		t.Error("apply should fail when the config test fails")
+	}
+	if _, err := os.Stat(path.Join(tmpDir, "available", "web.example.com.cfg")); !os.IsNotExist(err) {
+		t.Error("new site file should have been rolled back")
+	}
+	b, _ := ioutil.ReadFile(path.Join(tmpDir, "available", "hosts.map"))
+	if len(b) != 0 {
+		t.Errorf("host map should be empty, but it is %s", b)
+	}
+}
+
+func TestProxyHAProxyHostMap(t *testing.T) {
+	// given
+	p, tmpDir := newTestProxy(t, ProxyHAProxy, "true")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	// when
+	_ = p.Apply(&ProxySite{Name: "web", Backends: []string{"10.0.0.2:11001"}})
+	_ = p.Apply(&ProxySite{
+		Name:     "api",
+		Routes:   []model.Route{{Hosts: []string{"web.example.com"}, PathPrefix: "/v2", StripPrefix: true}},
+		Backends: []string{"10.0.0.2:11002"},
+	})
+
+	// then
+	b, _ := ioutil.ReadFile(path.Join(tmpDir, "available", "hosts.map"))
+	expected := `^web\.example\.com(:[0-9]+)?/v2(/|$) web_example_com_api_v2
+^web\.example\.com(:[0-9]+)?/.* web_example_com_web
+`
+	if string(b) != expected {
+		t.Errorf("unexpected host map %q", b)
+	}
+	b, _ = ioutil.ReadFile(path.Join(tmpDir, "available", "web.example.com.cfg"))
+	if !strings.Contains(string(b), "backend web_example_com_api_v2") || !strings.Contains(string(b), "set-path %[path,regsub(^/v2/?,/)]") {
+		t.Errorf("both definitions should be in the host file:\n%s", b)
+	}
+
+	// removing a definition keeps the other one on the host
+	_ = p.Remove("api")
+	sites, _ := p.Sites()
+	if _, ok := sites["web"]; len(sites) != 1 || !ok {
+		t.Errorf("only web should be configured, got %v", sites)
+	}
+	b, _ = ioutil.ReadFile(path.Join(tmpDir, "available", "web.example.com.cfg"))
+	if strings.Contains(string(b), "api") {
+		t.Errorf("api should have been removed from the host file:\n%s", b)
+	}
+}
+
+func TestProxyApacheCustomHosts(t *testing.T) {
+	// given
+	p, tmpDir := newTestProxy(t, ProxyApache, "true")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	// when
+	err := p.Apply(&ProxySite{
+		Name:     "web",
+		Routes:   []model.Route{{Hosts: []string{"www.customer.com", "customer.com"}, AllowHTTP: true}},
+		Backends: []string{"10.0.0.2:11001"},
+	})
+
+	// then
+	if err != nil {
+		t.Errorf("error applying site: %s", err)
+	}
+	if _, err := os.Stat(path.Join(tmpDir, "available", "web.example.com.conf")); !os.IsNotExist(err) {
+		t.Error("default host should not be configured")
+	}
+	for _, h := range []string{"www.customer.com", "customer.com"} {
+		b, err := ioutil.ReadFile(path.Join(tmpDir, "available", h+".conf"))
+		if err != nil {
+			t.Errorf("%s should be configured: %s", h, err)
+		}
+		if strings.Contains(string(b), "https://") {
+			t.Errorf("%s should not redirect to https:\n%s", h, b)
+		}
+		if !strings.Contains(string(b), `BalancerMember "http://10.0.0.2:11001"`) {
+			t.Errorf("%s should proxy to the backend:\n%s", h, b)
+		}
+	}
+}
+
+func TestProxyPathPrefixEscaping(t *testing.T) {
+	// given
+	p, tmpDir := newTestProxy(t, ProxyApache, "true")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	// when
+	err := p.Apply(&ProxySite{
+		Name:     "api",
+		Routes:   []model.Route{{Hosts: []string{"web.example.com"}, PathPrefix: "/v1.2"}},
+		Backends: []string{"10.0.0.2:11001"},
+	})
+	var invalid []string
+	for _, prefix := range []string{"/a;b", "/a b", "/a(b)", "/a$", "/a|b", "/a+", "/a[b]", "/a#b", "/a^b", "/a,b"} {
+		site := &ProxySite{Name: "web", Routes: []model.Route{{PathPrefix: prefix}}, Backends: []string{"10.0.0.2:11002"}}
+		if p.Apply(site) == nil {
+			invalid = append(invalid, prefix)
+		}
+	}
+
+	// then
+	if err != nil {
+		t.Fatalf("error applying site: %s", err)
+	}
+	b, _ := ioutil.ReadFile(path.Join(tmpDir, "available", "web.example.com.conf"))
+	if !strings.Contains(string(b), `RedirectMatch 301 ^/v1\.2$ /v1.2/`) {
+		t.Errorf("the prefix should be escaped in regular expressions:\n%s", b)
+	}
+	if len(invalid) > 0 {
+		t.Errorf("prefixes %v should be refused", invalid)
+	}
+}
+
+func TestProxyWildcardCertificate(t *testing.T) {
+	// given
+	tmpDir, _ := ioutil.TempDir("", "testing-proxy")
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	certs := NewCertManager(path.Join(tmpDir, "certs"), NewSelfSignedProvider(path.Join(tmpDir, "ca"), time.Hour), time.Minute)
+	p := NewProxy(ProxyNginx, ProxyConfig{
+		BaseDomain:   "example.com",
+		ConfigDir:    path.Join(tmpDir, "available"),
+		EnabledDir:   path.Join(tmpDir, "enabled"),
+		TestCmd:      "true",
+		ReloadCmd:    "true",
+		WebRoot:      path.Join(tmpDir, "www"),
+		Certs:        certs,
+		WildcardCert: true,
+	})
+	_ = os.MkdirAll(path.Join(tmpDir, "enabled"), 0775)
+
+	// when
+	_ = p.Apply(&ProxySite{Name: "web", Backends: []string{"10.0.0.2:11001"}})
+	_ = p.Apply(&ProxySite{Name: "api", Backends: []string{"10.0.0.2:11002"}})
+	_ = p.Apply(&ProxySite{
+		Name:     "shop",
+		Routes:   []model.Route{{Hosts: []string{"shop.customer.com"}}},
+		Backends: []string{"10.0.0.2:11003"},
+	})
+
+	// then
+	domains := make([]string, 0)
+	for _, c := range certs.Certificates() {
+		domains = append(domains, c.Domain)
+	}
+	if strings.Join(domains, ",") != "*.example.com,shop.customer.com" {
+		t.Errorf("one wildcard and one custom host certificate should be issued, got %v", domains)
+	}
+	for _, h := range []string{"web.example.com", "api.example.com"} {
+		b, _ := ioutil.ReadFile(path.Join(tmpDir, "available", h+".conf"))
+		if !strings.Contains(string(b), path.Join(tmpDir, "certs", "_wildcard.example.com", "fullchain.pem")) {
+			t.Errorf("%s should use the wildcard certificate:\n%s", h, b)
+		}
+	}
+}
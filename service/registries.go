@@ -0,0 +1,205 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/libgolang/log"
+	"github.com/libgolang/one/model"
+	"github.com/libgolang/one/utils"
+)
+
+// dockerHubHost registry host of the images without one
+const dockerHubHost = "docker.io"
+
+var (
+	registryNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][-A-Za-z0-9_.]{0,62}$`)
+	registryHostRegexp = regexp.MustCompile(`^[A-Za-z0-9][-A-Za-z0-9.]*(:[0-9]+)?$`)
+)
+
+// validateRegistry checks the name, host and username of registry
+func validateRegistry(registry *model.Registry) error {
+	if !registryNameRegexp.MatchString(registry.Name) {
+		return fmt.Errorf("invalid registry name %q: up to 63 letters, digits, -, _ or . starting with a letter or digit", registry.Name)
+	}
+	if !registryHostRegexp.MatchString(registry.Host) {
+		return fmt.Errorf("invalid registry host %q: a host name with an optional port, without scheme or path", registry.Host)
+	}
+	if registry.Password != "" && registry.Username == "" {
+		return fmt.Errorf("registry %s requires a username with its password", registry.Name)
+	}
+	return nil
+}
+
+// imageHost returns the registry host of image, docker.io for the
+// images of Docker Hub
+func imageHost(image string) string {
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return dockerHubHost
+	}
+	host := image[:i]
+	if host != "localhost" && !strings.ContainsAny(host, ".:") {
+		return dockerHubHost
+	}
+	return host
+}
+
+// containerRegistries returns the credentials of the registries of the
+// images of conts and their sidecars, sorted by host.  The registry of
+// the definition of a container applies to its image, the registry of
+// their host to the others.  Registries whose password cannot be
+// decrypted with key are left out.
+func containerRegistries(conts []model.Container, registries map[string]*model.Registry, key []byte) []model.RegistryAuth {
+	byHost := make(map[string]*model.Registry)
+	for _, registry := range registries {
+		byHost[registry.Host] = registry
+	}
+	auths := make(map[string]model.RegistryAuth)
+	add := func(image string, registry *model.Registry) {
+		host := imageHost(image)
+		if registry == nil {
+			registry = byHost[host]
+		}
+		if _, ok := auths[host]; ok || registry == nil {
+			return
+		}
+		auth := model.RegistryAuth{Host: host, Username: registry.Username}
+		if registry.EncryptedPassword != "" {
+			password, err := utils.Decrypt(key, registry.EncryptedPassword)
+			if err != nil {
+				log.Error("Unable to decrypt the password of registry %s: %s", registry.Name, err)
+				return
+			}
+			auth.Password = password
+		}
+		auths[host] = auth
+	}
+	for _, cont := range conts {
+		add(cont.Image, registries[cont.Registry])
+		for _, sc := range cont.Sidecars {
+			add(sc.Image, nil)
+		}
+	}
+	result := make([]model.RegistryAuth, 0, len(auths))
+	for _, auth := range auths {
+		result = append(result, auth)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Host < result[j].Host })
+	return result
+}
+
+// redactRegistry returns a copy of registry without its password
+func redactRegistry(registry *model.Registry) *model.Registry {
+	redacted := *registry
+	redacted.Password = ""
+	redacted.EncryptedPassword = ""
+	return &redacted
+}
+
+func (m *masterService) listRegistries(w http.ResponseWriter, r *http.Request) RestResponse {
+	def := map[string]string{
+		"Name":     "string",
+		"Host":     "string",
+		"Username": "string",
+	}
+	list := make([]*model.Registry, 0)
+	for _, registry := range m.db.ListRegistries() {
+		list = append(list, redactRegistry(registry))
+	}
+	page, err := utils.RestList(def, "Name", r, &list)
+	if err != nil {
+		return (&JSONResponse{}).SetStatus(400).SetBody(map[string]string{"error": err.Error()})
+	}
+	return listResponse(page)
+}
+
+func (m *masterService) getRegistry(w http.ResponseWriter, r *http.Request) RestResponse {
+	resp := &JSONResponse{}
+	registry, err := m.db.GetRegistry(mux.Vars(r)["name"])
+	if err != nil {
+		return resp.SetStatus(404).SetBody(`{"error":"registry not found"}`)
+	}
+	return resp.SetETag(registry.ResourceVersion).SetBody(redactRegistry(registry))
+}
+
+// saveRegistry declares or updates the credentials of a registry.  The
+// password is encrypted with the registry key of the master, an update
+// without password keeps the stored one.  Passwords are never returned.
+func (m *masterService) saveRegistry(w http.ResponseWriter, r *http.Request) RestResponse {
+	resp := &JSONResponse{}
+	name := mux.Vars(r)["name"]
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error("error reading body: %s", err)
+		return resp.SetStatus(400).SetBody(`{"error":"Unable to read request"}`)
+	}
+	registry := &model.Registry{}
+	if err = json.Unmarshal(b, registry); err != nil {
+		log.Error("error decoding json: %s", err)
+		return resp.SetStatus(400).SetBody(`{"error":"Unable to parse request"}`)
+	}
+	if registry.Name == "" {
+		registry.Name = name
+	}
+	if registry.Name != name {
+		return resp.SetStatus(400).SetBody(`{"error":"Name does not match the url"}`)
+	}
+	if err := validateRegistry(registry); err != nil {
+		return resp.SetStatus(400).SetBody(map[string]string{"error": err.Error()})
+	}
+	registry.EncryptedPassword = ""
+	if registry.Password != "" {
+		if m.registryKey == nil {
+			return resp.SetStatus(400).SetBody(`{"error":"registry passwords require the master.registry.key of the master"}`)
+		}
+		if registry.EncryptedPassword, err = utils.Encrypt(m.registryKey, registry.Password); err != nil {
+			log.Error("error encrypting the password of registry %s: %s", name, err)
+			return resp.SetStatus(500).SetBody(`{"error":"Unable to encrypt password"}`)
+		}
+		registry.Password = ""
+	}
+
+	var invalid error
+	if terr := m.db.Trx(func(db Db) {
+		if err = matchVersion(r, &registry.ResourceVersion, func() (string, error) {
+			stored, err := db.GetRegistry(name)
+			if err != nil {
+				return "", &ConflictError{Kind: "registry", Name: name}
+			}
+			return stored.ResourceVersion, nil
+		}); err != nil {
+			return
+		}
+		for _, other := range db.ListRegistries() {
+			if other.Name != name && other.Host == registry.Host {
+				invalid = fmt.Errorf("host %s is the host of registry %s", registry.Host, other.Name)
+				return
+			}
+			if other.Name == name && registry.EncryptedPassword == "" {
+				registry.EncryptedPassword = other.EncryptedPassword
+			}
+		}
+		err = db.SaveRegistry(registry)
+	}); terr != nil {
+		return unavailableResponse(terr)
+	}
+	if invalid != nil {
+		return resp.SetStatus(400).SetBody(map[string]string{"error": invalid.Error()})
+	}
+	if _, ok := err.(*ConflictError); ok {
+		return conflictResponse(r, err)
+	}
+	if err != nil {
+		log.Error("error saving registry %s: %s", name, err)
+		return resp.SetStatus(500).SetBody(`{"error":"Unable to save registry"}`)
+	}
+	return resp.SetETag(registry.ResourceVersion).SetBody(redactRegistry(registry))
+}
@@ -3,10 +3,13 @@ package service
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/libgolang/log"
+	"github.com/libgolang/one/utils"
 	"golang.org/x/net/context"
 )
 
@@ -15,7 +18,13 @@ type RestServer interface {
 	Start()
 	StartAndBlock()
 	Stop()
+	// HandleFunc routes path to f.  The response of f is written with its
+	// status and headers, its body marshalled to json unless it is a
+	// string, which is written as is.  Nothing is written when f returns
+	// nil, f wrote the response itself.
 	HandleFunc(path string, f func(w http.ResponseWriter, r *http.Request) RestResponse) *mux.Route
+	// Use wraps the handlers of every route with middleware
+	Use(middleware func(http.Handler) http.Handler)
 }
 
 type restServer struct {
@@ -25,6 +34,19 @@ type restServer struct {
 	keyFile  string
 }
 
+var metricRESTDuration = metrics.histogram("one_rest_request_duration_seconds", "REST request latency by route, method and status code.", nil, "route", "method", "code")
+
+// statusWriter keeps the status code written to a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
 // RestResponse response interface
 type RestResponse interface {
 	ContentType() string
@@ -74,33 +96,50 @@ func (m *restServer) Router() *mux.Router {
 }
 
 func (m *restServer) HandleFunc(path string, f func(w http.ResponseWriter, r *http.Request) RestResponse) *mux.Route {
-	return m.router.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+	return m.router.HandleFunc(path, func(rw http.ResponseWriter, r *http.Request) {
+		w := &statusWriter{ResponseWriter: rw, status: http.StatusOK}
+		start := time.Now()
+		defer func() {
+			metricRESTDuration.since(start, path, r.Method, strconv.Itoa(w.status))
+		}()
 		ret := f(w, r)
 		if ret == nil {
 			return
 		}
-		bytes, err := json.Marshal(ret.Body())
-		if err != nil {
-			log.Error("%s", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			_, err = w.Write([]byte(`{"error": "Internal Server Error"}`))
+
+		// strings are expected to be json already
+		var bytes []byte
+		if str, ok := ret.Body().(string); ok {
+			bytes = []byte(str)
+		} else {
+			var err error
+			bytes, err = json.Marshal(ret.Body())
 			if err != nil {
 				log.Error("%s", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				_, err = w.Write([]byte(`{"error": "Internal Server Error"}`))
+				if err != nil {
+					log.Error("%s", err)
+				}
+				return
 			}
-			return
 		}
 
+		for k, v := range ret.Headers() {
+			w.Header().Set(k, v)
+		}
 		w.Header().Set("Content-Type", ret.ContentType())
+		w.WriteHeader(ret.Status())
 		if _, err := w.Write(bytes); err != nil {
 			log.Error("%s", err)
 		}
-
-		for k, v := range ret.Headers() {
-			w.Header().Set(k, v)
-		}
 	})
 }
 
+func (m *restServer) Use(middleware func(http.Handler) http.Handler) {
+	m.router.Use(middleware)
+}
+
 // Stop method to stop the service
 func (m *restServer) Stop() {
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
@@ -159,6 +198,58 @@ func (j *JSONResponse) SetBody(b interface{}) *JSONResponse {
 	return j
 }
 
+// SetHeader sets a response header
+func (j *JSONResponse) SetHeader(k, v string) *JSONResponse {
+	if j.headers == nil {
+		j.headers = make(map[string]string)
+	}
+	j.headers[k] = v
+	return j
+}
+
+// SetETag sets the ETag header to a resource version, if any
+func (j *JSONResponse) SetETag(version string) *JSONResponse {
+	if version == "" {
+		return j
+	}
+	return j.SetHeader("ETag", `"`+version+`"`)
+}
+
+// ifMatch returns the resource version required by the If-Match header
+// of r, "*" for any version or empty when there is no header
+func ifMatch(r *http.Request) string {
+	v := strings.TrimSpace(r.Header.Get("If-Match"))
+	return strings.Trim(strings.TrimPrefix(v, "W/"), `"`)
+}
+
+// conflictResponse answers a save that failed with a ConflictError: 412
+// when the version came from If-Match and 409 when it came in the body
+func conflictResponse(r *http.Request, err error) *JSONResponse {
+	status := http.StatusConflict
+	if ifMatch(r) != "" {
+		status = http.StatusPreconditionFailed
+	}
+	return (&JSONResponse{}).SetStatus(status).SetBody(map[string]string{"error": err.Error()})
+}
+
+// unavailableResponse answers a request whose writes were not
+// committed, so that clients retry, possibly with another master
+func unavailableResponse(err error) *JSONResponse {
+	log.Warn("writes not committed: %s", err)
+	return (&JSONResponse{}).SetStatus(http.StatusServiceUnavailable).SetBody(map[string]string{"error": err.Error()})
+}
+
+// listResponse answers a list request with a page of utils.RestList,
+// its total and continue token in the X-Total-Count and X-Continue
+// headers
+func listResponse(page *utils.RestListPage) *JSONResponse {
+	resp := (&JSONResponse{}).SetHeader("X-Total-Count", strconv.Itoa(page.Total)).SetBody(page.Items)
+	if page.Continue != "" {
+		resp.SetHeader("X-Continue", page.Continue)
+	}
+	return resp
+}
+
 // SetContentType  content-type
 func (j *JSONResponse) SetContentType(c string) *JSONResponse {
 	j.contentType = c
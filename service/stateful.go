@@ -0,0 +1,82 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/libgolang/log"
+	"github.com/libgolang/one/model"
+)
+
+// statefulName returns the stable name of the container with the
+// ordinal index of the stateful definition def
+func statefulName(def *model.Definition, index int) string {
+	return fmt.Sprintf("%s-%d", def.Name, index)
+}
+
+// modeChangeError returns an error when def switches the stored
+// definition to or from the stateful mode while its containers conts
+// remain, the ordinal names would collide with their names
+func modeChangeError(stored, def *model.Definition, conts map[string]*model.Container) error {
+	wasStateful := stored.WorkloadMode() == model.ModeStateful
+	if wasStateful == (def.WorkloadMode() == model.ModeStateful) || len(conts) == 0 {
+		return nil
+	}
+	return fmt.Errorf("definition %s must have no containers to change its mode from %s to %s", def.Name, stored.WorkloadMode(), def.WorkloadMode())
+}
+
+// statefulReady returns whether cont is running and healthy, when it
+// has a health check
+func statefulReady(cont *model.Container) bool {
+	return cont.State == model.ContainerRunning && (cont.Health == "" || cont.Health == "healthy")
+}
+
+// allocateStateful moves the stateful definition def one step towards
+// Count containers with the ordinals 0 to Count-1.  conts are its
+// containers desired running and contMap all containers.  Ordinals
+// beyond Count are removed highest first, each once the previous one is
+// gone.  A missing ordinal is created, under its previous name, once
+// every lower one is ready and its previous container is gone.  A failed
+// ordinal is removed, to be created again the same way.
+func (m *masterService) allocateStateful(def *model.Definition, conts []*model.Container, contMap map[string]*model.Container, nodeContMap map[string][]*model.Container, eligible map[string]bool) {
+	for _, cont := range contMap {
+		if cont.DefinitionName == def.Name && cont.Desired() == model.ContainerTerminated {
+			log.Debug("Definition %s waits for container %s to be removed", def.Name, cont.Name)
+			return
+		}
+	}
+
+	var highest *model.Container
+	byIndex := make(map[int]*model.Container)
+	for _, cont := range conts {
+		byIndex[cont.Index] = cont
+		if highest == nil || cont.Index > highest.Index {
+			highest = cont
+		}
+	}
+	if highest != nil && highest.Index >= def.Count {
+		log.Info("Scaling down %s, removing ordinal %d", def.Name, highest.Index)
+		m.terminateContainer(highest)
+		return
+	}
+
+	if definitionWaiting(def) {
+		return
+	}
+	for i := 0; i < def.Count; i++ {
+		cont, ok := byIndex[i]
+		if !ok {
+			log.Info("Scaling up %s, creating ordinal %d", def.Name, i)
+			m.createContainer(def, "", nodeContMap, eligible)
+			return
+		}
+		if cont.State == model.ContainerFailed {
+			log.Info("Replacing failed ordinal %d of %s", i, def.Name)
+			m.terminateContainer(cont)
+			return
+		}
+		if !statefulReady(cont) {
+			log.Debug("Definition %s waits for container %s to be ready", def.Name, cont.Name)
+			return
+		}
+	}
+}
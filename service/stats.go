@@ -0,0 +1,89 @@
+package service
+
+import (
+	"sync"
+
+	"github.com/libgolang/log"
+	"github.com/libgolang/one/model"
+)
+
+// statsHistoryLen samples kept for each container, 10 minutes of node
+// reports
+const statsHistoryLen = 30
+
+// statsHistory recent resource usage samples of containers by name
+type statsHistory struct {
+	mu      sync.Mutex
+	max     int
+	samples map[string][]model.ContainerStats
+}
+
+func newStatsHistory(max int) *statsHistory {
+	return &statsHistory{max: max, samples: make(map[string][]model.ContainerStats)}
+}
+
+// add appends a sample of the named container, dropping the oldest
+// beyond max
+func (h *statsHistory) add(name string, s model.ContainerStats) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := append(h.samples[name], s)
+	if len(list) > h.max {
+		list = list[len(list)-h.max:]
+	}
+	h.samples[name] = list
+}
+
+// get returns a copy of the samples of the named container, oldest
+// first
+func (h *statsHistory) get(name string) []model.ContainerStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]model.ContainerStats{}, h.samples[name]...)
+}
+
+// remove forgets the named container
+func (h *statsHistory) remove(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.samples, name)
+}
+
+// retain forgets every container not in names
+func (h *statsHistory) retain(names map[string]bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name := range h.samples {
+		if !names[name] {
+			delete(h.samples, name)
+		}
+	}
+}
+
+// sampleStats samples the running containers in parallel, docker takes
+// about a second to answer for each
+func sampleStats(d Docker, containers []model.Container) map[string]model.ContainerStats {
+	result := make(map[string]model.ContainerStats)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := range containers {
+		cont := containers[i]
+		if !cont.Running {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := d.ContainerStats(&cont)
+			if err != nil {
+				log.Warn("%s", err)
+				return
+			}
+			mu.Lock()
+			result[cont.Name] = *s
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return result
+}
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/libgolang/one/model"
+)
+
+func TestConvertStats(t *testing.T) {
+	// given
+	s := &types.StatsJSON{}
+	s.Read = time.Now()
+	s.PreCPUStats.CPUUsage.TotalUsage = 1000
+	s.PreCPUStats.SystemUsage = 10000
+	s.CPUStats.CPUUsage.TotalUsage = 1500
+	s.CPUStats.CPUUsage.PercpuUsage = []uint64{750, 750}
+	s.CPUStats.SystemUsage = 20000
+	s.MemoryStats.Usage = 300
+	s.MemoryStats.Limit = 1000
+	s.MemoryStats.Stats = map[string]uint64{"inactive_file": 100}
+	s.Networks = map[string]types.NetworkStats{"eth0": {RxBytes: 10, TxBytes: 20}, "eth1": {RxBytes: 1, TxBytes: 2}}
+	s.BlkioStats.IoServiceBytesRecursive = []types.BlkioStatEntry{{Op: "Read", Value: 5}, {Op: "Write", Value: 7}, {Op: "Total", Value: 12}}
+
+	// when
+	stats := convertStats(s)
+
+	// then
+	if stats.CPUPercent != 10 {
+		t.Errorf("cpu should be 10%%, got %v", stats.CPUPercent)
+	}
+	if stats.MemoryUsage != 200 || stats.MemoryPercent != 20 {
+		t.Errorf("memory should exclude the page cache, got %d %v", stats.MemoryUsage, stats.MemoryPercent)
+	}
+	if stats.NetworkRx != 11 || stats.NetworkTx != 22 || stats.BlockRead != 5 || stats.BlockWrite != 7 {
+		t.Errorf("unexpected io %+v", stats)
+	}
+}
+
+func TestStatsHistory(t *testing.T) {
+	// given
+	h := newStatsHistory(2)
+
+	// when
+	for i := 1; i <= 3; i++ {
+		h.add("web-1", model.ContainerStats{CPUPercent: float64(i)})
+	}
+	h.add("web-2", model.ContainerStats{})
+	h.retain(map[string]bool{"web-1": true})
+
+	// then
+	list := h.get("web-1")
+	if len(list) != 2 || list[0].CPUPercent != 2 || list[1].CPUPercent != 3 {
+		t.Errorf("the newest 2 samples should be kept, got %v", list)
+	}
+	if len(h.get("web-2")) != 0 {
+		t.Error("web-2 should be forgotten")
+	}
+}
@@ -0,0 +1,194 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/libgolang/log"
+	"github.com/libgolang/one/model"
+	"github.com/libgolang/one/utils"
+)
+
+var volumeNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][-A-Za-z0-9_.]+$`)
+
+// validateNamedVolumes checks the name templates, paths and drivers of
+// the named volumes of def
+func validateNamedVolumes(def *model.Definition) error {
+	paths := make(map[string]bool)
+	for _, v := range def.NamedVolumes {
+		name, err := v.Resolve(0)
+		if err != nil {
+			return fmt.Errorf("invalid volume name %q: %s", v.Name, err)
+		}
+		if !volumeNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid volume name %q: letters, digits, -, _ or . starting with a letter or digit", v.Name)
+		}
+		if !path.IsAbs(v.Path) {
+			return fmt.Errorf("volume %s requires an absolute path", v.Name)
+		}
+		if paths[v.Path] {
+			return fmt.Errorf("path %s is mounted twice", v.Path)
+		}
+		paths[v.Path] = true
+		if v.Driver != "" && !dockerDriverRegexp.MatchString(v.Driver) {
+			return fmt.Errorf("invalid volume driver %q", v.Driver)
+		}
+	}
+	return nil
+}
+
+// resolveNamedVolumes returns the named volumes of def with the names of
+// the replica index
+func resolveNamedVolumes(def *model.Definition, index int) []model.NamedVolume {
+	result := make([]model.NamedVolume, 0, len(def.NamedVolumes))
+	for _, v := range def.NamedVolumes {
+		name, err := v.Resolve(index)
+		if err != nil {
+			log.Error("Definition %s has an invalid volume name %q: %s", def.Name, v.Name, err)
+			continue
+		}
+		v.Name = name
+		result = append(result, v)
+	}
+	return result
+}
+
+// freeReplicaIndex returns the lowest replica index none of the
+// containers desired running in conts has
+func freeReplicaIndex(conts map[string]*model.Container) int {
+	used := make(map[int]bool)
+	for _, cont := range conts {
+		if cont.Desired() == model.ContainerRunning {
+			used[cont.Index] = true
+		}
+	}
+	i := 0
+	for used[i] {
+		i++
+	}
+	return i
+}
+
+// hasLocalVolumes returns whether def mounts a named volume whose data
+// stays on the node
+func hasLocalVolumes(def *model.Definition) bool {
+	for _, v := range def.NamedVolumes {
+		if v.Local() {
+			return true
+		}
+	}
+	return false
+}
+
+// pinReplicas pins the replicas of def with local volumes to the node of
+// their container conts, unless they are pinned already.  It returns
+// whether the status of def changed.
+func pinReplicas(def *model.Definition, conts []*model.Container) bool {
+	if def.WorkloadMode() == model.ModeGlobal || !hasLocalVolumes(def) {
+		return false
+	}
+	changed := false
+	for _, cont := range conts {
+		if cont.NodeName == "" || (def.Status != nil && def.Status.Pins[cont.Index] != "") {
+			continue
+		}
+		if def.Status == nil {
+			def.Status = &model.DefinitionStatus{}
+		}
+		if def.Status.Pins == nil {
+			def.Status.Pins = make(map[int]string)
+		}
+		log.Info("Replica %d of %s is pinned to node %s holding its volumes", cont.Index, def.Name, cont.NodeName)
+		def.Status.Pins[cont.Index] = cont.NodeName
+		changed = true
+	}
+	return changed
+}
+
+// pinnedNodes restricts the eligible nodes of the replica index of def
+// to the node it is pinned to, if any.  The replica stays Pending while
+// that node is not eligible.
+func pinnedNodes(def *model.Definition, index int, eligible map[string]bool) map[string]bool {
+	if def == nil || def.Status == nil {
+		return eligible
+	}
+	node, ok := def.Status.Pins[index]
+	if !ok {
+		return eligible
+	}
+	if !eligible[node] {
+		log.Warn("Replica %d of %s waits for node %s holding its volumes", index, def.Name, node)
+	}
+	return map[string]bool{node: eligible[node]}
+}
+
+func (m *masterService) listVolumes(w http.ResponseWriter, r *http.Request) RestResponse {
+	def := map[string]string{
+		"Name":           "string",
+		"NodeName":       "string",
+		"Driver":         "string",
+		"Scope":          "string",
+		"DefinitionName": "string",
+		"Index":          "int",
+	}
+	list := make([]*model.VolumeInfo, 0)
+	for _, node := range m.db.ListNodes() {
+		for i := range node.Volumes {
+			v := node.Volumes[i]
+			v.NodeName = node.Name
+			list = append(list, &v)
+		}
+	}
+	page, err := utils.RestList(def, "Name", r, &list)
+	if err != nil {
+		return (&JSONResponse{}).SetStatus(400).SetBody(map[string]string{"error": err.Error()})
+	}
+	return listResponse(page)
+}
+
+// releaseReplica unpins a replica of a definition from the node holding
+// its local volumes.  Its next container may run on any eligible node,
+// without the data left on the previous one.
+func (m *masterService) releaseReplica(w http.ResponseWriter, r *http.Request) RestResponse {
+	resp := &JSONResponse{}
+	name := mux.Vars(r)["name"]
+	index, err := strconv.Atoi(mux.Vars(r)["index"])
+	if err != nil || index < 0 {
+		return resp.SetStatus(400).SetBody(`{"error":"invalid replica index"}`)
+	}
+
+	var def *model.Definition
+	pinned := false
+	if terr := m.db.Trx(func(db Db) {
+		if def, err = db.GetDefinition(name); err != nil {
+			return
+		}
+		var node string
+		if def.Status != nil {
+			node, pinned = def.Status.Pins[index]
+		}
+		if !pinned {
+			return
+		}
+		log.Info("Releasing replica %d of %s from node %s", index, name, node)
+		delete(def.Status.Pins, index)
+		err = db.SaveDefinition(def)
+	}); terr != nil {
+		return unavailableResponse(terr)
+	}
+	if def == nil {
+		return resp.SetStatus(404).SetBody(`{"error":"definition not found"}`)
+	}
+	if !pinned {
+		return resp.SetStatus(404).SetBody(`{"error":"replica is not pinned"}`)
+	}
+	if err != nil {
+		log.Error("error saving definition %s: %s", name, err)
+		return resp.SetStatus(500).SetBody(`{"error":"Unable to save definition"}`)
+	}
+	return resp.SetETag(def.ResourceVersion).SetBody(def)
+}
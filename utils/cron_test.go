@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2024, time.January, 31, 10, 17, 30, 0, time.UTC) // a Wednesday
+	tests := map[string]string{
+		"* * * * *":       "2024-01-31T10:18:00Z",
+		"*/15 * * * *":    "2024-01-31T10:30:00Z",
+		"30 2 * * *":      "2024-02-01T02:30:00Z",
+		"0 9 * * 1-5":     "2024-02-01T09:00:00Z",
+		"0 0 29 2 *":      "2024-02-29T00:00:00Z",
+		"0 0 1,15 * 0":    "2024-02-01T00:00:00Z",
+		"0 12 * * 7":      "2024-02-04T12:00:00Z",
+		"5-10/5 10 * * *": "2024-02-01T10:05:00Z",
+		"@monthly":        "2024-02-01T00:00:00Z",
+		"@hourly":         "2024-01-31T11:00:00Z",
+	}
+	for spec, expected := range tests {
+		// given
+		s, err := ParseCron(spec)
+		if err != nil {
+			t.Errorf("%s: %s", spec, err)
+			continue
+		}
+
+		// when
+		next := s.Next(from)
+
+		// then
+		if next.Format(time.RFC3339) != expected {
+			t.Errorf("%s: expected %s, got %s", spec, expected, next.Format(time.RFC3339))
+		}
+	}
+}
+
+func TestCronNextDaylightSaving(t *testing.T) {
+	// given
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	s, _ := ParseCron("0 9 * * *")
+	from := time.Date(2024, time.March, 10, 0, 30, 0, 0, loc) // 2:00 becomes 3:00
+
+	// when
+	next := s.Next(from)
+
+	// then
+	if expected := time.Date(2024, time.March, 10, 9, 0, 0, 0, loc); !next.Equal(expected) {
+		t.Errorf("expected %s, got %s", expected, next)
+	}
+}
+
+func TestCronParseErrors(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "a * * * *", "5-1 * * * *", "@often"} {
+		if _, err := ParseCron(spec); err == nil {
+			t.Errorf("%q should be refused", spec)
+		}
+	}
+	if s, _ := ParseCron("0 0 31 2 *"); !s.Next(time.Now()).IsZero() {
+		t.Error("a schedule that never matches should return the zero time")
+	}
+}
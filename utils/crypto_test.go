@@ -0,0 +1,24 @@
+package utils
+
+import "testing"
+
+func TestEncryptDecrypt(t *testing.T) {
+	// given
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	// when
+	sealed, err := Encrypt(key, "s3cret")
+	plain, derr := Decrypt(key, sealed)
+	_, wrongKey := Decrypt([]byte("fedcba9876543210fedcba9876543210"), sealed)
+
+	// then
+	if err != nil || derr != nil || plain != "s3cret" {
+		t.Errorf("should decrypt what was encrypted, got %q %v %v", plain, err, derr)
+	}
+	if sealed == "s3cret" || wrongKey == nil {
+		t.Errorf("should not be readable without the key, got %q %v", sealed, wrongKey)
+	}
+	if _, err := Encrypt([]byte("short"), "s3cret"); err == nil {
+		t.Error("an invalid key should be refused")
+	}
+}
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLockFile(t *testing.T) {
+	// given
+	tmpDir, _ := ioutil.TempDir("", "testing-lock")
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	file := path.Join(tmpDir, "master.lock")
+	unlock, err := LockFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// when
+	_, held := LockFile(file)
+	unlock()
+	again, released := LockFile(file)
+
+	// then
+	if held != ErrLocked {
+		t.Errorf("a held lock should be refused, got %v", held)
+	}
+	if released != nil {
+		t.Errorf("a released lock should be taken, got %s", released)
+	} else {
+		again()
+	}
+}
@@ -7,3 +7,17 @@ func CopyStringStringMap(m map[string]string) map[string]string {
 	}
 	return target
 }
+
+// EqualStringStringMap returns whether a and b have the same entries, nil
+// and empty maps being equal
+func EqualStringStringMap(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
@@ -1,23 +1,32 @@
 package utils
 
 import (
+	"fmt"
 	"net/http"
 	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/libgolang/one/model"
 )
 
-// RestFilterReduce filter out items out of the slice by using a definition
-func RestFilterReduce(def map[string]string, r *http.Request, slicePtr interface{}) {
+// RestFilterReduce filter out items out of the slice by using a definition.
+// It returns the error of the first invalid filter of the request, in
+// which case the slice is left untouched.
+func RestFilterReduce(def map[string]string, r *http.Request, slicePtr interface{}) error {
 	p := reflect.ValueOf(slicePtr)
 	if p.Kind() != reflect.Ptr {
 		panic("Must be a slice pointer")
 	}
 
 	//
-	filters := RestFilters(def, r)
+	filters, err := RestFilters(def, r)
+	if err != nil {
+		return err
+	}
 
 	// reflect
 	origSlice := p.Elem()
@@ -44,7 +53,7 @@ func RestFilterReduce(def map[string]string, r *http.Request, slicePtr interface
 	} else {
 		panic("Invalid Type passed")
 	}
-
+	return nil
 }
 
 //
@@ -53,8 +62,42 @@ type defMap struct {
 	Type  string
 }
 
-// RestFilters gnerates filters from request
-func RestFilters(def map[string]string, r *http.Request) []model.Filter {
+// filterOps operations supported by each field type of a definition
+var filterOps = map[string][]string{
+	"string": {"eq", "ne", "gt", "ge", "lt", "le", "like", "in", "nin", "re", "exists"},
+	"int":    {"eq", "ne", "gt", "ge", "lt", "le", "like", "in", "nin", "exists"},
+	"bool":   {"eq", "ne"},
+	"time":   {"eq", "ne", "gt", "ge", "lt", "le", "exists"},
+	"map":    {"eq", "ne", "gt", "ge", "lt", "le", "like", "in", "nin", "re", "exists"},
+}
+
+// restFilterOr query parameter of the OR groups, whose value is a list
+// of filters separated by |, e.g. or=state=Running|state.eq=Starting
+const restFilterOr = "or"
+
+// restFilterSelector query parameter of the label selector, see
+// model.ParseLabelSelector.  It needs a map field Labels.
+const restFilterSelector = "selector"
+
+// reservedParams query parameters that are not field filters
+var reservedParams = map[string]bool{
+	restFilterOr:       true,
+	restFilterSelector: true,
+	restListLimit:      true,
+	restListOffset:     true,
+	restListContinue:   true,
+	restListSort:       true,
+	restListFields:     true,
+	restListOutput:     true,
+}
+
+// RestFilters gnerates filters from request.  Parameters are AND-ed
+// filters written field=value or field.op=value, map fields take a key
+// as in labels.app=web or labels.app.ne=web, each or parameter adds a
+// group of filters of which any must match and each selector parameter
+// a label selector.  Unknown fields and operations and values that
+// cannot be parsed are errors.
+func RestFilters(def map[string]string, r *http.Request) ([]model.Filter, error) {
 	values := r.URL.Query()
 
 	// lowercase keys
@@ -64,67 +107,219 @@ func RestFilters(def map[string]string, r *http.Request) []model.Filter {
 		dm[canonName] = defMap{k, t}
 	}
 
+	// sorted keys, so the same request always reports the same error
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
 	//
+	now := time.Now()
 	result := make([]model.Filter, 0)
-	for key, vals := range values {
-		parts := strings.Split(strings.TrimSpace(key), ".")
-		n := len(parts)
-		var fieldName string
-		var operation string
-		if n == 1 {
-			fieldName = parts[0]
-			operation = "eq"
-		} else if n == 2 {
-			fieldName = strings.ToLower(strings.TrimSpace(parts[0]))
-			operation = strings.TrimSpace(parts[1])
-		} else {
-			continue
-		}
-
-		if fieldName == "" || operation == "" {
-			continue
-		}
-
-		if operation != "eq" && operation != "ne" && operation != "gt" && operation != "ge" && operation != "lt" && operation != "le" && operation != "like" {
-			continue
-		}
-
-		d, ok := dm[fieldName]
-		if !ok {
-			continue
-		}
-
-		switch d.Type {
-		case "string":
-			for _, val := range vals {
-				result = append(result, &model.FilterString{
-					Operation: operation,
-					Field:     d.Field,
-					Value:     val,
-				})
+	for _, key := range keys {
+		for _, val := range values[key] {
+			if key == restFilterOr {
+				or, err := restFilterOrGroup(dm, val, now)
+				if err != nil {
+					return nil, err
+				}
+				result = append(result, or)
+				continue
+			}
+			if key == restFilterSelector {
+				if d, ok := dm["labels"]; !ok || d.Type != "map" {
+					return nil, fmt.Errorf("invalid selector %q: this list has no labels", val)
+				}
+				selector, err := model.ParseLabelSelector(val)
+				if err != nil {
+					return nil, err
+				}
+				result = append(result, selector)
+				continue
+			}
+			if reservedParams[key] {
+				continue
+			}
+			filter, err := restFilter(dm, key, val, now)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, filter)
+		}
+	}
+	return result, nil
+}
+
+// restFilterOrGroup parses the value of an or parameter
+func restFilterOrGroup(dm map[string]defMap, group string, now time.Time) (model.Filter, error) {
+	or := &model.FilterOr{}
+	for _, term := range strings.Split(group, "|") {
+		kv := strings.SplitN(term, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid filter %q in or=%s: expected field=value or field.op=value", term, group)
+		}
+		filter, err := restFilter(dm, kv[0], kv[1], now)
+		if err != nil {
+			return nil, err
+		}
+		or.Filters = append(or.Filters, filter)
+	}
+	return or, nil
+}
+
+// restFilter parses the filter of the query parameter key=val.  Relative
+// times are added to now.
+func restFilter(dm map[string]defMap, key, val string, now time.Time) (model.Filter, error) {
+	parts := strings.Split(strings.TrimSpace(key), ".")
+	fieldName := strings.ToLower(strings.TrimSpace(parts[0]))
+	d, ok := dm[fieldName]
+	if !ok {
+		return nil, fmt.Errorf("invalid filter %s=%s: unknown field %q", key, val, parts[0])
+	}
+
+	operation := "eq"
+	var mapKey string
+	rest := parts[1:]
+	if d.Type == "map" {
+		// keys may contain dots, the last part is the operation only
+		// when it names one
+		if n := len(rest); n > 1 && restFilterOpSupported("map", rest[n-1]) {
+			operation = rest[n-1]
+			rest = rest[:n-1]
+		}
+		mapKey = strings.Join(rest, ".")
+		if mapKey == "" {
+			return nil, fmt.Errorf("invalid filter %s=%s: field %s needs a key, e.g. %s.<key>=value", key, val, parts[0], parts[0])
+		}
+	} else if len(rest) == 1 {
+		operation = strings.TrimSpace(rest[0])
+	} else if len(rest) > 1 {
+		return nil, fmt.Errorf("invalid filter %s=%s: expected field=value or field.op=value", key, val)
+	}
+
+	if !restFilterOpSupported(d.Type, operation) {
+		return nil, fmt.Errorf("invalid filter %s=%s: operation %q is not supported by %s field %s, use one of %s",
+			key, val, operation, d.Type, d.Field, strings.Join(filterOps[d.Type], ", "))
+	}
+
+	filter, err := restFilterValue(d, operation, mapKey, val, now)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %s=%s: %s", key, val, err)
+	}
+	return filter, nil
+}
+
+func restFilterOpSupported(typ, operation string) bool {
+	for _, op := range filterOps[typ] {
+		if op == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// restFilterValue builds the filter of field d parsing val
+func restFilterValue(d defMap, operation, mapKey, val string, now time.Time) (model.Filter, error) {
+	var list []string
+	if operation == "in" || operation == "nin" {
+		list = strings.Split(val, ",")
+	}
+
+	switch d.Type {
+	case "string", "map":
+		var re *regexp.Regexp
+		switch operation {
+		case "re":
+			var err error
+			if re, err = regexp.Compile(val); err != nil {
+				return nil, fmt.Errorf("invalid regular expression: %s", err)
+			}
+		case "exists":
+			b, err := restFilterExists(val)
+			if err != nil {
+				return nil, err
+			}
+			val = strconv.FormatBool(b)
+		}
+		if d.Type == "map" {
+			return &model.FilterMap{Operation: operation, Field: d.Field, Key: mapKey, Value: val, Values: list, Regexp: re}, nil
+		}
+		return &model.FilterString{Operation: operation, Field: d.Field, Value: val, Values: list, Regexp: re}, nil
+	case "int":
+		f := &model.FilterInt{Operation: operation, Field: d.Field}
+		if operation == "exists" {
+			b, err := restFilterExists(val)
+			if err != nil {
+				return nil, err
 			}
-		case "int":
-			for _, val := range vals {
-				i, _ := strconv.ParseInt(val, 10, 64)
-				result = append(result, &model.FilterInt{
-					Operation: operation,
-					Field:     d.Field,
-					Value:     i,
-				})
+			if b {
+				f.Value = 1
 			}
-		case "bool":
-			for _, val := range vals {
-				b, _ := strconv.ParseBool(val)
-				result = append(result, &model.FilterBool{
-					Operation: operation,
-					Field:     d.Field,
-					Value:     b,
-				})
+			return f, nil
+		}
+		for _, s := range list {
+			i, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not an integer", s)
 			}
+			f.Values = append(f.Values, i)
+		}
+		if list == nil {
+			i, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not an integer", val)
+			}
+			f.Value = i
+		}
+		return f, nil
+	case "bool":
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", val)
+		}
+		return &model.FilterBool{Operation: operation, Field: d.Field, Value: b}, nil
+	case "time":
+		f := &model.FilterTime{Operation: operation, Field: d.Field}
+		if operation == "exists" {
+			b, err := restFilterExists(val)
+			f.Exists = b
+			return f, err
 		}
+		t, err := restFilterTime(val, now)
+		f.Value = t
+		return f, err
+	}
+	return nil, fmt.Errorf("unknown type %s of field %s", d.Type, d.Field)
+}
 
+// restFilterExists parses the value of the exists operation, empty
+// meaning true
+func restFilterExists(val string) (bool, error) {
+	if val == "" {
+		return true, nil
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("%q is not a boolean", val)
+	}
+	return b, nil
+}
+
+// restFilterTime parses an RFC 3339 time or a duration relative to now,
+// e.g. -5m for five minutes ago
+func restFilterTime(val string, now time.Time) (time.Time, error) {
+	// an unescaped + of the query string is decoded as a space, times
+	// have none
+	val = strings.Replace(val, " ", "+", -1)
+	if t, err := time.Parse(time.RFC3339, val); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC 3339 time nor a duration like -5m", val)
 	}
-	return result
+	return now.Add(d), nil
 }
 
 // FilterMatch takes an array of struct and array of filter and retuns
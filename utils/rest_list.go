@@ -0,0 +1,399 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// query parameters of RestList, reserved so RestFilters does not take
+// them for fields
+const (
+	restListLimit    = "limit"
+	restListOffset   = "offset"
+	restListContinue = "continue"
+	restListSort     = "sort"
+	restListFields   = "fields"
+	restListOutput   = "output"
+)
+
+// RestListPage page of a list returned by RestList
+type RestListPage struct {
+	Items    interface{} // json body: an object keyed like the listed map or an array
+	Total    int         // number of items matching the filters
+	Continue string      // token of the next page, empty on the last one
+}
+
+// restListItem item of a list with the values it is sorted by
+type restListItem struct {
+	mapKey string
+	value  reflect.Value
+	pos    restListPos
+}
+
+// restListPos position of an item in the sorted list: the values of the
+// sort fields followed by the key field
+type restListPos struct {
+	Values []string `json:"v"`
+	Key    string   `json:"k"`
+}
+
+// restListToken json of the continue token
+type restListToken struct {
+	Sort string      `json:"s"`
+	Pos  restListPos `json:"p"`
+}
+
+type restSortField struct {
+	defMap
+	desc bool
+}
+
+// RestList filters the map or slice pointed by listPtr like
+// RestFilterReduce, then sorts, pages and projects it following the
+// parameters of the request:
+//
+//	sort=field,-field   sort fields of def, - for descending order
+//	limit=n             at most n items
+//	offset=n            skip the first n items
+//	continue=token      items after the last one of a previous page
+//	fields=a,b          only these json fields of each item
+//	output=array        an array even when listing a map
+//
+// Items are always ordered by keyField last, so pages are stable.  Maps
+// are returned as objects in that order unless an array is requested.
+func RestList(def map[string]string, keyField string, r *http.Request, listPtr interface{}) (*RestListPage, error) {
+	p := reflect.ValueOf(listPtr)
+	if p.Kind() != reflect.Ptr {
+		panic("Must be a slice or map pointer")
+	}
+	list := p.Elem()
+	if list.Kind() != reflect.Map && list.Kind() != reflect.Slice {
+		panic("Invalid Type passed")
+	}
+	query := r.URL.Query()
+
+	filters, err := RestFilters(def, r)
+	if err != nil {
+		return nil, err
+	}
+	sortFields, err := restListSortFields(def, query.Get(restListSort))
+	if err != nil {
+		return nil, err
+	}
+	limit, err := restListInt(query, restListLimit)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := restListInt(query, restListOffset)
+	if err != nil {
+		return nil, err
+	}
+	output := query.Get(restListOutput)
+	if output != "" && output != "array" && output != "object" {
+		return nil, fmt.Errorf("invalid output %q: use array or object", output)
+	}
+	if output == "object" && list.Kind() != reflect.Map {
+		return nil, fmt.Errorf("invalid output object: this list is an array")
+	}
+	elemType := list.Type().Elem()
+	fields, err := restListProjection(elemType, query.Get(restListFields))
+	if err != nil {
+		return nil, err
+	}
+
+	// filter
+	items := make([]restListItem, 0, list.Len())
+	add := func(mapKey string, el reflect.Value) {
+		if !FilterMatch(el.Interface(), filters) {
+			return
+		}
+		items = append(items, restListItem{mapKey: mapKey, value: el, pos: restListPosOf(el, sortFields, keyField)})
+	}
+	if list.Kind() == reflect.Map {
+		for _, key := range list.MapKeys() {
+			add(fmt.Sprint(key.Interface()), list.MapIndex(key))
+		}
+	} else {
+		for i := 0; i < list.Len(); i++ {
+			add("", list.Index(i))
+		}
+	}
+
+	// sort
+	sort.SliceStable(items, func(i, j int) bool {
+		return restListCompare(sortFields, items[i].pos, items[j].pos) < 0
+	})
+
+	// page
+	page := &RestListPage{Total: len(items)}
+	start := offset
+	if token := query.Get(restListContinue); token != "" {
+		if offset != 0 {
+			return nil, fmt.Errorf("invalid continue: offset and continue cannot be combined")
+		}
+		after, err := restListDecodeToken(token, query.Get(restListSort), sortFields)
+		if err != nil {
+			return nil, err
+		}
+		start = sort.Search(len(items), func(i int) bool {
+			return restListCompare(sortFields, items[i].pos, after) > 0
+		})
+	}
+	if start > len(items) {
+		start = len(items)
+	}
+	end := len(items)
+	if limit > 0 && start+limit < end {
+		end = start + limit
+		page.Continue = restListEncodeToken(query.Get(restListSort), items[end-1].pos)
+	}
+	items = items[start:end]
+
+	// project
+	values := make([]interface{}, len(items))
+	for i, it := range items {
+		values[i] = it.value.Interface()
+		if fields != nil {
+			if values[i], err = restListProject(values[i], fields); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if list.Kind() == reflect.Map && output != "array" {
+		keys := make([]string, len(items))
+		for i, it := range items {
+			keys[i] = it.mapKey
+		}
+		page.Items = &restOrderedMap{keys: keys, values: values}
+	} else {
+		page.Items = values
+	}
+	return page, nil
+}
+
+// restListInt parses a non negative integer parameter, 0 when missing
+func restListInt(query map[string][]string, name string) (int, error) {
+	vals := query[name]
+	if len(vals) == 0 || vals[0] == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(vals[0])
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("invalid %s %q: expected a non negative integer", name, vals[0])
+	}
+	return i, nil
+}
+
+// restListSortFields parses the sort parameter, e.g. state,-name
+func restListSortFields(def map[string]string, spec string) ([]restSortField, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	dm := make(map[string]defMap)
+	for k, t := range def {
+		dm[strings.ToLower(k)] = defMap{k, t}
+	}
+	result := make([]restSortField, 0)
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		desc := strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(strings.TrimPrefix(name, "-"), "+")
+		d, ok := dm[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("invalid sort %q: unknown field %q", spec, name)
+		}
+		if d.Type == "map" {
+			return nil, fmt.Errorf("invalid sort %q: map field %s cannot be sorted", spec, d.Field)
+		}
+		result = append(result, restSortField{defMap: d, desc: desc})
+	}
+	return result, nil
+}
+
+// restListPosOf formats the sort values of el, so they can be compared
+// and written in continue tokens
+func restListPosOf(el reflect.Value, sortFields []restSortField, keyField string) restListPos {
+	el = reflect.Indirect(el)
+	pos := restListPos{Values: make([]string, len(sortFields))}
+	for i, f := range sortFields {
+		pos.Values[i] = restListFormat(el.FieldByName(f.Field))
+	}
+	if keyField != "" {
+		pos.Key = restListFormat(el.FieldByName(keyField))
+	}
+	return pos
+}
+
+func restListFormat(v reflect.Value) string {
+	if !v.IsValid() {
+		return ""
+	}
+	if t, ok := v.Interface().(time.Time); ok {
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// restListCompare compares the positions a and b by the sort fields then
+// by key
+func restListCompare(sortFields []restSortField, a, b restListPos) int {
+	for i, f := range sortFields {
+		c := restListCompareValues(f.Type, a.Values[i], b.Values[i])
+		if f.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(a.Key, b.Key)
+}
+
+// restListCompareValues compares two formatted values of type typ
+func restListCompareValues(typ, a, b string) int {
+	switch typ {
+	case "int":
+		x, _ := strconv.ParseInt(a, 10, 64)
+		y, _ := strconv.ParseInt(b, 10, 64)
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+		return 0
+	case "time":
+		x, _ := time.Parse(time.RFC3339Nano, a)
+		y, _ := time.Parse(time.RFC3339Nano, b)
+		switch {
+		case x.Before(y):
+			return -1
+		case x.After(y):
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+func restListEncodeToken(sortSpec string, pos restListPos) string {
+	b, _ := json.Marshal(&restListToken{Sort: sortSpec, Pos: pos})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// restListDecodeToken returns the position of the last item of the page
+// that issued the continue token
+func restListDecodeToken(token, sortSpec string, sortFields []restSortField) (restListPos, error) {
+	t := &restListToken{}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		err = json.Unmarshal(b, t)
+	}
+	if err != nil || len(t.Pos.Values) != len(sortFields) {
+		return restListPos{}, fmt.Errorf("invalid continue token")
+	}
+	if t.Sort != sortSpec {
+		return restListPos{}, fmt.Errorf("invalid continue token: it was issued for sort %q", t.Sort)
+	}
+	return t.Pos, nil
+}
+
+// restListProjection resolves the fields parameter to the json names of the
+// fields of elemType.  Fields are matched without case by json or Go
+// name.  It returns nil when every field is wanted.
+func restListProjection(elemType reflect.Type, spec string) ([]string, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	for elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+	}
+	known := make(map[string]string)
+	if elemType.Kind() == reflect.Struct {
+		for i := 0; i < elemType.NumField(); i++ {
+			f := elemType.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "-" || f.PkgPath != "" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			known[strings.ToLower(name)] = name
+			known[strings.ToLower(f.Name)] = name
+		}
+	}
+	result := make([]string, 0)
+	for _, name := range strings.Split(spec, ",") {
+		jsonName, ok := known[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("invalid fields %q: unknown field %q", spec, name)
+		}
+		result = append(result, jsonName)
+	}
+	return result, nil
+}
+
+// restListProject returns the given json fields of it
+func restListProject(it interface{}, fields []string) (interface{}, error) {
+	b, err := json.Marshal(it)
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	result := make(map[string]json.RawMessage, len(fields))
+	for _, name := range fields {
+		if v, ok := all[name]; ok {
+			result[name] = v
+		}
+	}
+	return result, nil
+}
+
+// restOrderedMap json object whose keys keep their order
+type restOrderedMap struct {
+	keys   []string
+	values []interface{}
+}
+
+// MarshalJSON implementation of json.Marshaler
+func (m *restOrderedMap) MarshalJSON() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, key := range m.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(m.values[i])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func restListJSON(t *testing.T, url string, list interface{}) (string, *RestListPage) {
+	page, err := RestList(restFilterDef, "Name", httptest.NewRequest("GET", url, nil), list)
+	if err != nil {
+		t.Fatalf("%s: %s", url, err)
+	}
+	b, err := json.Marshal(page.Items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b), page
+}
+
+func TestRestListSortAndProject(t *testing.T) {
+	// given
+	items := restFilterItems()
+
+	// when
+	body, page := restListJSON(t, "/?sort=-count&fields=name,count", &items)
+
+	// then
+	expected := `{"db-1":{"Count":3,"Name":"db-1"},"web-2":{"Count":2,"Name":"web-2"},"web-1":{"Count":1,"Name":"web-1"}}`
+	if body != expected {
+		t.Errorf("expected %s, got %s", expected, body)
+	}
+	if page.Total != 3 || page.Continue != "" {
+		t.Errorf("unexpected page %+v", page)
+	}
+}
+
+func TestRestListPages(t *testing.T) {
+	// given
+	items := restFilterItems()
+
+	// when
+	first, page1 := restListJSON(t, "/?sort=enabled,-name&limit=2&fields=name&output=array", &items)
+	second, page2 := restListJSON(t, "/?sort=enabled,-name&limit=2&fields=name&output=array&continue="+page1.Continue, &items)
+	offset, _ := restListJSON(t, "/?offset=1&limit=1&fields=name&output=array", &items)
+
+	// then
+	if first != `[{"Name":"web-2"},{"Name":"web-1"}]` || page1.Continue == "" {
+		t.Errorf("unexpected first page %s %+v", first, page1)
+	}
+	if second != `[{"Name":"db-1"}]` || page2.Continue != "" || page2.Total != 3 {
+		t.Errorf("unexpected second page %s %+v", second, page2)
+	}
+	if offset != `[{"Name":"web-1"}]` {
+		t.Errorf("offset should skip db-1, got %s", offset)
+	}
+}
+
+func TestRestListSlice(t *testing.T) {
+	// given
+	list := []*restFilterItem{{Name: "b", Count: 1}, {Name: "a", Count: 1}, {Name: "c", Count: 0}}
+
+	// when
+	body, _ := restListJSON(t, "/?count=1&fields=name", &list)
+
+	// then
+	if body != `[{"Name":"a"},{"Name":"b"}]` {
+		t.Errorf("filtered slice should be ordered by key, got %s", body)
+	}
+}
+
+func TestRestListErrors(t *testing.T) {
+	tests := map[string]string{
+		"/?limit=-1":              `invalid limit "-1"`,
+		"/?offset=x":              `invalid offset "x"`,
+		"/?sort=nope":             `unknown field "nope"`,
+		"/?sort=labels":           "cannot be sorted",
+		"/?fields=name,nope":      `unknown field "nope"`,
+		"/?output=yaml":           `invalid output "yaml"`,
+		"/?continue=garbage":      "invalid continue token",
+		"/?continue=e30&offset=1": "cannot be combined",
+		"/?name.in=web-1&count=x": `"x" is not an integer`,
+		"/?sort=name&limit=1&continue=" + restListEncodeToken("-name", restListPos{Values: []string{"a"}}): "issued for sort",
+	}
+	for url, expected := range tests {
+		// given
+		items := restFilterItems()
+
+		// when
+		_, err := RestList(restFilterDef, "Name", httptest.NewRequest("GET", url, nil), &items)
+
+		// then
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected error containing %q, got %v", url, expected, err)
+		}
+	}
+}
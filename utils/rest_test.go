@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type restFilterItem struct {
+	Name        string
+	Count       int
+	Enabled     bool
+	LastUpdated time.Time
+	Labels      map[string]string
+}
+
+var restFilterDef = map[string]string{
+	"Name":        "string",
+	"Count":       "int",
+	"Enabled":     "bool",
+	"LastUpdated": "time",
+	"Labels":      "map",
+}
+
+func restFilterItems() map[string]*restFilterItem {
+	now := time.Now()
+	return map[string]*restFilterItem{
+		"web-1": {Name: "web-1", Count: 1, Enabled: true, LastUpdated: now, Labels: map[string]string{"app": "web", "tier.name": "front"}},
+		"web-2": {Name: "web-2", Count: 2, LastUpdated: now.Add(-10 * time.Minute), Labels: map[string]string{"app": "web"}},
+		"db-1":  {Name: "db-1", Count: 3, Enabled: true},
+	}
+}
+
+func TestRestFilterReduce(t *testing.T) {
+	tests := map[string][]string{
+		"/?name.in=web-1,db-1":                    {"db-1", "web-1"},
+		"/?name.nin=web-1,db-1":                   {"web-2"},
+		"/?name.re=^web-[0-9]$":                   {"web-1", "web-2"},
+		"/?count.in=2,3&enabled=true":             {"db-1"},
+		"/?lastupdated.gt=-5m":                    {"web-1"},
+		"/?lastupdated.exists=false":              {"db-1"},
+		"/?labels.app=web":                        {"web-1", "web-2"},
+		"/?labels.tier.name=front":                {"web-1"},
+		"/?labels.app.exists=false":               {"db-1"},
+		"/?labels.app.ne=web":                     {"db-1"},
+		"/?or=name=db-1|labels.tier.name=front":   {"db-1", "web-1"},
+		"/?or=name=db-1|count.ge=2&or=count.lt=3": {"web-2"},
+	}
+	for url, expected := range tests {
+		// given
+		items := restFilterItems()
+
+		// when
+		err := RestFilterReduce(restFilterDef, httptest.NewRequest("GET", url, nil), &items)
+
+		// then
+		if err != nil {
+			t.Errorf("%s: %s", url, err)
+			continue
+		}
+		names := make([]string, 0, len(items))
+		for name := range items {
+			names = append(names, name)
+		}
+		if len(names) != len(expected) {
+			t.Errorf("%s: expected %v, got %v", url, expected, names)
+			continue
+		}
+		for _, name := range expected {
+			if items[name] == nil {
+				t.Errorf("%s: expected %v, got %v", url, expected, names)
+			}
+		}
+	}
+}
+
+func TestRestFiltersErrors(t *testing.T) {
+	tests := map[string]string{
+		"/?nope=1":                   `unknown field "nope"`,
+		"/?count=abc":                `"abc" is not an integer`,
+		"/?count.in=1,x":             `"x" is not an integer`,
+		"/?enabled=maybe":            `"maybe" is not a boolean`,
+		"/?enabled.like=t":           `operation "like" is not supported`,
+		"/?name.re=(":                "invalid regular expression",
+		"/?lastupdated.gt=yesterday": "neither an RFC 3339 time nor a duration",
+		"/?labels=web":               "needs a key",
+		"/?name.eq.ne=web":           "expected field=value or field.op=value",
+		"/?or=name=web|nope=1":       `unknown field "nope"`,
+		"/?or=name":                  "expected field=value or field.op=value",
+	}
+	for url, expected := range tests {
+		// given
+		items := restFilterItems()
+
+		// when
+		err := RestFilterReduce(restFilterDef, httptest.NewRequest("GET", url, nil), &items)
+
+		// then
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected error containing %q, got %v", url, expected, err)
+		}
+		if len(items) != 3 {
+			t.Errorf("%s: items should be left untouched", url)
+		}
+	}
+}
+
+func TestRestFiltersSelector(t *testing.T) {
+	tests := map[string][]string{
+		"/?selector=app=web":                          {"web-1", "web-2"},
+		"/?selector=app==web,tier.name":               {"web-1"},
+		"/?selector=app!=web":                         {"db-1"},
+		"/?selector=!app":                             {"db-1"},
+		"/?selector=app+notin+(web,cache),!tier.name": {"db-1"},
+		"/?selector=app+in+(web)&name.ne=web-1":       {"web-2"},
+	}
+	for url, expected := range tests {
+		// given
+		items := restFilterItems()
+
+		// when
+		err := RestFilterReduce(restFilterDef, httptest.NewRequest("GET", url, nil), &items)
+
+		// then
+		if err != nil {
+			t.Errorf("%s: %s", url, err)
+			continue
+		}
+		if len(items) != len(expected) {
+			t.Errorf("%s: expected %v, got %d items", url, expected, len(items))
+		}
+		for _, name := range expected {
+			if items[name] == nil {
+				t.Errorf("%s: expected %v", url, expected)
+			}
+		}
+	}
+	for _, url := range []string{"/?selector=app=web,", "/?selector=app=a=b", "/?selector=app+in+web"} {
+		if err := RestFilterReduce(restFilterDef, httptest.NewRequest("GET", url, nil), &map[string]*restFilterItem{}); err == nil {
+			t.Errorf("%s: invalid selector should be refused", url)
+		}
+	}
+	if err := RestFilterReduce(map[string]string{"Name": "string"}, httptest.NewRequest("GET", "/?selector=app", nil), &map[string]*restFilterItem{}); err == nil {
+		t.Error("selector on a list without labels should be refused")
+	}
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"bytes"
+	"regexp"
 	tpl "text/template"
 )
 
@@ -37,9 +38,15 @@ type templateContext struct {
 
 /////////////////////////////////////////////////////////////////////
 
+// templateFuncs functions available to every template.  quoteMeta
+// escapes a string used in a regular expression.
+var templateFuncs = tpl.FuncMap{
+	"quoteMeta": regexp.QuoteMeta,
+}
+
 // NewTemplate constructor
 func NewTemplate(content string) Template {
-	t, err := tpl.New("html").Parse(content)
+	t, err := tpl.New("html").Funcs(templateFuncs).Parse(content)
 	if err != nil {
 		panic(err)
 	}